@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// compact summarises an agent's old memories by the compaction_* config keys,
+// and prints the result as json.
+func compact(args []string) {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	agent := fs.String("agent", "", "agent id to compact")
+	m, conf := load(fs, args)
+
+	aid, err := primitive.ObjectIDFromHex(*agent)
+	if err != nil {
+		log.Fatalf("invalid agent id: %s", *agent)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	compaction, err := m.Compact(ctx, aid, conf.CompactionPolicy())
+	stop()
+
+	if compaction != nil {
+		_ = json.NewEncoder(os.Stdout).Encode(compaction)
+	}
+	if cerr := m.Close(context.Background()); cerr != nil {
+		log.Println(cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,7 +1,113 @@
 package main
 
-import "os"
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/sleep2death/memo-go/memo/memo"
+)
+
+// usage: server [serve] [flags]
+//
+//	server reconcile [flags]
+//	server compact -agent <aid> [flags]
+//	server reembed -agent <aid> [flags]
 func main() {
-	os.Exit(-1)
+	args := os.Args[1:]
+	cmd := "serve"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "reconcile":
+		reconcile(args)
+	case "compact":
+		compact(args)
+	case "reembed":
+		reembed(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s, should be serve, reconcile, compact or reembed\n", cmd)
+		os.Exit(2)
+	}
+}
+
+// load parses the command's flags, the config flags included, then creates the memo
+func load(fs *flag.FlagSet, args []string) (*memo.Memo, *memo.Config) {
+	configPath := fs.String("config", "", "path to the config file, MEMO_* environment variables and flags override its values")
+	overrides := memo.ConfigFlags(fs)
+	_ = fs.Parse(args) // flag.ExitOnError
+
+	conf, err := memo.LoadConfig(*configPath, overrides)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m, err := memo.New(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m, conf
+}
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address for the http server to listen on")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests when shutting down")
+	m, conf := load(fs, args)
+	defer m.Logger.Sync()
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: memo.NewRouter(m),
+	}
+
+	// stop accepting requests on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// retry queued compensations of half applied writes until shutdown
+	go m.RunOutbox(ctx, conf.OutboxInterval)
+
+	// purge agents whose trash retention expired
+	if conf.AgentTrashRetention > 0 {
+		go m.RunTrashPurge(ctx, conf.AgentTrashPurgeInterval)
+	}
+
+	go func() {
+		m.Logger.Infof("memo server listening on %s", *addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.Logger.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	m.Logger.Info("shutting down, waiting for in-flight requests")
+
+	// in-flight embedding and qdrant calls keep their own request contexts,
+	// so they can finish before the timeout
+	sctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		m.Logger.Errorf("server shutdown: %v", err)
+	}
+
+	// release mongodb and qdrant clients after all requests are done, with a timeout of their own,
+	// as the shutdown may have used up sctx
+	cctx, ccancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer ccancel()
+	if err := m.Close(cctx); err != nil {
+		m.Logger.Errorf("memo close: %v", err)
+	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sleep2death/memo-go/memo/memo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reconcile reports the drift between mongodb and qdrant as json lines, one per agent,
+// and repairs it with the -repair modes. It exits with 1 if any drift is left unrepaired.
+func reconcile(args []string) {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	agent := fs.String("agent", "", "agent id to reconcile, all agents if empty")
+	repair := fs.String("repair", "none", "comma separated repair modes: none, missing-points, orphan-points, missing-collections, missing-indexes, all")
+	m, _ := load(fs, args)
+
+	mode, err := memo.ParseRepairMode(*repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	aid := primitive.NilObjectID
+	if *agent != "" {
+		if aid, err = primitive.ObjectIDFromHex(*agent); err != nil {
+			log.Fatalf("invalid agent id: %s", *agent)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	drifts, err := m.Reconcile(ctx, aid, mode)
+	stop()
+
+	enc := json.NewEncoder(os.Stdout)
+	dirty := false
+	for _, d := range drifts {
+		_ = enc.Encode(d)
+		if !d.Consistent() {
+			dirty = true
+		}
+	}
+
+	if cerr := m.Close(context.Background()); cerr != nil {
+		log.Println(cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dirty {
+		os.Exit(1)
+	}
+}
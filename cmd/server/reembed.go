@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sleep2death/memo-go/memo/memo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reembed moves an agent's memories to the embedding model of the config, and prints the progress
+// as json lines. an interrupted one is resumed by running it again with the same config
+func reembed(args []string) {
+	fs := flag.NewFlagSet("reembed", flag.ExitOnError)
+	agent := fs.String("agent", "", "agent id to re-embed")
+	batch := fs.Int("batch", memo.REEMBED_BATCH_SIZE, "how many memories are re-embedded per request")
+	m, _ := load(fs, args)
+
+	aid, err := primitive.ObjectIDFromHex(*agent)
+	if err != nil {
+		log.Fatalf("invalid agent id: %s", *agent)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	_, err = m.Reembed(ctx, aid, *batch, func(r *memo.Reembedding) {
+		_ = enc.Encode(r)
+	})
+	stop()
+
+	if cerr := m.Close(context.Background()); cerr != nil {
+		log.Println(cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
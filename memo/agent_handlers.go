@@ -1,6 +1,10 @@
 package memo
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -129,3 +133,183 @@ func (m *Memo) ListAgents(c *gin.Context) {
 
 	c.JSON(200, agents)
 }
+
+// ListTrash is a gin Handler which list agents in the trash.
+func (m *Memo) ListTrash(c *gin.Context) {
+	var oid primitive.ObjectID
+	var err error
+	// get offset from url params
+
+	offset := c.Query("offset")
+	if offset != "" && offset != "nil" && offset != "-1" {
+		oid, err = primitive.ObjectIDFromHex(offset)
+		if err != nil {
+			m.AbortWithError(c, NewWrapError(400, err, "invalid offset id"))
+			return
+		}
+	} else {
+		oid = primitive.NilObjectID
+	}
+
+	ctx := c.Request.Context()
+	agents, err := m.Agents.ListTrash(ctx, oid)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, agents)
+}
+
+// RestoreAgent is a gin Handler which restore an agent from the trash.
+func (m *Memo) RestoreAgent(c *gin.Context) {
+	// get agent id from url params
+	aid := c.Param("aid")
+	oid, err := primitive.ObjectIDFromHex(aid)
+	if err != nil {
+		m.AbortWithError(c, NewWrapError(400, err, "invalid agent id"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	err = m.Agents.Restore(ctx, oid)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// PurgeAgent is a gin Handler which remove an agent and all its memories permanently.
+func (m *Memo) PurgeAgent(c *gin.Context) {
+	// get agent id from url params
+	aid := c.Param("aid")
+	oid, err := primitive.ObjectIDFromHex(aid)
+	if err != nil {
+		m.AbortWithError(c, NewWrapError(400, err, "invalid agent id"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	err = m.Agents.Purge(ctx, oid)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// chat streaming modes of the stream url param
+const STREAM_SSE = "sse"       // server-sent events
+const STREAM_NDJSON = "ndjson" // newline delimited json
+
+// chatEvent is an event of a streamed chat: "delta" events carry the pieces of the reply,
+// then a "done" event carries the whole reply, or an "error" event ends the stream
+type chatEvent struct {
+	Type  string     `json:"type"`
+	Delta string     `json:"delta,omitempty"`
+	Reply *ChatReply `json:"reply,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// ChatWithAgent is a gin Handler which replies to a conversation as the agent, with its relevant memories.
+// the reply is streamed if the stream url param is "sse" or "ndjson", or the request accepts either of them.
+func (m *Memo) ChatWithAgent(c *gin.Context) {
+	aid, _ := c.Get("agent")
+	agent := aid.(primitive.ObjectID)
+
+	req := new(ChatRequest)
+	if err := c.ShouldBindJSON(req); err != nil {
+		m.AbortWithError(c, NewWrapError(400, err, "can't bind chat request"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	mode := streamMode(c)
+	if mode == "" {
+		reply, err := m.Chat(ctx, agent, req)
+		if err != nil {
+			m.AbortWithError(c, err)
+			return
+		}
+		c.JSON(200, reply)
+		return
+	}
+
+	// errors are still responded as json before anything is streamed
+	turn, err := m.prepareChat(ctx, agent, req)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	started := false
+	send := func(event *chatEvent) error {
+		if !started {
+			started = true
+			if mode == STREAM_SSE {
+				c.Header("Content-Type", "text/event-stream")
+				c.Header("Cache-Control", "no-cache")
+				c.Header("Connection", "keep-alive")
+				c.Header("X-Accel-Buffering", "no")
+			} else {
+				c.Header("Content-Type", "application/x-ndjson")
+			}
+			c.Status(200)
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if mode == STREAM_SSE {
+			_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, data)
+		} else {
+			_, err = fmt.Fprintf(c.Writer, "%s\n", data)
+		}
+		if err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	// the request's context is cancelled if the client disconnects, which cancels the llm's stream
+	reply, err := m.streamChat(ctx, agent, req, turn, func(delta string) error {
+		return send(&chatEvent{Type: "delta", Delta: delta})
+	})
+	if err != nil {
+		if !started {
+			m.AbortWithError(c, err)
+			return
+		}
+		if m.Logger != nil {
+			m.Logger.Error(err)
+		}
+		message := "oops, an unknown error occurred, please try later"
+		if e, ok := err.(WrapError); ok {
+			message = e.Message
+		}
+		_ = send(&chatEvent{Type: "error", Error: message})
+		return
+	}
+	_ = send(&chatEvent{Type: "done", Reply: reply})
+}
+
+// streamMode is the chat streaming mode of the request, empty if it is not streamed
+func streamMode(c *gin.Context) string {
+	switch mode := c.Query("stream"); mode {
+	case STREAM_SSE, STREAM_NDJSON:
+		return mode
+	}
+	accept := c.GetHeader("Accept")
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		return STREAM_SSE
+	case strings.Contains(accept, "application/x-ndjson"):
+		return STREAM_NDJSON
+	}
+	return ""
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/suite"
@@ -25,10 +26,35 @@ func (mam *mockAgentModel) Update(ctx context.Context, agent *Agent) error {
 	return mam.Error
 }
 
+func (mam *mockAgentModel) MarkReflected(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	return mam.Error
+}
+
+func (mam *mockAgentModel) AddImportance(ctx context.Context, id primitive.ObjectID, importance float64) (float64, error) {
+	return importance, mam.Error
+}
+
 func (mam *mockAgentModel) Delete(ctx context.Context, id primitive.ObjectID) error {
 	return mam.Error
 }
 
+func (mam *mockAgentModel) Restore(ctx context.Context, id primitive.ObjectID) error {
+	return mam.Error
+}
+
+func (mam *mockAgentModel) Purge(ctx context.Context, id primitive.ObjectID) error {
+	return mam.Error
+}
+
+func (mam *mockAgentModel) PurgeExpired(ctx context.Context) (int, error) {
+	return 0, mam.Error
+}
+
+func (mam *mockAgentModel) ListTrash(ctx context.Context, offset primitive.ObjectID) ([]*Agent, error) {
+	list := make([]*Agent, 2)
+	return list, mam.Error
+}
+
 func (mam *mockAgentModel) Get(ctx context.Context, id primitive.ObjectID) (*Agent, error) {
 	return &Agent{Name: "aspirin2d"}, mam.Error
 }
@@ -66,6 +92,9 @@ func (s *AgentHandlersSuite) SetupTest() {
 	s.router.PUT("/add", s.memo.AddAgent)
 	s.router.POST("/:aid/update", s.memo.UpdateAgent)
 	s.router.DELETE("/:aid/delete", s.memo.DeleteAgent)
+	s.router.GET("/trash", s.memo.ListTrash)
+	s.router.POST("/:aid/restore", s.memo.RestoreAgent)
+	s.router.DELETE("/:aid/purge", s.memo.PurgeAgent)
 }
 
 func (s *AgentHandlersSuite) TearDownTest() {
@@ -168,6 +197,36 @@ func (s *AgentHandlersSuite) TestDeleteAgents() {
 	s.Equal(400, s.writer.Code)
 }
 
+func (s *AgentHandlersSuite) TestTrash() {
+	req := httptest.NewRequest("GET", "/trash?offset=nil", nil)
+	s.router.ServeHTTP(s.writer, req)
+	var l []interface{}
+	s.Equal(200, s.writer.Code)
+	_ = json.NewDecoder(s.writer.Body).Decode(&l)
+	s.Equal(2, len(l))
+
+	s.writer = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/"+primitive.NewObjectID().Hex()+"/restore", nil)
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(200, s.writer.Code)
+
+	s.writer = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/"+primitive.NewObjectID().Hex()+"/purge", nil)
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(200, s.writer.Code)
+
+	s.memo.Agents.(*mockAgentModel).Error = NewWrapError(404, errors.New("agent not found in trash"), "")
+	s.writer = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/"+primitive.NewObjectID().Hex()+"/restore", nil)
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(404, s.writer.Code)
+
+	s.writer = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/123/purge", nil)
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(400, s.writer.Code)
+}
+
 func TestAgentHandlersSuite(t *testing.T) {
 	suite.Run(t, new(AgentHandlersSuite))
 }
@@ -14,11 +14,28 @@ import (
 
 // Agents is  a model which implements AgentModel interface
 // it holds mongo collection and qdrant collection
+// memories is the mongo collection of memories, which are removed with their agent
+// sessions and messages are the mongo collections of sessions, which are removed with their agent too, they are optional
+// points is used to create the payload indexes of agent's collection
 type Agents struct {
-	mongo  *mongo.Collection
-	qdrant pb.CollectionsClient
+	mongo    *mongo.Collection
+	memories *mongo.Collection
+	sessions *mongo.Collection
+	messages *mongo.Collection
+	qdrant   pb.CollectionsClient
+	points   pb.PointsClient
 
 	ListLimit int64
+
+	// Embedding is the configured embedding model, which is recorded on the added agents,
+	// the default one if it is nil
+	Embedding *EmbeddingSpec
+	// PayloadIndexes are the payload fields indexed in the agents' collections, the default ones if it is nil
+	PayloadIndexes map[string]pb.FieldType
+
+	// if TrashRetention is positive, Delete moves the agent into the trash,
+	// and it will be purged after the retention, otherwise Delete purges the agent
+	TrashRetention time.Duration
 }
 
 // Add agent and return inserted id
@@ -28,18 +45,25 @@ func (s *Agents) Add(ctx context.Context, agent *Agent) (primitive.ObjectID, err
 	if agent.ID != primitive.NilObjectID {
 		return primitive.NilObjectID, NewWrapError(400, fmt.Errorf("agent id should be nil"), "")
 	}
+	if err := agent.Validate(); err != nil {
+		return primitive.NilObjectID, err
+	}
 
 	agent.ID = primitive.NewObjectID()
 	if agent.Created.IsZero() {
 		agent.Created = time.Now()
 	}
+	agent.Embedding, agent.Reembedding, agent.Unreflected, agent.Collection = s.Embedding, nil, 0, ""
+	if agent.Embedding == nil {
+		agent.Embedding = DefaultConfig().EmbeddingSpec()
+	}
 
 	_, err := s.mongo.InsertOne(ctx, agent)
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
 
-	err = s.createQdrantCollection(ctx, agent.ID.Hex())
+	err = createAgentCollection(ctx, s.qdrant, s.points, agent.ID, agent.Embedding, s.PayloadIndexes)
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
@@ -48,23 +72,136 @@ func (s *Agents) Add(ctx context.Context, agent *Agent) (primitive.ObjectID, err
 
 // Delete agent, if no agent matched it will return an notfound error
 // id is agent's id
-func (s Agents) Delete(ctx context.Context, id primitive.ObjectID) error {
-	res, err := s.mongo.DeleteOne(ctx, bson.M{"_id": id})
+// the agent will be moved into the trash if TrashRetention is positive, otherwise it will be purged
+func (s *Agents) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if s.TrashRetention <= 0 {
+		return s.Purge(ctx, id)
+	}
+
+	res, err := s.mongo.UpdateOne(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"deleted_at": time.Now()}})
 	if err != nil {
 		return err
 	}
 
 	// check if agent exists
-	if res.DeletedCount == 0 {
+	if res.MatchedCount == 0 {
+		return NewWrapError(404, fmt.Errorf("agent not found: %s", id), "")
+	}
+	return nil
+}
+
+// Restore the agent from the trash
+func (s *Agents) Restore(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.mongo.UpdateOne(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return NewWrapError(404, fmt.Errorf("agent not found in trash: %s", id), "")
+	}
+	return nil
+}
+
+// Purge removes the agent, trashed or not, with all its memories and its qdrant collection.
+// the agent document is removed last, so a failed purge can be retried
+func (s *Agents) Purge(ctx context.Context, id primitive.ObjectID) error {
+	err := s.mongo.FindOne(ctx, bson.M{"_id": id}).Err()
+	if err == mongo.ErrNoDocuments {
 		return NewWrapError(404, fmt.Errorf("agent not found: %s", id), "")
 	}
+	if err != nil {
+		return err
+	}
+
+	// the current collection, and the ones left by unfinished re-embedding jobs
+	names, err := agentCollections(ctx, s.qdrant, id)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = s.deleteQdrantCollection(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	if _, err = s.memories.DeleteMany(ctx, bson.M{"aid": id}); err != nil {
+		return err
+	}
+
+	if s.sessions != nil {
+		if _, err = s.messages.DeleteMany(ctx, bson.M{"aid": id}); err != nil {
+			return err
+		}
+		if _, err = s.sessions.DeleteMany(ctx, bson.M{"aid": id}); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.mongo.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// PurgeExpired purges the agents which have been in the trash longer than TrashRetention,
+// and returns the number of them
+func (s *Agents) PurgeExpired(ctx context.Context) (int, error) {
+	if s.TrashRetention <= 0 {
+		return 0, nil
+	}
 
-	return s.deleteQdrantCollection(ctx, id.Hex())
+	cur, err := s.mongo.Find(ctx, bson.M{"deleted_at": bson.M{"$lt": time.Now().Add(-s.TrashRetention)}})
+	if err != nil {
+		return 0, err
+	}
+	var agents []*Agent
+	if err = cur.All(ctx, &agents); err != nil {
+		return 0, err
+	}
+
+	for idx, agent := range agents {
+		if err := s.Purge(ctx, agent.ID); err != nil {
+			return idx, err
+		}
+	}
+	return len(agents), nil
 }
 
-// Update an agent, if no agent matched it will return an notfound error
+// RunTrashPurge purges the agents whose trash retention expired every interval until ctx is done
+func (m *Memo) RunTrashPurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := m.Agents.PurgeExpired(ctx)
+			if n > 0 && m.Logger != nil {
+				m.Logger.Infof("trash: %d agents purged", n)
+			}
+			if err != nil && m.Logger != nil {
+				m.Logger.Error(err)
+			}
+		}
+	}
+}
+
+// Update an agent, if no agent matched it will return an notfound error.
+// the profile is replaced, so its empty fields are cleared, see Agent.clearedProfile
 func (s *Agents) Update(ctx context.Context, agent *Agent) error {
-	res, err := s.mongo.UpdateByID(ctx, agent.ID, bson.M{"$set": agent})
+	if err := agent.Validate(); err != nil {
+		return err
+	}
+	agent.Deleted = nil     // only Delete and Restore change it
+	agent.Embedding = nil   // only Add records it
+	agent.Reembedding = nil // only Reembed changes it
+	agent.Collection = ""   // only Reembed changes it
+	agent.Reflected = nil   // only MarkReflected changes it
+	agent.Unreflected = 0   // only AddImportance and MarkReflected change it
+	update := bson.M{"$set": agent}
+	if cleared := agent.clearedProfile(); len(cleared) > 0 {
+		update["$unset"] = cleared
+	}
+	res, err := s.mongo.UpdateOne(ctx, bson.M{"_id": agent.ID, "deleted_at": bson.M{"$exists": false}}, update)
 	if err != nil {
 		return err
 	}
@@ -76,23 +213,58 @@ func (s *Agents) Update(ctx context.Context, agent *Agent) error {
 	return err
 }
 
-// Get agent by id
+// MarkReflected sets the agent's reflected time and resets its unreflected importance,
+// if no agent matched it will return an notfound error
+func (s *Agents) MarkReflected(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	update := bson.M{"$set": bson.M{"reflected_at": at}, "$unset": bson.M{"unreflected": ""}}
+	res, err := s.mongo.UpdateOne(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return NewWrapError(404, fmt.Errorf("agent not found: %s", id.Hex()), "")
+	}
+	return nil
+}
+
+// AddImportance increments the agent's unreflected importance and returns it,
+// if no agent matched it will return an notfound error
+func (s *Agents) AddImportance(ctx context.Context, id primitive.ObjectID, importance float64) (float64, error) {
+	var agent Agent
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"unreflected": 1}).SetReturnDocument(options.After)
+	err := s.mongo.FindOneAndUpdate(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}},
+		bson.M{"$inc": bson.M{"unreflected": importance}}, opts).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		return 0, NewWrapError(404, fmt.Errorf("agent not found: %s", id.Hex()), "")
+	}
+	return agent.Unreflected, err
+}
+
+// Get agent by id, agents in the trash are not found
 func (s *Agents) Get(ctx context.Context, id primitive.ObjectID) (agent *Agent, err error) {
 	agent = &Agent{}
-	err = s.mongo.FindOne(ctx, bson.M{"_id": id}).Decode(agent)
+	err = s.mongo.FindOne(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}).Decode(agent)
 	if err == mongo.ErrNoDocuments {
-		return nil, NewWrapError(404, fmt.Errorf("agent not found: %s", agent.ID.Hex()), "")
+		return nil, NewWrapError(404, fmt.Errorf("agent not found: %s", id.Hex()), "")
 	}
 	return
 }
 
 // List agents with offset, you can set search limit by session
 func (s *Agents) List(ctx context.Context, offset primitive.ObjectID) (agents []*Agent, err error) {
+	return s.list(ctx, bson.M{"deleted_at": bson.M{"$exists": false}}, offset)
+}
+
+// ListTrash lists agents in the trash with offset
+func (s *Agents) ListTrash(ctx context.Context, offset primitive.ObjectID) (agents []*Agent, err error) {
+	return s.list(ctx, bson.M{"deleted_at": bson.M{"$exists": true}}, offset)
+}
+
+func (s *Agents) list(ctx context.Context, filter bson.M, offset primitive.ObjectID) (agents []*Agent, err error) {
 	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(s.ListLimit)
-	var filter bson.M
 	// if offset is not nil, then make the offset filter
 	if offset != primitive.NilObjectID {
-		filter = bson.M{"_id": bson.M{"$lt": offset}}
+		filter = bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$lt": offset}}}}
 	}
 	cur, err := s.mongo.Find(ctx, filter, opts)
 	if err != nil {
@@ -103,19 +275,23 @@ func (s *Agents) List(ctx context.Context, offset primitive.ObjectID) (agents []
 	return
 }
 
-func (s Agents) createQdrantCollection(ctx context.Context, name string) (err error) {
-	_, err = s.qdrant.Create(ctx, &pb.CreateCollection{
+// createCollection creates a qdrant collection for agent's memory vectors of the embedding model, and its payload indexes
+func createCollection(ctx context.Context, qdrant pb.CollectionsClient, points pb.PointsClient, name string, spec *EmbeddingSpec, indexes map[string]pb.FieldType) (err error) {
+	_, err = qdrant.Create(ctx, &pb.CreateCollection{
 		CollectionName: name,
 		VectorsConfig: &pb.VectorsConfig{
 			Config: &pb.VectorsConfig_Params{
 				Params: &pb.VectorParams{
-					Size:     1536,
-					Distance: pb.Distance_Cosine,
+					Size:     uint64(spec.Dim),
+					Distance: spec.qdrantDistance(),
 				},
 			},
 		},
 	})
-	return
+	if err != nil {
+		return
+	}
+	return createPayloadIndexes(ctx, points, name, indexes)
 }
 
 func (s Agents) deleteQdrantCollection(ctx context.Context, name string) (err error) {
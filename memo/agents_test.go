@@ -39,7 +39,9 @@ func (s *AgentsSuite) SetupSuite() {
 
 	s.agents = &Agents{
 		qdrant:    pb.NewCollectionsClient(qc),
+		points:    pb.NewPointsClient(qc),
 		mongo:     mc.Database("test-db").Collection("agents"),
+		memories:  mc.Database("test-db").Collection("memories"),
 		ListLimit: 15,
 	}
 }
@@ -84,6 +86,8 @@ func (s *AgentsSuite) TestGetAgent() {
 	s.Equal(agent.Name, "aspirin")
 	// it will create a new "created" value for the agent
 	s.True(agent.Created.After(time.Now().Add(-5 * time.Second)))
+	// the default embedding model is recorded without a configured one
+	s.Equal(DefaultConfig().EmbeddingSpec(), agent.Embedding)
 
 	_, err = s.agents.Get(ctx, primitive.NewObjectID())
 	s.Error(err)
@@ -140,17 +144,72 @@ func (s *AgentsSuite) TestUpdateAgent() {
 	ctx := context.TODO()
 	id, err := s.agents.Add(ctx, &Agent{Name: "aspirin2d"})
 	s.NoError(err)
-	err = s.agents.Update(ctx, &Agent{ID: id, Name: "aspirin3d"})
+	err = s.agents.Update(ctx, &Agent{ID: id, Name: "aspirin3d", Embedding: &EmbeddingSpec{Provider: LLM_LOCAL, Dim: 3}})
 	s.NoError(err)
 	agent, err := s.agents.Get(ctx, id)
 	s.NoError(err)
 	s.Equal("aspirin3d", agent.Name)
+	s.Equal(DefaultConfig().EmbeddingSpec(), agent.Embedding) // only Add records it
+
+	// the empty profile fields are cleared
+	err = s.agents.Update(ctx, &Agent{ID: id, Name: "aspirin3d", Description: "A pirate.", Persona: []string{"grumpy"}})
+	s.NoError(err)
+	err = s.agents.Update(ctx, &Agent{ID: id, Name: "aspirin3d", Persona: []string{"kind"}})
+	s.NoError(err)
+	agent, err = s.agents.Get(ctx, id)
+	s.NoError(err)
+	s.Empty(agent.Description)
+	s.Equal([]string{"kind"}, agent.Persona)
+
+	// the unreflected importance is changed by AddImportance and MarkReflected only
+	unreflected, err := s.agents.AddImportance(ctx, id, 0.5)
+	s.NoError(err)
+	s.Equal(0.5, unreflected)
+	unreflected, err = s.agents.AddImportance(ctx, id, 0.25)
+	s.NoError(err)
+	s.Equal(0.75, unreflected)
+	s.NoError(s.agents.Update(ctx, &Agent{ID: id, Name: "aspirin3d", Unreflected: 9}))
+	agent, err = s.agents.Get(ctx, id)
+	s.NoError(err)
+	s.Equal(0.75, agent.Unreflected)
+	s.NoError(s.agents.MarkReflected(ctx, id, time.Now()))
+	agent, err = s.agents.Get(ctx, id)
+	s.NoError(err)
+	s.Zero(agent.Unreflected)
 
 	// try to update a not existed agent will cause error
 	err = s.agents.Update(ctx, &Agent{ID: primitive.NewObjectID(), Name: "aspirin3d"})
 	s.Error(err)
 }
 
+func (s *AgentsSuite) TestTrashAgent() {
+	ctx := context.TODO()
+	s.agents.TrashRetention = time.Hour
+	defer func() { s.agents.TrashRetention = 0 }()
+
+	id, err := s.agents.Add(ctx, &Agent{Name: "aspirin"})
+	s.NoError(err)
+
+	err = s.agents.Delete(ctx, id)
+	s.NoError(err)
+	_, err = s.agents.Get(ctx, id)
+	s.Error(err)
+	trash, err := s.agents.ListTrash(ctx, primitive.NilObjectID)
+	s.NoError(err)
+	s.Len(trash, 1)
+
+	err = s.agents.Restore(ctx, id)
+	s.NoError(err)
+	agent, err := s.agents.Get(ctx, id)
+	s.NoError(err)
+	s.Nil(agent.Deleted)
+
+	err = s.agents.Purge(ctx, id)
+	s.NoError(err)
+	err = s.agents.Restore(ctx, id)
+	s.Error(err)
+}
+
 func TestAgentsSuite(t *testing.T) {
 	suite.Run(t, new(AgentsSuite))
 }
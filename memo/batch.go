@@ -0,0 +1,116 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// provider-sized embedding batches, tokens are estimated
+const OPENAI_EMBEDDING_BATCH_SIZE = 2048
+const OPENAI_EMBEDDING_BATCH_TOKENS = 100000
+const AZURE_EMBEDDING_BATCH_SIZE = 16
+const OLLAMA_EMBEDDING_BATCH_SIZE = 1 // the api embeds one prompt per request
+
+// DEFAULT_LLM_CONCURRENCY is how many embedding requests of a call run at the same time by default
+const DEFAULT_LLM_CONCURRENCY = 4
+
+// EmbeddingBatch splits the contents of an embedding call into requests of Size contents and Tokens estimated tokens
+// at most, a content which has more tokens is requested alone. Concurrency requests run at the same time.
+// zero values are the provider's defaults, and no limit if the provider has none
+type EmbeddingBatch struct {
+	Size        int
+	Tokens      int
+	Concurrency int
+}
+
+// EmbeddingBatch returns the batch of the config's embedding calls
+func (c *Config) EmbeddingBatch() EmbeddingBatch {
+	return EmbeddingBatch{Size: c.EmbeddingBatchSize, Tokens: c.EmbeddingBatchTokens, Concurrency: c.LLMConcurrency}
+}
+
+// or returns the batch whose zero values are replaced by the defaults'
+func (b EmbeddingBatch) or(defaults EmbeddingBatch) EmbeddingBatch {
+	if b.Size <= 0 {
+		b.Size = defaults.Size
+	}
+	if b.Tokens <= 0 {
+		b.Tokens = defaults.Tokens
+	}
+	if b.Concurrency <= 0 {
+		b.Concurrency = defaults.Concurrency
+	}
+	if b.Concurrency <= 0 {
+		b.Concurrency = DEFAULT_LLM_CONCURRENCY
+	}
+	return b
+}
+
+// split the contents into the ranges [start, end) of the batches, in order
+func (b EmbeddingBatch) split(contents []string) [][2]int {
+	var batches [][2]int
+	start, tokens := 0, 0
+	for idx, content := range contents {
+		t := estimateTokens(content)
+		full := (b.Size > 0 && idx-start >= b.Size) || (b.Tokens > 0 && tokens+t > b.Tokens)
+		if full && idx > start {
+			batches = append(batches, [2]int{start, idx})
+			start, tokens = idx, 0
+		}
+		tokens += t
+	}
+	if start < len(contents) {
+		batches = append(batches, [2]int{start, len(contents)})
+	}
+	return batches
+}
+
+// embedInBatches embeds the contents batch by batch with embed, and reassembles the embeddings in the contents' order.
+// the first error cancels the other requests
+func embedInBatches(ctx context.Context, b EmbeddingBatch, contents []string, embed func(ctx context.Context, contents []string) ([]vectors, error)) ([]vectors, error) {
+	batches := b.split(contents)
+	if len(batches) <= 1 {
+		return embed(ctx, contents)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ems := make([]vectors, len(contents))
+	sem := make(chan struct{}, b.Concurrency)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	for _, batch := range batches {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer func() { <-sem; wg.Done() }()
+			res, err := embed(ctx, contents[start:end])
+			if err == nil && len(res) != end-start {
+				err = NewWrapError(500, fmt.Errorf("expected %d embeddings, got %d", end-start, len(res)), "")
+			}
+			if err != nil {
+				once.Do(func() { first = err; cancel() })
+				return
+			}
+			copy(ems[start:end], res)
+		}(batch[0], batch[1])
+	}
+	wg.Wait()
+
+	if first != nil {
+		return nil, first
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ems, nil
+}
@@ -0,0 +1,66 @@
+package memo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddingBatchSplit(t *testing.T) {
+	long := strings.Repeat("a", 60) // 15 tokens
+	b := EmbeddingBatch{Size: 2, Tokens: 12}
+	assert.Equal(t, [][2]int{{0, 2}, {2, 3}}, b.split([]string{"ab", "cd", "ef"}))
+	// a content over the tokens is requested alone
+	assert.Equal(t, [][2]int{{0, 1}, {1, 2}, {2, 3}}, b.split([]string{"ab", long, long}))
+	assert.Equal(t, [][2]int{{0, 3}}, EmbeddingBatch{}.split([]string{"ab", "cd", long}))
+	assert.Empty(t, b.split(nil))
+
+	b = EmbeddingBatch{Tokens: 20}.or(EmbeddingBatch{Size: 16, Tokens: 100})
+	assert.Equal(t, EmbeddingBatch{Size: 16, Tokens: 20, Concurrency: DEFAULT_LLM_CONCURRENCY}, b)
+}
+
+func TestEmbedInBatches(t *testing.T) {
+	ctx := context.TODO()
+	contents := []string{"a", "bb", "ccc", "dddd", "eeeee"}
+	var running, most, requests atomic.Int32
+	embed := func(ctx context.Context, contents []string) ([]vectors, error) {
+		requests.Add(1)
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		// the later batches finish first
+		time.Sleep(time.Duration(10-len(contents[0])) * time.Millisecond)
+		ems := make([]vectors, len(contents))
+		for idx, content := range contents {
+			ems[idx] = vectors{float32(len(content))}
+		}
+		return ems, nil
+	}
+
+	ems, err := embedInBatches(ctx, EmbeddingBatch{Size: 1, Concurrency: 2}, contents, embed)
+	assert.NoError(t, err)
+	assert.Equal(t, []vectors{{1}, {2}, {3}, {4}, {5}}, ems)
+	assert.Equal(t, int32(5), requests.Load())
+	assert.Equal(t, int32(2), most.Load())
+
+	// the first error fails the call, and the batches not started yet are not requested
+	requests.Store(0)
+	_, err = embedInBatches(ctx, EmbeddingBatch{Size: 1, Concurrency: 1}, contents, func(ctx context.Context, contents []string) ([]vectors, error) {
+		requests.Add(1)
+		return nil, errors.New("llm is down")
+	})
+	assert.ErrorContains(t, err, "llm is down")
+	assert.Equal(t, int32(1), requests.Load())
+
+	// a batch missing embeddings fails
+	_, err = embedInBatches(ctx, EmbeddingBatch{Size: 2, Concurrency: 1}, contents, func(ctx context.Context, contents []string) ([]vectors, error) {
+		return []vectors{{1}}, nil
+	})
+	assert.Equal(t, 500, err.(WrapError).Code())
+}
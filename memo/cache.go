@@ -0,0 +1,247 @@
+package memo
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// backends of the embedding cache
+const CACHE_OFF = "off"
+const CACHE_LRU = "lru"
+const CACHE_REDIS = "redis"
+
+// REDIS_CACHE_PREFIX is the prefix of the embedding cache's redis keys
+const REDIS_CACHE_PREFIX = "memo:embedding:"
+
+// EmbeddingCache stores embeddings by their keys, see CachedLLM
+type EmbeddingCache interface {
+	// Get returns the cached embeddings of the keys in their order, nil for the missing ones
+	Get(ctx context.Context, keys []string) ([]vectors, error)
+	// Set caches the embeddings of the keys
+	Set(ctx context.Context, keys []string, ems []vectors) error
+}
+
+// CacheStats are the counters of an embedding cache, errors are the failed reads and writes of the backend,
+// a failed read counts its contents as misses
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Errors uint64 `json:"errors"`
+}
+
+// CachedLLM embeds with the llm only the contents which are not cached, the embeddings are keyed by
+// the embedding model and the sha256 of the content, so another model never gets them.
+// the cache is best effort, its errors never fail an embedding
+type CachedLLM struct {
+	llm   LLM
+	model string
+	cache EmbeddingCache
+
+	hits, misses, errors atomic.Uint64
+}
+
+// NewCachedLLM caches the embeddings of llm, which makes the vectors of spec
+func NewCachedLLM(llm LLM, spec *EmbeddingSpec, cache EmbeddingCache) *CachedLLM {
+	return &CachedLLM{llm: llm, model: fmt.Sprintf("%s/%s/%d", spec.Provider, spec.Model, spec.Dim), cache: cache}
+}
+
+// key of the content's embedding
+func (c *CachedLLM) key(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return c.model + ":" + hex.EncodeToString(sum[:])
+}
+
+// Embedding returns the cached embeddings, and creates the missing ones with the llm in one request,
+// a content which is repeated is embedded once
+func (c *CachedLLM) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	keys := make([]string, len(contents))
+	for idx, content := range contents {
+		keys[idx] = c.key(content)
+	}
+
+	ems, err := c.cache.Get(ctx, keys)
+	if err != nil || len(ems) != len(keys) {
+		c.errors.Add(1)
+		ems = make([]vectors, len(keys))
+	}
+
+	// key -> index of the missing contents
+	missing := make(map[string]int)
+	var misses []string
+	var missKeys []string
+	for idx, em := range ems {
+		if em != nil {
+			c.hits.Add(1)
+			continue
+		}
+		c.misses.Add(1)
+		if _, ok := missing[keys[idx]]; !ok {
+			missing[keys[idx]] = len(misses)
+			misses = append(misses, contents[idx])
+			missKeys = append(missKeys, keys[idx])
+		}
+	}
+	if len(misses) == 0 {
+		return ems, nil
+	}
+
+	created, err := c.llm.Embedding(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+	if len(created) != len(misses) {
+		return nil, NewWrapError(500, fmt.Errorf("expected %d embeddings, got %d", len(misses), len(created)), "")
+	}
+	for idx, em := range ems {
+		if em == nil {
+			ems[idx] = created[missing[keys[idx]]]
+		}
+	}
+	if err := c.cache.Set(ctx, missKeys, created); err != nil {
+		c.errors.Add(1)
+	}
+	return ems, nil
+}
+
+func (c *CachedLLM) Chat(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+	return c.llm.Chat(ctx, messages)
+}
+
+func (c *CachedLLM) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(delta string) error) (ChatMessage, *Usage, error) {
+	return c.llm.ChatStream(ctx, messages, onDelta)
+}
+
+// Stats returns the counters since the llm was created
+func (c *CachedLLM) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Errors: c.errors.Load()}
+}
+
+// LRUEmbeddingCache keeps the most recently used embeddings in process
+type LRUEmbeddingCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // of *lruEntry, the most recently used first
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	em  vectors
+}
+
+// NewLRUEmbeddingCache creates a cache which keeps size embeddings at most
+func NewLRUEmbeddingCache(size int) *LRUEmbeddingCache {
+	return &LRUEmbeddingCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *LRUEmbeddingCache) Get(ctx context.Context, keys []string) ([]vectors, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ems := make([]vectors, len(keys))
+	for idx, key := range keys {
+		if el, ok := l.items[key]; ok {
+			l.order.MoveToFront(el)
+			ems[idx] = el.Value.(*lruEntry).em
+		}
+	}
+	return ems, nil
+}
+
+func (l *LRUEmbeddingCache) Set(ctx context.Context, keys []string, ems []vectors) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for idx, key := range keys {
+		if el, ok := l.items[key]; ok {
+			el.Value.(*lruEntry).em = ems[idx]
+			l.order.MoveToFront(el)
+			continue
+		}
+		l.items[key] = l.order.PushFront(&lruEntry{key: key, em: ems[idx]})
+		if l.order.Len() > l.size {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+	return nil
+}
+
+// Len returns how many embeddings are cached
+func (l *LRUEmbeddingCache) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// RedisEmbeddingCache keeps embeddings in redis, shared by all servers,
+// they are stored as little-endian float32s which expire after ttl, never if it is zero
+type RedisEmbeddingCache struct {
+	client redis.UniversalClient
+	ttl    time.Duration
+}
+
+// NewRedisEmbeddingCache creates a cache of the redis client
+func NewRedisEmbeddingCache(client redis.UniversalClient, ttl time.Duration) *RedisEmbeddingCache {
+	return &RedisEmbeddingCache{client: client, ttl: ttl}
+}
+
+func (r *RedisEmbeddingCache) Get(ctx context.Context, keys []string) ([]vectors, error) {
+	rkeys := make([]string, len(keys))
+	for idx, key := range keys {
+		rkeys[idx] = REDIS_CACHE_PREFIX + key
+	}
+	values, err := r.client.MGet(ctx, rkeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ems := make([]vectors, len(keys))
+	for idx, v := range values {
+		if s, ok := v.(string); ok {
+			ems[idx] = decodeVectors([]byte(s))
+		}
+	}
+	return ems, nil
+}
+
+func (r *RedisEmbeddingCache) Set(ctx context.Context, keys []string, ems []vectors) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for idx, key := range keys {
+			pipe.Set(ctx, REDIS_CACHE_PREFIX+key, encodeVectors(ems[idx]), r.ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func encodeVectors(em vectors) []byte {
+	b := make([]byte, 4*len(em))
+	for idx, v := range em {
+		binary.LittleEndian.PutUint32(b[4*idx:], math.Float32bits(v))
+	}
+	return b
+}
+
+// decodeVectors returns nil if b is not made by encodeVectors
+func decodeVectors(b []byte) vectors {
+	if len(b) == 0 || len(b)%4 != 0 {
+		return nil
+	}
+	em := make(vectors, len(b)/4)
+	for idx := range em {
+		em[idx] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*idx:]))
+	}
+	return em
+}
@@ -0,0 +1,106 @@
+package memo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingLLM records the contents it was asked to embed
+type countingLLM struct {
+	*Local
+	calls [][]string
+}
+
+func (c *countingLLM) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	c.calls = append(c.calls, contents)
+	return c.Local.Embedding(ctx, contents)
+}
+
+// brokenCache fails every read and write
+type brokenCache struct{}
+
+func (brokenCache) Get(ctx context.Context, keys []string) ([]vectors, error) {
+	return nil, errors.New("cache is down")
+}
+
+func (brokenCache) Set(ctx context.Context, keys []string, ems []vectors) error {
+	return errors.New("cache is down")
+}
+
+func TestCachedLLM(t *testing.T) {
+	var _ LLM = (*CachedLLM)(nil)
+	ctx := context.TODO()
+	spec := &EmbeddingSpec{Provider: LLM_LOCAL, Model: LOCAL_EMBEDDING_MODEL, Dim: 8}
+	llm := &countingLLM{Local: NewLocal(8)}
+	cache := NewLRUEmbeddingCache(16)
+	cached := NewCachedLLM(llm, spec, cache)
+
+	// repeated contents are embedded once
+	ems, err := cached.Embedding(ctx, []string{"hi", "hello", "hi"})
+	assert.NoError(t, err)
+	expected, _ := NewLocal(8).Embedding(ctx, []string{"hi", "hello", "hi"})
+	assert.Equal(t, expected, ems)
+	assert.Equal(t, [][]string{{"hi", "hello"}}, llm.calls)
+	assert.Equal(t, CacheStats{Misses: 3}, cached.Stats())
+
+	// only the missing ones are embedded
+	ems, err = cached.Embedding(ctx, []string{"hello", "hey"})
+	assert.NoError(t, err)
+	assert.Equal(t, expected[1], ems[0])
+	assert.Equal(t, []string{"hey"}, llm.calls[1])
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 4}, cached.Stats())
+
+	// another model never gets them
+	other := NewCachedLLM(llm, &EmbeddingSpec{Provider: LLM_OLLAMA, Model: "nomic-embed-text", Dim: 8}, cache)
+	_, err = other.Embedding(ctx, []string{"hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, CacheStats{Misses: 1}, other.Stats())
+
+	// a broken cache doesn't fail embeddings
+	broken := NewCachedLLM(llm, spec, brokenCache{})
+	ems, err = broken.Embedding(ctx, []string{"hi"})
+	assert.NoError(t, err)
+	assert.Equal(t, expected[0], ems[0])
+	assert.Equal(t, CacheStats{Misses: 1, Errors: 2}, broken.Stats())
+}
+
+func TestLRUEmbeddingCache(t *testing.T) {
+	ctx := context.TODO()
+	cache := NewLRUEmbeddingCache(2)
+	assert.NoError(t, cache.Set(ctx, []string{"a", "b"}, []vectors{{1}, {2}}))
+
+	// a is used recently, so b is evicted
+	ems, _ := cache.Get(ctx, []string{"a", "c"})
+	assert.Equal(t, []vectors{{1}, nil}, ems)
+	assert.NoError(t, cache.Set(ctx, []string{"c"}, []vectors{{3}}))
+	ems, _ = cache.Get(ctx, []string{"a", "b", "c"})
+	assert.Equal(t, []vectors{{1}, nil, {3}}, ems)
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestEncodeVectors(t *testing.T) {
+	em := vectors{0.5, -1, 3.25}
+	assert.Equal(t, em, decodeVectors(encodeVectors(em)))
+	assert.Nil(t, decodeVectors([]byte{1, 2, 3}))
+}
+
+func TestRedisEmbeddingCache(t *testing.T) {
+	ctx := context.TODO()
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer client.Close()
+
+	cache := NewRedisEmbeddingCache(client, time.Minute)
+	key := "test:" + time.Now().String()
+	defer client.Del(ctx, REDIS_CACHE_PREFIX+key)
+
+	assert.NoError(t, cache.Set(ctx, []string{key}, []vectors{{0.5, 1}}))
+	ems, err := cache.Get(ctx, []string{key, key + ":missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, []vectors{{0.5, 1}, nil}, ems)
+	assert.Greater(t, client.TTL(ctx, REDIS_CACHE_PREFIX+key).Val(), time.Duration(0))
+}
@@ -0,0 +1,167 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SOURCE_CHAT is the source of the memories remembered from chats
+const SOURCE_CHAT = "chat"
+
+const CHAT_PROMPT = `%s
+Reply to the conversation in character, ` +
+	`use the numbered memories below when they are relevant, and don't make up memories you don't have.
+Memories:
+%s`
+
+// ChatRequest is a conversation with an agent, the latest user message is the query of its memories.
+// if it references a session, the messages are the new ones after the session's messages,
+// and they are appended to the session with the reply
+type ChatRequest struct {
+	Messages []ChatMessage      `json:"messages"`
+	Session  primitive.ObjectID `json:"session,omitempty"`
+	Window   *Window            `json:"window,omitempty"`   // session's messages which the chat is given, the config's by default
+	Filter   *MemoryFilter      `json:"filter,omitempty"`   // narrows the searched memories
+	Remember bool               `json:"remember,omitempty"` // store the latest user message and the reply as memories
+}
+
+// ChatReply is the agent's reply, with the memories it was given
+type ChatReply struct {
+	Reply      ChatMessage          `json:"reply"`
+	Memories   []primitive.ObjectID `json:"memories"`
+	Remembered []primitive.ObjectID `json:"remembered,omitempty"` // the memories of the exchange, if it is remembered
+	Usage      *Usage               `json:"usage,omitempty"`      // only streamed replies have it
+}
+
+// chatTurn is a chat whose prompt is ready
+type chatTurn struct {
+	agent    *Agent
+	query    string
+	messages []ChatMessage // the system prompt and the conversation
+	memories []*Memory
+}
+
+// Chat replies to the conversation as the agent: agent's profile and the memories searched by the latest
+// user message are put into a system prompt before the conversation, then llm replies with agent's model settings.
+func (m *Memo) Chat(ctx context.Context, aid primitive.ObjectID, req *ChatRequest) (*ChatReply, error) {
+	turn, err := m.prepareChat(ctx, aid, req)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := m.LLM.Chat(turn.agent.context(ctx), turn.messages)
+	if err != nil {
+		return nil, err
+	}
+	return m.finishChat(ctx, aid, req, turn, reply, nil)
+}
+
+// ChatStream replies like Chat, but onDelta is called with each piece of the reply as it arrives,
+// the reply has the token usage
+func (m *Memo) ChatStream(ctx context.Context, aid primitive.ObjectID, req *ChatRequest, onDelta func(delta string) error) (*ChatReply, error) {
+	turn, err := m.prepareChat(ctx, aid, req)
+	if err != nil {
+		return nil, err
+	}
+	return m.streamChat(ctx, aid, req, turn, onDelta)
+}
+
+// streamChat streams the reply of a prepared chat
+func (m *Memo) streamChat(ctx context.Context, aid primitive.ObjectID, req *ChatRequest, turn *chatTurn, onDelta func(delta string) error) (*ChatReply, error) {
+	reply, usage, err := m.LLM.ChatStream(turn.agent.context(ctx), turn.messages, onDelta)
+	if err != nil {
+		return nil, err
+	}
+	return m.finishChat(ctx, aid, req, turn, reply, usage)
+}
+
+// prepareChat searches the memories by the latest user message, and puts them into the system prompt
+func (m *Memo) prepareChat(ctx context.Context, aid primitive.ObjectID, req *ChatRequest) (*chatTurn, error) {
+	query := latestUserMessage(req.Messages)
+	if query == "" {
+		return nil, NewWrapError(400, fmt.Errorf("chat needs a user message"), "")
+	}
+
+	agent, err := m.Agents.Get(ctx, aid)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation := req.Messages
+	if req.Session != primitive.NilObjectID {
+		if m.Sessions == nil {
+			return nil, NewWrapError(501, fmt.Errorf("sessions are not supported"), "")
+		}
+		if err := validateChatMessages(req.Messages); err != nil {
+			return nil, err
+		}
+		window := req.Window
+		if window == nil {
+			window = m.config().SessionWindow()
+		}
+		history, err := m.Sessions.Messages(ctx, aid, req.Session, window)
+		if err != nil {
+			return nil, err
+		}
+		conversation = make([]ChatMessage, 0, len(history)+len(req.Messages))
+		for _, h := range history {
+			conversation = append(conversation, h.ChatMessage)
+		}
+		conversation = append(conversation, req.Messages...)
+	}
+
+	memories, _, err := m.Memories.Search(ctx, aid, query, req.Filter)
+	if e, ok := err.(WrapError); ok && e.Code() == 404 {
+		err = nil // nothing to remember yet
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	messages := append([]ChatMessage{
+		{Role: "system", Content: fmt.Sprintf(CHAT_PROMPT, agent.profile(), numberedStatements(memories))},
+	}, conversation...)
+	return &chatTurn{agent: agent, query: query, messages: messages, memories: memories}, nil
+}
+
+// finishChat appends the new messages and the reply to the session, and remembers the exchange if it is requested
+func (m *Memo) finishChat(ctx context.Context, aid primitive.ObjectID, req *ChatRequest, turn *chatTurn, reply ChatMessage, usage *Usage) (*ChatReply, error) {
+	res := &ChatReply{Reply: reply, Memories: make([]primitive.ObjectID, len(turn.memories)), Usage: usage}
+	for idx, mem := range turn.memories {
+		res.Memories[idx] = mem.ID
+	}
+
+	if req.Session != primitive.NilObjectID {
+		messages := req.Messages
+		if reply.Content != "" {
+			messages = append(messages[:len(messages):len(messages)], ChatMessage{Role: "assistant", Content: reply.Content})
+		}
+		if _, err := m.Sessions.Append(ctx, aid, req.Session, messages); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Remember && strings.TrimSpace(reply.Content) != "" {
+		var err error
+		res.Remembered, err = m.Remember(ctx, aid, []*Memory{
+			{Content: turn.query, Source: SOURCE_CHAT, Metadata: map[string]interface{}{"role": "user"}},
+			{Content: reply.Content, Source: SOURCE_CHAT, Metadata: map[string]interface{}{"role": "assistant"}},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// latestUserMessage is the content of the last user message, empty if there is none
+func latestUserMessage(messages []ChatMessage) string {
+	for idx := len(messages) - 1; idx >= 0; idx-- {
+		if messages[idx].Role == "user" {
+			return strings.TrimSpace(messages[idx].Content)
+		}
+	}
+	return ""
+}
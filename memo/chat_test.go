@@ -0,0 +1,283 @@
+package memo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ChatSuite struct {
+	suite.Suite
+	memo  *Memo
+	llm   *Local
+	agent *Agent
+
+	prompts []ChatMessage // the messages of the last chat
+}
+
+func (s *ChatSuite) SetupTest() {
+	s.agent = &Agent{Name: "aspirin"}
+	s.memo, s.llm = newTestMemo(s.T(), s.agent)
+	s.llm.ChatFunc = func(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+		s.prompts = messages
+		return ChatMessage{Role: "assistant", Content: "Your favorite color is red."}, nil
+	}
+}
+
+func (s *ChatSuite) TestChat() {
+	ctx := context.TODO()
+	ids, err := s.memo.Memories.AddMany(ctx, s.agent.ID, []*Memory{{Content: "My favorite color is red."}})
+	s.NoError(err)
+
+	reply, err := s.memo.Chat(ctx, s.agent.ID, &ChatRequest{Messages: []ChatMessage{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+		{Role: "user", Content: "What is my favorite color?"},
+	}})
+	s.NoError(err)
+	s.Equal("Your favorite color is red.", reply.Reply.Content)
+	s.Equal(ids, reply.Memories)
+	s.Empty(reply.Remembered)
+
+	// the memories are put into the system prompt before the conversation
+	s.Len(s.prompts, 4)
+	s.Equal("system", s.prompts[0].Role)
+	s.True(strings.Contains(s.prompts[0].Content, "aspirin"))
+	s.True(strings.Contains(s.prompts[0].Content, "1. My favorite color is red."))
+	s.Equal("What is my favorite color?", s.prompts[3].Content)
+}
+
+func (s *ChatSuite) TestChatAndRemember() {
+	ctx := context.TODO()
+
+	// no memories yet
+	reply, err := s.memo.Chat(ctx, s.agent.ID, &ChatRequest{
+		Messages: []ChatMessage{{Role: "user", Content: "What is my favorite color?"}},
+		Remember: true,
+	})
+	s.NoError(err)
+	s.Empty(reply.Memories)
+	s.Len(reply.Remembered, 2)
+
+	memories, err := s.memo.Memories.GetMany(ctx, s.agent.ID, reply.Remembered)
+	s.NoError(err)
+	for _, mem := range memories {
+		s.Equal(SOURCE_CHAT, mem.Source)
+	}
+
+	reply, err = s.memo.Chat(ctx, s.agent.ID, &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "Which color?"}}})
+	s.NoError(err)
+	s.Len(reply.Memories, 2)
+}
+
+func (s *ChatSuite) TestChatErrors() {
+	ctx := context.TODO()
+	_, err := s.memo.Chat(ctx, s.agent.ID, &ChatRequest{Messages: []ChatMessage{{Role: "assistant", Content: "Hello"}}})
+	s.Equal(400, err.(WrapError).Code())
+
+	_, err = s.memo.Chat(ctx, primitive.NewObjectID(), &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "Hi"}}})
+	s.Equal(404, err.(WrapError).Code())
+}
+
+func (s *ChatSuite) TestChatHandler() {
+	gin.SetMode(gin.ReleaseMode)
+	router := NewRouter(s.memo)
+
+	body, _ := json.Marshal(ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "What is my favorite color?"}}, Remember: true})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", API_BASE_PATH+"/agents/"+s.agent.ID.Hex()+"/chat", bytes.NewReader(body))
+	router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	var reply ChatReply
+	s.NoError(json.NewDecoder(w.Body).Decode(&reply))
+	s.Equal("Your favorite color is red.", reply.Reply.Content)
+	s.Len(reply.Remembered, 2)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", API_BASE_PATH+"/agents/"+s.agent.ID.Hex()+"/chat", bytes.NewBufferString("{"))
+	router.ServeHTTP(w, req)
+	s.Equal(400, w.Code)
+}
+
+func (s *ChatSuite) TestChatStream() {
+	ctx := context.TODO()
+	_, err := s.memo.Memories.AddMany(ctx, s.agent.ID, []*Memory{{Content: "My favorite color is red."}})
+	s.NoError(err)
+
+	var deltas []string
+	reply, err := s.memo.ChatStream(ctx, s.agent.ID, &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "What is my favorite color?"}}},
+		func(delta string) error {
+			deltas = append(deltas, delta)
+			return nil
+		})
+	s.NoError(err)
+	s.Equal([]string{"Your ", "favorite ", "color ", "is ", "red."}, deltas)
+	s.Equal("Your favorite color is red.", reply.Reply.Content)
+	s.Len(reply.Memories, 1)
+	s.True(reply.Usage.Estimated)
+	s.Equal(reply.Usage.PromptTokens+reply.Usage.CompletionTokens, reply.Usage.TotalTokens)
+
+	// the stream stops when the context is cancelled
+	cctx, cancel := context.WithCancel(ctx)
+	_, err = s.memo.ChatStream(cctx, s.agent.ID, &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "Hi"}}, Remember: true},
+		func(delta string) error {
+			cancel()
+			return nil
+		})
+	s.ErrorIs(err, context.Canceled)
+	memories, err := s.memo.listMemories(ctx, s.agent.ID, nil, 0)
+	s.NoError(err)
+	s.Len(memories, 1) // nothing is remembered
+}
+
+func (s *ChatSuite) TestChatStreamHandler() {
+	gin.SetMode(gin.ReleaseMode)
+	router := NewRouter(s.memo)
+	url := API_BASE_PATH + "/agents/" + s.agent.ID.Hex() + "/chat"
+	body, _ := json.Marshal(ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "What is my favorite color?"}}})
+
+	// server-sent events
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Accept", "text/event-stream")
+	router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+	s.Equal("text/event-stream", w.Header().Get("Content-Type"))
+
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	s.Len(events, 6)
+	s.Equal("event: delta\ndata: {\"type\":\"delta\",\"delta\":\"Your \"}", events[0])
+	s.True(strings.HasPrefix(events[5], "event: done\ndata: "))
+
+	var done chatEvent
+	s.NoError(json.Unmarshal([]byte(strings.TrimPrefix(events[5], "event: done\ndata: ")), &done))
+	s.Equal("Your favorite color is red.", done.Reply.Reply.Content)
+	s.NotNil(done.Reply.Usage)
+
+	// newline delimited json
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", url+"?stream=ndjson", bytes.NewReader(body))
+	router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	s.Len(lines, 6)
+	s.NoError(json.Unmarshal([]byte(lines[5]), &done))
+	s.Equal("done", done.Type)
+
+	// errors before streaming are responded as json
+	body, _ = json.Marshal(ChatRequest{Messages: []ChatMessage{{Role: "assistant", Content: "Hi"}}})
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", url+"?stream=sse", bytes.NewReader(body))
+	router.ServeHTTP(w, req)
+	s.Equal(400, w.Code)
+
+	// so are llm errors before the first delta
+	s.llm.ChatFunc = nil
+	body, _ = json.Marshal(ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "Hi"}}})
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", url+"?stream=ndjson", bytes.NewReader(body))
+	router.ServeHTTP(w, req)
+	s.Equal(500, w.Code)
+}
+
+func (s *ChatSuite) TestChatWithSession() {
+	ctx := context.TODO()
+	sid, err := s.memo.Sessions.Add(ctx, s.agent.ID, &Session{})
+	s.NoError(err)
+	_, err = s.memo.Sessions.Append(ctx, s.agent.ID, sid, []ChatMessage{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+	})
+	s.NoError(err)
+
+	_, err = s.memo.Chat(ctx, s.agent.ID, &ChatRequest{
+		Session:  sid,
+		Messages: []ChatMessage{{Role: "user", Content: "What is my favorite color?"}},
+	})
+	s.NoError(err)
+	s.Len(s.prompts, 4) // the system prompt, the session's messages and the new one
+	s.Equal("Hi", s.prompts[1].Content)
+
+	messages, err := s.memo.Sessions.Messages(ctx, s.agent.ID, sid, nil)
+	s.NoError(err)
+	s.Len(messages, 4)
+	s.Equal("Your favorite color is red.", messages[3].Content)
+
+	// the window limits the session's messages
+	_, err = s.memo.Chat(ctx, s.agent.ID, &ChatRequest{
+		Session:  sid,
+		Window:   &Window{Last: 1},
+		Messages: []ChatMessage{{Role: "user", Content: "Again?"}},
+	})
+	s.NoError(err)
+	s.Len(s.prompts, 3)
+
+	_, err = s.memo.Chat(ctx, s.agent.ID, &ChatRequest{Session: primitive.NewObjectID(), Messages: []ChatMessage{{Role: "user", Content: "Hi"}}})
+	s.Equal(404, err.(WrapError).Code())
+
+	s.memo.Sessions = nil
+	_, err = s.memo.Chat(ctx, s.agent.ID, &ChatRequest{Session: sid, Messages: []ChatMessage{{Role: "user", Content: "Hi"}}})
+	s.Equal(501, err.(WrapError).Code())
+}
+
+func (s *ChatSuite) TestSessionHandlers() {
+	gin.SetMode(gin.ReleaseMode)
+	router := NewRouter(s.memo)
+	url := API_BASE_PATH + "/agents/" + s.agent.ID.Hex() + "/sessions"
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, url, bytes.NewBufferString(body)))
+		return w
+	}
+
+	w := serve("POST", url, `{"title":"hello"}`)
+	s.Equal(200, w.Code)
+	var res struct {
+		Inserted primitive.ObjectID `json:"inserted"`
+	}
+	s.NoError(json.NewDecoder(w.Body).Decode(&res))
+	sid := res.Inserted.Hex()
+
+	s.Equal(200, serve("PUT", url+"/"+sid, `{"title":"colors"}`).Code)
+	w = serve("GET", url+"/"+sid, "")
+	s.Equal(200, w.Code)
+	var session Session
+	s.NoError(json.NewDecoder(w.Body).Decode(&session))
+	s.Equal("colors", session.Title)
+
+	s.Equal(200, serve("POST", url+"/"+sid+"/messages", `[{"role":"user","message":"Hi"},{"role":"assistant","message":"Hello"}]`).Code)
+	w = serve("GET", url+"/"+sid+"/messages?last=1", "")
+	s.Equal(200, w.Code)
+	var messages []*SessionMessage
+	s.NoError(json.NewDecoder(w.Body).Decode(&messages))
+	s.Len(messages, 1)
+	s.Equal("Hello", messages[0].Content)
+
+	s.Equal(400, serve("GET", url+"/"+sid+"/messages?last=x", "").Code)
+	s.Equal(400, serve("GET", url+"/123", "").Code)
+
+	w = serve("GET", url, "")
+	s.Equal(200, w.Code)
+	var sessions []*Session
+	s.NoError(json.NewDecoder(w.Body).Decode(&sessions))
+	s.Len(sessions, 1)
+	s.Equal(2, sessions[0].Messages)
+
+	s.Equal(200, serve("DELETE", url+"/"+sid, "").Code)
+	s.Equal(404, serve("GET", url+"/"+sid, "").Code)
+
+	s.memo.Sessions = nil
+	s.Equal(501, serve("GET", url, "").Code)
+}
+
+func TestChatSuite(t *testing.T) {
+	suite.Run(t, new(ChatSuite))
+}
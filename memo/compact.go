@@ -0,0 +1,206 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// how old memories are grouped before they are summarised
+const GROUPING_TIME = "time"             // memories created in the same time window
+const GROUPING_SIMILARITY = "similarity" // memories similar to the group's first memory
+
+const SUMMARY_PROMPT = `Summarise the numbered memories above into one concise memory written in the same person, ` +
+	`keep the important facts, names, places and dates. Answer with the summary only.`
+
+// CompactionPolicy decides which memories are compacted and how, see the compaction_* config keys
+type CompactionPolicy struct {
+	Age           time.Duration // memories older than it are compacted
+	Grouping      string        // GROUPING_TIME or GROUPING_SIMILARITY
+	Window        time.Duration // time window of a group
+	Similarity    float64       // minimal cosine similarity to the group's first memory
+	MaxGroupSize  int
+	KeepOriginals bool // archive the originals if true, otherwise delete them
+}
+
+// CompactionPolicy returns the compaction policy of the config
+func (c *Config) CompactionPolicy() CompactionPolicy {
+	return CompactionPolicy{
+		Age:           c.CompactionAge,
+		Grouping:      c.CompactionGrouping,
+		Window:        c.CompactionWindow,
+		Similarity:    c.CompactionSimilarity,
+		MaxGroupSize:  c.CompactionGroupSize,
+		KeepOriginals: c.CompactionKeepOriginals,
+	}
+}
+
+// Compaction is the result of compacting agent's memories
+type Compaction struct {
+	Summaries []*Memory `json:"summaries"`
+	Archived  int       `json:"archived"`
+	Deleted   int       `json:"deleted"`
+}
+
+// Compact summarises agent's old memories group by group. Each summary is stored as a memory of
+// KIND_SUMMARY linked to its sources, then the sources are archived, or deleted if the policy doesn't
+// keep them. Only observed memories are compacted, reflections and summaries are left as they are.
+func (m *Memo) Compact(ctx context.Context, aid primitive.ObjectID, policy CompactionPolicy) (*Compaction, error) {
+	agent, err := m.Agents.Get(ctx, aid)
+	if err != nil {
+		return nil, err
+	}
+	ctx = agent.context(ctx) // llm summarises with agent's model settings
+
+	cutoff := time.Now().Add(-policy.Age)
+	memories, err := m.listMemories(ctx, aid, &MemoryFilter{Before: &cutoff}, 0)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*Memory
+	for _, mem := range memories {
+		if mem.Kind == "" {
+			candidates = append(candidates, mem)
+		}
+	}
+	// oldest first
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Created.Before(candidates[j].Created) })
+
+	var groups [][]*Memory
+	switch policy.Grouping {
+	case GROUPING_SIMILARITY:
+		groups, err = m.groupBySimilarity(ctx, candidates, policy.Similarity, policy.MaxGroupSize)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		groups = groupByTime(candidates, policy.Window, policy.MaxGroupSize)
+	}
+
+	compaction := &Compaction{Summaries: []*Memory{}}
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue // nothing to compact
+		}
+		summary, err := m.summarise(ctx, group)
+		if err != nil {
+			return compaction, err
+		}
+		if _, err := m.Memories.AddOne(ctx, aid, summary); err != nil {
+			return compaction, err
+		}
+
+		if policy.KeepOriginals {
+			err = m.Memories.Archive(ctx, aid, summary.Evidence)
+		} else {
+			err = m.Memories.DeleteMany(ctx, aid, summary.Evidence)
+		}
+		if err != nil {
+			// the sources are still there, so the summary is removed, or they would be summarised twice
+			if derr := m.Memories.DeleteOne(ctx, aid, summary.ID); derr != nil && m.Logger != nil {
+				m.Logger.Errorw("summary not removed after a failed compaction", "aid", aid.Hex(), "mid", summary.ID.Hex(), "error", derr)
+			}
+			return compaction, err
+		}
+
+		compaction.Summaries = append(compaction.Summaries, summary)
+		if policy.KeepOriginals {
+			compaction.Archived += len(group)
+		} else {
+			compaction.Deleted += len(group)
+		}
+	}
+	return compaction, nil
+}
+
+// summarise a group of memories into a summary memory, which is linked to the group,
+// it takes the group's last created time, the highest importance, and the tags of all
+func (m *Memo) summarise(ctx context.Context, group []*Memory) (*Memory, error) {
+	answer, err := m.LLM.Chat(ctx, []ChatMessage{
+		{Role: "user", Content: numberedStatements(group) + "\n" + SUMMARY_PROMPT},
+	})
+	if err != nil {
+		return nil, err
+	}
+	content := strings.TrimSpace(answer.Content)
+	if content == "" {
+		return nil, NewWrapError(500, fmt.Errorf("llm summarised nothing"), "")
+	}
+
+	summary := &Memory{Content: content, Kind: KIND_SUMMARY, Source: group[0].Source}
+	seen := make(map[string]bool)
+	for _, mem := range group {
+		summary.Evidence = append(summary.Evidence, mem.ID)
+		if mem.Created.After(summary.Created) {
+			summary.Created = mem.Created
+		}
+		if mem.Importance > summary.Importance {
+			summary.Importance = mem.Importance
+		}
+		if mem.Source != summary.Source {
+			summary.Source = ""
+		}
+		for _, tag := range mem.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				summary.Tags = append(summary.Tags, tag)
+			}
+		}
+	}
+	return summary, nil
+}
+
+// groupByTime groups memories sorted by created time, a group spans at most window from its first memory
+func groupByTime(memories []*Memory, window time.Duration, size int) [][]*Memory {
+	var groups [][]*Memory
+	var group []*Memory
+	for _, mem := range memories {
+		if len(group) > 0 && (len(group) >= size || mem.Created.Sub(group[0].Created) >= window) {
+			groups = append(groups, group)
+			group = nil
+		}
+		group = append(group, mem)
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// groupBySimilarity puts each memory into the first group whose first memory is similar enough,
+// or it starts a new group
+func (m *Memo) groupBySimilarity(ctx context.Context, memories []*Memory, similarity float64, size int) ([][]*Memory, error) {
+	if len(memories) == 0 {
+		return nil, nil
+	}
+	contents := make([]string, len(memories))
+	for idx, mem := range memories {
+		contents[idx] = mem.Content
+	}
+	ems, err := m.LLM.Embedding(ctx, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups [][]*Memory
+	var seeds []vectors
+	for idx, mem := range memories {
+		placed := false
+		for g, seed := range seeds {
+			if len(groups[g]) < size && float64(cosine(seed, ems[idx])) >= similarity {
+				groups[g] = append(groups[g], mem)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			groups = append(groups, []*Memory{mem})
+			seeds = append(seeds, ems[idx])
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,143 @@
+package memo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type CompactSuite struct {
+	suite.Suite
+	memo  *Memo
+	llm   *Local
+	agent *Agent
+	ids   []primitive.ObjectID
+}
+
+func (s *CompactSuite) SetupTest() {
+	s.agent = &Agent{Name: "Klaus"}
+	s.memo, s.llm = newTestMemo(s.T(), s.agent)
+
+	monthsAgo := time.Now().Add(-60 * 24 * time.Hour)
+	var err error
+	s.ids, err = s.memo.Memories.AddMany(context.TODO(), s.agent.ID, []*Memory{
+		{Content: "Klaus had coffee in the morning", Created: monthsAgo, Importance: 0.1, Tags: []string{"food"}},
+		{Content: "Klaus read a book on gentrification", Created: monthsAgo.Add(time.Hour), Importance: 0.4, Tags: []string{"work"}},
+		{Content: "Klaus had coffee in the morning again", Created: monthsAgo.Add(48 * time.Hour), Importance: 0.1},
+		{Content: "Klaus is writing a research paper", Importance: 0.5},
+	})
+	s.NoError(err)
+}
+
+func (s *CompactSuite) TestCompactByTime() {
+	ctx := context.TODO()
+	s.llm.Script(ChatMessage{Content: " Klaus read about gentrification over coffee \n"})
+
+	compaction, err := s.memo.Compact(ctx, s.agent.ID, s.memo.config().CompactionPolicy())
+	s.NoError(err)
+	s.Len(compaction.Summaries, 1) // the third memory is alone in its window, the fourth is too young
+	s.Equal(2, compaction.Archived)
+
+	summary := compaction.Summaries[0]
+	s.Equal("Klaus read about gentrification over coffee", summary.Content)
+	s.Equal(KIND_SUMMARY, summary.Kind)
+	s.Equal(s.ids[:2], summary.Evidence)
+	s.Equal(0.4, summary.Importance)
+	s.Equal([]string{"food", "work"}, summary.Tags)
+
+	// archived memories are only listed with include_archived, but they can still be read
+	memories, err := s.memo.listMemories(ctx, s.agent.ID, nil, 0)
+	s.NoError(err)
+	s.Len(memories, 3)
+	memories, err = s.memo.listMemories(ctx, s.agent.ID, &MemoryFilter{IncludeArchived: true}, 0)
+	s.NoError(err)
+	s.Len(memories, 5)
+
+	archived, err := s.memo.Memories.GetOne(ctx, s.agent.ID, s.ids[0])
+	s.NoError(err)
+	s.NotNil(archived.Archived)
+
+	mems, _, err := s.memo.Memories.Search(ctx, s.agent.ID, "coffee in the morning", nil)
+	s.NoError(err)
+	for _, mem := range mems {
+		s.Nil(mem.Archived)
+	}
+
+	// archived memories are not updated, and summaries are not compacted again
+	err = s.memo.Memories.UpdateOne(ctx, s.agent.ID, &Memory{ID: s.ids[0], Content: "Klaus had tea"})
+	s.Equal(400, err.(WrapError).Code())
+
+	compaction, err = s.memo.Compact(ctx, s.agent.ID, s.memo.config().CompactionPolicy())
+	s.NoError(err)
+	s.Empty(compaction.Summaries)
+}
+
+func (s *CompactSuite) TestCompactBySimilarity() {
+	ctx := context.TODO()
+	s.llm.Script(ChatMessage{Content: "Klaus has coffee every morning"})
+
+	policy := s.memo.config().CompactionPolicy()
+	policy.Grouping = GROUPING_SIMILARITY
+	policy.Similarity = 0.7
+	policy.KeepOriginals = false
+
+	compaction, err := s.memo.Compact(ctx, s.agent.ID, policy)
+	s.NoError(err)
+	s.Len(compaction.Summaries, 1)
+	s.Equal(2, compaction.Deleted)
+	s.Equal([]primitive.ObjectID{s.ids[0], s.ids[2]}, compaction.Summaries[0].Evidence)
+
+	_, err = s.memo.Memories.GetOne(ctx, s.agent.ID, s.ids[2])
+	s.Equal(404, err.(WrapError).Code())
+
+	memories, err := s.memo.listMemories(ctx, s.agent.ID, &MemoryFilter{IncludeArchived: true}, 0)
+	s.NoError(err)
+	s.Len(memories, 3)
+}
+
+func (s *CompactSuite) TestCompactFailed() {
+	ctx := context.TODO()
+
+	// llm summarised nothing
+	s.llm.Script(ChatMessage{Content: "\n"})
+	_, err := s.memo.Compact(ctx, s.agent.ID, s.memo.config().CompactionPolicy())
+	s.Equal(500, err.(WrapError).Code())
+
+	memories, err := s.memo.listMemories(ctx, s.agent.ID, nil, 0)
+	s.NoError(err)
+	s.Len(memories, 4)
+
+	_, err = s.memo.Compact(ctx, primitive.NewObjectID(), s.memo.config().CompactionPolicy())
+	s.Equal(404, err.(WrapError).Code())
+}
+
+func (s *CompactSuite) TestCompactHandler() {
+	gin.SetMode(gin.ReleaseMode)
+	router := NewRouter(s.memo)
+	s.llm.Script(ChatMessage{Content: "Klaus read about gentrification over coffee"})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", API_BASE_PATH+"/agents/"+s.agent.ID.Hex()+"/memories/compact", bytes.NewBuffer(nil))
+	router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	var compaction Compaction
+	s.NoError(json.NewDecoder(w.Body).Decode(&compaction))
+	s.Equal(2, compaction.Archived)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", API_BASE_PATH+"/agents/"+s.agent.ID.Hex()+"/memories?include_archived=true", nil)
+	router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+}
+
+func TestCompactSuite(t *testing.T) {
+	suite.Run(t, new(CompactSuite))
+}
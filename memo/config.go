@@ -0,0 +1,473 @@
+package memo
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const LLM_OPENAI = "openai"
+const LLM_AZURE = "azure"
+const LLM_OLLAMA = "ollama"
+const LLM_LOCAL = "local"
+
+const STORAGE_MONGO = "mongo"
+const STORAGE_MEMORY = "memory"
+
+// ENV_PREFIX is the prefix of environment variables which override config keys,
+// e.g. MEMO_MONGO_URI overrides mongo_uri
+const ENV_PREFIX = "MEMO_"
+
+type Config struct {
+	// LLM is the provider of embeddings and chats: "openai" (default), "azure", "ollama",
+	// or "local" for offline deterministic embeddings.
+	// EmbeddingLLM and ChatLLM choose the provider of each capability, LLM's by default
+	LLM          string `toml:"llm"`
+	EmbeddingLLM string `toml:"embedding_llm"`
+	ChatLLM      string `toml:"chat_llm"`
+	// the embeddings' dimension and the distance metric of their vectors: "cosine" (default), "dot" or "euclid",
+	// they are recorded on agents with the embedding model when they are created
+	EmbeddingDim      int    `toml:"embedding_dim"`
+	EmbeddingDistance string `toml:"embedding_distance"`
+
+	// openai api, or a server compatible with it if OpenAIBaseURL is set
+	OpenAIAPIKey         string `toml:"openai_api_key"`
+	OpenAIBaseURL        string `toml:"openai_base_url"`
+	OpenAIOrg            string `toml:"openai_org"`
+	OpenAIChatModel      string `toml:"openai_chat_model"`
+	OpenAIEmbeddingModel string `toml:"openai_embedding_model"`
+
+	// Azure OpenAI deployments
+	AzureEndpoint            string `toml:"azure_endpoint"`
+	AzureAPIKey              string `toml:"azure_api_key"`
+	AzureAPIVersion          string `toml:"azure_api_version"`
+	AzureChatDeployment      string `toml:"azure_chat_deployment"`
+	AzureEmbeddingDeployment string `toml:"azure_embedding_deployment"`
+
+	// ollama's native api
+	OllamaUri            string `toml:"ollama_uri"`
+	OllamaChatModel      string `toml:"ollama_chat_model"`
+	OllamaEmbeddingModel string `toml:"ollama_embedding_model"`
+
+	// embeddings are cached by EmbeddingCache: "lru" (default) keeps EmbeddingCacheSize of them in process,
+	// "redis" keeps them in RedisUri for EmbeddingCacheTTL, zero never expires, or "off"
+	EmbeddingCache     string        `toml:"embedding_cache"`
+	EmbeddingCacheSize int           `toml:"embedding_cache_size"`
+	EmbeddingCacheTTL  time.Duration `toml:"embedding_cache_ttl"`
+	RedisUri           string        `toml:"redis_uri"`
+
+	// embedding calls are split into requests of EmbeddingBatchSize contents and EmbeddingBatchTokens estimated tokens,
+	// zero is the provider's limit, and LLMConcurrency of them run at the same time
+	EmbeddingBatchSize   int `toml:"embedding_batch_size"`
+	EmbeddingBatchTokens int `toml:"embedding_batch_tokens"`
+	LLMConcurrency       int `toml:"llm_concurrency"`
+
+	// llm requests failed with 429, 5xx or a network error are retried LLMRetries times,
+	// with an exponential backoff from LLMRetryDelay to LLMRetryMaxDelay
+	LLMRetries       int           `toml:"llm_retries"`
+	LLMRetryDelay    time.Duration `toml:"llm_retry_delay"`
+	LLMRetryMaxDelay time.Duration `toml:"llm_retry_max_delay"`
+
+	// Storage is "mongo" (default) for mongodb and qdrant,
+	// or "memory" to keep agents and memories in process
+	Storage string `toml:"storage"`
+
+	MongoUri  string `toml:"mongo_uri"`
+	MongoDb   string `toml:"mongo_db"`
+	QdrantUri string `toml:"qdrant_uri"`
+	// ConnectTimeout bounds the connection to mongodb and qdrant when the Memo is created
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+	// metadata keys indexed in the agents' collections besides tags, source and created_at, as comma separated
+	// "key:type" where type is "keyword", "integer" or "float", e.g. "priority:integer,team:keyword"
+	MetadataIndexes string `toml:"metadata_indexes"`
+
+	AgentListLimit    int `toml:"agent_list_limit"`
+	MemorySearchLimit int `toml:"memory_search_limit"`
+	MemoryListLimit   int `toml:"memory_list_limit"`
+	SessionListLimit  int `toml:"session_list_limit"`
+
+	// how long deleted agents stay in the trash before they are purged,
+	// agents are purged right away if it is zero
+	AgentTrashRetention time.Duration `toml:"agent_trash_retention"`
+	// how often the agents whose trash retention expired are purged
+	AgentTrashPurgeInterval time.Duration `toml:"agent_trash_purge_interval"`
+
+	// how often the queued compensations of half applied writes are retried
+	OutboxInterval time.Duration `toml:"outbox_interval"`
+
+	// if RateImportance is true, llm rates the importance of added memories which have none,
+	// ImportanceBatchSize memories per chat
+	RateImportance      bool `toml:"rate_importance"`
+	ImportanceBatchSize int  `toml:"importance_batch_size"`
+
+	// added memories whose similarity to an agent's memory reaches DedupThreshold are handled by DedupMode,
+	// which is one of "off", "skip", "merge" or "conflict"
+	DedupMode      string  `toml:"dedup_mode"`
+	DedupThreshold float64 `toml:"dedup_threshold"`
+
+	// reflection takes the ReflectionRecent most recent memories, asks ReflectionQuestions questions about them,
+	// and infers at most ReflectionInsights insights from the memories searched by the questions.
+	// agents reflect automatically when the importance of memories added since the last reflection
+	// adds up to ReflectionThreshold, zero disables it
+	ReflectionRecent    int     `toml:"reflection_recent"`
+	ReflectionQuestions int     `toml:"reflection_questions"`
+	ReflectionInsights  int     `toml:"reflection_insights"`
+	ReflectionThreshold float64 `toml:"reflection_threshold"`
+
+	// chats of a session are given its latest SessionWindowMessages messages,
+	// which have at most SessionWindowTokens estimated tokens, zero is unlimited
+	SessionWindowMessages int `toml:"session_window_messages"`
+	SessionWindowTokens   int `toml:"session_window_tokens"`
+
+	// compaction summarises memories older than CompactionAge, which are grouped by "time" within
+	// CompactionWindow, or by "similarity" of at least CompactionSimilarity, CompactionGroupSize at most.
+	// the originals are archived if CompactionKeepOriginals is true, otherwise they are deleted
+	CompactionAge           time.Duration `toml:"compaction_age"`
+	CompactionGrouping      string        `toml:"compaction_grouping"`
+	CompactionWindow        time.Duration `toml:"compaction_window"`
+	CompactionSimilarity    float64       `toml:"compaction_similarity"`
+	CompactionGroupSize     int           `toml:"compaction_group_size"`
+	CompactionKeepOriginals bool          `toml:"compaction_keep_originals"`
+}
+
+// DefaultConfig returns the config with default values
+func DefaultConfig() *Config {
+	return &Config{
+		LLM:               LLM_OPENAI,
+		EmbeddingDim:      1536,
+		EmbeddingDistance: DISTANCE_COSINE,
+
+		OpenAIChatModel:      "gpt-3.5-turbo",
+		OpenAIEmbeddingModel: "text-embedding-ada-002",
+		AzureAPIVersion:      "2023-05-15",
+		OllamaUri:            "http://localhost:11434",
+		OllamaChatModel:      "llama2",
+		OllamaEmbeddingModel: "llama2",
+
+		EmbeddingCache:     CACHE_LRU,
+		EmbeddingCacheSize: 10000,
+		EmbeddingCacheTTL:  30 * 24 * time.Hour,
+		RedisUri:           "redis://localhost:6379/0",
+
+		LLMConcurrency:   DEFAULT_LLM_CONCURRENCY,
+		LLMRetries:       DEFAULT_LLM_RETRIES,
+		LLMRetryDelay:    DEFAULT_LLM_RETRY_DELAY,
+		LLMRetryMaxDelay: DEFAULT_LLM_RETRY_MAX_DELAY,
+
+		Storage:           STORAGE_MONGO,
+		MongoUri:          "mongodb://localhost:27017",
+		MongoDb:           "memo",
+		QdrantUri:         "localhost:6334",
+		ConnectTimeout:    10 * time.Second,
+		AgentListLimit:    15,
+		MemoryListLimit:   15,
+		SessionListLimit:  15,
+		MemorySearchLimit: 5, // top_k
+		OutboxInterval:    30 * time.Second,
+
+		AgentTrashPurgeInterval: time.Minute,
+
+		ImportanceBatchSize: DEFAULT_IMPORTANCE_BATCH_SIZE,
+
+		DedupMode:      DEDUP_OFF,
+		DedupThreshold: 0.95,
+
+		ReflectionRecent:    100,
+		ReflectionQuestions: 3,
+		ReflectionInsights:  5,
+
+		SessionWindowMessages: 20,
+
+		CompactionAge:           30 * 24 * time.Hour,
+		CompactionGrouping:      GROUPING_TIME,
+		CompactionWindow:        24 * time.Hour,
+		CompactionSimilarity:    0.8,
+		CompactionGroupSize:     20,
+		CompactionKeepOriginals: true,
+	}
+}
+
+// LoadConfig builds the config in layers: defaults, then the config file, then MEMO_* environment
+// variables, then overrides (usually collected by ConfigFlags), and validates the result.
+// config_path can be empty if there is no config file, keys in overrides are config keys.
+func LoadConfig(config_path string, overrides map[string]string) (*Config, error) {
+	conf := DefaultConfig()
+
+	if config_path != "" {
+		md, err := toml.DecodeFile(config_path, conf)
+		if err != nil {
+			return nil, fmt.Errorf("can't load config file %s: %w", config_path, err)
+		}
+		// reject typos instead of silently ignoring them
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, k := range undecoded {
+				keys[i] = k.String()
+			}
+			return nil, fmt.Errorf("unknown config keys in %s: %s", config_path, strings.Join(keys, ", "))
+		}
+	}
+
+	for _, key := range ConfigKeys() {
+		if value, ok := os.LookupEnv(ENV_PREFIX + strings.ToUpper(key)); ok {
+			if err := conf.Set(key, value); err != nil {
+				return nil, fmt.Errorf("environment %s: %w", ENV_PREFIX+strings.ToUpper(key), err)
+			}
+		}
+	}
+
+	// sorted for stable error messages
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := conf.Set(key, overrides[key]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// ConfigKeys returns all config keys in the declaration order
+func ConfigKeys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("toml"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ConfigFlags registers a flag for every config key on fs, e.g. -mongo-uri for mongo_uri.
+// The returned map is filled with the flags which are set when fs is parsed, pass it to LoadConfig.
+func ConfigFlags(fs *flag.FlagSet) map[string]string {
+	overrides := make(map[string]string)
+	for _, key := range ConfigKeys() {
+		key := key
+		fs.Func(strings.ReplaceAll(key, "_", "-"), "overrides config key "+key, func(value string) error {
+			overrides[key] = value
+			return nil
+		})
+	}
+	return overrides
+}
+
+// Set the config value by its key, the value is parsed by the field's type
+func (c *Config) Set(key string, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("toml") != key {
+			continue
+		}
+
+		f := v.Field(i)
+		switch {
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			f.SetInt(int64(d))
+		case f.Kind() == reflect.String:
+			f.SetString(value)
+		case f.Kind() == reflect.Int || f.Kind() == reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			f.SetInt(n)
+		case f.Kind() == reflect.Float64:
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			f.SetFloat(n)
+		case f.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			f.SetBool(b)
+		default:
+			return fmt.Errorf("config key %s can't be set from string", key)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown config key: %s", key)
+}
+
+// Validate checks the config values, every error names the offending key
+func (c *Config) Validate() error {
+	var errs []error
+
+	providers := []struct{ key, value string }{{"llm", c.LLM}, {"embedding_llm", c.EmbeddingLLM}, {"chat_llm", c.ChatLLM}}
+	for _, p := range providers {
+		switch p.value {
+		case LLM_OPENAI, LLM_AZURE, LLM_OLLAMA, LLM_LOCAL:
+		case "":
+			if p.key == "llm" {
+				errs = append(errs, fmt.Errorf("llm should not be empty"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s should be %q, %q, %q or %q, got %q", p.key, LLM_OPENAI, LLM_AZURE, LLM_OLLAMA, LLM_LOCAL, p.value))
+		}
+	}
+	if c.EmbeddingDim <= 0 {
+		errs = append(errs, fmt.Errorf("embedding_dim should be positive, got %d", c.EmbeddingDim))
+	}
+	switch c.EmbeddingDistance {
+	case DISTANCE_COSINE, DISTANCE_DOT, DISTANCE_EUCLID:
+	default:
+		errs = append(errs, fmt.Errorf("embedding_distance should be %q, %q or %q, got %q", DISTANCE_COSINE, DISTANCE_DOT, DISTANCE_EUCLID, c.EmbeddingDistance))
+	}
+
+	switch c.EmbeddingCache {
+	case CACHE_OFF:
+	case CACHE_LRU:
+		if c.EmbeddingCacheSize <= 0 {
+			errs = append(errs, fmt.Errorf("embedding_cache_size should be positive, got %d", c.EmbeddingCacheSize))
+		}
+	case CACHE_REDIS:
+		if c.RedisUri == "" {
+			errs = append(errs, fmt.Errorf("redis_uri should not be empty"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("embedding_cache should be %q, %q or %q, got %q", CACHE_OFF, CACHE_LRU, CACHE_REDIS, c.EmbeddingCache))
+	}
+	if c.EmbeddingCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("embedding_cache_ttl should not be negative, got %s", c.EmbeddingCacheTTL))
+	}
+
+	if c.EmbeddingBatchSize < 0 {
+		errs = append(errs, fmt.Errorf("embedding_batch_size should not be negative, got %d", c.EmbeddingBatchSize))
+	}
+	if c.EmbeddingBatchTokens < 0 {
+		errs = append(errs, fmt.Errorf("embedding_batch_tokens should not be negative, got %d", c.EmbeddingBatchTokens))
+	}
+	if c.LLMConcurrency <= 0 {
+		errs = append(errs, fmt.Errorf("llm_concurrency should be positive, got %d", c.LLMConcurrency))
+	}
+	if c.LLMRetries < 0 {
+		errs = append(errs, fmt.Errorf("llm_retries should not be negative, got %d", c.LLMRetries))
+	}
+	if c.LLMRetryDelay <= 0 {
+		errs = append(errs, fmt.Errorf("llm_retry_delay should be positive, got %s", c.LLMRetryDelay))
+	}
+	if c.LLMRetryMaxDelay < c.LLMRetryDelay {
+		errs = append(errs, fmt.Errorf("llm_retry_max_delay should not be less than llm_retry_delay, got %s", c.LLMRetryMaxDelay))
+	}
+
+	switch c.Storage {
+	case STORAGE_MONGO:
+		if c.MongoUri == "" {
+			errs = append(errs, fmt.Errorf("mongo_uri should not be empty"))
+		}
+		if c.MongoDb == "" {
+			errs = append(errs, fmt.Errorf("mongo_db should not be empty"))
+		}
+		if c.QdrantUri == "" {
+			errs = append(errs, fmt.Errorf("qdrant_uri should not be empty"))
+		}
+		if c.ConnectTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("connect_timeout should be positive, got %s", c.ConnectTimeout))
+		}
+	case STORAGE_MEMORY:
+	default:
+		errs = append(errs, fmt.Errorf("storage should be %q or %q, got %q", STORAGE_MONGO, STORAGE_MEMORY, c.Storage))
+	}
+
+	if _, err := parseMetadataIndexes(c.MetadataIndexes); err != nil {
+		errs = append(errs, fmt.Errorf("metadata_indexes: %w", err))
+	}
+
+	if c.AgentListLimit <= 0 {
+		errs = append(errs, fmt.Errorf("agent_list_limit should be positive, got %d", c.AgentListLimit))
+	}
+	if c.MemorySearchLimit <= 0 {
+		errs = append(errs, fmt.Errorf("memory_search_limit should be positive, got %d", c.MemorySearchLimit))
+	}
+	if c.MemoryListLimit <= 0 {
+		errs = append(errs, fmt.Errorf("memory_list_limit should be positive, got %d", c.MemoryListLimit))
+	}
+	if c.SessionListLimit <= 0 {
+		errs = append(errs, fmt.Errorf("session_list_limit should be positive, got %d", c.SessionListLimit))
+	}
+
+	if c.AgentTrashRetention < 0 {
+		errs = append(errs, fmt.Errorf("agent_trash_retention should not be negative, got %s", c.AgentTrashRetention))
+	}
+	if c.AgentTrashRetention > 0 && c.AgentTrashPurgeInterval <= 0 {
+		errs = append(errs, fmt.Errorf("agent_trash_purge_interval should be positive, got %s", c.AgentTrashPurgeInterval))
+	}
+	if c.OutboxInterval <= 0 {
+		errs = append(errs, fmt.Errorf("outbox_interval should be positive, got %s", c.OutboxInterval))
+	}
+	if c.ImportanceBatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("importance_batch_size should be positive, got %d", c.ImportanceBatchSize))
+	}
+
+	switch c.DedupMode {
+	case DEDUP_OFF, DEDUP_SKIP, DEDUP_MERGE, DEDUP_CONFLICT:
+	default:
+		errs = append(errs, fmt.Errorf("dedup_mode should be %q, %q, %q or %q, got %q", DEDUP_OFF, DEDUP_SKIP, DEDUP_MERGE, DEDUP_CONFLICT, c.DedupMode))
+	}
+	if c.DedupThreshold < -1 || c.DedupThreshold > 1 {
+		errs = append(errs, fmt.Errorf("dedup_threshold should be in [-1, 1], got %g", c.DedupThreshold))
+	}
+	if c.ReflectionRecent <= 0 {
+		errs = append(errs, fmt.Errorf("reflection_recent should be positive, got %d", c.ReflectionRecent))
+	}
+	if c.ReflectionQuestions <= 0 {
+		errs = append(errs, fmt.Errorf("reflection_questions should be positive, got %d", c.ReflectionQuestions))
+	}
+	if c.ReflectionInsights <= 0 {
+		errs = append(errs, fmt.Errorf("reflection_insights should be positive, got %d", c.ReflectionInsights))
+	}
+	if c.ReflectionThreshold < 0 {
+		errs = append(errs, fmt.Errorf("reflection_threshold should not be negative, got %g", c.ReflectionThreshold))
+	}
+
+	if c.SessionWindowMessages < 0 {
+		errs = append(errs, fmt.Errorf("session_window_messages should not be negative, got %d", c.SessionWindowMessages))
+	}
+	if c.SessionWindowTokens < 0 {
+		errs = append(errs, fmt.Errorf("session_window_tokens should not be negative, got %d", c.SessionWindowTokens))
+	}
+
+	if c.CompactionAge < 0 {
+		errs = append(errs, fmt.Errorf("compaction_age should not be negative, got %s", c.CompactionAge))
+	}
+	switch c.CompactionGrouping {
+	case GROUPING_TIME, GROUPING_SIMILARITY:
+	default:
+		errs = append(errs, fmt.Errorf("compaction_grouping should be %q or %q, got %q", GROUPING_TIME, GROUPING_SIMILARITY, c.CompactionGrouping))
+	}
+	if c.CompactionWindow <= 0 {
+		errs = append(errs, fmt.Errorf("compaction_window should be positive, got %s", c.CompactionWindow))
+	}
+	if c.CompactionSimilarity < -1 || c.CompactionSimilarity > 1 {
+		errs = append(errs, fmt.Errorf("compaction_similarity should be in [-1, 1], got %g", c.CompactionSimilarity))
+	}
+	if c.CompactionGroupSize < 2 {
+		errs = append(errs, fmt.Errorf("compaction_group_size should be at least 2, got %d", c.CompactionGroupSize))
+	}
+
+	return errors.Join(errs...)
+}
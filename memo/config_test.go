@@ -0,0 +1,100 @@
+package memo
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	// the example config should always be valid
+	conf, err := LoadConfig("../.example.config.toml", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "memo", conf.MongoDb)
+
+	// no config file, defaults only
+	conf, err = LoadConfig("", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), conf)
+
+	path := writeConfig(t, `
+mongo_db = "from-file"
+memory_list_limit = 10
+agent_list_limit = 20
+`)
+
+	// file overrides defaults, env overrides file, overrides win over env
+	t.Setenv("MEMO_MONGO_DB", "from-env")
+	t.Setenv("MEMO_MEMORY_LIST_LIMIT", "30")
+	conf, err = LoadConfig(path, map[string]string{"memory_list_limit": "40"})
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", conf.MongoDb)
+	assert.Equal(t, 40, conf.MemoryListLimit)
+	assert.Equal(t, 20, conf.AgentListLimit)
+	assert.Equal(t, 5, conf.MemorySearchLimit)
+
+	// env with wrong type
+	t.Setenv("MEMO_MEMORY_LIST_LIMIT", "many")
+	_, err = LoadConfig(path, nil)
+	assert.ErrorContains(t, err, "MEMO_MEMORY_LIST_LIMIT")
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	// unknown keys are rejected
+	_, err := LoadConfig(writeConfig(t, `mongo_db_name = "memo"`), nil)
+	assert.ErrorContains(t, err, "mongo_db_name")
+
+	_, err = LoadConfig(writeConfig(t, `agent_search_limit = 3`), nil)
+	assert.ErrorContains(t, err, "agent_search_limit")
+
+	// nonsensical values name the key
+	_, err = LoadConfig(writeConfig(t, `memory_search_limit = 0`), nil)
+	assert.ErrorContains(t, err, "memory_search_limit")
+
+	_, err = LoadConfig(writeConfig(t, `mongo_uri = ""`), nil)
+	assert.ErrorContains(t, err, "mongo_uri")
+
+	_, err = LoadConfig(writeConfig(t, `storage = "redis"`), nil)
+	assert.ErrorContains(t, err, "storage")
+
+	_, err = LoadConfig(writeConfig(t, `chat_llm = "claude"`), nil)
+	assert.ErrorContains(t, err, "chat_llm")
+
+	_, err = LoadConfig(writeConfig(t, `embedding_cache = "memcached"`), nil)
+	assert.ErrorContains(t, err, "embedding_cache")
+
+	_, err = LoadConfig(writeConfig(t, "llm_retry_delay = \"1m\""), nil)
+	assert.ErrorContains(t, err, "llm_retry_max_delay")
+
+	// empty mongo_uri is fine without mongo storage
+	_, err = LoadConfig(writeConfig(t, "mongo_uri = \"\"\nstorage = \"memory\""), nil)
+	assert.NoError(t, err)
+
+	_, err = LoadConfig("", map[string]string{"not_a_key": "1"})
+	assert.ErrorContains(t, err, "not_a_key")
+
+	_, err = LoadConfig("./not-exists.toml", nil)
+	assert.Error(t, err)
+}
+
+func TestConfigFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := ConfigFlags(fs)
+	assert.NoError(t, fs.Parse([]string{"-mongo-db", "from-flag", "-agent-list-limit", "3"}))
+	assert.Equal(t, map[string]string{"mongo_db": "from-flag", "agent_list_limit": "3"}, overrides)
+
+	t.Setenv("MEMO_MONGO_DB", "from-env")
+	conf, err := LoadConfig("", overrides)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-flag", conf.MongoDb)
+	assert.Equal(t, 3, conf.AgentListLimit)
+}
@@ -0,0 +1,121 @@
+package memo
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// how near-duplicates of the existing memories are handled when memories are added
+const DEDUP_OFF = "off"           // insert all of them
+const DEDUP_SKIP = "skip"         // drop the duplicates
+const DEDUP_MERGE = "merge"       // drop the duplicates, and reinforce the memories they duplicate
+const DEDUP_CONFLICT = "conflict" // drop the duplicates, and report them as conflicts to resolve
+
+// what happened to an added memory
+const INSERTION_INSERTED = "inserted"
+const INSERTION_SKIPPED = "skipped"
+const INSERTION_MERGED = "merged"
+const INSERTION_CONFLICT = "conflict"
+
+// Dedup decides which added memories are near-duplicates, and how they are handled
+type Dedup struct {
+	Mode      string  `json:"mode"`      // one of DEDUP_*
+	Threshold float64 `json:"threshold"` // minimal similarity of a near-duplicate, by the agent's distance
+}
+
+// Dedup returns the dedup settings of the config
+func (c *Config) Dedup() *Dedup {
+	return &Dedup{Mode: c.DedupMode, Threshold: c.DedupThreshold}
+}
+
+// Validate checks the mode is known and the threshold is a similarity
+func (d *Dedup) Validate() error {
+	switch d.Mode {
+	case DEDUP_OFF, DEDUP_SKIP, DEDUP_MERGE, DEDUP_CONFLICT:
+	default:
+		return NewWrapError(400, fmt.Errorf("invalid dedup mode: %q", d.Mode), "")
+	}
+	if d.Threshold < -1 || d.Threshold > 1 {
+		return NewWrapError(400, fmt.Errorf("dedup threshold should be in [-1, 1], got %g", d.Threshold), "")
+	}
+	return nil
+}
+
+// Insertion reports what happened to an added memory
+type Insertion struct {
+	Status     string             `json:"status"`               // one of INSERTION_*
+	ID         primitive.ObjectID `json:"id"`                   // the inserted memory, or the memory it duplicates
+	Similarity float32            `json:"similarity,omitempty"` // similarity to the memory it duplicates
+
+	of int // index of the added memory it duplicates, -1 if it duplicates an existing one
+}
+
+// neighbour is the nearest existing memory of an added memory
+type neighbour struct {
+	id         primitive.ObjectID
+	similarity float32
+}
+
+// dedupPlan is what to do with the added memories
+type dedupPlan struct {
+	insertions []*Insertion
+	memories   []*Memory // memories to insert
+	ems        []vectors // and their embeddings
+
+	reinforced map[primitive.ObjectID]int // how many duplicates are merged into the existing memories
+}
+
+// plan compares each added memory with its nearest existing memory, which may be nil,
+// and with the added memories before it by the distance of spec, the most similar one above the threshold is its duplicate
+func (d *Dedup) plan(memories []*Memory, ems []vectors, nearest []*neighbour, spec *EmbeddingSpec, now time.Time) *dedupPlan {
+	p := &dedupPlan{insertions: make([]*Insertion, len(memories)), reinforced: make(map[primitive.ObjectID]int)}
+	var inserted []int // indexes of the memories to insert
+	for idx, m := range memories {
+		dup := &Insertion{of: -1}
+		if n := nearest[idx]; n != nil {
+			dup.ID, dup.Similarity = n.id, n.similarity
+		}
+		for _, j := range inserted {
+			if sim := spec.compare(ems[idx], ems[j]); sim > dup.Similarity {
+				dup.ID, dup.Similarity, dup.of = primitive.NilObjectID, sim, j
+			}
+		}
+
+		if d.Mode == DEDUP_OFF || float64(dup.Similarity) < d.Threshold || (dup.of < 0 && nearest[idx] == nil) {
+			p.insertions[idx] = &Insertion{Status: INSERTION_INSERTED, of: idx}
+			p.memories = append(p.memories, m)
+			p.ems = append(p.ems, ems[idx])
+			inserted = append(inserted, idx)
+			continue
+		}
+
+		switch d.Mode {
+		case DEDUP_SKIP:
+			dup.Status = INSERTION_SKIPPED
+		case DEDUP_MERGE:
+			dup.Status = INSERTION_MERGED
+			if dup.of < 0 {
+				p.reinforced[dup.ID]++
+			} else {
+				memories[dup.of].Reinforced++
+				memories[dup.of].Seen = &now
+			}
+		default:
+			dup.Status = INSERTION_CONFLICT
+		}
+		p.insertions[idx] = dup
+	}
+	return p
+}
+
+// done fills the ids of the insertions which refer to the inserted memories
+func (p *dedupPlan) done(memories []*Memory) []*Insertion {
+	for _, ins := range p.insertions {
+		if ins.of >= 0 {
+			ins.ID = memories[ins.of].ID
+		}
+	}
+	return p.insertions
+}
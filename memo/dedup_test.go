@@ -0,0 +1,119 @@
+package memo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDedupPlan(t *testing.T) {
+	existing := primitive.NewObjectID()
+	memories := []*Memory{{Content: "red"}, {Content: "pink"}, {Content: "blue"}, {Content: "navy"}}
+	ems := []vectors{{1, 0, 0}, {0.99, 0.1, 0}, {0, 0, 1}, {0, 0.1, 0.99}}
+	nearest := []*neighbour{{id: existing, similarity: 0.99}, {id: existing, similarity: 0.96}, nil, nil}
+	now := time.Now()
+
+	plan := (&Dedup{Mode: DEDUP_MERGE, Threshold: 0.95}).plan(memories, ems, nearest, nil, now)
+	assert.Equal(t, []*Memory{memories[2]}, plan.memories)
+	assert.Equal(t, map[primitive.ObjectID]int{existing: 2}, plan.reinforced)
+	assert.Equal(t, 1, memories[2].Reinforced) // navy is merged into blue added before it
+	assert.Equal(t, &now, memories[2].Seen)
+
+	memories[2].ID = primitive.NewObjectID()
+	insertions := plan.done(memories)
+	assert.Equal(t, INSERTION_MERGED, insertions[0].Status)
+	assert.Equal(t, existing, insertions[0].ID)
+	assert.Equal(t, INSERTION_INSERTED, insertions[2].Status)
+	assert.Equal(t, memories[2].ID, insertions[2].ID)
+	assert.Equal(t, INSERTION_MERGED, insertions[3].Status)
+	assert.Equal(t, memories[2].ID, insertions[3].ID)
+
+	plan = (&Dedup{Mode: DEDUP_CONFLICT, Threshold: 0.97}).plan(memories, ems, nearest, nil, now)
+	assert.Equal(t, INSERTION_CONFLICT, plan.insertions[0].Status)
+	assert.Equal(t, INSERTION_INSERTED, plan.insertions[1].Status) // below the threshold
+	assert.Empty(t, plan.reinforced)
+
+	plan = (&Dedup{Mode: DEDUP_OFF, Threshold: 0.95}).plan(memories, ems, nearest, nil, now)
+	assert.Len(t, plan.memories, 4)
+
+	assert.Error(t, (&Dedup{Mode: "drop", Threshold: 0.9}).Validate())
+	assert.Error(t, (&Dedup{Mode: DEDUP_SKIP, Threshold: 1.1}).Validate())
+}
+
+type DedupSuite struct {
+	suite.Suite
+	memories *InMemoryMemories
+	agent    *Agent
+	red      primitive.ObjectID
+}
+
+func (s *DedupSuite) SetupTest() {
+	var agents *InMemoryAgents
+	agents, s.memories = NewInMemory(tableLLM{
+		"red":   {1, 0, 0},
+		"pink":  {0.99, 0.1, 0},
+		"green": {0, 1, 0},
+		"blue":  {0, 0, 1},
+	})
+
+	s.agent = &Agent{Name: "aspirin"}
+	_, err := agents.Add(context.TODO(), s.agent)
+	s.NoError(err)
+
+	s.red, err = s.memories.AddOne(context.TODO(), s.agent.ID, &Memory{Content: "red"})
+	s.NoError(err)
+}
+
+func (s *DedupSuite) TestSkip() {
+	ctx := context.TODO()
+	insertions, err := s.memories.AddManyDedup(ctx, s.agent.ID, []*Memory{{Content: "red"}, {Content: "green"}, {Content: "green"}}, &Dedup{Mode: DEDUP_SKIP, Threshold: 0.95})
+	s.NoError(err)
+	s.Equal(INSERTION_SKIPPED, insertions[0].Status)
+	s.Equal(s.red, insertions[0].ID)
+	s.InDelta(1, insertions[0].Similarity, 1e-6)
+	s.Equal(INSERTION_INSERTED, insertions[1].Status)
+	s.Equal(INSERTION_SKIPPED, insertions[2].Status)
+	s.Equal(insertions[1].ID, insertions[2].ID)
+
+	mems, err := s.memories.List(ctx, s.agent.ID, primitive.NilObjectID, nil)
+	s.NoError(err)
+	s.Len(mems, 2)
+}
+
+func (s *DedupSuite) TestMerge() {
+	ctx := context.TODO()
+	insertions, err := s.memories.AddManyDedup(ctx, s.agent.ID, []*Memory{{Content: "pink"}, {Content: "red"}}, &Dedup{Mode: DEDUP_MERGE, Threshold: 0.95})
+	s.NoError(err)
+	s.Equal(INSERTION_MERGED, insertions[0].Status)
+	s.Equal(INSERTION_MERGED, insertions[1].Status)
+
+	mem, err := s.memories.GetOne(ctx, s.agent.ID, s.red)
+	s.NoError(err)
+	s.Equal(2, mem.Reinforced)
+	s.NotNil(mem.Seen)
+}
+
+func (s *DedupSuite) TestConflict() {
+	ctx := context.TODO()
+	insertions, err := s.memories.AddManyDedup(ctx, s.agent.ID, []*Memory{{Content: "pink"}, {Content: "blue"}}, &Dedup{Mode: DEDUP_CONFLICT, Threshold: 0.95})
+	s.NoError(err)
+	s.Equal(INSERTION_CONFLICT, insertions[0].Status)
+	s.Equal(s.red, insertions[0].ID)
+	s.Equal(INSERTION_INSERTED, insertions[1].Status)
+
+	// the threshold is too high for pink
+	insertions, err = s.memories.AddManyDedup(ctx, s.agent.ID, []*Memory{{Content: "pink"}}, &Dedup{Mode: DEDUP_CONFLICT, Threshold: 0.999})
+	s.NoError(err)
+	s.Equal(INSERTION_INSERTED, insertions[0].Status)
+
+	_, err = s.memories.AddManyDedup(ctx, s.agent.ID, []*Memory{{Content: "pink"}}, &Dedup{Mode: "drop"})
+	s.Equal(400, err.(WrapError).Code())
+}
+
+func TestDedupSuite(t *testing.T) {
+	suite.Run(t, new(DedupSuite))
+}
@@ -0,0 +1,209 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	pb "github.com/qdrant/go-client/qdrant"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// distance metrics of agents' vectors
+const DISTANCE_COSINE = "cosine"
+const DISTANCE_DOT = "dot"
+const DISTANCE_EUCLID = "euclid"
+
+// LOCAL_EMBEDDING_MODEL is the embedding model of the local llm
+const LOCAL_EMBEDDING_MODEL = "local"
+
+// EmbeddingSpec is the embedding model which makes an agent's vectors, it is recorded on the agent when
+// it is created, so its vectors are never mixed with the vectors of another model
+type EmbeddingSpec struct {
+	Provider string `bson:"provider" json:"provider"`
+	Model    string `bson:"model" json:"model"`
+	Dim      int    `bson:"dim" json:"dim"`
+	Distance string `bson:"distance" json:"distance"`
+}
+
+// EmbeddingSpec returns the configured embedding model, which is the model of embedding_llm or llm
+func (c *Config) EmbeddingSpec() *EmbeddingSpec {
+	spec := &EmbeddingSpec{Provider: c.EmbeddingLLM, Dim: c.EmbeddingDim, Distance: c.EmbeddingDistance}
+	if spec.Provider == "" {
+		spec.Provider = c.LLM
+	}
+	switch spec.Provider {
+	case LLM_OPENAI:
+		spec.Model = c.OpenAIEmbeddingModel
+	case LLM_AZURE:
+		spec.Model = c.AzureEmbeddingDeployment
+	case LLM_OLLAMA:
+		spec.Model = c.OllamaEmbeddingModel
+	case LLM_LOCAL:
+		spec.Model = LOCAL_EMBEDDING_MODEL
+	}
+	return spec
+}
+
+func (e *EmbeddingSpec) String() string {
+	return fmt.Sprintf("%s/%s (%d dimensions, %s)", e.Provider, e.Model, e.Dim, e.Distance)
+}
+
+// qdrantDistance is the distance of the collection, cosine by default
+func (e *EmbeddingSpec) qdrantDistance() pb.Distance {
+	switch e.Distance {
+	case DISTANCE_DOT:
+		return pb.Distance_Dot
+	case DISTANCE_EUCLID:
+		return pb.Distance_Euclid
+	default:
+		return pb.Distance_Cosine
+	}
+}
+
+// similarity converts a qdrant score of the distance to a similarity, the higher the nearer,
+// cosine and dot scores are similarities already, euclid distances d are 1/(1+d)
+func (e *EmbeddingSpec) similarity(score float32) float32 {
+	if e != nil && e.Distance == DISTANCE_EUCLID {
+		return 1 / (1 + score)
+	}
+	return score
+}
+
+// scoreThreshold converts a minimal similarity to the qdrant score threshold of the distance,
+// which is a maximal distance for euclid, nil if every distance is similar enough
+func (e *EmbeddingSpec) scoreThreshold(similarity float32) *float32 {
+	if e != nil && e.Distance == DISTANCE_EUCLID {
+		if similarity <= 0 {
+			return nil
+		}
+		similarity = 1/similarity - 1
+	}
+	return &similarity
+}
+
+// compare returns the similarity of two vectors by the distance, like the similarity of their qdrant score
+func (e *EmbeddingSpec) compare(a, b vectors) float32 {
+	if e == nil || len(a) != len(b) {
+		return cosine(a, b)
+	}
+	switch e.Distance {
+	case DISTANCE_DOT:
+		var dot float64
+		for i := range a {
+			dot += float64(a[i]) * float64(b[i])
+		}
+		return float32(dot)
+	case DISTANCE_EUCLID:
+		var sum float64
+		for i := range a {
+			d := float64(a[i]) - float64(b[i])
+			sum += d * d
+		}
+		return e.similarity(float32(math.Sqrt(sum)))
+	default:
+		return cosine(a, b)
+	}
+}
+
+// compatible checks the configured embedding model is the one recorded on the agent,
+// agents created before the models were recorded, whose record is nil, are not checked
+func (e *EmbeddingSpec) compatible(aid primitive.ObjectID, recorded *EmbeddingSpec) error {
+	if e == nil || recorded == nil || *e == *recorded {
+		return nil
+	}
+	return NewWrapError(409, fmt.Errorf("agent %s was created with embedding %s, but %s is configured, its memories should be re-embedded first",
+		aid.Hex(), recorded, e), "")
+}
+
+// Embedders makes the llms of the embedding models which agents are recorded with, so an agent whose model is not
+// the configured one is still embedded by its own model, e.g. while the agents are being re-embedded one by one
+type Embedders struct {
+	conf  *Config
+	llm   LLM            // llm of the configured model
+	cache EmbeddingCache // nil if the embeddings are not cached
+
+	mu   sync.Mutex
+	llms map[EmbeddingSpec]LLM
+}
+
+// NewEmbedders creates the embedders of the config, llm makes the embeddings of the configured model
+func NewEmbedders(conf *Config, llm LLM, cache EmbeddingCache) *Embedders {
+	return &Embedders{conf: conf, llm: llm, cache: cache, llms: make(map[EmbeddingSpec]LLM)}
+}
+
+// For returns the llm which makes the vectors of spec, the providers' settings but the model come from the config
+func (e *Embedders) For(spec *EmbeddingSpec) (LLM, error) {
+	configured := e.conf.EmbeddingSpec()
+	if spec == nil || *spec == *configured {
+		return e.llm, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if llm, ok := e.llms[*spec]; ok {
+		return llm, nil
+	}
+
+	conf := *e.conf
+	conf.EmbeddingLLM, conf.EmbeddingDim, conf.EmbeddingDistance = spec.Provider, spec.Dim, spec.Distance
+	switch spec.Provider {
+	case LLM_OPENAI:
+		conf.OpenAIEmbeddingModel = spec.Model
+	case LLM_AZURE:
+		conf.AzureEmbeddingDeployment = spec.Model
+	case LLM_OLLAMA:
+		conf.OllamaEmbeddingModel = spec.Model
+	}
+	llm, err := newProvider(&conf, spec.Provider, CAPABILITY_EMBEDDING)
+	if err != nil {
+		return nil, fmt.Errorf("can't embed with %s: %w", spec, err)
+	}
+	if e.cache != nil {
+		llm = NewCachedLLM(llm, spec, e.cache)
+	}
+	e.llms[*spec] = llm
+	return llm, nil
+}
+
+// llmOf returns the llm of the agent's recorded model, and the model to check the embeddings against,
+// which are llm and the configured model without embedders, or for the agents with no recorded model
+func (e *Embedders) llmOf(llm LLM, recorded, configured *EmbeddingSpec) (LLM, *EmbeddingSpec, error) {
+	if e == nil || recorded == nil {
+		return llm, configured, nil
+	}
+	llm, err := e.For(recorded)
+	if err != nil {
+		return nil, nil, NewWrapError(409, err, "")
+	}
+	return llm, recorded, nil
+}
+
+// embedFor creates the embeddings for the agent's vectors, after the configured model is checked against
+// the agent's record, and the dimension of the embeddings is checked against the record, or the configured one,
+// which is returned as the spec of the agent's vectors
+func embedFor(ctx context.Context, llm LLM, aid primitive.ObjectID, recorded, configured *EmbeddingSpec, contents []string) ([]vectors, *EmbeddingSpec, error) {
+	if err := configured.compatible(aid, recorded); err != nil {
+		return nil, nil, err
+	}
+	ems, err := llm.Embedding(ctx, contents)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expected := recorded
+	if expected == nil {
+		expected = configured
+	}
+	if expected == nil {
+		return ems, nil, nil
+	}
+	for _, em := range ems {
+		if len(em) != expected.Dim {
+			return nil, nil, NewWrapError(500, fmt.Errorf("llm made %d-dimensional embeddings, but agent %s expects %s, check embedding_dim",
+				len(em), aid.Hex(), expected), "")
+		}
+	}
+	return ems, expected, nil
+}
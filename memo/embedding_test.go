@@ -0,0 +1,184 @@
+package memo
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/qdrant/go-client/qdrant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEmbeddingSpec(t *testing.T) {
+	conf := DefaultConfig()
+	assert.Equal(t, &EmbeddingSpec{Provider: LLM_OPENAI, Model: "text-embedding-ada-002", Dim: 1536, Distance: DISTANCE_COSINE}, conf.EmbeddingSpec())
+	assert.Equal(t, pb.Distance_Cosine, conf.EmbeddingSpec().qdrantDistance())
+
+	// the model of embedding_llm wins over llm's
+	conf.LLM, conf.EmbeddingLLM, conf.EmbeddingDim, conf.EmbeddingDistance = LLM_AZURE, LLM_OLLAMA, 768, DISTANCE_DOT
+	conf.OllamaEmbeddingModel = "nomic-embed-text"
+	assert.Equal(t, &EmbeddingSpec{Provider: LLM_OLLAMA, Model: "nomic-embed-text", Dim: 768, Distance: DISTANCE_DOT}, conf.EmbeddingSpec())
+	assert.Equal(t, pb.Distance_Dot, conf.EmbeddingSpec().qdrantDistance())
+
+	conf.EmbeddingLLM, conf.AzureEmbeddingDeployment = "", "embed"
+	assert.Equal(t, "embed", conf.EmbeddingSpec().Model)
+
+	_, err := LoadConfig(writeConfig(t, `embedding_distance = "manhattan"`), nil)
+	assert.ErrorContains(t, err, "embedding_distance")
+}
+
+type EmbeddingSuite struct {
+	suite.Suite
+	agents   *InMemoryAgents
+	memories *InMemoryMemories
+	spec     *EmbeddingSpec
+	agent    *Agent
+}
+
+func (s *EmbeddingSuite) SetupTest() {
+	s.spec = &EmbeddingSpec{Provider: LLM_LOCAL, Model: LOCAL_EMBEDDING_MODEL, Dim: 64, Distance: DISTANCE_COSINE}
+	s.agents, s.memories = NewInMemory(NewLocal(64))
+	s.agents.Embedding, s.memories.Embedding = s.spec, s.spec
+
+	s.agent = &Agent{Name: "aspirin", Embedding: &EmbeddingSpec{Model: "ignored"}}
+	_, err := s.agents.Add(context.TODO(), s.agent)
+	s.NoError(err)
+	_, err = s.memories.AddMany(context.TODO(), s.agent.ID, []*Memory{{Content: "My favorite color is red."}})
+	s.NoError(err)
+}
+
+func (s *EmbeddingSuite) TestRecorded() {
+	agent, err := s.agents.Get(context.TODO(), s.agent.ID)
+	s.NoError(err)
+	s.Equal(s.spec, agent.Embedding)
+
+	// only Add records it
+	s.NoError(s.agents.Update(context.TODO(), &Agent{ID: s.agent.ID, Name: "aspirin", Embedding: &EmbeddingSpec{Dim: 3}}))
+	agent, err = s.agents.Get(context.TODO(), s.agent.ID)
+	s.NoError(err)
+	s.Equal(s.spec, agent.Embedding)
+}
+
+func (s *EmbeddingSuite) TestModelMismatch() {
+	ctx := context.TODO()
+	s.memories.Embedding = &EmbeddingSpec{Provider: LLM_OLLAMA, Model: "nomic-embed-text", Dim: 64, Distance: DISTANCE_COSINE}
+
+	_, err := s.memories.AddMany(ctx, s.agent.ID, []*Memory{{Content: "I like tea."}})
+	s.Equal(409, err.(WrapError).Code())
+	s.ErrorContains(err, "local/local (64 dimensions, cosine)")
+	s.ErrorContains(err, "ollama/nomic-embed-text (64 dimensions, cosine)")
+
+	_, _, err = s.memories.Search(ctx, s.agent.ID, "color", nil)
+	s.Equal(409, err.(WrapError).Code())
+
+	// nothing is written
+	memories, err := s.memories.List(ctx, s.agent.ID, primitive.NilObjectID, nil)
+	s.NoError(err)
+	s.Len(memories, 1)
+
+	// agents created before the models were recorded are not checked
+	legacy := &Agent{Name: "legacy"}
+	s.agents.Embedding = nil
+	_, err = s.agents.Add(ctx, legacy)
+	s.NoError(err)
+	_, err = s.memories.AddMany(ctx, legacy.ID, []*Memory{{Content: "I like tea."}})
+	s.NoError(err)
+}
+
+func (s *EmbeddingSuite) TestDimensionMismatch() {
+	// the llm doesn't make the recorded dimension
+	_, memories := NewInMemory(NewLocal(32))
+	memories.store, memories.Embedding = s.memories.store, s.spec
+
+	_, err := memories.AddMany(context.TODO(), s.agent.ID, []*Memory{{Content: "I like tea."}})
+	s.Equal(500, err.(WrapError).Code())
+	s.ErrorContains(err, "32-dimensional")
+}
+
+func (s *EmbeddingSuite) TestEuclid() {
+	ctx := context.TODO()
+	agents, memories := NewInMemory(tableLLM{
+		"query": {1, 0},
+		"far":   {10, 0},  // the same direction, but 9 away
+		"near":  {1, 0.5}, // another direction, but 0.5 away
+	})
+	spec := &EmbeddingSpec{Provider: LLM_LOCAL, Model: "table", Dim: 2, Distance: DISTANCE_EUCLID}
+	agents.Embedding, memories.Embedding = spec, spec
+
+	agent := &Agent{Name: "euclid"}
+	_, err := agents.Add(ctx, agent)
+	s.NoError(err)
+	_, err = memories.AddMany(ctx, agent.ID, []*Memory{{Content: "far"}, {Content: "near"}})
+	s.NoError(err)
+
+	// the nearest is the most relevant, not the most similar direction
+	found, scores, err := memories.Search(ctx, agent.ID, "query", nil)
+	s.NoError(err)
+	s.Equal("near", found[0].Content)
+	s.InDelta(1/1.5, scores[0].Relevance, 1e-5)
+	s.InDelta(0.1, scores[1].Relevance, 1e-5)
+
+	// and the threshold is a similarity of the distance too
+	insertions, err := memories.AddManyDedup(ctx, agent.ID, []*Memory{{Content: "query"}}, &Dedup{Mode: DEDUP_SKIP, Threshold: 0.6})
+	s.NoError(err)
+	s.Equal(INSERTION_SKIPPED, insertions[0].Status)
+	s.Equal(found[0].ID, insertions[0].ID)
+
+	insertions, err = memories.AddManyDedup(ctx, agent.ID, []*Memory{{Content: "query"}}, &Dedup{Mode: DEDUP_SKIP, Threshold: 0.7})
+	s.NoError(err)
+	s.Equal(INSERTION_INSERTED, insertions[0].Status)
+}
+
+func (s *EmbeddingSuite) TestEmbedders() {
+	ctx := context.TODO()
+	conf := DefaultConfig()
+	conf.LLM, conf.EmbeddingDim, conf.OpenAIAPIKey = LLM_LOCAL, 32, ""
+	llm := NewLocal(32)
+
+	// the servers are configured with another model than the agent's, which is still embedded by its own
+	_, memories := NewInMemory(llm)
+	memories.store, memories.Embedding = s.memories.store, conf.EmbeddingSpec()
+	memories.Embedders = NewEmbedders(conf, llm, NewLRUEmbeddingCache(16))
+
+	_, err := memories.AddMany(ctx, s.agent.ID, []*Memory{{Content: "I like tea."}})
+	s.NoError(err)
+	found, _, err := memories.Search(ctx, s.agent.ID, "color", nil)
+	s.NoError(err)
+	s.Len(found, 2)
+
+	embedder, err := memories.Embedders.For(s.spec)
+	s.NoError(err)
+	s.IsType(&CachedLLM{}, embedder)
+	again, _ := memories.Embedders.For(s.spec)
+	s.Same(embedder, again)
+	configured, _ := memories.Embedders.For(conf.EmbeddingSpec())
+	s.Equal(llm, configured)
+
+	// the agent's model can't be made with the config
+	s.memories.store.agents[s.agent.ID].Embedding = &EmbeddingSpec{Provider: LLM_OPENAI, Model: "text-embedding-3-small", Dim: 64}
+	_, err = memories.AddMany(ctx, s.agent.ID, []*Memory{{Content: "I like coffee."}})
+	s.Equal(409, err.(WrapError).Code())
+	s.ErrorContains(err, "openai_api_key is empty")
+}
+
+func TestEmbeddingSuite(t *testing.T) {
+	suite.Run(t, new(EmbeddingSuite))
+}
+
+func TestEmbeddingDistance(t *testing.T) {
+	euclid := &EmbeddingSpec{Distance: DISTANCE_EUCLID}
+	assert.Equal(t, float32(0.25), euclid.similarity(3))
+	assert.Equal(t, float32(3), *euclid.scoreThreshold(0.25))
+	assert.Nil(t, euclid.scoreThreshold(0))
+	assert.InDelta(t, 1.0/6, euclid.compare(vectors{1, 0}, vectors{4, 4}), 1e-6)
+
+	dot := &EmbeddingSpec{Distance: DISTANCE_DOT}
+	assert.Equal(t, float32(0.5), dot.similarity(0.5))
+	assert.Equal(t, float32(8), dot.compare(vectors{2, 0}, vectors{4, 4}))
+
+	// cosine by default
+	var legacy *EmbeddingSpec
+	assert.Equal(t, float32(0.5), *legacy.scoreThreshold(0.5))
+	assert.InDelta(t, 1, legacy.compare(vectors{2, 0}, vectors{4, 0}), 1e-6)
+}
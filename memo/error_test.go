@@ -1,6 +1,7 @@
 package memo
 
 import (
+	"fmt"
 	"net/http/httptest"
 	"testing"
 
@@ -22,3 +23,10 @@ func TestModelError(t *testing.T) {
 	m.AbortWithError(ctx, err)
 	assert.Equal(t, "{\"msg\":\"test\"}", w.Body.String())
 }
+
+func TestWrapErrorUnwrap(t *testing.T) {
+	err := NewWrapError(500, fmt.Errorf("%w: qdrant is down", ErrRolledBack), "memories add failed and was rolled back")
+	assert.ErrorIs(t, err, ErrRolledBack)
+	assert.NotErrorIs(t, err, ErrRepairPending)
+	assert.Equal(t, "memories add failed and was rolled back", err.Error())
+}
@@ -1,11 +1,23 @@
 package memo
 
 import (
+	"errors"
+
 	"github.com/gin-gonic/gin"
 )
 
 var OKMessage = gin.H{"ok": true}
 
+// a write across mongodb and qdrant failed half way, and every applied change has been undone
+var ErrRolledBack = errors.New("write rolled back")
+
+// a write across mongodb and qdrant failed half way and couldn't be undone right now,
+// the compensation is queued in the outbox and will be retried
+var ErrRepairPending = errors.New("write partially applied, repair pending")
+
+// a write across mongodb and qdrant failed half way, and the compensation failed too
+var ErrInconsistent = errors.New("write partially applied, repair needed")
+
 type WrapError struct {
 	ErrorMessage
 	code  int
@@ -24,6 +36,10 @@ func (w WrapError) Code() int {
 	return w.code
 }
 
+func (w WrapError) Unwrap() error {
+	return w.error
+}
+
 func NewWrapError(code int, err error, msg string) WrapError {
 	if msg == "" {
 		msg = err.Error()
@@ -0,0 +1,155 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SOURCE_EXTRACTION is the source of the memories extracted from transcripts
+const SOURCE_EXTRACTION = "extraction"
+
+// kinds of the extracted statements, they are the extracted memories' tags
+const EXTRACTED_FACT = "fact"
+const EXTRACTED_PREFERENCE = "preference"
+const EXTRACTED_EVENT = "event"
+
+const EXTRACTION_PROMPT = `The numbered turns above are a conversation between the user and %s. ` +
+	`Extract the durable facts, preferences and events worth remembering about the user or %s, ignore small talk. ` +
+	`Write each of them as a standalone statement in the third person, which can be understood without the conversation, ` +
+	`e.g. "The user's favorite color is red." Answer with one statement per line in the form ` +
+	`"<fact|preference|event>: <statement> (from 1, 3)", where the numbers are the turns' numbers, ` +
+	`or answer nothing if there is nothing worth remembering.`
+
+// ExtractionRequest is a transcript to extract memories from, either the messages or a stored session
+type ExtractionRequest struct {
+	Messages []ChatMessage      `json:"messages,omitempty"`
+	Session  primitive.ObjectID `json:"session,omitempty"`
+	Window   *Window            `json:"window,omitempty"` // session's messages to extract from, all of them by default
+}
+
+// Extraction is the memories extracted from a transcript
+type Extraction struct {
+	Memories []*Memory `json:"memories"`
+}
+
+// Extract asks llm for the durable facts, preferences and events in the transcript, and adds them as memories.
+// the memories' metadata points back to their source turns: "turns" are the turns' numbers from 1,
+// and if the transcript is a session, "session" is its id and "messages" are the ids of the turns
+func (m *Memo) Extract(ctx context.Context, aid primitive.ObjectID, req *ExtractionRequest) (*Extraction, error) {
+	agent, err := m.Agents.Get(ctx, aid)
+	if err != nil {
+		return nil, err
+	}
+	ctx = agent.context(ctx) // llm extracts with agent's model settings
+
+	if err := validateChatMessages(req.Messages); err != nil {
+		return nil, err
+	}
+
+	transcript := req.Messages
+	var mids []primitive.ObjectID // ids of the session's messages
+	if req.Session != primitive.NilObjectID {
+		if len(req.Messages) > 0 {
+			return nil, NewWrapError(400, fmt.Errorf("extract from either messages or a session"), "")
+		}
+		if m.Sessions == nil {
+			return nil, NewWrapError(501, fmt.Errorf("sessions are not supported"), "")
+		}
+		messages, err := m.Sessions.Messages(ctx, aid, req.Session, req.Window)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range messages {
+			transcript = append(transcript, msg.ChatMessage)
+			mids = append(mids, msg.ID)
+		}
+	}
+	if len(transcript) == 0 {
+		return nil, NewWrapError(400, fmt.Errorf("no messages to extract from"), "")
+	}
+
+	answer, err := m.LLM.Chat(ctx, []ChatMessage{
+		{Role: "user", Content: numberedTurns(transcript) + "\n" + fmt.Sprintf(EXTRACTION_PROMPT, agent.Name, agent.Name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	memories := parseExtraction(answer.Content, len(transcript))
+	for _, mem := range memories {
+		if req.Session == primitive.NilObjectID {
+			continue
+		}
+		mem.Metadata["session"] = req.Session.Hex()
+		var ids []interface{}
+		for _, turn := range mem.Metadata["turns"].([]interface{}) {
+			ids = append(ids, mids[turn.(int)-1].Hex())
+		}
+		mem.Metadata["messages"] = ids
+	}
+
+	extraction := &Extraction{Memories: memories}
+	if len(memories) == 0 {
+		extraction.Memories = []*Memory{}
+		return extraction, nil
+	}
+	if _, err := m.Remember(ctx, aid, memories); err != nil {
+		return nil, err
+	}
+	return extraction, nil
+}
+
+var extractedStatement = regexp.MustCompile(`(?i)^(fact|preference|event)s?\s*:\s*(.+)$`)
+var extractedFrom = regexp.MustCompile(`(?i)\s*\(\s*(?:from|turns?) ([^)]*)\)\W*$`)
+
+// parseExtraction parses the statements of llm's answer, n is the number of the transcript's turns.
+// lines which are not "<kind>: <statement>" are dropped, unknown turns are ignored
+func parseExtraction(answer string, n int) []*Memory {
+	var memories []*Memory
+	for _, line := range strings.Split(answer, "\n") {
+		match := extractedStatement.FindStringSubmatch(trimListMarker(line))
+		if match == nil {
+			continue
+		}
+		kind, statement := strings.ToLower(match[1]), match[2]
+
+		turns := []interface{}{}
+		if loc := extractedFrom.FindStringSubmatchIndex(statement); loc != nil {
+			seen := make(map[int]bool)
+			for _, s := range statementNumber.FindAllString(statement[loc[2]:loc[3]], -1) {
+				turn, _ := strconv.Atoi(s)
+				if turn >= 1 && turn <= n && !seen[turn] {
+					seen[turn] = true
+					turns = append(turns, turn)
+				}
+			}
+			statement = statement[:loc[0]]
+		}
+		statement = strings.TrimSpace(statement)
+		if statement == "" {
+			continue
+		}
+
+		memories = append(memories, &Memory{
+			Content:  statement,
+			Tags:     []string{kind},
+			Source:   SOURCE_EXTRACTION,
+			Metadata: map[string]interface{}{"turns": turns},
+		})
+	}
+	return memories
+}
+
+// numberedTurns lists the messages one per line with their roles, numbered from 1
+func numberedTurns(messages []ChatMessage) string {
+	var sb strings.Builder
+	for idx, msg := range messages {
+		fmt.Fprintf(&sb, "%d. %s: %s\n", idx+1, msg.Role, strings.Join(strings.Fields(msg.Content), " "))
+	}
+	return sb.String()
+}
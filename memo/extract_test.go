@@ -0,0 +1,163 @@
+package memo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const EXTRACTED_ANSWER = `1. Fact: The user's name is Bob. (from 1)
+- preference: The user likes spicy food, especially Sichuan dishes (from 1, 3, 3, 9)
+Event: The user moved to Berlin last week.
+Sure, here they are!
+fact: (from 2)`
+
+type ExtractSuite struct {
+	suite.Suite
+	memo  *Memo
+	llm   *Local
+	agent *Agent
+
+	prompts []ChatMessage // the messages of the last chat
+}
+
+func (s *ExtractSuite) SetupTest() {
+	s.agent = &Agent{Name: "aspirin"}
+	s.memo, s.llm = newTestMemo(s.T(), s.agent)
+	s.llm.ChatFunc = func(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+		s.prompts = messages
+		return ChatMessage{Role: "assistant", Content: EXTRACTED_ANSWER}, nil
+	}
+}
+
+func (s *ExtractSuite) transcript() []ChatMessage {
+	return []ChatMessage{
+		{Role: "user", Content: "Hi, I'm Bob and I love spicy food."},
+		{Role: "assistant", Content: "Nice to meet you, Bob!"},
+		{Role: "user", Content: "Sichuan dishes are the best.\nI just moved to Berlin."},
+	}
+}
+
+func (s *ExtractSuite) TestParseExtraction() {
+	memories := parseExtraction(EXTRACTED_ANSWER, 3)
+	s.Len(memories, 3)
+
+	s.Equal("The user's name is Bob.", memories[0].Content)
+	s.Equal([]string{EXTRACTED_FACT}, memories[0].Tags)
+	s.Equal(SOURCE_EXTRACTION, memories[0].Source)
+	s.Equal([]interface{}{1}, memories[0].Metadata["turns"])
+
+	// duplicated and unknown turns are dropped
+	s.Equal("The user likes spicy food, especially Sichuan dishes", memories[1].Content)
+	s.Equal([]string{EXTRACTED_PREFERENCE}, memories[1].Tags)
+	s.Equal([]interface{}{1, 3}, memories[1].Metadata["turns"])
+
+	s.Equal("The user moved to Berlin last week.", memories[2].Content)
+	s.Equal([]string{EXTRACTED_EVENT}, memories[2].Tags)
+	s.Equal([]interface{}{}, memories[2].Metadata["turns"])
+
+	s.Empty(parseExtraction("Nothing worth remembering.", 3))
+}
+
+func (s *ExtractSuite) TestExtract() {
+	ctx := context.TODO()
+	extraction, err := s.memo.Extract(ctx, s.agent.ID, &ExtractionRequest{Messages: s.transcript()})
+	s.NoError(err)
+	s.Len(extraction.Memories, 3)
+	for _, mem := range extraction.Memories {
+		s.NotEqual(primitive.NilObjectID, mem.ID)
+		s.Nil(mem.Metadata["session"])
+	}
+
+	// the transcript is numbered with its roles, one turn per line
+	s.Len(s.prompts, 1)
+	s.True(strings.Contains(s.prompts[0].Content, "1. user: Hi, I'm Bob and I love spicy food.\n"))
+	s.True(strings.Contains(s.prompts[0].Content, "3. user: Sichuan dishes are the best. I just moved to Berlin.\n"))
+	s.True(strings.Contains(s.prompts[0].Content, "between the user and aspirin"))
+
+	memories, err := s.memo.listMemories(ctx, s.agent.ID, &MemoryFilter{Source: SOURCE_EXTRACTION}, 0)
+	s.NoError(err)
+	s.Len(memories, 3)
+}
+
+func (s *ExtractSuite) TestExtractFromSession() {
+	ctx := context.TODO()
+	sid, err := s.memo.Sessions.Add(ctx, s.agent.ID, &Session{})
+	s.NoError(err)
+	stored, err := s.memo.Sessions.Append(ctx, s.agent.ID, sid, s.transcript())
+	s.NoError(err)
+
+	extraction, err := s.memo.Extract(ctx, s.agent.ID, &ExtractionRequest{Session: sid})
+	s.NoError(err)
+	s.Len(extraction.Memories, 3)
+
+	preference := extraction.Memories[1]
+	s.Equal(sid.Hex(), preference.Metadata["session"])
+	s.Equal([]interface{}{stored[0].ID.Hex(), stored[2].ID.Hex()}, preference.Metadata["messages"])
+
+	// the window narrows the transcript to the latest messages
+	_, err = s.memo.Extract(ctx, s.agent.ID, &ExtractionRequest{Session: sid, Window: &Window{Last: 1}})
+	s.NoError(err)
+	s.True(strings.HasPrefix(s.prompts[0].Content, "1. user: Sichuan dishes"))
+}
+
+func (s *ExtractSuite) TestExtractNothing() {
+	s.llm.Script(ChatMessage{Content: "Nothing worth remembering."})
+	extraction, err := s.memo.Extract(context.TODO(), s.agent.ID, &ExtractionRequest{Messages: s.transcript()})
+	s.NoError(err)
+	s.Empty(extraction.Memories)
+}
+
+func (s *ExtractSuite) TestExtractErrors() {
+	ctx := context.TODO()
+	_, err := s.memo.Extract(ctx, s.agent.ID, &ExtractionRequest{})
+	s.Equal(400, err.(WrapError).Code())
+
+	_, err = s.memo.Extract(ctx, s.agent.ID, &ExtractionRequest{Messages: []ChatMessage{{Role: "robot", Content: "beep"}}})
+	s.Equal(400, err.(WrapError).Code())
+
+	_, err = s.memo.Extract(ctx, s.agent.ID, &ExtractionRequest{Messages: s.transcript(), Session: primitive.NewObjectID()})
+	s.Equal(400, err.(WrapError).Code())
+
+	_, err = s.memo.Extract(ctx, s.agent.ID, &ExtractionRequest{Session: primitive.NewObjectID()})
+	s.Equal(404, err.(WrapError).Code())
+
+	_, err = s.memo.Extract(ctx, primitive.NewObjectID(), &ExtractionRequest{Messages: s.transcript()})
+	s.Equal(404, err.(WrapError).Code())
+
+	s.memo.Sessions = nil
+	_, err = s.memo.Extract(ctx, s.agent.ID, &ExtractionRequest{Session: primitive.NewObjectID()})
+	s.Equal(501, err.(WrapError).Code())
+}
+
+func (s *ExtractSuite) TestExtractHandler() {
+	gin.SetMode(gin.TestMode)
+	r := NewRouter(s.memo)
+
+	body, _ := json.Marshal(&ExtractionRequest{Messages: s.transcript()})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", API_BASE_PATH+"/agents/"+s.agent.ID.Hex()+"/memories/extract", bytes.NewReader(body))
+	r.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	var extraction Extraction
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &extraction))
+	s.Len(extraction.Memories, 3)
+	s.Equal("The user's name is Bob.", extraction.Memories[0].Content)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", API_BASE_PATH+"/agents/"+s.agent.ID.Hex()+"/memories/extract", strings.NewReader("{}"))
+	r.ServeHTTP(w, req)
+	s.Equal(400, w.Code)
+}
+
+func TestExtractSuite(t *testing.T) {
+	suite.Run(t, new(ExtractSuite))
+}
@@ -0,0 +1,366 @@
+package memo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	pb "github.com/qdrant/go-client/qdrant"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MemoryFilter narrows searched or listed memories, all the set conditions must match
+// a nil filter matches all the memories which are not archived
+type MemoryFilter struct {
+	After  *time.Time `json:"after,omitempty"`  // created at or after, qdrant compares it in seconds
+	Before *time.Time `json:"before,omitempty"` // created before
+
+	Tags        []string `json:"tags,omitempty"`         // memories must have all the tags
+	ExcludeTags []string `json:"exclude_tags,omitempty"` // memories must have none of the tags
+	Source      string   `json:"source,omitempty"`
+
+	Metadata []MetadataCondition `json:"metadata,omitempty"`
+
+	IncludeArchived bool `json:"include_archived,omitempty"` // archived memories are only listed with it
+}
+
+// MetadataCondition matches a metadata value by one of equality, membership or range
+// key can be a dotted path of nested values, e.g. "user.name"
+type MetadataCondition struct {
+	Key string `json:"key"`
+
+	Eq interface{}   `json:"eq,omitempty"`
+	In []interface{} `json:"in,omitempty"`
+
+	Gt  *float64 `json:"gt,omitempty"`
+	Gte *float64 `json:"gte,omitempty"`
+	Lt  *float64 `json:"lt,omitempty"`
+	Lte *float64 `json:"lte,omitempty"`
+}
+
+func (mc *MetadataCondition) isRange() bool {
+	return mc.Gt != nil || mc.Gte != nil || mc.Lt != nil || mc.Lte != nil
+}
+
+// Validate checks the filter, it returns a 400 error which names the invalid condition
+func (f *MemoryFilter) Validate() error {
+	if f == nil {
+		return nil
+	}
+	if f.After != nil && f.Before != nil && !f.After.Before(*f.Before) {
+		return NewWrapError(400, fmt.Errorf("filter after should be earlier than before"), "")
+	}
+	for _, tag := range append(f.Tags, f.ExcludeTags...) {
+		if tag == "" {
+			return NewWrapError(400, fmt.Errorf("filter tag should not be empty"), "")
+		}
+	}
+	for _, mc := range f.Metadata {
+		if mc.Key == "" || strings.Contains(mc.Key, "$") || strings.Contains(mc.Key, "..") ||
+			strings.HasPrefix(mc.Key, ".") || strings.HasSuffix(mc.Key, ".") {
+			return NewWrapError(400, fmt.Errorf("invalid filter metadata key: %q", mc.Key), "")
+		}
+
+		n := 0
+		if mc.Eq != nil {
+			n++
+			if !isScalar(mc.Eq) {
+				return NewWrapError(400, fmt.Errorf("filter metadata %q: eq should be a string, number or bool", mc.Key), "")
+			}
+		}
+		if mc.In != nil {
+			n++
+			if len(mc.In) == 0 {
+				return NewWrapError(400, fmt.Errorf("filter metadata %q: in should not be empty", mc.Key), "")
+			}
+			for _, v := range mc.In {
+				if !isScalar(v) {
+					return NewWrapError(400, fmt.Errorf("filter metadata %q: in should only have strings, numbers or bools", mc.Key), "")
+				}
+			}
+		}
+		if mc.isRange() {
+			n++
+		}
+		if n != 1 {
+			return NewWrapError(400, fmt.Errorf("filter metadata %q: needs exactly one of eq, in or range", mc.Key), "")
+		}
+	}
+	return nil
+}
+
+// qdrantFilter translates the filter into a qdrant filter of memory payloads, nil if nothing to filter
+func (f *MemoryFilter) qdrantFilter() *pb.Filter {
+	if f == nil {
+		return nil
+	}
+
+	filter := &pb.Filter{}
+	if f.After != nil || f.Before != nil {
+		r := &pb.Range{}
+		if f.After != nil {
+			gte := float64(f.After.Unix())
+			r.Gte = &gte
+		}
+		if f.Before != nil {
+			lt := float64(f.Before.Unix())
+			r.Lt = &lt
+		}
+		filter.Must = append(filter.Must, fieldCondition(&pb.FieldCondition{Key: PAYLOAD_CREATED, Range: r}))
+	}
+	for _, tag := range f.Tags {
+		filter.Must = append(filter.Must, matchCondition(PAYLOAD_TAGS, tag))
+	}
+	if len(f.ExcludeTags) > 0 {
+		filter.MustNot = append(filter.MustNot, fieldCondition(&pb.FieldCondition{
+			Key:   PAYLOAD_TAGS,
+			Match: &pb.Match{MatchValue: &pb.Match_Keywords{Keywords: &pb.RepeatedStrings{Strings: f.ExcludeTags}}},
+		}))
+	}
+	if f.Source != "" {
+		filter.Must = append(filter.Must, matchCondition(PAYLOAD_SOURCE, f.Source))
+	}
+	for _, mc := range f.Metadata {
+		key := PAYLOAD_METADATA + "." + mc.Key
+		switch {
+		case mc.Eq != nil:
+			filter.Must = append(filter.Must, matchCondition(key, mc.Eq))
+		case mc.In != nil:
+			filter.Must = append(filter.Must, inCondition(key, mc.In))
+		default:
+			filter.Must = append(filter.Must, fieldCondition(&pb.FieldCondition{
+				Key:   key,
+				Range: &pb.Range{Gt: mc.Gt, Gte: mc.Gte, Lt: mc.Lt, Lte: mc.Lte},
+			}))
+		}
+	}
+
+	if len(filter.Must) == 0 && len(filter.MustNot) == 0 {
+		return nil
+	}
+	return filter
+}
+
+func fieldCondition(fc *pb.FieldCondition) *pb.Condition {
+	return &pb.Condition{ConditionOneOf: &pb.Condition_Field{Field: fc}}
+}
+
+// matchCondition matches a scalar value, numbers which are not whole are matched by a closed range
+func matchCondition(key string, v interface{}) *pb.Condition {
+	switch x := v.(type) {
+	case string:
+		return fieldCondition(&pb.FieldCondition{Key: key, Match: &pb.Match{MatchValue: &pb.Match_Keyword{Keyword: x}}})
+	case bool:
+		return fieldCondition(&pb.FieldCondition{Key: key, Match: &pb.Match{MatchValue: &pb.Match_Boolean{Boolean: x}}})
+	}
+
+	f, _ := toFloat(v)
+	if f == float64(int64(f)) {
+		return fieldCondition(&pb.FieldCondition{Key: key, Match: &pb.Match{MatchValue: &pb.Match_Integer{Integer: int64(f)}}})
+	}
+	return fieldCondition(&pb.FieldCondition{Key: key, Range: &pb.Range{Gte: &f, Lte: &f}})
+}
+
+// inCondition matches any of the values, mixed values are matched one by one
+func inCondition(key string, values []interface{}) *pb.Condition {
+	var strs []string
+	var ints []int64
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			strs = append(strs, s)
+		} else if f, ok := toFloat(v); ok && f == float64(int64(f)) {
+			ints = append(ints, int64(f))
+		}
+	}
+	if len(strs) == len(values) {
+		return fieldCondition(&pb.FieldCondition{Key: key, Match: &pb.Match{MatchValue: &pb.Match_Keywords{Keywords: &pb.RepeatedStrings{Strings: strs}}}})
+	}
+	if len(ints) == len(values) {
+		return fieldCondition(&pb.FieldCondition{Key: key, Match: &pb.Match{MatchValue: &pb.Match_Integers{Integers: &pb.RepeatedIntegers{Integers: ints}}}})
+	}
+
+	should := make([]*pb.Condition, len(values))
+	for i, v := range values {
+		should[i] = matchCondition(key, v)
+	}
+	return &pb.Condition{ConditionOneOf: &pb.Condition_Filter{Filter: &pb.Filter{Should: should}}}
+}
+
+// mongoFilter translates the filter into mongodb conditions, which are added into filter
+func (f *MemoryFilter) mongoFilter(filter bson.M) bson.M {
+	if f == nil || !f.IncludeArchived {
+		filter["archived_at"] = bson.M{"$exists": false}
+	}
+	if f == nil {
+		return filter
+	}
+
+	if f.After != nil || f.Before != nil {
+		created := bson.M{}
+		if f.After != nil {
+			created["$gte"] = *f.After
+		}
+		if f.Before != nil {
+			created["$lt"] = *f.Before
+		}
+		filter["created_at"] = created
+	}
+	if len(f.Tags) > 0 || len(f.ExcludeTags) > 0 {
+		tags := bson.M{}
+		if len(f.Tags) > 0 {
+			tags["$all"] = f.Tags
+		}
+		if len(f.ExcludeTags) > 0 {
+			tags["$nin"] = f.ExcludeTags
+		}
+		filter["tags"] = tags
+	}
+	if f.Source != "" {
+		filter["source"] = f.Source
+	}
+	// the conditions of a key which has one already are and-ed, so they don't overwrite each other
+	var and []bson.M
+	for _, mc := range f.Metadata {
+		key := "metadata." + mc.Key
+		if _, ok := filter[key]; ok {
+			and = append(and, bson.M{key: mc.mongoCondition()})
+			continue
+		}
+		filter[key] = mc.mongoCondition()
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	return filter
+}
+
+func (mc *MetadataCondition) mongoCondition() interface{} {
+	switch {
+	case mc.Eq != nil:
+		return mc.Eq
+	case mc.In != nil:
+		return bson.M{"$in": mc.In}
+	}
+	r := bson.M{}
+	for op, v := range map[string]*float64{"$gt": mc.Gt, "$gte": mc.Gte, "$lt": mc.Lt, "$lte": mc.Lte} {
+		if v != nil {
+			r[op] = *v
+		}
+	}
+	return r
+}
+
+// Match reports whether the memory matches the filter, it is used by the in-memory model
+func (f *MemoryFilter) Match(m *Memory) bool {
+	if f == nil {
+		return m.Archived == nil
+	}
+	if m.Archived != nil && !f.IncludeArchived {
+		return false
+	}
+	if f.After != nil && m.Created.Before(*f.After) {
+		return false
+	}
+	if f.Before != nil && !m.Created.Before(*f.Before) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !hasTag(m.Tags, tag) {
+			return false
+		}
+	}
+	for _, tag := range f.ExcludeTags {
+		if hasTag(m.Tags, tag) {
+			return false
+		}
+	}
+	if f.Source != "" && m.Source != f.Source {
+		return false
+	}
+	for _, mc := range f.Metadata {
+		if !mc.match(metadataValue(m.Metadata, mc.Key)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (mc *MetadataCondition) match(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	switch {
+	case mc.Eq != nil:
+		return scalarEqual(v, mc.Eq)
+	case mc.In != nil:
+		for _, e := range mc.In {
+			if scalarEqual(v, e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	f, ok := toFloat(v)
+	if !ok {
+		return false
+	}
+	return (mc.Gt == nil || f > *mc.Gt) && (mc.Gte == nil || f >= *mc.Gte) &&
+		(mc.Lt == nil || f < *mc.Lt) && (mc.Lte == nil || f <= *mc.Lte)
+}
+
+// metadataValue looks up a dotted path in the metadata, nil if not found
+func metadataValue(metadata map[string]interface{}, key string) interface{} {
+	var v interface{} = metadata
+	for _, k := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// scalarEqual compares numbers by their values regardless of their types
+func scalarEqual(a, b interface{}) bool {
+	fa, oka := toFloat(a)
+	fb, okb := toFloat(b)
+	if oka || okb {
+		return oka && okb && fa == fb
+	}
+	return a == b
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, bool:
+		return true
+	}
+	_, ok := toFloat(v)
+	return ok
+}
+
+// toFloat converts numbers into float64
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,155 @@
+package memo
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/qdrant/go-client/qdrant"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestMemoryFilterValidate(t *testing.T) {
+	var nilFilter *MemoryFilter
+	assert.NoError(t, nilFilter.Validate())
+
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+	assert.NoError(t, (&MemoryFilter{After: &earlier, Before: &now, Metadata: []MetadataCondition{
+		{Key: "user.name", Eq: "aspirin"},
+		{Key: "priority", In: []interface{}{1.0, 2.0}},
+		{Key: "score", Gte: float(0.5)},
+	}}).Validate())
+
+	for _, f := range []*MemoryFilter{
+		{After: &now, Before: &earlier},
+		{Tags: []string{""}},
+		{Metadata: []MetadataCondition{{Key: "", Eq: 1}}},
+		{Metadata: []MetadataCondition{{Key: "$where", Eq: 1}}},
+		{Metadata: []MetadataCondition{{Key: "a..b", Eq: 1}}},
+		{Metadata: []MetadataCondition{{Key: "a"}}},                                     // no condition
+		{Metadata: []MetadataCondition{{Key: "a", Eq: 1, Gt: float(1)}}},                // more than one
+		{Metadata: []MetadataCondition{{Key: "a", In: []interface{}{}}}},                // empty in
+		{Metadata: []MetadataCondition{{Key: "a", Eq: map[string]interface{}{"b": 1}}}}, // not a scalar
+	} {
+		err := f.Validate()
+		assert.Equal(t, 400, err.(WrapError).Code(), "%+v", f)
+	}
+}
+
+func TestMemoryFilterQdrant(t *testing.T) {
+	var nilFilter *MemoryFilter
+	assert.Nil(t, nilFilter.qdrantFilter())
+	assert.Nil(t, (&MemoryFilter{}).qdrantFilter())
+
+	after := time.Unix(100, 0)
+	filter := (&MemoryFilter{
+		After:       &after,
+		Tags:        []string{"work", "chat"},
+		ExcludeTags: []string{"secret"},
+		Source:      "slack",
+		Metadata: []MetadataCondition{
+			{Key: "channel", Eq: "general"},
+			{Key: "priority", In: []interface{}{1.0, 2.0}},
+			{Key: "mixed", In: []interface{}{"a", 1.5}},
+			{Key: "score", Lt: float(0.5)},
+		},
+	}).qdrantFilter()
+
+	assert.Len(t, filter.Must, 8)
+	created := filter.Must[0].GetField()
+	assert.Equal(t, PAYLOAD_CREATED, created.Key)
+	assert.Equal(t, 100.0, created.Range.GetGte())
+	assert.Nil(t, created.Range.Lt)
+	assert.Equal(t, "work", filter.Must[1].GetField().Match.GetKeyword())
+	assert.Equal(t, "chat", filter.Must[2].GetField().Match.GetKeyword())
+	assert.Equal(t, []string{"secret"}, filter.MustNot[0].GetField().Match.GetKeywords().Strings)
+	assert.Equal(t, PAYLOAD_SOURCE, filter.Must[3].GetField().Key)
+	assert.Equal(t, "metadata.channel", filter.Must[4].GetField().Key)
+	assert.Equal(t, []int64{1, 2}, filter.Must[5].GetField().Match.GetIntegers().Integers)
+
+	// mixed values are matched one by one, 1.5 is matched by a closed range
+	should := filter.Must[6].GetFilter().Should
+	assert.Len(t, should, 2)
+	assert.Equal(t, "a", should[0].GetField().Match.GetKeyword())
+	assert.Equal(t, 1.5, should[1].GetField().Range.GetGte())
+	assert.Equal(t, 1.5, should[1].GetField().Range.GetLte())
+
+	assert.Equal(t, 0.5, filter.Must[7].GetField().Range.GetLt())
+	assert.IsType(t, &pb.Match_Boolean{}, matchCondition("k", true).GetField().Match.MatchValue)
+}
+
+func TestMemoryFilterMongo(t *testing.T) {
+	before := time.Unix(100, 0)
+	filter := (&MemoryFilter{
+		Before:      &before,
+		Tags:        []string{"work"},
+		ExcludeTags: []string{"secret"},
+		Metadata: []MetadataCondition{
+			{Key: "channel", Eq: "general"},
+			{Key: "priority", In: []interface{}{1.0, 2.0}},
+			{Key: "score", Gt: float(0.5), Lte: float(1)},
+		},
+	}).mongoFilter(bson.M{"aid": "aid"})
+
+	assert.Equal(t, bson.M{
+		"aid":               "aid",
+		"archived_at":       bson.M{"$exists": false},
+		"created_at":        bson.M{"$lt": before},
+		"tags":              bson.M{"$all": []string{"work"}, "$nin": []string{"secret"}},
+		"metadata.channel":  "general",
+		"metadata.priority": bson.M{"$in": []interface{}{1.0, 2.0}},
+		"metadata.score":    bson.M{"$gt": 0.5, "$lte": 1.0},
+	}, filter)
+
+	filter = (&MemoryFilter{IncludeArchived: true}).mongoFilter(bson.M{})
+	assert.Empty(t, filter)
+
+	// the conditions of the same key are and-ed
+	gte := 1.0
+	filter = (&MemoryFilter{IncludeArchived: true, Metadata: []MetadataCondition{
+		{Key: "priority", Gte: &gte},
+		{Key: "priority", In: []interface{}{1.0, 3.0}},
+	}}).mongoFilter(bson.M{})
+	assert.Equal(t, bson.M{
+		"metadata.priority": bson.M{"$gte": 1.0},
+		"$and":              []bson.M{{"metadata.priority": bson.M{"$in": []interface{}{1.0, 3.0}}}},
+	}, filter)
+}
+
+func TestMemoryFilterMatch(t *testing.T) {
+	m := &Memory{
+		Created:  time.Unix(100, 0),
+		Tags:     []string{"work", "chat"},
+		Source:   "slack",
+		Metadata: map[string]interface{}{"priority": 2.0, "user": map[string]interface{}{"name": "aspirin"}},
+	}
+
+	var nilFilter *MemoryFilter
+	assert.True(t, nilFilter.Match(m))
+
+	archived := &Memory{Archived: &m.Created}
+	assert.False(t, nilFilter.Match(archived))
+	assert.True(t, (&MemoryFilter{IncludeArchived: true}).Match(archived))
+
+	at, later := time.Unix(100, 0), time.Unix(200, 0)
+	assert.True(t, (&MemoryFilter{After: &at, Before: &later}).Match(m))
+	assert.False(t, (&MemoryFilter{Before: &at}).Match(m))
+	assert.True(t, (&MemoryFilter{Tags: []string{"work", "chat"}}).Match(m))
+	assert.False(t, (&MemoryFilter{Tags: []string{"work", "home"}}).Match(m))
+	assert.False(t, (&MemoryFilter{ExcludeTags: []string{"chat"}}).Match(m))
+	assert.False(t, (&MemoryFilter{Source: "email"}).Match(m))
+
+	// numbers are compared by values
+	assert.True(t, (&MemoryFilter{Metadata: []MetadataCondition{{Key: "priority", Eq: 2}}}).Match(m))
+	assert.True(t, (&MemoryFilter{Metadata: []MetadataCondition{{Key: "priority", In: []interface{}{"2", 2}}}}).Match(m))
+	assert.False(t, (&MemoryFilter{Metadata: []MetadataCondition{{Key: "priority", Eq: "2"}}}).Match(m))
+	assert.True(t, (&MemoryFilter{Metadata: []MetadataCondition{{Key: "priority", Gt: float(1), Lte: float(2)}}}).Match(m))
+	assert.False(t, (&MemoryFilter{Metadata: []MetadataCondition{{Key: "priority", Lt: float(2)}}}).Match(m))
+	assert.True(t, (&MemoryFilter{Metadata: []MetadataCondition{{Key: "user.name", Eq: "aspirin"}}}).Match(m))
+	assert.False(t, (&MemoryFilter{Metadata: []MetadataCondition{{Key: "user.age", Gt: float(1)}}}).Match(m))
+}
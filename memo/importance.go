@@ -0,0 +1,126 @@
+package memo
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// memories are rated by llm in batches of this size by default
+const DEFAULT_IMPORTANCE_BATCH_SIZE = 10
+
+// the poignancy scale which llm rates memories on, it is mapped to importance in [0, 1]
+const MIN_POIGNANCY = 1
+const MAX_POIGNANCY = 10
+
+const IMPORTANCE_PROMPT = `On the scale of 1 to 10, where 1 is purely mundane (e.g., brushing teeth, making bed) ` +
+	`and 10 is extremely poignant (e.g., a break up, college acceptance), rate the likely poignancy of each of the numbered memories. ` +
+	`Answer with one line per memory in the form "<number>: <rating>", and nothing else.`
+
+// rateImportance rates the poignancy of memories whose importance is not supplied, batchSize memories per chat.
+// memories whose ratings can't be found in the answer are left unrated, so are the batches whose chat fails,
+// the chat errors are returned after all batches are tried
+func rateImportance(ctx context.Context, llm LLM, memories []*Memory, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = DEFAULT_IMPORTANCE_BATCH_SIZE
+	}
+
+	var unrated []*Memory
+	for _, m := range memories {
+		if m.Importance == 0 {
+			unrated = append(unrated, m)
+		}
+	}
+
+	var errs []error
+	for start := 0; start < len(unrated); start += batchSize {
+		end := start + batchSize
+		if end > len(unrated) {
+			end = len(unrated)
+		}
+		batch := unrated[start:end]
+
+		answer, err := llm.Chat(ctx, []ChatMessage{
+			{Role: "system", Content: IMPORTANCE_PROMPT},
+			{Role: "user", Content: numberedStatements(batch)},
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for idx, rating := range parseRatings(answer.Content, len(batch)) {
+			if rating > 0 {
+				batch[idx].Importance = poignancyToImportance(rating)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rateImportanceOrLog rates like rateImportance, the rating is optional, so its errors are logged instead of
+// failing the add, and the memories it can't rate are added unrated
+func rateImportanceOrLog(ctx context.Context, llm LLM, memories []*Memory, batchSize int, logger *zap.SugaredLogger) {
+	if err := rateImportance(ctx, llm, memories, batchSize); err != nil && logger != nil {
+		logger.Warnw("memories added unrated", "error", err)
+	}
+}
+
+var ratingNumber = regexp.MustCompile(`\d+(?:\.\d+)?`)
+var ratingScale = regexp.MustCompile(`/\s*10\b`)
+
+// parseRatings parses n ratings from llm's answer, missing or invalid ones are 0.
+// a line with more than one number is "<number>: <rating>", whose first number is the memory's number
+// and the last one is the rating, so "Memory 2 (woke up at 7am) - rating: 3/10" is fine.
+// if no such line is found, and the answer has exactly n numbers, they are the ratings in order
+func parseRatings(answer string, n int) []float64 {
+	ratings := make([]float64, n)
+	answer = ratingScale.ReplaceAllString(answer, "")
+
+	found := false
+	for _, line := range strings.Split(answer, "\n") {
+		numbers := ratingNumber.FindAllString(line, -1)
+		if len(numbers) < 2 {
+			continue
+		}
+		idx, err := strconv.Atoi(numbers[0])
+		if err != nil || idx < 1 || idx > n {
+			continue
+		}
+		if rating, ok := parsePoignancy(numbers[len(numbers)-1]); ok {
+			ratings[idx-1] = rating
+			found = true
+		}
+	}
+	if found {
+		return ratings
+	}
+
+	numbers := ratingNumber.FindAllString(answer, -1)
+	if len(numbers) != n {
+		return ratings
+	}
+	for idx, s := range numbers {
+		if rating, ok := parsePoignancy(s); ok {
+			ratings[idx] = rating
+		}
+	}
+	return ratings
+}
+
+func parsePoignancy(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < MIN_POIGNANCY || f > MAX_POIGNANCY {
+		return 0, false
+	}
+	return f, true
+}
+
+// poignancyToImportance maps the poignancy scale onto (0, 1], the mundane ones are not zero so they count as rated
+func poignancyToImportance(poignancy float64) float64 {
+	return poignancy / MAX_POIGNANCY
+}
@@ -0,0 +1,69 @@
+package memo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRatings(t *testing.T) {
+	cases := []struct {
+		answer  string
+		ratings []float64
+	}{
+		{"1: 2\n2: 9", []float64{2, 9}},
+		{"Sure! Here are the ratings:\n1. 3\n2) 8/10\n", []float64{3, 8}},
+		{"Memory 2 (woke up at 7am) - rating: 3/10\n[1] 10", []float64{10, 3}},
+		{"1: 2.5\n3: 4", []float64{2.5, 0}},      // out of range number is skipped
+		{"1: 11\n2: 0", []float64{0, 0}},         // invalid ratings
+		{"2\n7", []float64{2, 7}},                // no numbered lines, numbers in order
+		{"I can't rate these.", []float64{0, 0}}, // nothing to parse
+		{"3 4 5", []float64{0, 0}},               // numbers don't match the memories
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.ratings, parseRatings(c.answer, 2), c.answer)
+	}
+}
+
+func TestRateImportance(t *testing.T) {
+	ctx := context.TODO()
+	llm := NewLocal(8)
+	var prompts []string
+	llm.ChatFunc = func(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+		prompts = append(prompts, messages[1].Content)
+		return ChatMessage{Content: "1: 1\n2: 10"}, nil
+	}
+
+	memories := []*Memory{
+		{Content: "I ate\nbreakfast"},
+		{Content: "My house burned down"},
+		{Content: "I got a cat", Importance: 0.7}, // supplied
+		{Content: "I brushed my teeth"},
+	}
+	assert.NoError(t, rateImportance(ctx, llm, memories, 2))
+
+	// supplied importance is skipped, then the rest are rated in two batches
+	assert.Len(t, prompts, 2)
+	assert.Equal(t, "1. I ate breakfast\n2. My house burned down\n", prompts[0])
+	assert.Equal(t, 1, strings.Count(prompts[1], "\n"))
+	assert.Equal(t, 0.1, memories[0].Importance)
+	assert.Equal(t, 1.0, memories[1].Importance)
+	assert.Equal(t, 0.7, memories[2].Importance)
+	assert.Equal(t, 0.1, memories[3].Importance)
+
+	// a failed batch is left unrated, the others are still rated
+	calls := 0
+	llm.ChatFunc = func(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+		if calls++; calls == 1 {
+			return ChatMessage{}, errors.New("chat failed")
+		}
+		return ChatMessage{Content: "1: 10"}, nil
+	}
+	memories = []*Memory{{Content: "hello"}, {Content: "I won the lottery"}}
+	assert.ErrorContains(t, rateImportance(ctx, llm, memories, 1), "chat failed")
+	assert.Zero(t, memories[0].Importance)
+	assert.Equal(t, 1.0, memories[1].Importance)
+}
@@ -0,0 +1,1081 @@
+package memo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// inMemoryStore holds the documents and vectors shared by InMemoryAgents and InMemoryMemories,
+// points is keyed by agent's id just like qdrant collections
+type inMemoryStore struct {
+	mu sync.RWMutex
+
+	agents   map[primitive.ObjectID]*Agent
+	memories map[primitive.ObjectID]*Memory
+	points   map[primitive.ObjectID]map[string]vectors
+
+	// the new points of the agents which are being re-embedded, like the new qdrant collections
+	reembedded map[primitive.ObjectID]map[string]vectors
+
+	sessions map[primitive.ObjectID]*Session
+	messages map[primitive.ObjectID][]*SessionMessage // keyed by session's id, in order
+}
+
+// InMemoryAgents is a model which implements AgentModel interface without any external services
+type InMemoryAgents struct {
+	store *inMemoryStore
+
+	ListLimit int64
+
+	// if TrashRetention is positive, Delete moves the agent into the trash
+	TrashRetention time.Duration
+
+	// Embedding is the configured embedding model, which is recorded on the added agents if it is not nil
+	Embedding *EmbeddingSpec
+}
+
+// InMemoryMemories is a model which implements MemoryModel interface without any external services,
+// it searches memories by brute-force similarity by the agent's distance
+type InMemoryMemories struct {
+	store *inMemoryStore
+
+	llm    LLM
+	Logger *zap.SugaredLogger // logs the problems which don't fail a call, it is optional
+
+	SearchLimit int64
+	ListLimit   int64
+
+	// if RateImportance is true, llm rates the importance of added memories which have none
+	RateImportance      bool
+	ImportanceBatchSize int
+
+	// Embedding is the configured embedding model, which should be the one recorded on the agents,
+	// the embeddings are not checked if it is nil
+	Embedding *EmbeddingSpec
+	// Embedders embed for each agent with its recorded model, it is optional, then llm embeds for all agents
+	Embedders *Embedders
+}
+
+// NewInMemory creates agents and memories models which share the same in-process storage,
+// llm is used for memories' embeddings
+func NewInMemory(llm LLM) (*InMemoryAgents, *InMemoryMemories) {
+	conf := DefaultConfig()
+	store := &inMemoryStore{
+		agents:   make(map[primitive.ObjectID]*Agent),
+		memories: make(map[primitive.ObjectID]*Memory),
+		points:   make(map[primitive.ObjectID]map[string]vectors),
+		sessions: make(map[primitive.ObjectID]*Session),
+		messages: make(map[primitive.ObjectID][]*SessionMessage),
+
+		reembedded: make(map[primitive.ObjectID]map[string]vectors),
+	}
+
+	agents := &InMemoryAgents{store: store, ListLimit: int64(conf.AgentListLimit)}
+	memories := &InMemoryMemories{
+		store:       store,
+		llm:         llm,
+		SearchLimit: int64(conf.MemorySearchLimit),
+		ListLimit:   int64(conf.MemoryListLimit),
+	}
+	return agents, memories
+}
+
+// Add agent and return inserted id
+// if agent's id is set, it will return an error
+func (s *InMemoryAgents) Add(ctx context.Context, agent *Agent) (primitive.ObjectID, error) {
+	if agent.ID != primitive.NilObjectID {
+		return primitive.NilObjectID, NewWrapError(400, fmt.Errorf("agent id should be nil"), "")
+	}
+	if err := agent.Validate(); err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	agent.ID = primitive.NewObjectID()
+	if agent.Created.IsZero() {
+		agent.Created = time.Now()
+	}
+	agent.Embedding, agent.Reembedding, agent.Unreflected = s.Embedding, nil, 0
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	doc := *agent
+	s.store.agents[agent.ID] = &doc
+	s.store.points[agent.ID] = make(map[string]vectors)
+	return agent.ID, nil
+}
+
+// Delete agent, it is moved into the trash if TrashRetention is positive, otherwise it is purged
+func (s *InMemoryAgents) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if s.TrashRetention <= 0 {
+		return s.Purge(ctx, id)
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	doc, ok := s.store.agents[id]
+	if !ok || doc.Deleted != nil {
+		return NewWrapError(404, fmt.Errorf("agent not found: %s", id), "")
+	}
+	now := time.Now()
+	doc.Deleted = &now
+	return nil
+}
+
+// Restore the agent from the trash
+func (s *InMemoryAgents) Restore(ctx context.Context, id primitive.ObjectID) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	doc, ok := s.store.agents[id]
+	if !ok || doc.Deleted == nil {
+		return NewWrapError(404, fmt.Errorf("agent not found in trash: %s", id), "")
+	}
+	doc.Deleted = nil
+	return nil
+}
+
+// Purge removes the agent, trashed or not, with all its memories and vectors
+func (s *InMemoryAgents) Purge(ctx context.Context, id primitive.ObjectID) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	if _, ok := s.store.agents[id]; !ok {
+		return NewWrapError(404, fmt.Errorf("agent not found: %s", id), "")
+	}
+	s.purge(id)
+	return nil
+}
+
+// PurgeExpired purges the agents which have been in the trash longer than TrashRetention
+func (s *InMemoryAgents) PurgeExpired(ctx context.Context) (int, error) {
+	if s.TrashRetention <= 0 {
+		return 0, nil
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	expired := time.Now().Add(-s.TrashRetention)
+	n := 0
+	for id, doc := range s.store.agents {
+		if doc.Deleted != nil && doc.Deleted.Before(expired) {
+			s.purge(id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// purge the agent, its memories and vectors, caller must hold the lock
+func (s *InMemoryAgents) purge(id primitive.ObjectID) {
+	for mid, m := range s.store.memories {
+		if m.AID == id {
+			delete(s.store.memories, mid)
+		}
+	}
+	for sid, session := range s.store.sessions {
+		if session.AID == id {
+			delete(s.store.sessions, sid)
+			delete(s.store.messages, sid)
+		}
+	}
+	delete(s.store.points, id)
+	delete(s.store.reembedded, id)
+	delete(s.store.agents, id)
+}
+
+// Update an agent, if no agent matched it will return an notfound error
+func (s *InMemoryAgents) Update(ctx context.Context, agent *Agent) error {
+	if err := agent.Validate(); err != nil {
+		return err
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	doc, ok := s.store.agents[agent.ID]
+	if !ok || doc.Deleted != nil {
+		return NewWrapError(404, fmt.Errorf("agent not found: %s", agent.ID.Hex()), "")
+	}
+
+	// the profile is replaced, so its empty fields are cleared
+	doc.Name = agent.Name
+	doc.Description = agent.Description
+	doc.Persona = nil
+	if len(agent.Persona) > 0 {
+		doc.Persona = append([]string(nil), agent.Persona...)
+	}
+	doc.SystemPrompt = agent.SystemPrompt
+	doc.LLM = nil
+	if agent.LLM != nil {
+		settings := *agent.LLM
+		doc.LLM = &settings
+	}
+	if !agent.Created.IsZero() {
+		doc.Created = agent.Created
+	}
+	if agent.Retrieval != nil {
+		retrieval := *agent.Retrieval
+		doc.Retrieval = &retrieval
+	}
+	return nil
+}
+
+// MarkReflected sets the agent's reflected time and resets its unreflected importance
+func (s *InMemoryAgents) MarkReflected(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	doc, ok := s.store.agents[id]
+	if !ok || doc.Deleted != nil {
+		return NewWrapError(404, fmt.Errorf("agent not found: %s", id.Hex()), "")
+	}
+	doc.Reflected, doc.Unreflected = &at, 0
+	return nil
+}
+
+// AddImportance increments the agent's unreflected importance and returns it
+func (s *InMemoryAgents) AddImportance(ctx context.Context, id primitive.ObjectID, importance float64) (float64, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	doc, ok := s.store.agents[id]
+	if !ok || doc.Deleted != nil {
+		return 0, NewWrapError(404, fmt.Errorf("agent not found: %s", id.Hex()), "")
+	}
+	doc.Unreflected += importance
+	return doc.Unreflected, nil
+}
+
+// Get agent by id, agents in the trash are not found
+func (s *InMemoryAgents) Get(ctx context.Context, id primitive.ObjectID) (*Agent, error) {
+	s.store.mu.RLock()
+	defer s.store.mu.RUnlock()
+
+	doc, ok := s.store.agents[id]
+	if !ok || doc.Deleted != nil {
+		return nil, NewWrapError(404, fmt.Errorf("agent not found: %s", id.Hex()), "")
+	}
+	agent := *doc
+	return &agent, nil
+}
+
+// List agents with offset, newest first
+func (s *InMemoryAgents) List(ctx context.Context, offset primitive.ObjectID) ([]*Agent, error) {
+	return s.list(false, offset), nil
+}
+
+// ListTrash lists agents in the trash with offset, newest first
+func (s *InMemoryAgents) ListTrash(ctx context.Context, offset primitive.ObjectID) ([]*Agent, error) {
+	return s.list(true, offset), nil
+}
+
+func (s *InMemoryAgents) list(trashed bool, offset primitive.ObjectID) []*Agent {
+	s.store.mu.RLock()
+	defer s.store.mu.RUnlock()
+
+	var ids []primitive.ObjectID
+	for id, doc := range s.store.agents {
+		if (doc.Deleted != nil) == trashed {
+			ids = append(ids, id)
+		}
+	}
+
+	var agents []*Agent
+	for _, id := range pageIDs(ids, offset, s.ListLimit) {
+		agent := *s.store.agents[id]
+		agents = append(agents, &agent)
+	}
+	return agents
+}
+
+// AddOne adds a memory to the agent
+func (ms *InMemoryMemories) AddOne(ctx context.Context, aid primitive.ObjectID, memory *Memory) (primitive.ObjectID, error) {
+	res, err := ms.AddMany(ctx, aid, []*Memory{memory})
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return res[0], nil
+}
+
+// AddMany adds memories to the agent
+func (ms *InMemoryMemories) AddMany(ctx context.Context, aid primitive.ObjectID, memories []*Memory) ([]primitive.ObjectID, error) {
+	if err := ms.validate(memories); err != nil {
+		return nil, err
+	}
+
+	if ms.RateImportance {
+		rateImportanceOrLog(ctx, ms.llm, memories, ms.ImportanceBatchSize, ms.Logger)
+	}
+
+	// create embeddings before anything is stored
+	ems, _, err := ms.embed(ctx, aid, contentsOf(memories))
+	if err != nil {
+		return nil, err
+	}
+
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+	return ms.insert(aid, memories, ems)
+}
+
+// AddManyDedup adds memories like AddMany, but their near-duplicates are handled by dedup instead of being inserted
+func (ms *InMemoryMemories) AddManyDedup(ctx context.Context, aid primitive.ObjectID, memories []*Memory, dedup *Dedup) ([]*Insertion, error) {
+	if err := dedup.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ms.validate(memories); err != nil {
+		return nil, err
+	}
+	ems, spec, err := ms.embed(ctx, aid, contentsOf(memories))
+	if err != nil {
+		return nil, err
+	}
+
+	ms.store.mu.RLock()
+	nearest := make([]*neighbour, len(memories))
+	if dedup.Mode != DEDUP_OFF {
+		for _, m := range ms.store.memories {
+			v, ok := ms.store.points[aid][m.PID]
+			if m.AID != aid || !ok {
+				continue
+			}
+			for idx, em := range ems {
+				if sim := spec.compare(em, v); float64(sim) >= dedup.Threshold && (nearest[idx] == nil || sim > nearest[idx].similarity) {
+					nearest[idx] = &neighbour{id: m.ID, similarity: sim}
+				}
+			}
+		}
+	}
+	ms.store.mu.RUnlock()
+
+	now := time.Now()
+	plan := dedup.plan(memories, ems, nearest, spec, now)
+	if ms.RateImportance && len(plan.memories) > 0 {
+		rateImportanceOrLog(ctx, ms.llm, plan.memories, ms.ImportanceBatchSize, ms.Logger)
+	}
+
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+	if _, err := ms.insert(aid, plan.memories, plan.ems); err != nil {
+		return nil, err
+	}
+	for mid, n := range plan.reinforced {
+		if m, ok := ms.store.memories[mid]; ok {
+			m.Reinforced += n
+			m.Seen = &now
+		}
+	}
+	return plan.done(memories), nil
+}
+
+// validate memories to add
+func (ms *InMemoryMemories) validate(memories []*Memory) error {
+	for _, m := range memories {
+		if m.ID != primitive.NilObjectID {
+			return NewWrapError(400, fmt.Errorf("memory id should be nil"), "")
+		}
+		if m.AID != primitive.NilObjectID {
+			return NewWrapError(400, fmt.Errorf("memory's agent id should be nil"), "")
+		}
+		if err := validateMemoryFields(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert memories with their embeddings, the store should be locked
+func (ms *InMemoryMemories) insert(aid primitive.ObjectID, memories []*Memory, ems []vectors) ([]primitive.ObjectID, error) {
+	points, ok := ms.store.points[aid]
+	if !ok {
+		return nil, NewWrapError(404, fmt.Errorf("agent not found: %s", aid.Hex()), "")
+	}
+
+	mids := make([]primitive.ObjectID, len(memories))
+	for idx, m := range memories {
+		m.ID = primitive.NewObjectID()
+		m.AID = aid
+		m.PID = uuid.New().String()
+		if m.Created.IsZero() {
+			m.Created = time.Now()
+		}
+		if m.Accessed.IsZero() {
+			m.Accessed = m.Created
+		}
+
+		doc := *m
+		ms.store.memories[m.ID] = &doc
+		points[m.PID] = ems[idx]
+		mids[idx] = m.ID
+	}
+	ms.markDirty(aid, mids)
+	return mids, nil
+}
+
+// contentsOf returns memories' contents
+func contentsOf(memories []*Memory) []string {
+	contents := make([]string, len(memories))
+	for idx, m := range memories {
+		contents[idx] = m.Content
+	}
+	return contents
+}
+
+// GetOne gets a memory by id
+func (ms *InMemoryMemories) GetOne(ctx context.Context, aid primitive.ObjectID, mid primitive.ObjectID) (*Memory, error) {
+	ms.store.mu.RLock()
+	defer ms.store.mu.RUnlock()
+
+	doc, ok := ms.store.memories[mid]
+	if !ok || doc.AID != aid {
+		return nil, NewWrapError(404, fmt.Errorf("memory not found: %s", mid), "")
+	}
+	memory := *doc
+	return &memory, nil
+}
+
+// GetMany gets memories by ids
+func (ms *InMemoryMemories) GetMany(ctx context.Context, aid primitive.ObjectID, ids []primitive.ObjectID) ([]*Memory, error) {
+	ms.store.mu.RLock()
+	defer ms.store.mu.RUnlock()
+
+	memories := ms.find(aid, ids)
+	if len(memories) != len(ids) {
+		return nil, NewWrapError(400, fmt.Errorf("some memories not found, expected %d but go %d", len(ids), len(memories)), "")
+	}
+	return memories, nil
+}
+
+// Archive memories by ids, their embeddings are removed but the memories are kept
+func (ms *InMemoryMemories) Archive(ctx context.Context, aid primitive.ObjectID, ids []primitive.ObjectID) error {
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+
+	memories := ms.find(aid, ids)
+	for _, m := range memories {
+		if m.Archived != nil {
+			return NewWrapError(400, fmt.Errorf("memory archived already: %s", m.ID.Hex()), "")
+		}
+	}
+	if len(memories) != len(ids) {
+		return NewWrapError(400, fmt.Errorf("some memories not found"), "")
+	}
+
+	now := time.Now()
+	for _, m := range memories {
+		ms.store.memories[m.ID].Archived = &now
+		ms.store.memories[m.ID].Updated = &now
+		if points, ok := ms.store.points[aid]; ok {
+			delete(points, m.PID)
+		}
+		delete(ms.store.reembedded[aid], m.PID)
+	}
+	return nil
+}
+
+// UpdateOne updates memory content, tags, source or metadata
+func (ms *InMemoryMemories) UpdateOne(ctx context.Context, aid primitive.ObjectID, memory *Memory) error {
+	return ms.UpdateMany(ctx, aid, []*Memory{memory})
+}
+
+// UpdateMany updates memories' content, tags, source or metadata, see mergeMemory for which fields are applied,
+// only the memories whose content changed will be re-embedded
+func (ms *InMemoryMemories) UpdateMany(ctx context.Context, aid primitive.ObjectID, memories []*Memory) error {
+	ids := make([]primitive.ObjectID, len(memories))
+	for idx, m := range memories {
+		if err := validateMemoryFields(m); err != nil {
+			return err
+		}
+		ids[idx] = m.ID
+	}
+
+	ms.store.mu.RLock()
+	found := ms.find(aid, ids)
+	ms.store.mu.RUnlock()
+
+	// only memories which exist and have changed will be updated
+	byID := make(map[primitive.ObjectID]*Memory, len(found))
+	for _, m := range found {
+		byID[m.ID] = m
+	}
+	var updates []*Memory
+	var embedded []int // indexes of the updates whose content changed
+	var contents []string
+	now := time.Now()
+	for _, m := range memories {
+		prev, ok := byID[m.ID]
+		if !ok {
+			continue
+		}
+		if prev.Archived != nil {
+			return NewWrapError(400, fmt.Errorf("archived memory can't be updated: %s", m.ID.Hex()), "")
+		}
+		next, contentChanged, modified := mergeMemory(prev, m)
+		if !modified {
+			continue
+		}
+		next.Updated = &now
+		if contentChanged {
+			embedded = append(embedded, len(updates))
+			contents = append(contents, next.Content)
+		}
+		updates = append(updates, next)
+	}
+
+	if len(updates) == 0 {
+		return NewWrapError(400, fmt.Errorf("memories not modified"), "")
+	}
+
+	var ems []vectors
+	if len(contents) > 0 {
+		var err error
+		ems, _, err = ms.embed(ctx, aid, contents)
+		if err != nil {
+			return err
+		}
+	}
+
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+	for _, m := range updates {
+		if _, ok := ms.store.memories[m.ID]; !ok {
+			continue // deleted meanwhile
+		}
+		ms.store.memories[m.ID] = m
+	}
+	var mids []primitive.ObjectID
+	for idx, i := range embedded {
+		m := updates[i]
+		if _, ok := ms.store.memories[m.ID]; !ok {
+			continue
+		}
+		if points, ok := ms.store.points[aid]; ok {
+			points[m.PID] = ems[idx]
+		}
+		mids = append(mids, m.ID)
+	}
+	ms.markDirty(aid, mids)
+	return nil
+}
+
+// DeleteOne deletes a memory by id
+func (ms *InMemoryMemories) DeleteOne(ctx context.Context, aid primitive.ObjectID, mid primitive.ObjectID) error {
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+
+	doc, ok := ms.store.memories[mid]
+	if !ok || doc.AID != aid {
+		return NewWrapError(404, fmt.Errorf("memory not found: %s", mid), "")
+	}
+	ms.remove(doc)
+	return nil
+}
+
+// DeleteMany deletes memories by ids
+func (ms *InMemoryMemories) DeleteMany(ctx context.Context, aid primitive.ObjectID, ids []primitive.ObjectID) error {
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+
+	memories := ms.find(aid, ids)
+	if len(memories) != len(ids) {
+		return NewWrapError(400, fmt.Errorf("some memories not found"), "")
+	}
+	for _, m := range memories {
+		ms.remove(m)
+	}
+	return nil
+}
+
+// List agent's memories older than offset and matching the filter, newest first
+func (ms *InMemoryMemories) List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID, filter *MemoryFilter) ([]*Memory, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	ms.store.mu.RLock()
+	defer ms.store.mu.RUnlock()
+
+	var ids []primitive.ObjectID
+	for id, m := range ms.store.memories {
+		if m.AID == aid && filter.Match(m) {
+			ids = append(ids, id)
+		}
+	}
+
+	var memories []*Memory
+	for _, id := range pageIDs(ids, offset, ms.ListLimit) {
+		memory := *ms.store.memories[id]
+		memories = append(memories, &memory)
+	}
+	return memories, nil
+}
+
+// embed creates the embeddings of the agent's vectors, see embedFor
+func (ms *InMemoryMemories) embed(ctx context.Context, aid primitive.ObjectID, contents []string) ([]vectors, *EmbeddingSpec, error) {
+	ms.store.mu.RLock()
+	var recorded *EmbeddingSpec
+	if agent, ok := ms.store.agents[aid]; ok {
+		recorded = agent.Embedding
+	}
+	ms.store.mu.RUnlock()
+	llm, configured, err := ms.Embedders.llmOf(ms.llm, recorded, ms.Embedding)
+	if err != nil {
+		return nil, nil, err
+	}
+	return embedFor(ctx, llm, aid, recorded, configured, contents)
+}
+
+// Search memories by their retrieval scores, whose relevances are the similarities
+// between the query and memories' embeddings by the agent's distance
+func (ms *InMemoryMemories) Search(ctx context.Context, aid primitive.ObjectID, query string, filter *MemoryFilter) ([]*Memory, []*Score, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	ems, spec, err := ms.embed(ctx, aid, []string{query})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+
+	retrieval := DefaultRetrieval()
+	if agent, ok := ms.store.agents[aid]; ok && agent.Retrieval != nil {
+		retrieval = agent.Retrieval
+	}
+
+	var candidates []*Memory
+	var relevances []float32
+	for _, m := range ms.store.memories {
+		if m.AID != aid || !filter.Match(m) {
+			continue
+		}
+		if v, ok := ms.store.points[aid][m.PID]; ok {
+			candidates = append(candidates, m)
+			relevances = append(relevances, spec.compare(ems[0], v))
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil, NewWrapError(404, fmt.Errorf("no memories found"), "")
+	}
+
+	now := time.Now()
+	ranked, scores := retrieval.rank(candidates, relevances, ms.SearchLimit, now)
+
+	memories := make([]*Memory, len(ranked))
+	for idx, m := range ranked {
+		m.Accessed = now
+		memory := *m
+		memories[idx] = &memory
+	}
+	return memories, scores, nil
+}
+
+// Reembed copies the agent's memories into new points with the embeddings of llm, then switches the agent to spec
+// and the new points, see Memories.Reembed. the memories whose content is written meanwhile are copied again,
+// the removed ones are removed from the new points right away
+func (ms *InMemoryMemories) Reembed(ctx context.Context, aid primitive.ObjectID, llm LLM, spec *EmbeddingSpec, batchSize int, progress func(*Reembedding)) (*Reembedding, error) {
+	if batchSize <= 0 {
+		batchSize = REEMBED_BATCH_SIZE
+	}
+	r, err := ms.beginReembedding(aid, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.Switched {
+		for {
+			ms.store.mu.RLock()
+			var ids []primitive.ObjectID
+			for id, m := range ms.store.memories {
+				if m.AID == aid && m.Archived == nil && bytes.Compare(id[:], r.After[:]) > 0 {
+					ids = append(ids, id)
+				}
+			}
+			sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+			if len(ids) > batchSize {
+				ids = ids[:batchSize]
+			}
+			batch := ms.find(aid, ids)
+			ms.store.mu.RUnlock()
+			if len(batch) == 0 {
+				break
+			}
+
+			if err := ms.copyPoints(ctx, aid, llm, r, batch); err != nil {
+				return r, err
+			}
+			r = ms.recordReembedding(aid, func(rec *Reembedding) {
+				rec.After, rec.Done = batch[len(batch)-1].ID, rec.Done+len(batch)
+			})
+			if progress != nil {
+				progress(r)
+			}
+		}
+
+		if err := ms.catchUp(ctx, aid, llm, r); err != nil {
+			return r, err
+		}
+		ms.store.mu.Lock()
+		doc := ms.store.agents[aid]
+		doc.Embedding = r.Embedding
+		ms.store.points[aid] = ms.store.reembedded[aid]
+		delete(ms.store.reembedded, aid)
+		ms.store.mu.Unlock()
+		r = ms.recordReembedding(aid, func(rec *Reembedding) { rec.Switched = true })
+	}
+
+	// the writes which raced the switch
+	if err := ms.catchUp(ctx, aid, llm, r); err != nil {
+		return r, err
+	}
+	ms.store.mu.Lock()
+	if doc, ok := ms.store.agents[aid]; ok {
+		doc.Reembedding = nil
+	}
+	ms.store.mu.Unlock()
+	if progress != nil {
+		progress(r)
+	}
+	return r, nil
+}
+
+// beginReembedding records a new job on the agent, or returns the recorded one
+func (ms *InMemoryMemories) beginReembedding(aid primitive.ObjectID, spec *EmbeddingSpec) (*Reembedding, error) {
+	if spec == nil || spec.Dim <= 0 {
+		return nil, NewWrapError(400, fmt.Errorf("embedding dimension should be positive"), "")
+	}
+
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+
+	doc, ok := ms.store.agents[aid]
+	if !ok {
+		return nil, NewWrapError(404, fmt.Errorf("agent not found: %s", aid.Hex()), "")
+	}
+	if r := doc.Reembedding; r != nil {
+		if *r.Embedding != *spec {
+			return nil, NewWrapError(409, fmt.Errorf("agent %s is being re-embedded with %s already", aid.Hex(), r.Embedding), "")
+		}
+		return r, nil
+	}
+	if doc.Embedding != nil && *doc.Embedding == *spec {
+		return nil, NewWrapError(400, fmt.Errorf("agent %s is embedded with %s already", aid.Hex(), spec), "")
+	}
+
+	doc.Reembedding = &Reembedding{Collection: newCollectionName(aid), Embedding: spec, Started: time.Now()}
+	ms.store.reembedded[aid] = make(map[string]vectors)
+	return doc.Reembedding, nil
+}
+
+// recordReembedding changes a copy of the agent's job and records it, so the copies which have been read never change,
+// and returns the recorded one
+func (ms *InMemoryMemories) recordReembedding(aid primitive.ObjectID, change func(rec *Reembedding)) *Reembedding {
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+	return ms.changeReembedding(aid, change)
+}
+
+// changeReembedding is recordReembedding whose caller holds the lock, it returns nil if the agent has no job
+func (ms *InMemoryMemories) changeReembedding(aid primitive.ObjectID, change func(rec *Reembedding)) *Reembedding {
+	doc, ok := ms.store.agents[aid]
+	if !ok || doc.Reembedding == nil {
+		return nil
+	}
+	rec := *doc.Reembedding
+	rec.Dirty = append([]primitive.ObjectID(nil), rec.Dirty...)
+	change(&rec)
+	doc.Reembedding = &rec
+	return &rec
+}
+
+// copyPoints embeds the memories with llm into the new points, the ones removed meanwhile are skipped
+func (ms *InMemoryMemories) copyPoints(ctx context.Context, aid primitive.ObjectID, llm LLM, r *Reembedding, memories []*Memory) error {
+	ems, _, err := embedFor(ctx, llm, aid, r.Embedding, r.Embedding, contentsOf(memories))
+	if err != nil {
+		return err
+	}
+
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+
+	// the new points are the agent's points once it is switched
+	points, ok := ms.store.reembedded[aid]
+	if r.Switched {
+		points, ok = ms.store.points[aid]
+	}
+	if !ok {
+		return NewWrapError(404, fmt.Errorf("agent not found: %s", aid.Hex()), "")
+	}
+	for idx, m := range memories {
+		if doc, ok := ms.store.memories[m.ID]; ok && doc.Archived == nil {
+			points[m.PID] = ems[idx]
+		}
+	}
+	return nil
+}
+
+// catchUp copies the memories whose content is written meanwhile again, until none is left
+func (ms *InMemoryMemories) catchUp(ctx context.Context, aid primitive.ObjectID, llm LLM, r *Reembedding) error {
+	for {
+		var dirty []primitive.ObjectID
+		ms.store.mu.Lock()
+		ms.changeReembedding(aid, func(rec *Reembedding) {
+			dirty, rec.Dirty = rec.Dirty, nil
+		})
+		memories := ms.find(aid, dirty)
+		ms.store.mu.Unlock()
+		if len(dirty) == 0 {
+			return nil
+		}
+
+		if len(memories) > 0 {
+			if err := ms.copyPoints(ctx, aid, llm, r, memories); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// markDirty records the memories whose content is written on the agent's job if it has one,
+// caller must hold the lock
+func (ms *InMemoryMemories) markDirty(aid primitive.ObjectID, ids []primitive.ObjectID) {
+	if len(ids) == 0 {
+		return
+	}
+	ms.changeReembedding(aid, func(rec *Reembedding) {
+		rec.Dirty = append(rec.Dirty, ids...)
+	})
+}
+
+// find copies of agent's memories by ids in the ids' order, missing ones are skipped
+// caller must hold the lock
+func (ms *InMemoryMemories) find(aid primitive.ObjectID, ids []primitive.ObjectID) []*Memory {
+	var memories []*Memory
+	for _, id := range ids {
+		if doc, ok := ms.store.memories[id]; ok && doc.AID == aid {
+			memory := *doc
+			memories = append(memories, &memory)
+		}
+	}
+	return memories
+}
+
+// remove the memory and its points, caller must hold the lock
+func (ms *InMemoryMemories) remove(m *Memory) {
+	delete(ms.store.memories, m.ID)
+	if points, ok := ms.store.points[m.AID]; ok {
+		delete(points, m.PID)
+	}
+	delete(ms.store.reembedded[m.AID], m.PID)
+}
+
+// pageIDs sorts ids from newest to oldest, and returns at most limit ids older than offset
+func pageIDs(ids []primitive.ObjectID, offset primitive.ObjectID, limit int64) []primitive.ObjectID {
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) > 0 })
+
+	var page []primitive.ObjectID
+	for _, id := range ids {
+		if offset != primitive.NilObjectID && bytes.Compare(id[:], offset[:]) >= 0 {
+			continue
+		}
+		if limit > 0 && int64(len(page)) >= limit {
+			break
+		}
+		page = append(page, id)
+	}
+	return page
+}
+
+// cosine similarity of two vectors, 0 if any of them is empty or the sizes don't match
+func cosine(a, b vectors) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return float32(dot / (math.Sqrt(na) * math.Sqrt(nb)))
+}
+
+// InMemorySessions is a model which implements SessionModel interface without any external services
+type InMemorySessions struct {
+	store *inMemoryStore
+
+	ListLimit int64
+}
+
+// Sessions creates the sessions model which shares the agents' storage, so sessions are purged with their agent
+func (s *InMemoryAgents) Sessions() *InMemorySessions {
+	return &InMemorySessions{store: s.store, ListLimit: int64(DefaultConfig().SessionListLimit)}
+}
+
+// Add session to the agent and return inserted id
+func (ss *InMemorySessions) Add(ctx context.Context, aid primitive.ObjectID, session *Session) (primitive.ObjectID, error) {
+	if session.ID != primitive.NilObjectID {
+		return primitive.NilObjectID, NewWrapError(400, fmt.Errorf("session id should be nil"), "")
+	}
+
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+
+	if agent, ok := ss.store.agents[aid]; !ok || agent.Deleted != nil {
+		return primitive.NilObjectID, NewWrapError(404, fmt.Errorf("agent not found: %s", aid.Hex()), "")
+	}
+
+	session.ID = primitive.NewObjectID()
+	session.AID = aid
+	session.Created = time.Now()
+	session.Updated = session.Created
+	session.Messages = 0
+
+	doc := *session
+	ss.store.sessions[session.ID] = &doc
+	return session.ID, nil
+}
+
+// Get agent's session by id
+func (ss *InMemorySessions) Get(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID) (*Session, error) {
+	ss.store.mu.RLock()
+	defer ss.store.mu.RUnlock()
+
+	session, err := ss.find(aid, sid)
+	if err != nil {
+		return nil, err
+	}
+	doc := *session
+	return &doc, nil
+}
+
+// Update session's title
+func (ss *InMemorySessions) Update(ctx context.Context, aid primitive.ObjectID, session *Session) error {
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+
+	doc, err := ss.find(aid, session.ID)
+	if err != nil {
+		return err
+	}
+	doc.Title = session.Title
+	return nil
+}
+
+// Delete session with its messages
+func (ss *InMemorySessions) Delete(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID) error {
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+
+	if _, err := ss.find(aid, sid); err != nil {
+		return err
+	}
+	delete(ss.store.sessions, sid)
+	delete(ss.store.messages, sid)
+	return nil
+}
+
+// List agent's sessions from newest to oldest, offset is the last session's id
+func (ss *InMemorySessions) List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID) ([]*Session, error) {
+	ss.store.mu.RLock()
+	defer ss.store.mu.RUnlock()
+
+	var sessions []*Session
+	for _, session := range ss.store.sessions {
+		if session.AID != aid {
+			continue
+		}
+		if offset != primitive.NilObjectID && bytes.Compare(session.ID[:], offset[:]) >= 0 {
+			continue
+		}
+		doc := *session
+		sessions = append(sessions, &doc)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return bytes.Compare(sessions[i].ID[:], sessions[j].ID[:]) > 0 })
+	if ss.ListLimit > 0 && int64(len(sessions)) > ss.ListLimit {
+		sessions = sessions[:ss.ListLimit]
+	}
+	return sessions, nil
+}
+
+// Append messages to the session in order, and return the stored ones
+func (ss *InMemorySessions) Append(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID, messages []ChatMessage) ([]*SessionMessage, error) {
+	if err := validateChatMessages(messages); err != nil {
+		return nil, err
+	}
+
+	ss.store.mu.Lock()
+	defer ss.store.mu.Unlock()
+
+	session, err := ss.find(aid, sid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	stored, _ := newSessionMessages(aid, sid, messages, now)
+	for _, m := range stored {
+		doc := *m
+		ss.store.messages[sid] = append(ss.store.messages[sid], &doc)
+	}
+	if len(stored) > 0 {
+		session.Updated = now
+		session.Messages += len(stored)
+	}
+	return stored, nil
+}
+
+// Messages lists the session's messages in the window from oldest to newest
+func (ss *InMemorySessions) Messages(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID, window *Window) ([]*SessionMessage, error) {
+	if err := window.Validate(); err != nil {
+		return nil, err
+	}
+
+	ss.store.mu.RLock()
+	defer ss.store.mu.RUnlock()
+
+	if _, err := ss.find(aid, sid); err != nil {
+		return nil, err
+	}
+
+	all := ss.store.messages[sid]
+	var messages []*SessionMessage
+	tokens := 0
+	for idx := len(all) - 1; idx >= 0; idx-- {
+		tokens += messageTokens(all[idx].ChatMessage)
+		if !window.fits(len(messages)+1, tokens) {
+			break
+		}
+		doc := *all[idx]
+		messages = append(messages, &doc)
+	}
+	return reverseMessages(messages), nil
+}
+
+// find agent's session, the store should be locked
+func (ss *InMemorySessions) find(aid primitive.ObjectID, sid primitive.ObjectID) (*Session, error) {
+	session, ok := ss.store.sessions[sid]
+	if !ok || session.AID != aid {
+		return nil, NewWrapError(404, fmt.Errorf("session not found: %s", sid.Hex()), "")
+	}
+	return session, nil
+}
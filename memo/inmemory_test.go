@@ -0,0 +1,466 @@
+package memo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// tableLLM embeds contents by looking up a fixed table, unknown contents get a zero vector
+type tableLLM map[string]vectors
+
+func (tl tableLLM) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	ems := make([]vectors, len(contents))
+	for i, c := range contents {
+		if v, ok := tl[c]; ok {
+			ems[i] = v
+		} else {
+			ems[i] = vectors{0, 0, 0}
+		}
+	}
+	return ems, nil
+}
+
+func (tl tableLLM) Chat(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+	return ChatMessage{}, nil
+}
+
+func (tl tableLLM) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(delta string) error) (ChatMessage, *Usage, error) {
+	return ChatMessage{}, nil, nil
+}
+
+type InMemorySuite struct {
+	suite.Suite
+	agents   *InMemoryAgents
+	memories *InMemoryMemories
+
+	agent *Agent
+}
+
+func (s *InMemorySuite) SetupTest() {
+	var _ AgentModel = (*InMemoryAgents)(nil)
+	var _ MemoryModel = (*InMemoryMemories)(nil)
+
+	s.agents, s.memories = NewInMemory(tableLLM{
+		"red":   {1, 0, 0},
+		"green": {0, 1, 0},
+		"blue":  {0, 0, 1},
+		"pink":  {0.9, 0.1, 0.1},
+		"cyan":  {0, 0.7, 0.7},
+	})
+
+	s.agent = &Agent{Name: "aspirin"}
+	_, err := s.agents.Add(context.TODO(), s.agent)
+	s.NoError(err)
+}
+
+func (s *InMemorySuite) TestAgents() {
+	ctx := context.TODO()
+
+	_, err := s.agents.Add(ctx, &Agent{ID: primitive.NewObjectID()})
+	s.Equal(400, err.(WrapError).Code())
+
+	agent, err := s.agents.Get(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Equal("aspirin", agent.Name)
+	s.False(agent.Created.IsZero())
+
+	err = s.agents.Update(ctx, &Agent{ID: s.agent.ID, Name: "aspirin2d"})
+	s.NoError(err)
+	agent, _ = s.agents.Get(ctx, s.agent.ID)
+	s.Equal("aspirin2d", agent.Name)
+
+	err = s.agents.Update(ctx, &Agent{ID: primitive.NewObjectID()})
+	s.Equal(404, err.(WrapError).Code())
+
+	for i := range [20]int{} {
+		_, err := s.agents.Add(ctx, &Agent{Name: fmt.Sprintf("aspirin %d", i)})
+		s.NoError(err)
+	}
+	agents, err := s.agents.List(ctx, primitive.NilObjectID)
+	s.NoError(err)
+	s.Len(agents, 15)
+	s.Equal("aspirin 19", agents[0].Name)
+
+	agents, err = s.agents.List(ctx, agents[len(agents)-1].ID)
+	s.NoError(err)
+	s.Len(agents, 6)
+
+	s.NoError(s.agents.Delete(ctx, s.agent.ID))
+	_, err = s.agents.Get(ctx, s.agent.ID)
+	s.Equal(404, err.(WrapError).Code())
+	err = s.agents.Delete(ctx, s.agent.ID)
+	s.Equal(404, err.(WrapError).Code())
+}
+
+func (s *InMemorySuite) TestDeleteAgentCascade() {
+	ctx := context.TODO()
+	mid, err := s.memories.AddOne(ctx, s.agent.ID, &Memory{Content: "red"})
+	s.NoError(err)
+
+	s.NoError(s.agents.Delete(ctx, s.agent.ID))
+	_, err = s.memories.GetOne(ctx, s.agent.ID, mid)
+	s.Equal(404, err.(WrapError).Code())
+
+	// not in the trash
+	err = s.agents.Restore(ctx, s.agent.ID)
+	s.Equal(404, err.(WrapError).Code())
+}
+
+func (s *InMemorySuite) TestTrashAgent() {
+	ctx := context.TODO()
+	s.agents.TrashRetention = time.Hour
+	mid, err := s.memories.AddOne(ctx, s.agent.ID, &Memory{Content: "red"})
+	s.NoError(err)
+
+	s.NoError(s.agents.Delete(ctx, s.agent.ID))
+	_, err = s.agents.Get(ctx, s.agent.ID)
+	s.Equal(404, err.(WrapError).Code())
+	agents, _ := s.agents.List(ctx, primitive.NilObjectID)
+	s.Len(agents, 0)
+	trash, _ := s.agents.ListTrash(ctx, primitive.NilObjectID)
+	s.Len(trash, 1)
+	s.NotNil(trash[0].Deleted)
+
+	// can't delete twice
+	err = s.agents.Delete(ctx, s.agent.ID)
+	s.Equal(404, err.(WrapError).Code())
+
+	// retention not expired
+	n, err := s.agents.PurgeExpired(ctx)
+	s.NoError(err)
+	s.Equal(0, n)
+
+	// restored with its memories
+	s.NoError(s.agents.Restore(ctx, s.agent.ID))
+	agent, err := s.agents.Get(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Nil(agent.Deleted)
+	_, err = s.memories.GetOne(ctx, s.agent.ID, mid)
+	s.NoError(err)
+
+	// expired agents are purged with their memories
+	s.NoError(s.agents.Delete(ctx, s.agent.ID))
+	s.agents.TrashRetention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	n, err = s.agents.PurgeExpired(ctx)
+	s.NoError(err)
+	s.Equal(1, n)
+	_, err = s.memories.GetOne(ctx, s.agent.ID, mid)
+	s.Equal(404, err.(WrapError).Code())
+	err = s.agents.Restore(ctx, s.agent.ID)
+	s.Equal(404, err.(WrapError).Code())
+}
+
+func (s *InMemorySuite) TestAddAndDeleteMemories() {
+	ctx := context.TODO()
+	aid := s.agent.ID
+
+	ids, err := s.memories.AddMany(ctx, aid, []*Memory{{Content: "red"}, {Content: "green"}, {Content: "blue"}})
+	s.NoError(err)
+	s.Len(ids, 3)
+
+	mem, err := s.memories.GetOne(ctx, aid, ids[0])
+	s.NoError(err)
+	s.Equal("red", mem.Content)
+	s.Equal(aid, mem.AID)
+	s.NotEmpty(mem.PID)
+
+	// memory belongs to another agent
+	_, err = s.memories.GetOne(ctx, primitive.NewObjectID(), ids[0])
+	s.Equal(404, err.(WrapError).Code())
+
+	_, err = s.memories.GetMany(ctx, aid, append(ids, primitive.NewObjectID()))
+	s.Equal(400, err.(WrapError).Code())
+
+	// memory id should be nil
+	_, err = s.memories.AddOne(ctx, aid, &Memory{ID: primitive.NewObjectID()})
+	s.Equal(400, err.(WrapError).Code())
+
+	// agent not found
+	_, err = s.memories.AddOne(ctx, primitive.NewObjectID(), &Memory{Content: "red"})
+	s.Equal(404, err.(WrapError).Code())
+
+	s.NoError(s.memories.DeleteOne(ctx, aid, ids[0]))
+	err = s.memories.DeleteOne(ctx, aid, ids[0])
+	s.Equal(404, err.(WrapError).Code())
+
+	err = s.memories.DeleteMany(ctx, aid, ids)
+	s.Equal(400, err.(WrapError).Code())
+	s.NoError(s.memories.DeleteMany(ctx, aid, ids[1:]))
+
+	_, _, err = s.memories.Search(ctx, aid, "red", nil)
+	s.Equal(404, err.(WrapError).Code())
+}
+
+func (s *InMemorySuite) TestAddMemoriesEmbeddingError() {
+	ctx := context.TODO()
+	s.memories.llm = &mockLLM{Error: errors.New("embedding failed")}
+
+	_, err := s.memories.AddMany(ctx, s.agent.ID, []*Memory{{Content: "red"}})
+	s.Error(err)
+
+	// nothing stored
+	mems, err := s.memories.List(ctx, s.agent.ID, primitive.NilObjectID, nil)
+	s.NoError(err)
+	s.Len(mems, 0)
+}
+
+func (s *InMemorySuite) TestSearchAndUpdateMemories() {
+	ctx := context.TODO()
+	aid := s.agent.ID
+	s.memories.SearchLimit = 2
+
+	ids, err := s.memories.AddMany(ctx, aid, []*Memory{{Content: "red"}, {Content: "green"}, {Content: "blue"}})
+	s.NoError(err)
+
+	mems, scores, err := s.memories.Search(ctx, aid, "pink", nil)
+	s.NoError(err)
+	s.Len(mems, 2)
+	s.Len(scores, 2)
+	s.Equal("red", mems[0].Content)
+	s.Greater(scores[0].Score, scores[1].Score)
+
+	// green becomes cyan, then it will be the top of "blue"'s neighbours after blue itself
+	err = s.memories.UpdateOne(ctx, aid, &Memory{ID: ids[1], Content: "cyan"})
+	s.NoError(err)
+	mems, _, err = s.memories.Search(ctx, aid, "blue", nil)
+	s.NoError(err)
+	s.Equal("blue", mems[0].Content)
+	s.Equal("cyan", mems[1].Content)
+
+	// same content, nothing modified
+	err = s.memories.UpdateOne(ctx, aid, &Memory{ID: ids[1], Content: "cyan"})
+	s.Equal(400, err.(WrapError).Code())
+}
+
+func (s *InMemorySuite) TestMemoryTagsAndMetadata() {
+	ctx := context.TODO()
+	aid := s.agent.ID
+
+	_, err := s.memories.AddOne(ctx, aid, &Memory{Content: "red", Metadata: map[string]interface{}{"a.b": 1}})
+	s.Equal(400, err.(WrapError).Code())
+
+	mid, err := s.memories.AddOne(ctx, aid, &Memory{Content: "red", Tags: []string{"color"}, Source: "slack"})
+	s.NoError(err)
+
+	// metadata only, the content and the embedding are kept
+	err = s.memories.UpdateOne(ctx, aid, &Memory{ID: mid, Metadata: map[string]interface{}{"channel": "general"}})
+	s.NoError(err)
+	mem, err := s.memories.GetOne(ctx, aid, mid)
+	s.NoError(err)
+	s.Equal("red", mem.Content)
+	s.Equal([]string{"color"}, mem.Tags)
+	s.Equal("slack", mem.Source)
+	s.Equal("general", mem.Metadata["channel"])
+	mems, _, err := s.memories.Search(ctx, aid, "red", nil)
+	s.NoError(err)
+	s.Equal(mid, mems[0].ID)
+
+	err = s.memories.UpdateOne(ctx, aid, &Memory{ID: mid, Tags: []string{""}})
+	s.Equal(400, err.(WrapError).Code())
+
+	// same tags, nothing modified
+	err = s.memories.UpdateOne(ctx, aid, &Memory{ID: mid, Tags: []string{"color"}})
+	s.Equal(400, err.(WrapError).Code())
+}
+
+func (s *InMemorySuite) TestFilterMemories() {
+	ctx := context.TODO()
+	aid := s.agent.ID
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+
+	_, err := s.memories.AddMany(ctx, aid, []*Memory{
+		{Content: "red", Source: "chat", Tags: []string{"color"}, Created: lastWeek.Add(-time.Hour)},
+		{Content: "pink", Source: "chat", Tags: []string{"color"}, Metadata: map[string]interface{}{"priority": 1.0}},
+		{Content: "green", Source: "email", Metadata: map[string]interface{}{"priority": 2.0}},
+	})
+	s.NoError(err)
+
+	// the nearest memory of "red" is filtered out, not ranked lower
+	mems, _, err := s.memories.Search(ctx, aid, "red", &MemoryFilter{After: &lastWeek, Source: "chat"})
+	s.NoError(err)
+	s.Len(mems, 1)
+	s.Equal("pink", mems[0].Content)
+
+	mems, err = s.memories.List(ctx, aid, primitive.NilObjectID, &MemoryFilter{Metadata: []MetadataCondition{{Key: "priority", Gte: float(1)}}})
+	s.NoError(err)
+	s.Len(mems, 2)
+	s.Equal("green", mems[0].Content)
+
+	mems, err = s.memories.List(ctx, aid, primitive.NilObjectID, &MemoryFilter{Tags: []string{"color"}, ExcludeTags: []string{"secret"}})
+	s.NoError(err)
+	s.Len(mems, 2)
+
+	_, _, err = s.memories.Search(ctx, aid, "red", &MemoryFilter{Source: "slack"})
+	s.Equal(404, err.(WrapError).Code())
+
+	_, err = s.memories.List(ctx, aid, primitive.NilObjectID, &MemoryFilter{Metadata: []MetadataCondition{{Key: "$where"}}})
+	s.Equal(400, err.(WrapError).Code())
+}
+
+func (s *InMemorySuite) TestRetrieval() {
+	ctx := context.TODO()
+	aid := s.agent.ID
+	lastMonth := time.Now().Add(-30 * 24 * time.Hour)
+
+	ids, err := s.memories.AddMany(ctx, aid, []*Memory{
+		{Content: "red", Created: lastMonth},
+		{Content: "pink", Importance: 1},
+	})
+	s.NoError(err)
+
+	// default weights, the recent and important one wins over the most relevant one
+	mems, scores, err := s.memories.Search(ctx, aid, "red", nil)
+	s.NoError(err)
+	s.Equal("pink", mems[0].Content)
+	s.Equal(float32(1), scores[0].Importance)
+	s.Equal(float32(1), scores[1].Relevance)
+	s.Less(scores[1].Recency, float32(0.01))
+
+	// the returned memories are accessed now
+	mem, err := s.memories.GetOne(ctx, aid, ids[0])
+	s.NoError(err)
+	s.WithinDuration(time.Now(), mem.Accessed, time.Second)
+
+	// relevance only
+	err = s.agents.Update(ctx, &Agent{ID: aid, Name: "aspirin", Retrieval: &Retrieval{Relevance: 1, HalfLifeHours: 1}})
+	s.NoError(err)
+	mems, scores, err = s.memories.Search(ctx, aid, "red", nil)
+	s.NoError(err)
+	s.Equal("red", mems[0].Content)
+	s.Equal(float32(1), scores[0].Score)
+
+	err = s.agents.Update(ctx, &Agent{ID: aid, Retrieval: &Retrieval{}})
+	s.Equal(400, err.(WrapError).Code())
+
+	_, err = s.memories.AddOne(ctx, aid, &Memory{Content: "blue", Importance: 2})
+	s.Equal(400, err.(WrapError).Code())
+}
+
+func (s *InMemorySuite) TestRateImportance() {
+	ctx := context.TODO()
+	llm := NewLocal(8)
+	llm.Script(ChatMessage{Content: "1: 9\n2: 2"})
+	s.memories.llm = llm
+	s.memories.RateImportance = true
+
+	ids, err := s.memories.AddMany(ctx, s.agent.ID, []*Memory{
+		{Content: "My house burned down"},
+		{Content: "I ate breakfast"},
+		{Content: "I got a cat", Importance: 0.5},
+	})
+	s.NoError(err)
+	mems, err := s.memories.GetMany(ctx, s.agent.ID, ids)
+	s.NoError(err)
+	s.Equal(0.9, mems[0].Importance)
+	s.Equal(0.2, mems[1].Importance)
+	s.Equal(0.5, mems[2].Importance)
+
+	// the memory is added unrated if the chat fails
+	id, err := s.memories.AddOne(ctx, s.agent.ID, &Memory{Content: "hello"})
+	s.NoError(err)
+	mem, err := s.memories.GetOne(ctx, s.agent.ID, id)
+	s.NoError(err)
+	s.Zero(mem.Importance)
+}
+
+func (s *InMemorySuite) TestArchiveMemories() {
+	ctx := context.TODO()
+	ids, err := s.memories.AddMany(ctx, s.agent.ID, []*Memory{{Content: "red"}, {Content: "blue"}})
+	s.NoError(err)
+
+	s.NoError(s.memories.Archive(ctx, s.agent.ID, ids[:1]))
+	err = s.memories.Archive(ctx, s.agent.ID, ids[:1])
+	s.Equal(400, err.(WrapError).Code())
+	err = s.memories.Archive(ctx, s.agent.ID, []primitive.ObjectID{primitive.NewObjectID()})
+	s.Equal(400, err.(WrapError).Code())
+
+	// archived memories are not searched or listed, but can be read
+	mems, _, err := s.memories.Search(ctx, s.agent.ID, "red", nil)
+	s.NoError(err)
+	s.Len(mems, 1)
+	s.Equal("blue", mems[0].Content)
+
+	mems, err = s.memories.List(ctx, s.agent.ID, primitive.NilObjectID, nil)
+	s.NoError(err)
+	s.Len(mems, 1)
+	mems, err = s.memories.List(ctx, s.agent.ID, primitive.NilObjectID, &MemoryFilter{IncludeArchived: true})
+	s.NoError(err)
+	s.Len(mems, 2)
+
+	mem, err := s.memories.GetOne(ctx, s.agent.ID, ids[0])
+	s.NoError(err)
+	s.NotNil(mem.Archived)
+}
+
+func (s *InMemorySuite) TestListMemories() {
+	ctx := context.TODO()
+	s.memories.ListLimit = 3
+
+	var memories []*Memory
+	for i := range [5]int{} {
+		memories = append(memories, &Memory{Content: fmt.Sprintf("memory %d", i)})
+	}
+	_, err := s.memories.AddMany(ctx, s.agent.ID, memories)
+	s.NoError(err)
+
+	mems, err := s.memories.List(ctx, s.agent.ID, primitive.NilObjectID, nil)
+	s.NoError(err)
+	s.Len(mems, 3)
+	s.Equal("memory 4", mems[0].Content)
+
+	mems, err = s.memories.List(ctx, s.agent.ID, mems[2].ID, nil)
+	s.NoError(err)
+	s.Len(mems, 2)
+}
+
+func (s *InMemorySuite) TestSessions() {
+	ctx := context.TODO()
+	var _ SessionModel = (*InMemorySessions)(nil)
+	sessions := s.agents.Sessions()
+
+	sid, err := sessions.Add(ctx, s.agent.ID, &Session{Title: "hello"})
+	s.NoError(err)
+	_, err = sessions.Add(ctx, primitive.NewObjectID(), &Session{})
+	s.Equal(404, err.(WrapError).Code())
+
+	_, err = sessions.Append(ctx, s.agent.ID, sid, []ChatMessage{
+		{Role: "user", Content: "What is my favorite color?"},
+		{Role: "assistant", Content: "Red."},
+		{Role: "user", Content: "And yours?"},
+	})
+	s.NoError(err)
+	_, err = sessions.Append(ctx, s.agent.ID, sid, []ChatMessage{{Role: "user"}})
+	s.Equal(400, err.(WrapError).Code())
+
+	session, err := sessions.Get(ctx, s.agent.ID, sid)
+	s.NoError(err)
+	s.Equal(3, session.Messages)
+
+	messages, err := sessions.Messages(ctx, s.agent.ID, sid, &Window{Last: 2})
+	s.NoError(err)
+	s.Len(messages, 2)
+	s.Equal("Red.", messages[0].Content)
+	messages, err = sessions.Messages(ctx, s.agent.ID, sid, &Window{Tokens: 12})
+	s.NoError(err)
+	s.Len(messages, 2)
+
+	list, err := sessions.List(ctx, s.agent.ID, primitive.NilObjectID)
+	s.NoError(err)
+	s.Len(list, 1)
+
+	// sessions are purged with their agent
+	s.NoError(s.agents.Purge(ctx, s.agent.ID))
+	_, err = sessions.Messages(ctx, s.agent.ID, sid, nil)
+	s.Equal(404, err.(WrapError).Code())
+}
+
+func TestInMemorySuite(t *testing.T) {
+	suite.Run(t, new(InMemorySuite))
+}
@@ -1,6 +1,8 @@
 package memo
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/net/context"
@@ -10,15 +12,35 @@ type AgentModel interface {
 	// Add agent and return inserted id
 	Add(ctx context.Context, agent *Agent) (primitive.ObjectID, error)
 
-	// Delete agent by id
+	// Delete agent by id, it moves the agent into the trash if the trash is enabled
 	Delete(ctx context.Context, id primitive.ObjectID) error
 
+	// Restore agent from the trash
+	Restore(ctx context.Context, id primitive.ObjectID) error
+
+	// Purge agent by id with all its memories, trashed or not
+	Purge(ctx context.Context, id primitive.ObjectID) error
+
+	// Purge agents which have been in the trash longer than the retention
+	PurgeExpired(ctx context.Context) (int, error)
+
 	// Update agent
 	Update(ctx context.Context, agent *Agent) error
 
+	// MarkReflected sets the agent's reflected time and resets its unreflected importance only,
+	// so the edits made while it reflects are kept
+	MarkReflected(ctx context.Context, id primitive.ObjectID, at time.Time) error
+
+	// AddImportance adds the importance of the remembered memories to the agent's unreflected importance,
+	// and returns the sum
+	AddImportance(ctx context.Context, id primitive.ObjectID, importance float64) (float64, error)
+
 	// List and offset agent's id
 	List(ctx context.Context, offset primitive.ObjectID) ([]*Agent, error)
 
+	// List and offset agents in the trash
+	ListTrash(ctx context.Context, offset primitive.ObjectID) ([]*Agent, error)
+
 	// Get agent by id
 	Get(ctx context.Context, id primitive.ObjectID) (*Agent, error)
 }
@@ -28,6 +50,8 @@ type MemoryModel interface {
 	AddOne(ctx context.Context, agent primitive.ObjectID, memory *Memory) (primitive.ObjectID, error)
 	// Add memories and return inserted ids
 	AddMany(ctx context.Context, agent primitive.ObjectID, memories []*Memory) ([]primitive.ObjectID, error)
+	// Add memories whose near-duplicates are handled by dedup, and return what happened to each of them
+	AddManyDedup(ctx context.Context, agent primitive.ObjectID, memories []*Memory, dedup *Dedup) ([]*Insertion, error)
 
 	// Update memory
 	GetOne(ctx context.Context, aid primitive.ObjectID, mid primitive.ObjectID) (*Memory, error)
@@ -44,14 +68,63 @@ type MemoryModel interface {
 	// Delete memories by ids
 	DeleteMany(ctx context.Context, aid primitive.ObjectID, ids []primitive.ObjectID) error
 
+	// Archive memories by ids, their vectors are deleted but the memories are kept
+	Archive(ctx context.Context, aid primitive.ObjectID, ids []primitive.ObjectID) error
+
 	// ListMemories and offset memory's id
 	// aid is agent's id which memories belong to
 	// offset is the last memory's id
-	List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID) ([]*Memory, error)
+	// filter narrows the memories, it can be nil
+	List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID, filter *MemoryFilter) ([]*Memory, error)
+
+	// Search with query string, and return related memories and their retrieval scores
+	// aid is agent's id which memories belong to, its Retrieval weighs the scores
+	// filter is applied before ranking, it can be nil
+	// the returned memories' accessed time is updated
+	Search(ctx context.Context, aid primitive.ObjectID, query string, filter *MemoryFilter) ([]*Memory, []*Score, error)
+}
 
-	// Search with query string, and return related memories and scores
-	// aid is agent's id which memories belong to
-	Search(ctx context.Context, aid primitive.ObjectID, query string) ([]*Memory, []float32, error)
+type SessionModel interface {
+	// Add session to the agent and return inserted id
+	Add(ctx context.Context, aid primitive.ObjectID, session *Session) (primitive.ObjectID, error)
+
+	// Get agent's session by id
+	Get(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID) (*Session, error)
+
+	// Update session's title
+	Update(ctx context.Context, aid primitive.ObjectID, session *Session) error
+
+	// Delete session with its messages
+	Delete(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID) error
+
+	// List and offset agent's sessions
+	List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID) ([]*Session, error)
+
+	// Append messages to the session in order
+	Append(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID, messages []ChatMessage) ([]*SessionMessage, error)
+
+	// Messages lists the latest messages of the session in the window, from oldest to newest
+	// window can be nil for all the messages
+	Messages(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID, window *Window) ([]*SessionMessage, error)
+}
+
+// OutboxApplier is implemented by memory models which queue failed compensations
+type OutboxApplier interface {
+	// ApplyOutbox retries the queued compensations and returns how many were applied
+	ApplyOutbox(ctx context.Context) (int, error)
+}
+
+// Reconciler is implemented by memory models which keep documents and vectors in separate stores
+type Reconciler interface {
+	// Reconcile finds the drift of the agent's memories between the stores, and repairs it by mode
+	Reconcile(ctx context.Context, aid primitive.ObjectID, mode RepairMode) (*Drift, error)
+}
+
+// Reembedder is implemented by memory models which can move agents' memories to another embedding model
+type Reembedder interface {
+	// Reembed re-embeds the agent's memories with llm, which makes the vectors of spec, then switches the agent to spec,
+	// an interrupted job is resumed, progress is called after each batch
+	Reembed(ctx context.Context, aid primitive.ObjectID, llm LLM, spec *EmbeddingSpec, batchSize int, progress func(*Reembedding)) (*Reembedding, error)
 }
 
 // AgentController is a controller for handling agent requests
@@ -65,6 +138,12 @@ type AgentController interface {
 	GetAgent(c *gin.Context)
 
 	ListAgents(c *gin.Context)
+
+	ListTrash(c *gin.Context)
+
+	RestoreAgent(c *gin.Context)
+
+	PurgeAgent(c *gin.Context)
 }
 
 // MemoryController is a controller for handling memory requests
@@ -83,4 +162,7 @@ type MemoryController interface {
 type LLM interface {
 	Embedding(ctx context.Context, contents []string) ([]vectors, error)
 	Chat(ctx context.Context, messages []ChatMessage) (ChatMessage, error)
+	// ChatStream calls onDelta with each piece of the reply as it arrives, and returns the whole reply,
+	// it stops when onDelta returns an error or ctx is done
+	ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(delta string) error) (ChatMessage, *Usage, error)
 }
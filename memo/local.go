@@ -0,0 +1,134 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Local which implemented LLM interface without any network calls.
+// Its embeddings are hashed word and character trigram features, so the same text always
+// gets the same vector and texts sharing words or word pieces land close together.
+// Its chat answers are scripted.
+type Local struct {
+	dimension int
+
+	mu        sync.Mutex
+	responses []ChatMessage
+
+	// ChatFunc answers the chat when no scripted response is left, it is optional
+	ChatFunc func(ctx context.Context, messages []ChatMessage) (ChatMessage, error)
+}
+
+// NewLocal creates a Local llm which generates embeddings of the dimension
+func NewLocal(dimension int) *Local {
+	return &Local{dimension: dimension}
+}
+
+// Script appends canned responses, Chat returns them one by one in order
+func (l *Local) Script(responses ...ChatMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.responses = append(l.responses, responses...)
+}
+
+// Embedding generates normalized hashed n-gram vectors
+func (l *Local) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	if l.dimension <= 0 {
+		return nil, NewWrapError(500, fmt.Errorf("invalid local embedding dimension: %d", l.dimension), "")
+	}
+
+	ems := make([]vectors, len(contents))
+	for i, c := range contents {
+		ems[i] = l.embed(c)
+	}
+	return ems, nil
+}
+
+// Chat returns the next scripted response, or the ChatFunc's answer if nothing is scripted
+func (l *Local) Chat(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+	l.mu.Lock()
+	if len(l.responses) > 0 {
+		res := l.responses[0]
+		l.responses = l.responses[1:]
+		l.mu.Unlock()
+		if res.Role == "" {
+			res.Role = "assistant"
+		}
+		return res, nil
+	}
+	l.mu.Unlock()
+
+	if l.ChatFunc != nil {
+		return l.ChatFunc(ctx, messages)
+	}
+	return ChatMessage{}, NewWrapError(500, fmt.Errorf("local llm has no scripted chat response"), "")
+}
+
+// ChatStream answers like Chat, and streams the answer word by word
+func (l *Local) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(delta string) error) (ChatMessage, *Usage, error) {
+	reply, err := l.Chat(ctx, messages)
+	if err != nil {
+		return ChatMessage{}, nil, err
+	}
+
+	pieces := strings.SplitAfter(reply.Content, " ")
+	for _, piece := range pieces {
+		if err := ctx.Err(); err != nil {
+			return ChatMessage{}, nil, err
+		}
+		if piece == "" {
+			continue
+		}
+		if err := onDelta(piece); err != nil {
+			return ChatMessage{}, nil, err
+		}
+	}
+	return reply, estimateUsage(messages, reply, 0), nil
+}
+
+func (l *Local) embed(content string) vectors {
+	v := make(vectors, l.dimension)
+	words := strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	for _, w := range words {
+		l.add(v, "w:"+w, 1)
+
+		// character trigrams with word boundaries, so "game" and "games" share most features
+		rs := []rune("^" + w + "$")
+		for i := 0; i+3 <= len(rs); i++ {
+			l.add(v, "t:"+string(rs[i:i+3]), 0.5)
+		}
+	}
+
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	if norm > 0 {
+		n := float32(math.Sqrt(norm))
+		for i := range v {
+			v[i] /= n
+		}
+	}
+	return v
+}
+
+// add the feature to the vector, the hash picks both the index and the sign
+func (l *Local) add(v vectors, feature string, weight float32) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+
+	idx := int(sum % uint64(l.dimension))
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	v[idx] += weight
+}
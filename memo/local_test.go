@@ -0,0 +1,83 @@
+package memo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalEmbedding(t *testing.T) {
+	var _ LLM = (*Local)(nil)
+
+	ctx := context.TODO()
+	local := NewLocal(256)
+	ems, err := local.Embedding(ctx, []string{"I like to play video games", "I like to play video games", "favorite video game", "the weather is cold", ""})
+	assert.NoError(t, err)
+	assert.Len(t, ems, 5)
+	assert.Len(t, ems[0], 256)
+
+	// stable and normalized
+	assert.Equal(t, ems[0], ems[1])
+	assert.InDelta(t, 1, cosine(ems[0], ems[1]), 1e-5)
+
+	// similar strings land closer
+	assert.Greater(t, cosine(ems[0], ems[2]), cosine(ems[0], ems[3]))
+
+	// empty content has zero vector
+	assert.Equal(t, float32(0), cosine(ems[0], ems[4]))
+
+	_, err = NewLocal(0).Embedding(ctx, []string{"hello"})
+	assert.Error(t, err)
+}
+
+func TestLocalChat(t *testing.T) {
+	ctx := context.TODO()
+	local := NewLocal(8)
+
+	_, err := local.Chat(ctx, []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.Error(t, err)
+
+	local.Script(ChatMessage{Content: "hi"}, ChatMessage{Role: "assistant", Content: "bye"})
+	res, err := local.Chat(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, ChatMessage{Role: "assistant", Content: "hi"}, res)
+	res, _ = local.Chat(ctx, nil)
+	assert.Equal(t, "bye", res.Content)
+
+	local.ChatFunc = func(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+		return ChatMessage{Role: "assistant", Content: "echo: " + messages[len(messages)-1].Content}, nil
+	}
+	res, err = local.Chat(ctx, []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: hello", res.Content)
+}
+
+func TestLocalSearchRanking(t *testing.T) {
+	ctx := context.TODO()
+	agents, memories := NewInMemory(NewLocal(512))
+	memories.SearchLimit = 3
+
+	agent := &Agent{Name: "aspirin"}
+	_, err := agents.Add(ctx, agent)
+	assert.NoError(t, err)
+
+	_, err = memories.AddMany(ctx, agent.ID, []*Memory{
+		{Content: "Hey, I am Aspirin."},
+		{Content: "My father is a teacher."},
+		{Content: "My favorite color is red."},
+		{Content: "My favorite food is pizza."},
+		{Content: "My favorite video game is Last of Us."},
+	})
+	assert.NoError(t, err)
+
+	mems, scores, err := memories.Search(ctx, agent.ID, "which video games do you play?", nil)
+	assert.NoError(t, err)
+	assert.Len(t, mems, 3)
+	assert.Len(t, scores, 3)
+	assert.Contains(t, mems[0].Content, "Last of Us")
+
+	mems, _, err = memories.Search(ctx, agent.ID, "teachers", nil)
+	assert.NoError(t, err)
+	assert.Contains(t, mems[0].Content, "teacher")
+}
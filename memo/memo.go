@@ -2,10 +2,13 @@ package memo
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	pb "github.com/qdrant/go-client/qdrant"
+	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -17,6 +20,12 @@ import (
 const AGENTS_COLLECTION = "agents"
 const MEMORIES_COLLECTION = "memories"
 
+// KIND_REFLECTION is the kind of memories synthesised by Reflect, observed memories have no kind
+const KIND_REFLECTION = "reflection"
+
+// KIND_SUMMARY is the kind of memories which summarise archived memories, see Compact
+const KIND_SUMMARY = "summary"
+
 type vectors []float32
 
 type Memory struct {
@@ -24,93 +33,298 @@ type Memory struct {
 	AID primitive.ObjectID `bson:"aid" json:"aid"` // agent's id
 	PID string             `bson:"pid" json:"pid"` // memory's point id
 
-	Content string    `bson:"content" json:"content"`
-	Created time.Time `bson:"created_at" json:"created_at"`
+	Content  string     `bson:"content" json:"content"`
+	Created  time.Time  `bson:"created_at" json:"created_at"`
+	Accessed time.Time  `bson:"accessed_at" json:"accessed_at"`                   // last time the memory was searched, or created
+	Updated  *time.Time `bson:"updated_at,omitempty" json:"updated_at,omitempty"` // last time the memory was updated or archived
+
+	Importance float64 `bson:"importance" json:"importance"` // in [0, 1]
+
+	Kind     string               `bson:"kind,omitempty" json:"kind,omitempty"`         // empty, KIND_REFLECTION or KIND_SUMMARY
+	Evidence []primitive.ObjectID `bson:"evidence,omitempty" json:"evidence,omitempty"` // memories which a reflection or a summary comes from
+
+	// how many near-duplicates were merged into the memory, and the last time one was
+	Reinforced int        `bson:"reinforced,omitempty" json:"reinforced,omitempty"`
+	Seen       *time.Time `bson:"seen_at,omitempty" json:"seen_at,omitempty"`
+
+	// archived memories have no vectors, so they are not searched, and they are not listed by default
+	Archived *time.Time `bson:"archived_at,omitempty" json:"archived_at,omitempty"`
+
+	Tags     []string               `bson:"tags,omitempty" json:"tags,omitempty"`
+	Source   string                 `bson:"source,omitempty" json:"source,omitempty"`     // where the memory came from, e.g. a channel's name
+	Metadata map[string]interface{} `bson:"metadata,omitempty" json:"metadata,omitempty"` // free-form values, keys can't contain "." or "$"
 }
 
 type Agent struct {
 	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
 	Name    string             `bson:"name" json:"name"`
 	Created time.Time          `bson:"created_at,omitempty" json:"created_at,omitempty"`
-}
+	Deleted *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"` // set when the agent is in the trash
 
-type Config struct {
-	OpenAIAPIKey string `toml:"openai_api_key"`
+	Description  string         `bson:"description,omitempty" json:"description,omitempty"`
+	Persona      []string       `bson:"persona,omitempty" json:"persona,omitempty"`             // persona traits
+	SystemPrompt string         `bson:"system_prompt,omitempty" json:"system_prompt,omitempty"` // "You are <name>." by default
+	LLM          *ModelSettings `bson:"llm,omitempty" json:"llm,omitempty"`                     // nil for llm's defaults
 
-	MongoUri  string `toml:"mongo_uri"`
-	MongoDb   string `toml:"mongo_db"`
-	QdrantUri string `toml:"qdrant_uri"`
+	Retrieval *Retrieval `bson:"retrieval,omitempty" json:"retrieval,omitempty"`       // nil for DefaultRetrieval
+	Reflected *time.Time `bson:"reflected_at,omitempty" json:"reflected_at,omitempty"` // last time the agent reflected
+	// importance of the memories remembered since the last reflection, see Memo.Remember
+	Unreflected float64 `bson:"unreflected,omitempty" json:"unreflected,omitempty"`
 
-	AgentListLimit    int `toml:"agent_search_limit"`
-	MemorySearchLimit int `toml:"memory_search_limit"`
-	MemoryListLimit   int `toml:"memory_list_limit"`
+	Embedding   *EmbeddingSpec `bson:"embedding,omitempty" json:"embedding,omitempty"`     // recorded when the agent is created
+	Reembedding *Reembedding   `bson:"reembedding,omitempty" json:"reembedding,omitempty"` // the running re-embedding job
+	// the qdrant collection of the agent once it is re-embedded, if it was created before aliases,
+	// the others are found by the agents' ids, their aliases. see Memories.Reembed
+	Collection string `bson:"collection,omitempty" json:"-"`
 }
 
 type Memo struct {
 	Config *Config
 
-	Agents   AgentModel  // agents model
-	Memories MemoryModel // memories model
-	LLM      LLM         // llm for embedding and chatting
+	Agents   AgentModel   // agents model
+	Memories MemoryModel  // memories model
+	Sessions SessionModel // sessions model, nil if sessions are not supported
+	LLM      LLM          // llm for embedding and chatting
 
 	Logger *zap.SugaredLogger
+
+	mongo  *mongo.Client    // nil if both models are injected
+	qdrant *grpc.ClientConn // nil if both models are injected
+	redis  *redis.Client    // nil if the embedding cache isn't redis
+
+	reflecting  sync.Map       // ids of agents which are reflecting in background
+	reflections sync.WaitGroup // reflections running in background, Close waits for them
 }
 
-// NewAgents creates the default Agents which implements the AgentModel interface.
-// config_path is the path to the config file.
-func FromConfig(config_path string) *Memo {
-	var conf Config = Config{
-		MongoUri:          "mongodb://localhost:27017",
-		MongoDb:           "memo",
-		QdrantUri:         "localhost:6334",
-		AgentListLimit:    15,
-		MemoryListLimit:   15,
-		MemorySearchLimit: 5, // top_k
+// config returns the config, or the default one if the Memo is not created by New
+func (m *Memo) config() *Config {
+	if m.Config == nil {
+		return DefaultConfig()
 	}
+	return m.Config
+}
 
-	_, err := toml.DecodeFile(config_path, &conf)
+// Option customizes the Memo created by New
+type Option func(*Memo)
+
+// WithAgentModel injects the agent model, then New won't create the default Agents
+func WithAgentModel(agents AgentModel) Option {
+	return func(m *Memo) { m.Agents = agents }
+}
+
+// WithMemoryModel injects the memory model, then New won't create the default Memories
+func WithMemoryModel(memories MemoryModel) Option {
+	return func(m *Memo) { m.Memories = memories }
+}
+
+// WithSessionModel injects the session model, then New won't create the default Sessions
+func WithSessionModel(sessions SessionModel) Option {
+	return func(m *Memo) { m.Sessions = sessions }
+}
+
+// WithLLM injects the llm, then New won't create the llm of the config
+func WithLLM(llm LLM) Option {
+	return func(m *Memo) { m.LLM = llm }
+}
+
+// WithLogger injects the logger, otherwise a zap production logger will be used
+func WithLogger(logger *zap.Logger) Option {
+	return func(m *Memo) { m.Logger = logger.Sugar() }
+}
+
+// FromConfig loads the config file, applies MEMO_* environment variables and creates the Memo with it.
+// config_path is the path to the config file.
+func FromConfig(config_path string, opts ...Option) (*Memo, error) {
+	conf, err := LoadConfig(config_path, nil)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return New(conf, opts...)
+}
+
+// New creates the Memo, the models, llm and logger which are not injected by options
+// will be created from the config.
+func New(conf *Config, opts ...Option) (*Memo, error) {
+	m := &Memo{Config: conf}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	// logger, it is created first, so nothing needs closing if it fails
+	if m.Logger == nil {
+		logger, err := zap.NewProduction()
+		if err != nil {
+			return nil, err
+		}
+		m.Logger = logger.Sugar()
+	}
+
+	// LLM Client, its embeddings are cached, and the agents recorded with other embedding models are embedded
+	// by their own models. an injected llm embeds for all agents
+	var embedders *Embedders
+	if m.LLM == nil {
+		llm, err := NewLLM(conf)
+		if err != nil {
+			return nil, err
+		}
+		var cache EmbeddingCache
+		switch conf.EmbeddingCache {
+		case CACHE_LRU:
+			cache = NewLRUEmbeddingCache(conf.EmbeddingCacheSize)
+		case CACHE_REDIS:
+			opts, err := redis.ParseURL(conf.RedisUri)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redis_uri: %w", err)
+			}
+			m.redis = redis.NewClient(opts)
+			cache = NewRedisEmbeddingCache(m.redis, conf.EmbeddingCacheTTL)
+		}
+		if cache != nil {
+			llm = NewCachedLLM(llm, conf.EmbeddingSpec(), cache)
+		}
+		m.LLM = llm
+		embedders = NewEmbedders(conf, llm, cache)
+	}
+
+	// in-process storage, only the models which are not injected will be replaced
+	if conf.Storage == STORAGE_MEMORY {
+		agents, memories := NewInMemory(m.LLM)
+		agents.ListLimit = int64(conf.AgentListLimit)
+		agents.TrashRetention = conf.AgentTrashRetention
+		agents.Embedding = conf.EmbeddingSpec()
+		memories.ListLimit = int64(conf.MemoryListLimit)
+		memories.SearchLimit = int64(conf.MemorySearchLimit)
+		memories.RateImportance = conf.RateImportance
+		memories.ImportanceBatchSize = conf.ImportanceBatchSize
+		memories.Embedding = conf.EmbeddingSpec()
+		memories.Embedders = embedders
+		memories.Logger = m.Logger
+		sessions := agents.Sessions()
+		sessions.ListLimit = int64(conf.SessionListLimit)
+		if m.Agents == nil {
+			m.Agents = agents
+		}
+		if m.Memories == nil {
+			m.Memories = memories
+		}
+		if m.Sessions == nil {
+			m.Sessions = sessions
+		}
 	}
 
-	if conf.OpenAIAPIKey == "" {
-		panic("OpenAIAPIKey is empty")
+	// all models are ready, no need to connect
+	if m.Agents != nil && m.Memories != nil {
+		return m, nil
+	}
+
+	// the clients connect lazily, they are checked to fail here rather than at the first request
+	ctx, cancel := context.WithTimeout(context.TODO(), conf.ConnectTimeout)
+	defer cancel()
+	fail := func(err error) (*Memo, error) {
+		_ = m.Close(context.TODO())
+		return nil, err
 	}
 
-	ctx := context.TODO()
 	// mongodb
 	mc, err := mongo.Connect(ctx, options.Client().ApplyURI(conf.MongoUri))
 	if err != nil {
-		panic(err)
+		return fail(fmt.Errorf("can't connect to mongodb: %w", err))
+	}
+	m.mongo = mc
+	if err := mc.Ping(ctx, nil); err != nil {
+		return fail(fmt.Errorf("can't connect to mongodb: %w", err))
 	}
 
 	// qdrant
-	qc, err := grpc.Dial(conf.QdrantUri, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	qc, err := grpc.DialContext(ctx, conf.QdrantUri, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 	if err != nil {
-		panic(err)
+		return fail(fmt.Errorf("can't connect to qdrant: %w", err))
 	}
+	m.qdrant = qc
 
-	// LLM Client
-	llm := NewOpenAI(conf.OpenAIAPIKey)
-
-	// logger
-	logger, _ := zap.NewProduction()
+	if m.Agents == nil {
+		m.Agents = &Agents{
+			mongo:          mc.Database(conf.MongoDb).Collection(AGENTS_COLLECTION),
+			memories:       mc.Database(conf.MongoDb).Collection(MEMORIES_COLLECTION),
+			sessions:       mc.Database(conf.MongoDb).Collection(SESSIONS_COLLECTION),
+			messages:       mc.Database(conf.MongoDb).Collection(SESSION_MESSAGES_COLLECTION),
+			qdrant:         pb.NewCollectionsClient(qc),
+			points:         pb.NewPointsClient(qc),
+			ListLimit:      int64(conf.AgentListLimit),
+			TrashRetention: conf.AgentTrashRetention,
+			Embedding:      conf.EmbeddingSpec(),
+			PayloadIndexes: conf.PayloadIndexes(),
+		}
+	}
 
-	return &Memo{
-		Agents: &Agents{
-			mongo:     mc.Database(conf.MongoDb).Collection(AGENTS_COLLECTION),
-			qdrant:    pb.NewCollectionsClient(qc),
-			ListLimit: int64(conf.AgentListLimit),
-		},
-		Memories: &Memories{
+	if m.Memories == nil {
+		m.Memories = &Memories{
 			mongo:       mc.Database(conf.MongoDb).Collection(MEMORIES_COLLECTION),
+			agents:      mc.Database(conf.MongoDb).Collection(AGENTS_COLLECTION),
 			qdrant:      pb.NewPointsClient(qc),
-			llm:         llm,
+			collections: pb.NewCollectionsClient(qc),
+			outbox:      mc.Database(conf.MongoDb).Collection(OUTBOX_COLLECTION),
+			llm:         m.LLM,
+			Logger:      m.Logger,
 			SearchLimit: int64(conf.MemorySearchLimit),
 			ListLimit:   int64(conf.MemoryListLimit),
-		},
 
-		Config: &conf,
-		Logger: logger.Sugar(),
+			RateImportance:      conf.RateImportance,
+			ImportanceBatchSize: conf.ImportanceBatchSize,
+			Embedding:           conf.EmbeddingSpec(),
+			Embedders:           embedders,
+			PayloadIndexes:      conf.PayloadIndexes(),
+		}
+	}
+
+	if m.Sessions == nil {
+		sessions := &Sessions{
+			mongo:     mc.Database(conf.MongoDb).Collection(SESSIONS_COLLECTION),
+			messages:  mc.Database(conf.MongoDb).Collection(SESSION_MESSAGES_COLLECTION),
+			agents:    mc.Database(conf.MongoDb).Collection(AGENTS_COLLECTION),
+			ListLimit: int64(conf.SessionListLimit),
+		}
+		if err := sessions.EnsureIndexes(ctx); err != nil {
+			return fail(fmt.Errorf("can't create the session indexes: %w", err))
+		}
+		m.Sessions = sessions
+	}
+
+	return m, nil
+}
+
+// Close waits for the reflections running in background until ctx is done, then disconnects the mongodb client,
+// the qdrant connection and the redis client if they were created by New
+func (m *Memo) Close(ctx context.Context) error {
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		m.reflections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("reflections are still running: %w", ctx.Err()))
+	}
+
+	if m.mongo != nil {
+		if err := m.mongo.Disconnect(ctx); err != nil {
+			errs = append(errs, err)
+		}
+		m.mongo = nil
+	}
+	if m.qdrant != nil {
+		if err := m.qdrant.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		m.qdrant = nil
+	}
+	if m.redis != nil {
+		if err := m.redis.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		m.redis = nil
 	}
+	return errors.Join(errs...)
 }
@@ -3,15 +3,106 @@ package memo
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+type mockLLM struct {
+	Error error
+}
+
+func (ml *mockLLM) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	ems := make([]vectors, len(contents))
+	for i := range contents {
+		ems[i] = vectors{1, 0, 0}
+	}
+	return ems, ml.Error
+}
+
+func (ml *mockLLM) Chat(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+	return ChatMessage{Role: "assistant", Content: "hello"}, ml.Error
+}
+
+func (ml *mockLLM) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(delta string) error) (ChatMessage, *Usage, error) {
+	return ChatMessage{Role: "assistant", Content: "hello"}, nil, ml.Error
+}
+
+// newTestMemo returns a memo over the in-memory stores and a local llm, with the agent added
+func newTestMemo(t *testing.T, agent *Agent) (*Memo, *Local) {
+	llm := NewLocal(64)
+	agents, memories := NewInMemory(llm)
+	memories.ListLimit = 2 // reflection and compaction read memories page by page
+	memo := &Memo{Config: DefaultConfig(), Agents: agents, Memories: memories, Sessions: agents.Sessions(), LLM: llm}
+
+	_, err := agents.Add(context.TODO(), agent)
+	require.NoError(t, err)
+	return memo, llm
+}
+
 func TestMemoFromConfig(t *testing.T) {
-	memo := FromConfig("../.config.toml")
+	memo, err := FromConfig("../.config.toml")
+	require.NoError(t, err)
 	ctx := context.TODO()
+	defer memo.Close(ctx)
+
 	id, err := memo.Agents.Add(ctx, &Agent{Name: "aspirin2d"})
 	assert.NoError(t, err)
 	err = memo.Agents.Delete(ctx, id)
 	assert.NoError(t, err)
 }
+
+func TestMemoNew(t *testing.T) {
+	ctx := context.TODO()
+
+	// no llm injected and no openai key
+	_, err := New(DefaultConfig())
+	assert.Error(t, err)
+
+	// everything injected, no connection will be made
+	memo, err := New(DefaultConfig(), WithAgentModel(&mockAgentModel{}), WithMemoryModel(&mockMemoryModel{}), WithLLM(&mockLLM{}))
+	assert.NoError(t, err)
+	assert.NotNil(t, memo.Logger)
+	assert.Nil(t, memo.mongo)
+	assert.Nil(t, memo.qdrant)
+	assert.NoError(t, memo.Close(ctx))
+
+	// in-process storage
+	conf := DefaultConfig()
+	conf.Storage = STORAGE_MEMORY
+	memo, err = New(conf, WithLLM(&mockLLM{}))
+	assert.NoError(t, err)
+	assert.IsType(t, &InMemoryAgents{}, memo.Agents)
+	assert.IsType(t, &InMemoryMemories{}, memo.Memories)
+	assert.Nil(t, memo.mongo)
+	assert.Nil(t, memo.Memories.(*InMemoryMemories).Embedders) // the injected llm embeds for all agents
+
+	// local llm needs no openai key, its embeddings are cached
+	conf.LLM = LLM_LOCAL
+	memo, err = New(conf)
+	assert.NoError(t, err)
+	assert.IsType(t, &Local{}, memo.LLM.(*CachedLLM).llm)
+	assert.Equal(t, &CacheStats{}, memo.Stats().EmbeddingCache)
+	assert.Same(t, memo.LLM, memo.Memories.(*InMemoryMemories).Embedders.llm)
+
+	conf.EmbeddingCache = CACHE_OFF
+	memo, err = New(conf)
+	assert.NoError(t, err)
+	assert.IsType(t, &Local{}, memo.LLM)
+	assert.Nil(t, memo.Stats().EmbeddingCache)
+
+	conf.LLM = "unknown"
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	// unreachable storage fails to create
+	conf = DefaultConfig()
+	conf.LLM, conf.MongoUri, conf.ConnectTimeout = LLM_LOCAL, "mongodb://127.0.0.1:1", 200*time.Millisecond
+	_, err = New(conf)
+	assert.ErrorContains(t, err, "can't connect to mongodb")
+
+	// missing config file
+	_, err = FromConfig("./not-exists.toml")
+	assert.Error(t, err)
+}
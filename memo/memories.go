@@ -3,6 +3,7 @@ package memo
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	pb "github.com/qdrant/go-client/qdrant"
@@ -10,20 +11,43 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Memories is a model which implements MemoryModel interface
 // mongo is a mongo collection of memories
+// agents is a mongo collection of agents, for their retrieval settings
 // qdrant is a qdrant points of memories
-// openai is an openai client
+// collections is a qdrant collections client, it is used by Reconcile only
+// outbox is a mongo collection of queued compensations, it is optional
+// llm is used for embeddings
+// Logger logs the problems which don't fail a call, it is optional
 type Memories struct {
-	mongo  *mongo.Collection
-	qdrant pb.PointsClient
+	mongo       *mongo.Collection
+	agents      *mongo.Collection
+	qdrant      pb.PointsClient
+	collections pb.CollectionsClient
+	outbox      *mongo.Collection
 
-	llm LLM
+	llm    LLM
+	Logger *zap.SugaredLogger
 
 	SearchLimit int64
 	ListLimit   int64
+
+	// Embedding is the configured embedding model, which should be the one recorded on the agents,
+	// the embeddings are not checked if it is nil
+	Embedding *EmbeddingSpec
+	// Embedders embed for each agent with its recorded model, it is optional, then llm embeds for all agents
+	Embedders *Embedders
+	// PayloadIndexes are the payload fields indexed in the agents' collections, the default ones if it is nil
+	PayloadIndexes map[string]pb.FieldType
+
+	// if RateImportance is true, llm rates the importance of added memories which have none
+	RateImportance      bool
+	ImportanceBatchSize int
 }
 
 // AddOne adds a memory to the agent
@@ -38,55 +62,147 @@ func (ms *Memories) AddOne(ctx context.Context, aid primitive.ObjectID, memory *
 
 // AddMany adds memories to the agent
 // aid is agent's id
+// embeddings are created before anything is written, if the qdrant upsert fails,
+// the inserted documents will be removed, see ErrRolledBack and ErrRepairPending
 func (ms *Memories) AddMany(ctx context.Context, aid primitive.ObjectID, memories []*Memory) ([]primitive.ObjectID, error) {
-	l := len(memories)
+	if err := ms.validate(memories); err != nil {
+		return nil, err
+	}
 
-	var docs []interface{} = make([]interface{}, l)               // mongodb documents
-	var contents []string = make([]string, l)                     // memory contents
-	var mids []primitive.ObjectID = make([]primitive.ObjectID, l) // memory objectids
-	var pids []string = make([]string, l)                         // point ids
+	if ms.RateImportance {
+		rateImportanceOrLog(ctx, ms.llm, memories, ms.ImportanceBatchSize, ms.Logger)
+	}
 
-	for idx, m := range memories {
-		docs[idx] = m
+	// create embeddings first, so nothing is written if it fails
+	ems, _, err := ms.embed(ctx, aid, contentsOf(memories))
+	if err != nil {
+		return nil, err
+	}
+	return ms.insert(ctx, aid, memories, ems)
+}
+
+// AddManyDedup adds memories to the agent like AddMany, but the near-duplicates of the agent's memories,
+// or of the memories added before them, are handled by dedup instead of being inserted
+func (ms *Memories) AddManyDedup(ctx context.Context, aid primitive.ObjectID, memories []*Memory, dedup *Dedup) ([]*Insertion, error) {
+	if err := dedup.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ms.validate(memories); err != nil {
+		return nil, err
+	}
+	ems, spec, err := ms.embed(ctx, aid, contentsOf(memories))
+	if err != nil {
+		return nil, err
+	}
+
+	nearest := make([]*neighbour, len(memories))
+	if dedup.Mode != DEDUP_OFF {
+		collection, err := ms.collectionOf(ctx, aid)
+		if err != nil {
+			return nil, err
+		}
+		threshold := spec.scoreThreshold(float32(dedup.Threshold))
+		for idx, em := range ems {
+			res, err := ms.qdrant.Search(ctx, &pb.SearchPoints{
+				CollectionName: collection,
+				Vector:         em,
+				WithPayload:    &pb.WithPayloadSelector{SelectorOptions: &pb.WithPayloadSelector_Enable{Enable: true}},
+				Limit:          1,
+				ScoreThreshold: threshold,
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(res.Result) == 0 {
+				continue
+			}
+			mid, err := primitive.ObjectIDFromHex(res.Result[0].GetPayload()[PAYLOAD_MID].GetStringValue())
+			if err != nil {
+				return nil, err
+			}
+			nearest[idx] = &neighbour{id: mid, similarity: spec.similarity(res.Result[0].Score)}
+		}
+	}
+
+	now := time.Now()
+	plan := dedup.plan(memories, ems, nearest, spec, now)
+	if len(plan.memories) > 0 {
+		if ms.RateImportance {
+			rateImportanceOrLog(ctx, ms.llm, plan.memories, ms.ImportanceBatchSize, ms.Logger)
+		}
+		if _, err := ms.insert(ctx, aid, plan.memories, plan.ems); err != nil {
+			return nil, err
+		}
+	}
+
+	for mid, n := range plan.reinforced {
+		_, err := ms.mongo.UpdateOne(ctx, bson.M{"_id": mid, "aid": aid}, bson.M{"$inc": bson.M{"reinforced": n}, "$set": bson.M{"seen_at": now}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan.done(memories), nil
+}
+
+// validate memories to add
+func (ms *Memories) validate(memories []*Memory) error {
+	for _, m := range memories {
 		// check if memory id is nil
 		if m.ID != primitive.NilObjectID {
-			return nil, NewWrapError(400, fmt.Errorf("memory id should be nil"), "")
+			return NewWrapError(400, fmt.Errorf("memory id should be nil"), "")
 		}
 
 		// check if memory aid is nil
 		if m.AID != primitive.NilObjectID {
-			return nil, NewWrapError(400, fmt.Errorf("agent id should NOT be nil"), "")
+			return NewWrapError(400, fmt.Errorf("agent id should NOT be nil"), "")
+		}
+
+		if err := validateMemoryFields(m); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
+// insert memories' documents, then upsert their points with the embeddings
+func (ms *Memories) insert(ctx context.Context, aid primitive.ObjectID, memories []*Memory, ems []vectors) ([]primitive.ObjectID, error) {
+	l := len(memories)
+
+	var docs []interface{} = make([]interface{}, l)               // mongodb documents
+	var mids []primitive.ObjectID = make([]primitive.ObjectID, l) // memory objectids
+
+	for idx, m := range memories {
 		m.ID = primitive.NewObjectID()
 		m.AID = aid
+		if m.Created.IsZero() {
+			m.Created = time.Now()
+		}
+		if m.Accessed.IsZero() {
+			m.Accessed = m.Created
+		}
 
+		docs[idx] = m
 		mids[idx] = m.ID
-		contents[idx] = m.Content
 
 		// create a reference to the point
-		pids[idx] = uuid.New().String()
-		m.PID = pids[idx]
+		m.PID = uuid.New().String()
 	}
 
 	res, err := ms.mongo.InsertMany(ctx, docs)
-	if err != nil {
-		return nil, err
+	if err == nil && len(res.InsertedIDs) != l {
+		err = fmt.Errorf("some memories not inserted: \n%v\n%v", res.InsertedIDs, mids)
 	}
-
-	if len(res.InsertedIDs) != l {
-		return nil, NewWrapError(400, fmt.Errorf("some memories not inserted: \n%v\n%v", res.InsertedIDs, mids), "")
+	if err != nil {
+		// an ordered insert may stop half way
+		return nil, ms.compensate(ctx, "add", err, &outboxTask{AID: aid, Op: OUTBOX_DELETE_DOCUMENTS, MIDs: mids})
 	}
 
-	// create embeddings
-	ems, err := ms.llm.Embedding(ctx, contents)
+	// upsert points into qdrant, a failed upsert may be written anyway, so its points are deleted too
+	err = ms.upsertPoints(ctx, aid, memories, ems)
 	if err != nil {
-		return nil, err
+		return nil, ms.compensate(ctx, "add", err, &outboxTask{AID: aid, Op: OUTBOX_DELETE_MEMORIES, MIDs: mids})
 	}
-
-	// upsert points into qdrant
-	err = ms.upsertPoints(ctx, aid, pids, mids, ems)
-	return mids, err
+	return mids, ms.markDirty(ctx, aid, mids)
 }
 
 // GetOne gets a memory by id
@@ -117,7 +233,7 @@ func (ms *Memories) GetMany(ctx context.Context, aid primitive.ObjectID, ids []p
 // DeleteOne deletes a memory by id
 func (ms *Memories) DeleteOne(ctx context.Context, aid primitive.ObjectID, mid primitive.ObjectID) error {
 	var mem Memory
-	err := ms.mongo.FindOneAndDelete(ctx, bson.M{"_id": mid, "aid": aid}).Decode(&mem)
+	err := ms.mongo.FindOne(ctx, bson.M{"_id": mid, "aid": aid}).Decode(&mem)
 
 	if err == mongo.ErrNoDocuments {
 		return NewWrapError(404, fmt.Errorf("memory not found: %s", mid), "")
@@ -127,13 +243,7 @@ func (ms *Memories) DeleteOne(ctx context.Context, aid primitive.ObjectID, mid p
 		return err
 	}
 
-	// also need to delete it from qdrant
-	uid, err := uuid.Parse(mem.PID)
-	if err != nil {
-		return err
-	}
-	err = ms.deletePoints(ctx, aid, []uuid.UUID{uid})
-	return err
+	return ms.delete(ctx, aid, []*Memory{&mem})
 }
 
 // DeleteMany deletes memories by ids
@@ -152,68 +262,178 @@ func (ms *Memories) DeleteMany(ctx context.Context, aid primitive.ObjectID, ids
 		return NewWrapError(400, fmt.Errorf("some memories not found"), "")
 	}
 
+	return ms.delete(ctx, aid, mems)
+}
+
+// delete memories from mongodb then their points from qdrant,
+// if the qdrant delete fails, the documents and their points will be restored
+func (ms *Memories) delete(ctx context.Context, aid primitive.ObjectID, mems []*Memory) error {
+	mids := make([]primitive.ObjectID, len(mems))
+	pids := make([]uuid.UUID, len(mems))
+	for idx, m := range mems {
+		mids[idx] = m.ID
+		pid, err := uuid.Parse(m.PID)
+		if err != nil {
+			return err
+		}
+		pids[idx] = pid
+	}
+
 	// delete memories from mongodb
-	_, err = ms.mongo.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	_, err := ms.mongo.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": mids}, "aid": aid})
+	if err != nil {
+		return err
+	}
+
+	// finally delete memories' points from qdrant
+	err = ms.deletePoints(ctx, aid, pids)
 	if err != nil {
+		return ms.compensate(ctx, "delete", err, &outboxTask{AID: aid, Op: OUTBOX_RESTORE_DOCUMENTS, Documents: mems})
+	}
+	return ms.markDirty(ctx, aid, mids)
+}
+
+// Archive memories by ids, their points are deleted from qdrant, and the documents are marked as archived,
+// if the qdrant delete fails, the documents will be restored
+func (ms *Memories) Archive(ctx context.Context, aid primitive.ObjectID, ids []primitive.ObjectID) error {
+	filter := bson.M{"_id": bson.M{"$in": ids}, "aid": aid, "archived_at": bson.M{"$exists": false}}
+	cur, err := ms.mongo.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var mems []*Memory
+	if err = cur.All(ctx, &mems); err != nil {
 		return err
 	}
+	if len(mems) != len(ids) {
+		return NewWrapError(400, fmt.Errorf("some memories not found or archived already"), "")
+	}
 
-	// get point ids
-	var pids []uuid.UUID = make([]uuid.UUID, len(mems))
+	pids := make([]uuid.UUID, len(mems))
 	for idx, m := range mems {
-		pids[idx], err = uuid.Parse(m.PID)
-		if err != nil {
+		if pids[idx], err = uuid.Parse(m.PID); err != nil {
 			return err
 		}
 	}
 
-	// finally delete memories' points from qdrant
-	return ms.deletePoints(ctx, aid, pids)
+	stamp := newStamp()
+	_, err = ms.mongo.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"archived_at": stamp, "updated_at": stamp}})
+	if err != nil {
+		return ms.compensate(ctx, "archive", err, &outboxTask{AID: aid, Op: OUTBOX_RESTORE_DOCUMENTS, Documents: mems, Stamp: &stamp})
+	}
+
+	err = ms.deletePoints(ctx, aid, pids)
+	if err != nil {
+		return ms.compensate(ctx, "archive", err, &outboxTask{AID: aid, Op: OUTBOX_RESTORE_DOCUMENTS, Documents: mems, Stamp: &stamp})
+	}
+	return ms.markDirty(ctx, aid, ids)
 }
 
-// update memory content and its embedding
+// UpdateOne updates memory content, tags, source or metadata
 func (ms *Memories) UpdateOne(ctx context.Context, aid primitive.ObjectID, memory *Memory) error {
 	return ms.UpdateMany(ctx, aid, []*Memory{memory})
 }
 
-// update memory content and its embedding
+// UpdateMany updates memories' content, tags, source or metadata, see mergeMemory for which fields are applied.
+// only the memories whose content changed will be re-embedded, the others only get their payloads overwritten.
+// if the qdrant write fails, the previous documents and their points will be restored
 func (ms *Memories) UpdateMany(ctx context.Context, aid primitive.ObjectID, memories []*Memory) error {
-	upsert := false
-
-	l := len(memories)
-	writeModels := make([]mongo.WriteModel, l)
-	contents := make([]string, l)
-	pids := make([]string, l)
-	mids := make([]primitive.ObjectID, l)
+	ids := make([]primitive.ObjectID, len(memories))
 	for idx, m := range memories {
-		writeModels[idx] = &mongo.UpdateOneModel{Upsert: &upsert, Filter: bson.M{"_id": m.ID, "aid": aid}, Update: bson.M{"$set": bson.M{"content": m.Content}}}
-		contents[idx] = m.Content
-		pids[idx] = m.PID
-		mids[idx] = m.ID
+		if err := validateMemoryFields(m); err != nil {
+			return err
+		}
+		ids[idx] = m.ID
 	}
 
-	opts := options.BulkWrite().SetOrdered(false)
-	res, err := ms.mongo.BulkWrite(ctx, writeModels, opts)
+	// previous documents, for their point ids and for rollback
+	cur, err := ms.mongo.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "aid": aid})
 	if err != nil {
 		return err
 	}
+	var prevs []*Memory
+	if err = cur.All(ctx, &prevs); err != nil {
+		return err
+	}
+	byID := make(map[primitive.ObjectID]*Memory, len(prevs))
+	for _, p := range prevs {
+		byID[p.ID] = p
+	}
+
+	var changed []*Memory  // previous documents of the changed memories
+	var embedded []*Memory // changed memories which need new embeddings
+	var payloads []*Memory // changed memories which need new payloads only
+	var contents []string
+	var writeModels []mongo.WriteModel
+	stamp := newStamp()
+	for _, m := range memories {
+		prev, ok := byID[m.ID]
+		if !ok {
+			continue
+		}
+		if prev.Archived != nil {
+			return NewWrapError(400, fmt.Errorf("archived memory can't be updated: %s", m.ID.Hex()), "")
+		}
+		next, contentChanged, modified := mergeMemory(prev, m)
+		if !modified {
+			continue
+		}
+		next.Updated = &stamp
+		changed = append(changed, prev)
+		if contentChanged {
+			embedded = append(embedded, next)
+			contents = append(contents, next.Content)
+		} else {
+			payloads = append(payloads, next)
+		}
+		writeModels = append(writeModels, &mongo.ReplaceOneModel{Filter: bson.M{"_id": m.ID, "aid": aid}, Replacement: next})
+	}
 
 	// if no memory is modified, then return directly
-	if res.ModifiedCount == 0 {
+	if len(changed) == 0 {
 		return NewWrapError(400, fmt.Errorf("memories not modified"), "")
 	}
 
-	// generate embedding for new content
-	ems, err := ms.llm.Embedding(ctx, contents)
+	// generate embedding for new content, before anything is written
+	var ems []vectors
+	if len(contents) > 0 {
+		ems, _, err = ms.embed(ctx, aid, contents)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts := options.BulkWrite().SetOrdered(false)
+	_, err = ms.mongo.BulkWrite(ctx, writeModels, opts)
+	if err != nil {
+		return ms.compensate(ctx, "update", err, &outboxTask{AID: aid, Op: OUTBOX_RESTORE_DOCUMENTS, Documents: changed, Stamp: &stamp})
+	}
+
+	if len(embedded) > 0 {
+		err = ms.upsertPoints(ctx, aid, embedded, ems)
+	}
+	if err == nil {
+		err = ms.overwritePayloads(ctx, aid, payloads)
+	}
+	// some points may hold the new vectors or payloads already, so they are restored too
 	if err != nil {
-		return err
+		return ms.compensate(ctx, "update", err, &outboxTask{AID: aid, Op: OUTBOX_RESTORE_DOCUMENTS, Documents: changed, Stamp: &stamp})
 	}
 
-	return ms.upsertPoints(ctx, aid, pids, mids, ems)
+	mids := make([]primitive.ObjectID, len(changed))
+	for idx, m := range changed {
+		mids[idx] = m.ID
+	}
+	return ms.markDirty(ctx, aid, mids)
 }
 
-func (ms *Memories) List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID) ([]*Memory, error) {
-	filter := bson.M{"aid": aid}
+// List memories from newest to oldest, which are older than offset and match the filter
+func (ms *Memories) List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID, mf *MemoryFilter) ([]*Memory, error) {
+	if err := mf.Validate(); err != nil {
+		return nil, err
+	}
+
+	filter := mf.mongoFilter(bson.M{"aid": aid})
 	if offset != primitive.NilObjectID {
 		filter["_id"] = bson.M{"$lt": offset} // find memories which are older than offset
 	}
@@ -231,17 +451,33 @@ func (ms *Memories) List(ctx context.Context, aid primitive.ObjectID, offset pri
 
 // Search searches memories by query
 // id is aeget's id
-func (ms *Memories) Search(ctx context.Context, aid primitive.ObjectID, query string) ([]*Memory, []float32, error) {
-	ems, err := ms.llm.Embedding(ctx, []string{query})
+// the filter is applied by qdrant, so the limit is reached by the matched memories only,
+// then the most relevant candidates are ranked by their retrieval scores, see Retrieval
+func (ms *Memories) Search(ctx context.Context, aid primitive.ObjectID, query string, filter *MemoryFilter) ([]*Memory, []*Score, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	retrieval, err := ms.retrieval(ctx, aid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ems, spec, err := ms.embed(ctx, aid, []string{query})
+	if err != nil {
+		return nil, nil, err
+	}
+	collection, err := ms.collectionOf(ctx, aid)
 	if err != nil {
 		return nil, nil, err
 	}
 	res, err := ms.qdrant.Search(ctx, &pb.SearchPoints{
-		CollectionName: aid.Hex(),
+		CollectionName: collection,
 		Vector:         ems[0],
+		Filter:         filter.qdrantFilter(),
 		WithPayload:    &pb.WithPayloadSelector{SelectorOptions: &pb.WithPayloadSelector_Enable{Enable: true}},  // with payload
 		WithVectors:    &pb.WithVectorsSelector{SelectorOptions: &pb.WithVectorsSelector_Enable{Enable: false}}, // without vectors
-		Limit:          uint64(ms.SearchLimit),
+		Limit:          uint64(ms.SearchLimit * RETRIEVAL_CANDIDATES_FACTOR),
 	})
 	if err != nil {
 		return nil, nil, err
@@ -254,18 +490,18 @@ func (ms *Memories) Search(ctx context.Context, aid primitive.ObjectID, query st
 
 	// get memories from mongodb by ids
 	var mids []primitive.ObjectID = make([]primitive.ObjectID, len(res.Result))
-	var scores []float32 = make([]float32, len(res.Result))
+	var relevances = make(map[primitive.ObjectID]float32, len(res.Result))
 
 	for idx, p := range res.Result {
-		mid := p.GetPayload()["mid"].GetStringValue() // unix timestamp
+		mid := p.GetPayload()[PAYLOAD_MID].GetStringValue()
 		mids[idx], err = primitive.ObjectIDFromHex(mid)
-		scores[idx] = p.Score // set scores
 		if err != nil {
 			return nil, nil, err
 		}
+		relevances[mids[idx]] = spec.similarity(p.Score)
 	}
 
-	mres, err := ms.mongo.Find(ctx, bson.M{"_id": bson.M{"$in": mids}})
+	mres, err := ms.mongo.Find(ctx, bson.M{"_id": bson.M{"$in": mids}, "aid": aid})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -276,40 +512,142 @@ func (ms *Memories) Search(ctx context.Context, aid primitive.ObjectID, query st
 		return nil, nil, err
 	}
 
-	// check if all memories found
+	// points whose documents are gone are left by half applied writes until the outbox removes them, they are dropped
 	if len(mids) != len(memories) {
-		return nil, nil, NewWrapError(400, fmt.Errorf("some memories not found: \n%v", mids), "")
+		if ms.Logger != nil {
+			ms.Logger.Warnw("dangling points dropped from search", "aid", aid.Hex(), "mids", danglingMIDs(mids, memories))
+		}
+		if len(memories) == 0 {
+			return nil, nil, NewWrapError(404, fmt.Errorf("no memories found"), "")
+		}
+	}
+
+	scores := make([]float32, len(memories))
+	for idx, m := range memories {
+		scores[idx] = relevances[m.ID]
+	}
+
+	now := time.Now()
+	ranked, rscores := retrieval.rank(memories, scores, ms.SearchLimit, now)
+
+	// update the last accessed time of the retrieved memories
+	accessed := make([]primitive.ObjectID, len(ranked))
+	for idx, m := range ranked {
+		accessed[idx] = m.ID
+		m.Accessed = now
+	}
+	_, err = ms.mongo.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": accessed}}, bson.M{"$set": bson.M{"accessed_at": now}})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// sort by score
-	var sorted []*Memory = make([]*Memory, len(memories))
+	return ranked, rscores, nil
+}
+
+// danglingMIDs returns the ids which have no memory
+func danglingMIDs(mids []primitive.ObjectID, memories []*Memory) []string {
+	found := make(map[primitive.ObjectID]bool, len(memories))
 	for _, m := range memories {
-		for j, s := range mids {
-			if s.Hex() == m.ID.Hex() {
-				sorted[j] = m
-				// log.Println("sorted: ", j, m.ID.Hex(), m.Content)
-				break
-			}
+		found[m.ID] = true
+	}
+	var dangling []string
+	for _, mid := range mids {
+		if !found[mid] {
+			dangling = append(dangling, mid.Hex())
 		}
 	}
+	return dangling
+}
+
+// retrieval gets agent's retrieval settings, or the default ones
+func (ms *Memories) retrieval(ctx context.Context, aid primitive.ObjectID) (*Retrieval, error) {
+	if ms.agents == nil {
+		return DefaultRetrieval(), nil
+	}
+
+	var agent Agent
+	opts := options.FindOne().SetProjection(bson.M{"retrieval": 1})
+	err := ms.agents.FindOne(ctx, bson.M{"_id": aid}, opts).Decode(&agent)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if agent.Retrieval == nil {
+		return DefaultRetrieval(), nil
+	}
+	return agent.Retrieval, nil
+}
+
+// embed creates the embeddings of the agent's vectors, see embedFor
+func (ms *Memories) embed(ctx context.Context, aid primitive.ObjectID, contents []string) ([]vectors, *EmbeddingSpec, error) {
+	recorded, err := ms.recordedEmbedding(ctx, aid)
+	if err != nil {
+		return nil, nil, err
+	}
+	llm, configured, err := ms.Embedders.llmOf(ms.llm, recorded, ms.Embedding)
+	if err != nil {
+		return nil, nil, err
+	}
+	return embedFor(ctx, llm, aid, recorded, configured, contents)
+}
+
+// recordedEmbedding gets the embedding model recorded on the agent, nil if it has none
+func (ms *Memories) recordedEmbedding(ctx context.Context, aid primitive.ObjectID) (*EmbeddingSpec, error) {
+	if ms.agents == nil {
+		return nil, nil
+	}
+
+	var agent Agent
+	opts := options.FindOne().SetProjection(bson.M{"embedding": 1})
+	err := ms.agents.FindOne(ctx, bson.M{"_id": aid}, opts).Decode(&agent)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return agent.Embedding, nil
+}
+
+// collectionOf returns the qdrant collection of the agent's vectors, the one recorded on the agent,
+// or the agent's id, which is the alias of its collection
+func (ms *Memories) collectionOf(ctx context.Context, aid primitive.ObjectID) (string, error) {
+	if ms.agents == nil {
+		return aid.Hex(), nil
+	}
+
+	var agent Agent
+	opts := options.FindOne().SetProjection(bson.M{"collection": 1})
+	err := ms.agents.FindOne(ctx, bson.M{"_id": aid}, opts).Decode(&agent)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return "", err
+	}
+	if agent.Collection == "" {
+		return aid.Hex(), nil
+	}
+	return agent.Collection, nil
+}
 
-	return sorted, scores, nil
+// upsertPoints upserts memories' points with their embeddings and payloads
+func (ms *Memories) upsertPoints(ctx context.Context, aid primitive.ObjectID, memories []*Memory, ems []vectors) error {
+	collection, err := ms.collectionOf(ctx, aid)
+	if err != nil {
+		return err
+	}
+	return ms.upsertPointsInto(ctx, collection, memories, ems)
 }
 
-func (ag *Memories) upsertPoints(ctx context.Context, aid primitive.ObjectID, pids []string, mids []primitive.ObjectID, ems []vectors) error {
+// upsertPointsInto upserts memories' points into the collection
+func (ms *Memories) upsertPointsInto(ctx context.Context, collection string, memories []*Memory, ems []vectors) error {
 	l := len(ems)
 	points := make([]*pb.PointStruct, l)
 	for i, em := range ems {
 		point := &pb.PointStruct{
-			Id:      &pb.PointId{PointIdOptions: &pb.PointId_Uuid{Uuid: pids[i]}},
-			Payload: map[string]*pb.Value{"mid": {Kind: &pb.Value_StringValue{StringValue: mids[i].Hex()}}},
+			Id:      &pb.PointId{PointIdOptions: &pb.PointId_Uuid{Uuid: memories[i].PID}},
+			Payload: memoryPayload(memories[i]),
 			Vectors: &pb.Vectors{VectorsOptions: &pb.Vectors_Vector{Vector: &pb.Vector{Data: em}}},
 		}
 		points[i] = point
 	}
 	waitUpsert := true
-	_, err := ag.qdrant.Upsert(ctx, &pb.UpsertPoints{
-		CollectionName: aid.Hex(), // agent's id and also the qdrant collection's name
+	_, err := ms.qdrant.Upsert(ctx, &pb.UpsertPoints{
+		CollectionName: collection,
 		Wait:           &waitUpsert,
 		Points:         points,
 	})
@@ -321,16 +659,42 @@ func (ag *Memories) upsertPoints(ctx context.Context, aid primitive.ObjectID, pi
 	return nil
 }
 
+// overwritePayloads replaces memories' point payloads, their vectors are kept
+func (ms *Memories) overwritePayloads(ctx context.Context, aid primitive.ObjectID, memories []*Memory) error {
+	collection, err := ms.collectionOf(ctx, aid)
+	if err != nil {
+		return err
+	}
+	wait := true
+	for _, m := range memories {
+		id := &pb.PointId{PointIdOptions: &pb.PointId_Uuid{Uuid: m.PID}}
+		_, err := ms.qdrant.OverwritePayload(ctx, &pb.SetPayloadPoints{
+			CollectionName: collection,
+			Wait:           &wait,
+			Payload:        memoryPayload(m),
+			PointsSelector: &pb.PointsSelector{PointsSelectorOneOf: &pb.PointsSelector_Points{Points: &pb.PointsIdsList{Ids: []*pb.PointId{id}}}},
+		})
+		if err != nil {
+			return NewWrapError(500, err, "memory payload overwrite error")
+		}
+	}
+	return nil
+}
+
 // deletePoints from qdrant by ids
 func (ms *Memories) deletePoints(ctx context.Context, aid primitive.ObjectID, pids []uuid.UUID) error {
+	collection, err := ms.collectionOf(ctx, aid)
+	if err != nil {
+		return err
+	}
 	ids := make([]*pb.PointId, len(pids))
 	for idx, p := range pids {
 		ids[idx] = &pb.PointId{PointIdOptions: &pb.PointId_Uuid{Uuid: p.String()}}
 	}
 
 	waitDelete := true
-	_, err := ms.qdrant.Delete(ctx, &pb.DeletePoints{
-		CollectionName: aid.Hex(),
+	_, err = ms.qdrant.Delete(ctx, &pb.DeletePoints{
+		CollectionName: collection,
 		Points:         &pb.PointsSelector{PointsSelectorOneOf: &pb.PointsSelector_Points{Points: &pb.PointsIdsList{Ids: ids}}},
 		Wait:           &waitDelete,
 	})
@@ -340,3 +704,28 @@ func (ms *Memories) deletePoints(ctx context.Context, aid primitive.ObjectID, pi
 	}
 	return nil
 }
+
+// deleteMemoryPoints deletes the points of the memories from the collection by their memory ids,
+// for the points whose ids are unknown. a missing collection has no points to delete
+func (ms *Memories) deleteMemoryPoints(ctx context.Context, collection string, mids []primitive.ObjectID) error {
+	hexes := make([]string, len(mids))
+	for idx, mid := range mids {
+		hexes[idx] = mid.Hex()
+	}
+
+	wait := true
+	_, err := ms.qdrant.Delete(ctx, &pb.DeletePoints{
+		CollectionName: collection,
+		Wait:           &wait,
+		Points: &pb.PointsSelector{PointsSelectorOneOf: &pb.PointsSelector_Filter{Filter: &pb.Filter{
+			Must: []*pb.Condition{fieldCondition(&pb.FieldCondition{
+				Key:   PAYLOAD_MID,
+				Match: &pb.Match{MatchValue: &pb.Match_Keywords{Keywords: &pb.RepeatedStrings{Strings: hexes}}},
+			})},
+		}}},
+	})
+	if err != nil && status.Code(err) != codes.NotFound {
+		return NewWrapError(500, err, "memory vectors delete error")
+	}
+	return nil
+}
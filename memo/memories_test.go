@@ -1,11 +1,15 @@
 package memo
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/google/uuid"
 	pb "github.com/qdrant/go-client/qdrant"
 	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -41,7 +45,9 @@ func (ms *MemoriesSuite) SetupSuite() {
 
 	ms.agents = &Agents{
 		qdrant:    pb.NewCollectionsClient(qc),
+		points:    pb.NewPointsClient(qc),
 		mongo:     mc.Database("test-db").Collection("agents"),
+		memories:  mc.Database("test-db").Collection("memories"),
 		ListLimit: 15,
 	}
 	var config Config
@@ -51,7 +57,9 @@ func (ms *MemoriesSuite) SetupSuite() {
 	}
 	ms.memories = &Memories{
 		qdrant:      pb.NewPointsClient(qc),
+		collections: pb.NewCollectionsClient(qc),
 		mongo:       mc.Database("test-db").Collection("memories"),
+		agents:      mc.Database("test-db").Collection("agents"),
 		llm:         NewOpenAI(config.OpenAIAPIKey),
 		SearchLimit: 3, // search limit
 	}
@@ -172,7 +180,7 @@ func (ms *MemoriesSuite) TestSearchMemories() {
 	ms.NoError(err)
 	ms.Equal(len(ids), len(memories))
 
-	mems, scores, err := ms.memories.Search(ctx, ms.agent.ID, "naughty dog") // just for fun
+	mems, scores, err := ms.memories.Search(ctx, ms.agent.ID, "naughty dog", nil) // just for fun
 	ms.NoError(err)
 	ms.Len(mems, 3)
 	ms.Len(scores, 3)
@@ -229,10 +237,165 @@ func (ms *MemoriesSuite) TestUpdateMemory2() {
 	memories[4].Content = "The sand is yellow"
 	_ = ms.memories.UpdateMany(ctx, ms.agent.ID, memories)
 
-	mems, _, _ := ms.memories.Search(ctx, ms.agent.ID, "planet") // just for fun
+	mems, _, _ := ms.memories.Search(ctx, ms.agent.ID, "planet", nil) // just for fun
 	ms.Contains(mems[0].Content, "moon")
 }
 
+func (ms *MemoriesSuite) TestMemoryMetadata() {
+	ctx := context.TODO()
+	var memory = Memory{
+		Content:  "My favorite color is red.",
+		Tags:     []string{"preference"},
+		Source:   "chat",
+		Metadata: map[string]interface{}{"channel": "general", "priority": 2},
+	}
+
+	id, err := ms.memories.AddOne(ctx, ms.agent.ID, &memory)
+	ms.NoError(err)
+
+	mem, err := ms.memories.GetOne(ctx, ms.agent.ID, id)
+	ms.NoError(err)
+	ms.Equal([]string{"preference"}, mem.Tags)
+	ms.Equal("general", mem.Metadata["channel"])
+
+	// the payload mirrors the memory
+	res, err := ms.memories.qdrant.Get(ctx, &pb.GetPoints{
+		CollectionName: ms.agent.ID.Hex(),
+		Ids:            []*pb.PointId{{PointIdOptions: &pb.PointId_Uuid{Uuid: mem.PID}}},
+		WithPayload:    &pb.WithPayloadSelector{SelectorOptions: &pb.WithPayloadSelector_Enable{Enable: true}},
+	})
+	ms.NoError(err)
+	ms.Equal("chat", res.Result[0].Payload[PAYLOAD_SOURCE].GetStringValue())
+
+	// tags only, the payload is overwritten without re-embedding
+	err = ms.memories.UpdateOne(ctx, ms.agent.ID, &Memory{ID: id, Tags: []string{"color"}})
+	ms.NoError(err)
+	res, err = ms.memories.qdrant.Get(ctx, &pb.GetPoints{
+		CollectionName: ms.agent.ID.Hex(),
+		Ids:            []*pb.PointId{{PointIdOptions: &pb.PointId_Uuid{Uuid: mem.PID}}},
+		WithPayload:    &pb.WithPayloadSelector{SelectorOptions: &pb.WithPayloadSelector_Enable{Enable: true}},
+	})
+	ms.NoError(err)
+	ms.Equal("color", res.Result[0].Payload[PAYLOAD_TAGS].GetListValue().GetValues()[0].GetStringValue())
+	ms.Equal("chat", res.Result[0].Payload[PAYLOAD_SOURCE].GetStringValue())
+
+	_, err = ms.memories.AddOne(ctx, ms.agent.ID, &Memory{Content: "invalid", Metadata: map[string]interface{}{"$where": 1}})
+	ms.Equal(400, err.(WrapError).Code())
+}
+
+func (ms *MemoriesSuite) TestFilterMemories() {
+	ctx := context.TODO()
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	var memories = []*Memory{
+		{Content: "My favorite color is red.", Source: "chat", Created: lastWeek.Add(-time.Hour)},
+		{Content: "My favorite color is pink.", Source: "chat", Tags: []string{"color"}, Metadata: map[string]interface{}{"priority": 1}},
+		{Content: "My favorite color is green.", Source: "email", Tags: []string{"color"}, Metadata: map[string]interface{}{"priority": 2}},
+	}
+	_, err := ms.memories.AddMany(ctx, ms.agent.ID, memories)
+	ms.NoError(err)
+
+	mems, _, err := ms.memories.Search(ctx, ms.agent.ID, "red", &MemoryFilter{After: &lastWeek, Source: "chat"})
+	ms.NoError(err)
+	ms.Len(mems, 1)
+	ms.Equal("My favorite color is pink.", mems[0].Content)
+
+	mems, _, err = ms.memories.Search(ctx, ms.agent.ID, "red", &MemoryFilter{Metadata: []MetadataCondition{{Key: "priority", In: []interface{}{2}}}})
+	ms.NoError(err)
+	ms.Len(mems, 1)
+	ms.Equal("My favorite color is green.", mems[0].Content)
+
+	mems, err = ms.memories.List(ctx, ms.agent.ID, primitive.NilObjectID, &MemoryFilter{Tags: []string{"color"}, Metadata: []MetadataCondition{{Key: "priority", Gt: float(1)}}})
+	ms.NoError(err)
+	ms.Len(mems, 1)
+	ms.Equal("My favorite color is green.", mems[0].Content)
+}
+
+func (ms *MemoriesSuite) TestRetrievalScores() {
+	ctx := context.TODO()
+	lastMonth := time.Now().Add(-30 * 24 * time.Hour)
+	var memories = []*Memory{
+		{Content: "My favorite color is red.", Created: lastMonth},
+		{Content: "I had a pizza for lunch.", Importance: 1},
+	}
+	ids, err := ms.memories.AddMany(ctx, ms.agent.ID, memories)
+	ms.NoError(err)
+
+	mems, scores, err := ms.memories.Search(ctx, ms.agent.ID, "favorite color", nil)
+	ms.NoError(err)
+	ms.Len(mems, 2)
+	for _, s := range scores {
+		ms.InDelta((s.Recency+s.Importance+s.Relevance)/3, s.Score, 1e-6)
+	}
+
+	mem, err := ms.memories.GetOne(ctx, ms.agent.ID, ids[0])
+	ms.NoError(err)
+	ms.WithinDuration(time.Now(), mem.Accessed, time.Second)
+
+	// relevance only
+	err = ms.agents.Update(ctx, &Agent{ID: ms.agent.ID, Name: ms.agent.Name, Retrieval: &Retrieval{Relevance: 1, HalfLifeHours: 24}})
+	ms.NoError(err)
+	mems, _, err = ms.memories.Search(ctx, ms.agent.ID, "favorite color", nil)
+	ms.NoError(err)
+	ms.Equal("My favorite color is red.", mems[0].Content)
+}
+
+func (ms *MemoriesSuite) TestArchiveMemories() {
+	ctx := context.TODO()
+	ids, err := ms.memories.AddMany(ctx, ms.agent.ID, []*Memory{
+		{Content: "My favorite color is red."},
+		{Content: "I had a pizza for lunch."},
+	})
+	ms.NoError(err)
+
+	ms.NoError(ms.memories.Archive(ctx, ms.agent.ID, ids[:1]))
+
+	mem, err := ms.memories.GetOne(ctx, ms.agent.ID, ids[0])
+	ms.NoError(err)
+	ms.NotNil(mem.Archived)
+
+	// the point is removed, so it is not searched any more
+	res, err := ms.memories.qdrant.Get(ctx, &pb.GetPoints{
+		CollectionName: ms.agent.ID.Hex(),
+		Ids:            []*pb.PointId{{PointIdOptions: &pb.PointId_Uuid{Uuid: mem.PID}}},
+	})
+	ms.NoError(err)
+	ms.Empty(res.Result)
+
+	mems, err := ms.memories.List(ctx, ms.agent.ID, primitive.NilObjectID, nil)
+	ms.NoError(err)
+	ms.Len(mems, 1)
+	mems, err = ms.memories.List(ctx, ms.agent.ID, primitive.NilObjectID, &MemoryFilter{IncludeArchived: true})
+	ms.NoError(err)
+	ms.Len(mems, 2)
+
+	err = ms.memories.Archive(ctx, ms.agent.ID, ids[:1])
+	ms.Equal(400, err.(WrapError).Code())
+}
+
+func (ms *MemoriesSuite) TestDedupMemories() {
+	ctx := context.TODO()
+	id, err := ms.memories.AddOne(ctx, ms.agent.ID, &Memory{Content: "My favorite color is red."})
+	ms.NoError(err)
+
+	insertions, err := ms.memories.AddManyDedup(ctx, ms.agent.ID, []*Memory{
+		{Content: "My favorite color is red."},
+		{Content: "I had a pizza for lunch."},
+	}, &Dedup{Mode: DEDUP_MERGE, Threshold: 0.95})
+	ms.NoError(err)
+	ms.Equal(INSERTION_MERGED, insertions[0].Status)
+	ms.Equal(id, insertions[0].ID)
+	ms.Equal(INSERTION_INSERTED, insertions[1].Status)
+
+	mem, err := ms.memories.GetOne(ctx, ms.agent.ID, id)
+	ms.NoError(err)
+	ms.Equal(1, mem.Reinforced)
+	ms.NotNil(mem.Seen)
+
+	mems, err := ms.memories.List(ctx, ms.agent.ID, primitive.NilObjectID, nil)
+	ms.NoError(err)
+	ms.Len(mems, 2)
+}
+
 func (ms *MemoriesSuite) TestListMemories() {
 	ctx := context.TODO()
 	var memories = []*Memory{
@@ -258,15 +421,212 @@ func (ms *MemoriesSuite) TestListMemories() {
 	ms.Equal(len(ids), len(memories))
 
 	ms.memories.ListLimit = 3 // set 3 per page
-	mems, err := ms.memories.List(ctx, ms.agent.ID, primitive.NilObjectID)
+	mems, err := ms.memories.List(ctx, ms.agent.ID, primitive.NilObjectID, nil)
 	ms.NoError(err)
 	ms.Len(mems, 3)
 
-	mems, err = ms.memories.List(ctx, ms.agent.ID, mems[2].ID)
+	mems, err = ms.memories.List(ctx, ms.agent.ID, mems[2].ID, nil)
 	ms.NoError(err)
 	ms.Len(mems, 2)
 }
 
+// downPoints fails every upsert and delete, like qdrant is down
+type downPoints struct {
+	pb.PointsClient
+}
+
+func (dp downPoints) Upsert(ctx context.Context, in *pb.UpsertPoints, opts ...grpc.CallOption) (*pb.PointsOperationResponse, error) {
+	return nil, errors.New("qdrant is down")
+}
+
+func (dp downPoints) Delete(ctx context.Context, in *pb.DeletePoints, opts ...grpc.CallOption) (*pb.PointsOperationResponse, error) {
+	return nil, errors.New("qdrant is down")
+}
+
+// lostPoints writes the first upsert but fails it, like a request which timed out after qdrant applied it
+type lostPoints struct {
+	pb.PointsClient
+	lost bool
+}
+
+func (lp *lostPoints) Upsert(ctx context.Context, in *pb.UpsertPoints, opts ...grpc.CallOption) (*pb.PointsOperationResponse, error) {
+	res, err := lp.PointsClient.Upsert(ctx, in, opts...)
+	if err != nil || lp.lost {
+		return res, err
+	}
+	lp.lost = true
+	return nil, errors.New("deadline exceeded")
+}
+
+// pointSource gets the source in the payload of the memory's point
+func (ms *MemoriesSuite) pointSource(mem *Memory) string {
+	res, err := ms.memories.qdrant.Get(context.TODO(), &pb.GetPoints{
+		CollectionName: ms.agent.ID.Hex(),
+		Ids:            []*pb.PointId{{PointIdOptions: &pb.PointId_Uuid{Uuid: mem.PID}}},
+		WithPayload:    &pb.WithPayloadSelector{SelectorOptions: &pb.WithPayloadSelector_Enable{Enable: true}},
+	})
+	ms.NoError(err)
+	ms.Len(res.Result, 1)
+	return res.Result[0].GetPayload()[PAYLOAD_SOURCE].GetStringValue()
+}
+
+func (ms *MemoriesSuite) TestRollbackMemories() {
+	ctx := context.TODO()
+	id, err := ms.memories.AddOne(ctx, ms.agent.ID, &Memory{Content: "Hey, I am Aspirin"})
+	ms.NoError(err)
+
+	// the inserted documents are removed, and the points which were written anyway
+	qdrant := ms.memories.qdrant
+	ms.memories.qdrant = &lostPoints{PointsClient: qdrant}
+	_, err = ms.memories.AddMany(ctx, ms.agent.ID, []*Memory{{Content: "My father is a teacher"}})
+	ms.ErrorIs(err, ErrRolledBack)
+	ms.memories.qdrant = qdrant
+	mems, err := ms.memories.List(ctx, ms.agent.ID, primitive.NilObjectID, nil)
+	ms.NoError(err)
+	ms.Len(mems, 1)
+	drift, err := ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_NONE)
+	ms.NoError(err)
+	ms.True(drift.Consistent())
+
+	// the new point which was written anyway is put back with the previous content and payload
+	ms.NoError(ms.memories.UpdateOne(ctx, ms.agent.ID, &Memory{ID: id, Source: "chat"}))
+	ms.memories.qdrant = &lostPoints{PointsClient: qdrant}
+	err = ms.memories.UpdateOne(ctx, ms.agent.ID, &Memory{ID: id, Content: "Hey, I am Aspirin2D", Source: "api"})
+	ms.ErrorIs(err, ErrRolledBack)
+	ms.memories.qdrant = qdrant
+	mem, err := ms.memories.GetOne(ctx, ms.agent.ID, id)
+	ms.NoError(err)
+	ms.Equal("Hey, I am Aspirin", mem.Content)
+	ms.Equal("chat", ms.pointSource(mem))
+
+	// the compensation can't write the points while qdrant is down, it is queued, and retried later
+	ms.memories.outbox = ms.memories.mongo.Database().Collection(OUTBOX_COLLECTION)
+	defer func() { ms.memories.outbox = nil }()
+	ms.memories.qdrant = downPoints{qdrant}
+	err = ms.memories.UpdateOne(ctx, ms.agent.ID, &Memory{ID: id, Content: "Hey, I am Aspirin2D"})
+	ms.ErrorIs(err, ErrRepairPending)
+	mem, err = ms.memories.GetOne(ctx, ms.agent.ID, id)
+	ms.NoError(err)
+	ms.Equal("Hey, I am Aspirin", mem.Content)
+
+	// the deleted document is restored
+	err = ms.memories.DeleteOne(ctx, ms.agent.ID, id)
+	ms.ErrorIs(err, ErrRepairPending)
+	_, err = ms.memories.GetOne(ctx, ms.agent.ID, id)
+	ms.NoError(err)
+
+	ms.memories.qdrant = qdrant
+	n, err := ms.memories.ApplyOutbox(ctx)
+	ms.NoError(err)
+	ms.GreaterOrEqual(n, 2)
+	drift, err = ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_NONE)
+	ms.NoError(err)
+	ms.True(drift.Consistent())
+
+	// a stale restore doesn't overwrite the updates made since
+	ms.NoError(ms.memories.UpdateOne(ctx, ms.agent.ID, &Memory{ID: id, Source: "api"}))
+	stamp := newStamp().Add(-time.Hour)
+	ms.NoError(ms.memories.applyTask(ctx, &outboxTask{AID: ms.agent.ID, Op: OUTBOX_RESTORE_DOCUMENTS, Documents: []*Memory{mem}, Stamp: &stamp}))
+	mem, err = ms.memories.GetOne(ctx, ms.agent.ID, id)
+	ms.NoError(err)
+	ms.Equal("api", mem.Source)
+}
+
+func (ms *MemoriesSuite) TestReconcile() {
+	ctx := context.TODO()
+	ids, err := ms.memories.AddMany(ctx, ms.agent.ID, []*Memory{{Content: "Hey, I am Aspirin"}, {Content: "My father is a teacher"}, {Content: "My mother is a doctor"}})
+	ms.NoError(err)
+
+	drift, err := ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_NONE)
+	ms.NoError(err)
+	ms.True(drift.Consistent())
+
+	// an index configured later is missing, and created
+	ms.memories.PayloadIndexes = map[string]pb.FieldType{PAYLOAD_TAGS: pb.FieldType_FieldTypeKeyword, "metadata.priority": pb.FieldType_FieldTypeInteger}
+	defer func() { ms.memories.PayloadIndexes = nil }()
+	drift, err = ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_NONE)
+	ms.NoError(err)
+	ms.Equal([]string{"metadata.priority"}, drift.MissingIndexes)
+	drift, err = ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_MISSING_INDEXES)
+	ms.NoError(err)
+	ms.True(drift.Consistent())
+	drift, err = ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_NONE)
+	ms.NoError(err)
+	ms.Empty(drift.MissingIndexes)
+
+	// remove the first memory's point, and the second memory's document
+	mems, err := ms.memories.GetMany(ctx, ms.agent.ID, ids)
+	ms.NoError(err)
+	pid := uuid.MustParse(mems[0].PID)
+	ms.NoError(ms.memories.deletePoints(ctx, ms.agent.ID, []uuid.UUID{pid}))
+	_, err = ms.memories.mongo.DeleteOne(ctx, bson.M{"_id": ids[1]})
+	ms.NoError(err)
+
+	// the dangling point is dropped from the search
+	found, _, err := ms.memories.Search(ctx, ms.agent.ID, "Who is my father?", nil)
+	ms.NoError(err)
+	ms.Len(found, 1)
+	ms.Equal(ids[2], found[0].ID)
+
+	drift, err = ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_NONE)
+	ms.NoError(err)
+	ms.False(drift.Consistent())
+	ms.Equal([]primitive.ObjectID{ids[0]}, drift.MissingPoints)
+	ms.Equal([]string{mems[1].PID}, drift.OrphanPoints)
+
+	drift, err = ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_ALL)
+	ms.NoError(err)
+	ms.True(drift.Consistent())
+
+	drift, err = ms.memories.Reconcile(ctx, ms.agent.ID, REPAIR_NONE)
+	ms.NoError(err)
+	ms.Empty(drift.MissingPoints)
+	ms.Empty(drift.OrphanPoints)
+}
+
+func (ms *MemoriesSuite) TestReembedLegacy() {
+	ctx := context.TODO()
+	aid := ms.agent.ID
+
+	// make the agent's collection a legacy one, named after the agent
+	current, err := ms.memories.resolveCollection(ctx, aid)
+	ms.NoError(err)
+	_, err = ms.memories.collections.UpdateAliases(ctx, &pb.ChangeAliases{Actions: []*pb.AliasOperations{
+		{Action: &pb.AliasOperations_DeleteAlias{DeleteAlias: &pb.DeleteAlias{AliasName: aid.Hex()}}},
+	}})
+	ms.NoError(err)
+	_, err = ms.memories.collections.Delete(ctx, &pb.DeleteCollection{CollectionName: current})
+	ms.NoError(err)
+	ms.NoError(createCollection(ctx, ms.memories.collections, ms.memories.qdrant, aid.Hex(), ms.agent.Embedding, nil))
+
+	ids, err := ms.memories.AddMany(ctx, aid, []*Memory{{Content: "My father is a teacher"}, {Content: "My mother is a doctor"}})
+	ms.NoError(err)
+
+	spec := *ms.agent.Embedding
+	spec.Model += "-copy" // same vectors, another model
+	r, err := ms.memories.Reembed(ctx, aid, ms.memories.llm, &spec, 1, nil)
+	ms.NoError(err)
+	ms.Equal(2, r.Done)
+
+	// the new collection is recorded on the agent, and the legacy one is dropped after the switch
+	var agent Agent
+	ms.NoError(ms.agents.mongo.FindOne(ctx, bson.M{"_id": aid}).Decode(&agent))
+	ms.Equal(r.Collection, agent.Collection)
+	ms.Equal(spec, *agent.Embedding)
+	ms.Nil(agent.Reembedding)
+	names, err := agentCollections(ctx, ms.memories.collections, aid)
+	ms.NoError(err)
+	ms.Equal([]string{r.Collection}, names)
+
+	found, _, err := ms.memories.Search(ctx, aid, "Who is my father?", nil)
+	ms.NoError(err)
+	ms.Equal(ids[0], found[0].ID)
+
+	drift, err := ms.memories.Reconcile(ctx, aid, REPAIR_NONE)
+	ms.NoError(err)
+	ms.True(drift.Consistent())
+}
+
 func TestMemoriesSuite(t *testing.T) {
 	suite.Run(t, new(MemoriesSuite))
 }
@@ -1,13 +1,18 @@
 package memo
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// GetAgentId is the middleware of the agent's routes, it sets the id of the agent, which exists and is not in the trash
 func (m *Memo) GetAgentId(c *gin.Context) {
 	str := c.Param("aid")
 	if str == "" {
@@ -21,10 +26,18 @@ func (m *Memo) GetAgentId(c *gin.Context) {
 		return
 	}
 
+	// an agent in the trash is not found, until it is restored
+	if _, err := m.Agents.Get(c.Request.Context(), aid); err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
 	c.Set("agent", aid)
 	c.Next()
 }
 
+// AddMemories adds memories to the agent, the dedup url param or the dedup_mode config
+// decides how their near-duplicates are handled
 func (m *Memo) AddMemories(c *gin.Context) {
 	aid, _ := c.Get("agent")
 	agent := aid.(primitive.ObjectID)
@@ -36,14 +49,37 @@ func (m *Memo) AddMemories(c *gin.Context) {
 		return
 	}
 
+	// the url param overrides the config's dedup mode
+	dedup := m.config().Dedup()
+	if mode := c.Query("dedup"); mode != "" {
+		dedup.Mode = mode
+	}
+
 	ctx := c.Request.Context()
-	ids, err := m.Memories.AddMany(ctx, agent, memories)
+	if dedup.Mode == DEDUP_OFF {
+		ids, err := m.Remember(ctx, agent, memories)
+		if err != nil {
+			m.AbortWithError(c, err)
+			return
+		}
+
+		c.JSON(200, gin.H{"inserted": ids})
+		return
+	}
+
+	insertions, err := m.RememberDedup(ctx, agent, memories, dedup)
 	if err != nil {
 		m.AbortWithError(c, err)
 		return
 	}
 
-	c.JSON(200, gin.H{"inserted": ids})
+	ids := []primitive.ObjectID{}
+	for _, ins := range insertions {
+		if ins.Status == INSERTION_INSERTED {
+			ids = append(ids, ins.ID)
+		}
+	}
+	c.JSON(200, gin.H{"inserted": ids, "results": insertions})
 }
 
 func (m *Memo) GetMemories(c *gin.Context) {
@@ -139,8 +175,14 @@ func (m *Memo) ListMemories(c *gin.Context) {
 		oid = primitive.NilObjectID
 	}
 
+	filter, err := parseMemoryFilter(c)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
 	ctx := c.Request.Context()
-	memories, err := m.Memories.List(ctx, agent, oid)
+	memories, err := m.Memories.List(ctx, agent, oid, filter)
 	if err != nil {
 		m.AbortWithError(c, err)
 		return
@@ -149,20 +191,87 @@ func (m *Memo) ListMemories(c *gin.Context) {
 	c.JSON(200, memories)
 }
 
+// ReflectMemories reflects on agent's recent memories, and returns the questions and the stored insights
+func (m *Memo) ReflectMemories(c *gin.Context) {
+	aid, _ := c.Get("agent")
+	agent := aid.(primitive.ObjectID)
+
+	ctx := c.Request.Context()
+	reflection, err := m.Reflect(ctx, agent)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, reflection)
+}
+
+// ExtractMemories extracts memories from a transcript of messages or a session
+func (m *Memo) ExtractMemories(c *gin.Context) {
+	aid, _ := c.Get("agent")
+	agent := aid.(primitive.ObjectID)
+
+	req := new(ExtractionRequest)
+	if err := c.ShouldBindJSON(req); err != nil {
+		m.AbortWithError(c, NewWrapError(400, err, "can't bind extraction request"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	extraction, err := m.Extract(ctx, agent, req)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+	c.JSON(200, extraction)
+}
+
+// CompactMemories summarises agent's old memories by the config's compaction policy
+func (m *Memo) CompactMemories(c *gin.Context) {
+	aid, _ := c.Get("agent")
+	agent := aid.(primitive.ObjectID)
+
+	ctx := c.Request.Context()
+	compaction, err := m.Compact(ctx, agent, m.config().CompactionPolicy())
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, compaction)
+}
+
+// SearchMemories searches memories by the query of GET url params,
+// or by the query and the filter of POST json body, see MemoryFilter
 func (m *Memo) SearchMemories(c *gin.Context) {
 	aid, _ := c.Get("agent")
 	agent := aid.(primitive.ObjectID)
 
-	// get query from url params
+	var req searchRequest
 	var err error
-	query := c.Query("q")
-	if query == "" {
-		m.AbortWithError(c, NewWrapError(400, err, "empty query"))
+	if c.Request.Method == "POST" {
+		err = c.ShouldBindJSON(&req)
+		if err != nil {
+			m.AbortWithError(c, NewWrapError(400, err, "can't bind search request"))
+			return
+		}
+	} else {
+		// get query from url params
+		req.Query = c.Query("q")
+		req.Filter, err = parseMemoryFilter(c)
+		if err != nil {
+			m.AbortWithError(c, err)
+			return
+		}
+	}
+
+	if req.Query == "" {
+		m.AbortWithError(c, NewWrapError(400, fmt.Errorf("empty query"), ""))
 		return
 	}
 
 	ctx := c.Request.Context()
-	memories, scores, err := m.Memories.Search(ctx, agent, query)
+	memories, scores, err := m.Memories.Search(ctx, agent, req.Query, req.Filter)
 	if err != nil {
 		m.AbortWithError(c, err)
 		return
@@ -170,3 +279,149 @@ func (m *Memo) SearchMemories(c *gin.Context) {
 
 	c.JSON(200, map[string]interface{}{"memories": memories, "scores": scores})
 }
+
+type searchRequest struct {
+	Query  string        `json:"query"`
+	Filter *MemoryFilter `json:"filter"`
+}
+
+// parseMemoryFilter parses the filter from url params, it returns nil if there is no filter param
+//
+//	after=&before=      created time range, RFC3339 or unix seconds
+//	tags=a,b            memories must have all the tags
+//	exclude_tags=c,d    memories must have none of the tags
+//	source=             memories' source
+//	metadata.key=value  metadata equality, the value is a json scalar or a string
+//	metadata.key[op]=value  op is eq, in of comma separated values, or gt, gte, lt, lte of a number,
+//	                        the range ops of a key make one range
+//	include_archived=true  archived memories are listed too
+func parseMemoryFilter(c *gin.Context) (*MemoryFilter, error) {
+	var f MemoryFilter
+	var set bool
+	for key, values := range c.Request.URL.Query() {
+		value := values[0]
+		switch {
+		case key == "after" || key == "before":
+			t, err := parseTime(value)
+			if err != nil {
+				return nil, NewWrapError(400, err, "invalid filter "+key)
+			}
+			if key == "after" {
+				f.After = &t
+			} else {
+				f.Before = &t
+			}
+		case key == "tags":
+			f.Tags = strings.Split(value, ",")
+		case key == "exclude_tags":
+			f.ExcludeTags = strings.Split(value, ",")
+		case key == "source":
+			f.Source = value
+		case key == "include_archived":
+			include, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, NewWrapError(400, err, "invalid filter include_archived")
+			}
+			f.IncludeArchived = include
+		case strings.HasPrefix(key, "metadata."):
+			if err := f.addMetadataParam(strings.TrimPrefix(key, "metadata."), value); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+	// url params are not ordered
+	sort.Slice(f.Metadata, func(i, j int) bool {
+		a, b := f.Metadata[i], f.Metadata[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return conditionRank(&a) < conditionRank(&b)
+	})
+	return &f, f.Validate()
+}
+
+// addMetadataParam adds the condition of a metadata url param, key is "name" or "name[op]"
+func (f *MemoryFilter) addMetadataParam(key string, value string) error {
+	op := "eq"
+	if start := strings.LastIndex(key, "["); start > 0 && strings.HasSuffix(key, "]") {
+		key, op = key[:start], key[start+1:len(key)-1]
+	}
+
+	switch op {
+	case "eq":
+		f.Metadata = append(f.Metadata, MetadataCondition{Key: key, Eq: paramScalar(value)})
+		return nil
+	case "in":
+		values := strings.Split(value, ",")
+		in := make([]interface{}, len(values))
+		for idx, v := range values {
+			in[idx] = paramScalar(v)
+		}
+		f.Metadata = append(f.Metadata, MetadataCondition{Key: key, In: in})
+		return nil
+	case "gt", "gte", "lt", "lte":
+	default:
+		return NewWrapError(400, fmt.Errorf("unknown filter metadata %q op: %s", key, op), "")
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return NewWrapError(400, err, fmt.Sprintf("filter metadata %q: %s should be a number", key, op))
+	}
+	var mc *MetadataCondition
+	for idx := range f.Metadata {
+		if f.Metadata[idx].Key == key && f.Metadata[idx].isRange() {
+			mc = &f.Metadata[idx]
+		}
+	}
+	if mc == nil {
+		f.Metadata = append(f.Metadata, MetadataCondition{Key: key})
+		mc = &f.Metadata[len(f.Metadata)-1]
+	}
+	switch op {
+	case "gt":
+		mc.Gt = &n
+	case "gte":
+		mc.Gte = &n
+	case "lt":
+		mc.Lt = &n
+	case "lte":
+		mc.Lte = &n
+	}
+	return nil
+}
+
+// paramScalar parses a url param value as a json scalar, or keeps it as a string
+func paramScalar(value string) interface{} {
+	var v interface{}
+	if json.Unmarshal([]byte(value), &v) != nil || !isScalar(v) {
+		return value
+	}
+	return v
+}
+
+// conditionRank orders the conditions of a key: eq, in, then range
+func conditionRank(mc *MetadataCondition) int {
+	switch {
+	case mc.Eq != nil:
+		return 0
+	case mc.In != nil:
+		return 1
+	}
+	return 2
+}
+
+// parseTime parses RFC3339 time or unix seconds
+func parseTime(value string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/suite"
@@ -14,7 +15,9 @@ import (
 )
 
 type mockMemoryModel struct {
-	Error error
+	Error  error
+	Filter *MemoryFilter // the last filter of List or Search
+	Dedup  *Dedup        // the last dedup of AddManyDedup
 }
 
 func (mmm *mockMemoryModel) AddOne(ctx context.Context, agent primitive.ObjectID, memory *Memory) (primitive.ObjectID, error) {
@@ -23,6 +26,10 @@ func (mmm *mockMemoryModel) AddOne(ctx context.Context, agent primitive.ObjectID
 func (mmm *mockMemoryModel) AddMany(ctx context.Context, agent primitive.ObjectID, memories []*Memory) ([]primitive.ObjectID, error) {
 	return []primitive.ObjectID{primitive.NewObjectID()}, mmm.Error
 }
+func (mmm *mockMemoryModel) AddManyDedup(ctx context.Context, agent primitive.ObjectID, memories []*Memory, dedup *Dedup) ([]*Insertion, error) {
+	mmm.Dedup = dedup
+	return []*Insertion{{Status: INSERTION_INSERTED, ID: primitive.NewObjectID()}, {Status: INSERTION_SKIPPED, ID: primitive.NewObjectID()}}, mmm.Error
+}
 
 func (mmm *mockMemoryModel) GetOne(ctx context.Context, agent primitive.ObjectID, id primitive.ObjectID) (*Memory, error) {
 	return &Memory{}, mmm.Error
@@ -42,18 +49,23 @@ func (mmm *mockMemoryModel) UpdateMany(ctx context.Context, agent primitive.Obje
 func (mmm *mockMemoryModel) DeleteOne(ctx context.Context, agent primitive.ObjectID, id primitive.ObjectID) error {
 	return mmm.Error
 }
+func (mmm *mockMemoryModel) Archive(ctx context.Context, agent primitive.ObjectID, ids []primitive.ObjectID) error {
+	return mmm.Error
+}
 func (mmm *mockMemoryModel) DeleteMany(ctx context.Context, agent primitive.ObjectID, ids []primitive.ObjectID) error {
 	return mmm.Error
 }
 
-func (mmm *mockMemoryModel) List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID) ([]*Memory, error) {
+func (mmm *mockMemoryModel) List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID, filter *MemoryFilter) ([]*Memory, error) {
+	mmm.Filter = filter
 	list := make([]*Memory, 5)
 	return list, mmm.Error
 }
 
-func (mmm *mockMemoryModel) Search(ctx context.Context, aid primitive.ObjectID, query string) ([]*Memory, []float32, error) {
+func (mmm *mockMemoryModel) Search(ctx context.Context, aid primitive.ObjectID, query string, filter *MemoryFilter) ([]*Memory, []*Score, error) {
+	mmm.Filter = filter
 	list := make([]*Memory, 5)
-	scores := make([]float32, 5)
+	scores := make([]*Score, 5)
 	return list, scores, mmm.Error
 }
 
@@ -72,7 +84,7 @@ func (s *MemoryHandlersSuite) SetupSuite() {
 	// create a mock server
 	gin.SetMode(gin.ReleaseMode)
 	// logger, _ := zap.NewProduction()
-	s.memo = &Memo{Memories: &mockMemoryModel{}, Logger: nil}
+	s.memo = &Memo{Agents: &mockAgentModel{}, Memories: &mockMemoryModel{}, Logger: nil}
 	s.NotNil(s.memo)
 }
 
@@ -86,9 +98,12 @@ func (s *MemoryHandlersSuite) SetupTest() {
 	s.router.GET("/:aid/get", s.memo.GetAgentId, s.memo.GetMemories)
 	s.router.GET("/:aid/list", s.memo.GetAgentId, s.memo.ListMemories)
 	s.router.GET("/:aid/search", s.memo.GetAgentId, s.memo.SearchMemories)
+	s.router.POST("/:aid/search", s.memo.GetAgentId, s.memo.SearchMemories)
 }
 func (s *MemoryHandlersSuite) TearDownTest() {
 	s.memo.Memories.(*mockMemoryModel).Error = nil
+	s.memo.Memories.(*mockMemoryModel).Filter = nil
+	s.memo.Memories.(*mockMemoryModel).Dedup = nil
 }
 
 func (s *MemoryHandlersSuite) TestAddMemories() {
@@ -103,6 +118,58 @@ func (s *MemoryHandlersSuite) TestAddMemories() {
 	var m map[string]interface{}
 	_ = json.NewDecoder(s.writer.Body).Decode(&m)
 	s.NotNil(m["inserted"])
+	s.Nil(m["results"])
+	s.Nil(s.memo.Memories.(*mockMemoryModel).Dedup)
+}
+
+func (s *MemoryHandlersSuite) TestTrashedAgent() {
+	agents, memories := NewInMemory(NewLocal(32))
+	agents.TrashRetention = time.Hour
+	memo := &Memo{Config: DefaultConfig(), Agents: agents, Memories: memories, Sessions: agents.Sessions(), LLM: NewLocal(32)}
+	router := NewRouter(memo)
+	ctx := context.TODO()
+
+	aid, err := agents.Add(ctx, &Agent{Name: "aspirin"})
+	s.NoError(err)
+	_, err = memories.AddOne(ctx, aid, &Memory{Content: "I like tea."})
+	s.NoError(err)
+	s.NoError(agents.Delete(ctx, aid))
+
+	// an agent in the trash has no memories, sessions or chats until it is restored
+	for _, route := range [][2]string{
+		{"GET", "/api/v1/agents/" + aid.Hex() + "/memories"},
+		{"GET", "/api/v1/agents/" + aid.Hex() + "/memories/search?q=tea"},
+		{"GET", "/api/v1/agents/" + aid.Hex() + "/sessions"},
+		{"POST", "/api/v1/agents/" + aid.Hex() + "/chat"},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(route[0], route[1], nil))
+		s.Equal(404, w.Code, route[1])
+	}
+
+	s.NoError(agents.Restore(ctx, aid))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/agents/"+aid.Hex()+"/memories", nil))
+	s.Equal(200, w.Code)
+}
+
+func (s *MemoryHandlersSuite) TestAddMemoriesWithDedup() {
+	body, _ := json.Marshal([]map[string]interface{}{{"content": "hello"}, {"content": "hello!"}})
+
+	url := "/" + primitive.NewObjectID().Hex() + "/add?dedup=merge"
+	req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(200, s.writer.Code)
+
+	var res struct {
+		Inserted []primitive.ObjectID `json:"inserted"`
+		Results  []*Insertion         `json:"results"`
+	}
+	s.NoError(json.NewDecoder(s.writer.Body).Decode(&res))
+	s.Len(res.Inserted, 1)
+	s.Equal(INSERTION_SKIPPED, res.Results[1].Status)
+	s.Equal(DEDUP_MERGE, s.memo.Memories.(*mockMemoryModel).Dedup.Mode)
+	s.Equal(DefaultConfig().DedupThreshold, s.memo.Memories.(*mockMemoryModel).Dedup.Threshold)
 }
 
 func (s *MemoryHandlersSuite) TestDelMemories() {
@@ -169,6 +236,63 @@ func (s *MemoryHandlersSuite) TestSearchMemories() {
 	s.NotNil(m["memories"])
 }
 
+func (s *MemoryHandlersSuite) TestSearchMemoriesWithFilter() {
+	mock := s.memo.Memories.(*mockMemoryModel)
+	aid := primitive.NewObjectID().Hex()
+
+	// no filter params
+	req := httptest.NewRequest("GET", "/"+aid+"/search?q=hello", nil)
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(200, s.writer.Code)
+	s.Nil(mock.Filter)
+
+	s.writer = httptest.NewRecorder()
+	url := "/" + aid + "/search?q=hello&after=100&before=2023-07-01T00:00:00Z&tags=work,chat&exclude_tags=secret&source=slack&metadata.priority=2&metadata.channel=general"
+	req = httptest.NewRequest("GET", url, nil)
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(200, s.writer.Code)
+	s.Equal(int64(100), mock.Filter.After.Unix())
+	s.Equal(2023, mock.Filter.Before.Year())
+	s.Equal([]string{"work", "chat"}, mock.Filter.Tags)
+	s.Equal([]string{"secret"}, mock.Filter.ExcludeTags)
+	s.Equal("slack", mock.Filter.Source)
+	s.Equal([]MetadataCondition{{Key: "channel", Eq: "general"}, {Key: "priority", Eq: 2.0}}, mock.Filter.Metadata)
+
+	// metadata ops, the range ops of a key make one condition
+	s.writer = httptest.NewRecorder()
+	url = "/" + aid + "/list?metadata.priority[gte]=1&metadata.priority[lt]=3&metadata.priority[in]=1,2,high&metadata.user.name[eq]=aspirin"
+	req = httptest.NewRequest("GET", url, nil)
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(200, s.writer.Code)
+	one, three := 1.0, 3.0
+	s.Equal([]MetadataCondition{
+		{Key: "priority", In: []interface{}{1.0, 2.0, "high"}},
+		{Key: "priority", Gte: &one, Lt: &three},
+		{Key: "user.name", Eq: "aspirin"},
+	}, mock.Filter.Metadata)
+
+	// filter in json body
+	s.writer = httptest.NewRecorder()
+	body := `{"query":"hello","filter":{"after":"2023-07-01T00:00:00Z","metadata":[{"key":"priority","gte":2}]}}`
+	req = httptest.NewRequest("POST", "/"+aid+"/search", bytes.NewBufferString(body))
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(200, s.writer.Code)
+	s.Equal(2.0, *mock.Filter.Metadata[0].Gte)
+
+	// invalid params
+	for _, url := range []string{"/search?q=hello&after=yesterday", "/search?q=hello&tags=a,,b", "/list?metadata.$where=1", "/list?metadata.priority[gte]=high", "/list?metadata.priority[ne]=1"} {
+		s.writer = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/"+aid+url, nil)
+		s.router.ServeHTTP(s.writer, req)
+		s.Equal(400, s.writer.Code, url)
+	}
+
+	s.writer = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/"+aid+"/search", bytes.NewBufferString(`{"filter":{}}`))
+	s.router.ServeHTTP(s.writer, req)
+	s.Equal(400, s.writer.Code)
+}
+
 func (s *MemoryHandlersSuite) TestUpdateMemories() {
 	mbody := []map[string]interface{}{
 		{"id": new(primitive.ObjectID).Hex()},
@@ -0,0 +1,208 @@
+package memo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Ollama which implemented LLM interface with ollama's native api
+type Ollama struct {
+	uri            string
+	chatModel      string
+	embeddingModel string
+	client         *http.Client // retries the requests
+	batch          EmbeddingBatch
+}
+
+// OllamaConfig is the settings of an ollama server
+type OllamaConfig struct {
+	URI            string // e.g. "http://localhost:11434"
+	ChatModel      string
+	EmbeddingModel string
+
+	Batch EmbeddingBatch // one content per request by default, the api embeds one prompt per request
+	Retry RetryPolicy    // DefaultRetryPolicy if it is zero
+}
+
+// NewOllama creates the llm of an ollama server, e.g. "http://localhost:11434"
+func NewOllama(uri string, chatModel string, embeddingModel string) *Ollama {
+	return NewOllamaWithConfig(OllamaConfig{URI: uri, ChatModel: chatModel, EmbeddingModel: embeddingModel})
+}
+
+// NewOllamaWithConfig creates the llm of an ollama server
+func NewOllamaWithConfig(c OllamaConfig) *Ollama {
+	return &Ollama{
+		uri:            strings.TrimRight(c.URI, "/"),
+		chatModel:      c.ChatModel,
+		embeddingModel: c.EmbeddingModel,
+		client:         retryClient(c.Retry),
+		batch:          c.Batch.or(EmbeddingBatch{Size: OLLAMA_EMBEDDING_BATCH_SIZE}),
+	}
+}
+
+type ollamaOptions struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"` // max tokens
+}
+
+type ollamaChatRequest struct {
+	Model    string         `json:"model"`
+	Messages []ollamaTurn   `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Options  *ollamaOptions `json:"options,omitempty"`
+}
+
+type ollamaTurn struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ollamaChatResponse is the reply, or a piece of it if it is streamed, only the last one is done and has the counts
+type ollamaChatResponse struct {
+	Message         ollamaTurn `json:"message"`
+	Done            bool       `json:"done"`
+	PromptEvalCount int        `json:"prompt_eval_count"`
+	EvalCount       int        `json:"eval_count"`
+	Error           string     `json:"error"`
+}
+
+// Embedding requests the vectors of the contents in batches, see EmbeddingBatch
+func (o *Ollama) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	return embedInBatches(ctx, o.batch, contents, o.embedding)
+}
+
+// embedding requests the vectors of the contents one by one, the api embeds one prompt per request
+func (o *Ollama) embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	ems := make([]vectors, len(contents))
+	for idx, content := range contents {
+		res, err := o.post(ctx, "/api/embeddings", map[string]string{"model": o.embeddingModel, "prompt": content})
+		if err != nil {
+			return nil, err
+		}
+
+		var data struct {
+			Embedding vectors `json:"embedding"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&data)
+		res.Body.Close()
+		if err != nil {
+			return nil, NewWrapError(500, err, "can't decode ollama embedding response")
+		}
+		if len(data.Embedding) == 0 {
+			return nil, NewWrapError(500, fmt.Errorf("no embedding of content %d", idx), "")
+		}
+		ems[idx] = data.Embedding
+	}
+	return ems, nil
+}
+
+// Chat to ollama chat api, the model settings which ctx carries override the defaults
+func (o *Ollama) Chat(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+	res, err := o.post(ctx, "/api/chat", o.chatRequest(ctx, messages, false))
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	defer res.Body.Close()
+
+	var reply ollamaChatResponse
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return ChatMessage{}, NewWrapError(500, err, "can't decode ollama chat response")
+	}
+	return ChatMessage{Role: reply.Message.Role, Content: reply.Message.Content}, nil
+}
+
+// ChatStream to ollama chat api, the pieces of the reply are json lines, and the last one has the token counts.
+// cancelling ctx closes the request
+func (o *Ollama) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(delta string) error) (ChatMessage, *Usage, error) {
+	res, err := o.post(ctx, "/api/chat", o.chatRequest(ctx, messages, true))
+	if err != nil {
+		return ChatMessage{}, nil, err
+	}
+	defer res.Body.Close()
+
+	result := ChatMessage{Role: "assistant"}
+	var content strings.Builder
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var piece ollamaChatResponse
+		if err := json.Unmarshal(scanner.Bytes(), &piece); err != nil {
+			return ChatMessage{}, nil, NewWrapError(500, err, "can't decode ollama chat stream")
+		}
+		if piece.Error != "" {
+			return ChatMessage{}, nil, NewWrapError(500, errors.New(piece.Error), "ollama chat stream error occurred")
+		}
+		if piece.Message.Role != "" {
+			result.Role = piece.Message.Role
+		}
+		if piece.Message.Content != "" {
+			content.WriteString(piece.Message.Content)
+			if err := onDelta(piece.Message.Content); err != nil {
+				return ChatMessage{}, nil, err
+			}
+		}
+		if piece.Done {
+			result.Content = content.String()
+			usage := &Usage{PromptTokens: piece.PromptEvalCount, CompletionTokens: piece.EvalCount}
+			usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+			return result, usage, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ChatMessage{}, nil, NewWrapError(500, err, "ollama chat stream error occurred")
+	}
+	return ChatMessage{}, nil, NewWrapError(500, fmt.Errorf("ollama chat stream ended before it was done"), "")
+}
+
+// chatRequest applies the model settings which ctx carries
+func (o *Ollama) chatRequest(ctx context.Context, messages []ChatMessage, stream bool) *ollamaChatRequest {
+	req := &ollamaChatRequest{Model: o.chatModel, Messages: make([]ollamaTurn, len(messages)), Stream: stream}
+	for idx, m := range messages {
+		req.Messages[idx] = ollamaTurn{Role: m.Role, Content: m.Content}
+	}
+	if settings := ModelSettingsFromContext(ctx); settings != nil {
+		if settings.Model != "" {
+			req.Model = settings.Model
+		}
+		if settings.Temperature != nil || settings.MaxTokens > 0 {
+			req.Options = &ollamaOptions{Temperature: settings.Temperature, NumPredict: settings.MaxTokens}
+		}
+	}
+	return req
+}
+
+// post the json body to the api, the response's status is checked, its body should be closed
+func (o *Ollama) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.uri+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return nil, NewWrapError(500, err, "ollama api error occurred")
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return nil, NewWrapError(500, fmt.Errorf("status code %d: %s", res.StatusCode, e.Error), "ollama api error occurred")
+	}
+	return res, nil
+}
@@ -0,0 +1,86 @@
+package memo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ollamaServer stands in for ollama's api, the chat requests it received are recorded
+func ollamaServer(t *testing.T, chats *[]ollamaChatRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/embeddings":
+			var req map[string]string
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			if req["model"] == "missing" {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":"model 'missing' not found"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"embedding":[%d,0.5]}`, len(req["prompt"]))
+		case "/api/chat":
+			var req ollamaChatRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			*chats = append(*chats, req)
+			if !req.Stream {
+				fmt.Fprint(w, `{"message":{"role":"assistant","content":"Hello, there"},"done":true}`)
+				return
+			}
+			for _, piece := range []string{"Hello", ", there"} {
+				fmt.Fprintf(w, "{\"message\":{\"role\":\"assistant\",\"content\":%q},\"done\":false}\n", piece)
+			}
+			fmt.Fprint(w, `{"message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":12,"eval_count":2}`+"\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestOllama(t *testing.T) {
+	var _ LLM = (*Ollama)(nil)
+
+	var chats []ollamaChatRequest
+	srv := ollamaServer(t, &chats)
+	defer srv.Close()
+
+	o := NewOllama(srv.URL+"/", "llama2", "nomic-embed-text")
+	ctx := context.TODO()
+
+	ems, err := o.Embedding(ctx, []string{"hi", "hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, []vectors{{2, 0.5}, {5, 0.5}}, ems)
+
+	reply, err := o.Chat(ctx, []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ChatMessage{Role: "assistant", Content: "Hello, there"}, reply)
+	assert.Equal(t, "llama2", chats[0].Model)
+	assert.Equal(t, []ollamaTurn{{Role: "user", Content: "hello"}}, chats[0].Messages)
+	assert.Nil(t, chats[0].Options)
+
+	// agent's model settings are the model and its options
+	temperature := float32(0.5)
+	ctx = WithModelSettings(ctx, &ModelSettings{Model: "mistral", Temperature: &temperature, MaxTokens: 32})
+	var deltas []string
+	reply, usage, err := o.ChatStream(ctx, []ChatMessage{{Role: "user", Content: "hello"}}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Hello", ", there"}, deltas)
+	assert.Equal(t, "Hello, there", reply.Content)
+	assert.Equal(t, &Usage{PromptTokens: 12, CompletionTokens: 2, TotalTokens: 14}, usage)
+	assert.Equal(t, "mistral", chats[1].Model)
+	assert.True(t, chats[1].Stream)
+	assert.Equal(t, &ollamaOptions{Temperature: &temperature, NumPredict: 32}, chats[1].Options)
+
+	// errors of the api are wrapped
+	_, err = NewOllama(srv.URL, "llama2", "missing").Embedding(context.TODO(), []string{"hi"})
+	assert.Equal(t, 500, err.(WrapError).Code())
+	assert.ErrorContains(t, err.(WrapError).Unwrap(), "model 'missing' not found")
+}
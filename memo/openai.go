@@ -1,7 +1,15 @@
 package memo
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
 
 	openai "github.com/sashabaranov/go-openai"
 )
@@ -11,58 +19,301 @@ type ChatMessage struct {
 	Content string `json:"message" bson:"message" toml:"message"`
 }
 
-// OpenAI which impletented LLM interface
+// Usage is the tokens used by a chat, they are Estimated if the api doesn't report them
+type Usage struct {
+	PromptTokens     int  `json:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens"`
+	TotalTokens      int  `json:"total_tokens"`
+	Estimated        bool `json:"estimated,omitempty"`
+}
+
+// estimateUsage estimates the tokens of the messages and the reply by about 4 characters per token,
+// completionTokens is used instead of the reply's estimation if it is positive
+func estimateUsage(messages []ChatMessage, reply ChatMessage, completionTokens int) *Usage {
+	u := &Usage{CompletionTokens: completionTokens, Estimated: true}
+	for _, m := range messages {
+		u.PromptTokens += estimateTokens(m.Content) + 4 // the role and separators of a message
+	}
+	if u.CompletionTokens <= 0 {
+		u.CompletionTokens = estimateTokens(reply.Content)
+	}
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+func estimateTokens(s string) int {
+	return (len([]rune(s)) + 3) / 4
+}
+
+// OpenAI which impletented LLM interface, it also talks to Azure OpenAI deployments
+// and the servers which are compatible with openai api
 type OpenAI struct {
 	client         *openai.Client
 	chatModel      string
-	emebddingModel openai.EmbeddingModel
+	emebddingModel string
+
+	// used to request the embedding models which the client doesn't know, only with openai api
+	baseURL string
+	apiKey  string
+	org     string
+	azure   bool
+
+	batch EmbeddingBatch
+	http  *http.Client // retries the requests
+}
+
+// OpenAIConfig is the settings of an openai api, empty values are the defaults of the public api
+type OpenAIConfig struct {
+	APIKey         string
+	BaseURL        string // e.g. "http://localhost:8000/v1" of a compatible server
+	Org            string // organization id
+	ChatModel      string
+	EmbeddingModel string
+
+	Batch EmbeddingBatch // 2048 contents and 100000 estimated tokens per request by default
+	Retry RetryPolicy    // DefaultRetryPolicy if it is zero
+}
+
+// AzureConfig is the settings of Azure OpenAI deployments
+type AzureConfig struct {
+	Endpoint            string // e.g. "https://<resource>.openai.azure.com"
+	APIKey              string
+	APIVersion          string
+	ChatDeployment      string
+	EmbeddingDeployment string
+
+	Batch EmbeddingBatch // 16 contents and 100000 estimated tokens per request by default
+	Retry RetryPolicy    // DefaultRetryPolicy if it is zero
 }
 
 func NewOpenAI(key string) *OpenAI {
+	return NewOpenAIWithConfig(OpenAIConfig{APIKey: key})
+}
+
+// NewOpenAIWithConfig creates the llm of an openai api, the models default to gpt-3.5-turbo and ada v2
+func NewOpenAIWithConfig(c OpenAIConfig) *OpenAI {
+	conf := openai.DefaultConfig(c.APIKey)
+	if c.BaseURL != "" {
+		conf.BaseURL = strings.TrimRight(c.BaseURL, "/")
+	}
+	conf.OrgID = c.Org
+	conf.HTTPClient = retryClient(c.Retry)
+
+	oa := &OpenAI{
+		client:         openai.NewClientWithConfig(conf),
+		chatModel:      c.ChatModel,
+		emebddingModel: c.EmbeddingModel,
+		baseURL:        conf.BaseURL,
+		apiKey:         c.APIKey,
+		org:            c.Org,
+		batch:          c.Batch.or(EmbeddingBatch{Size: OPENAI_EMBEDDING_BATCH_SIZE, Tokens: OPENAI_EMBEDDING_BATCH_TOKENS}),
+		http:           conf.HTTPClient,
+	}
+	if oa.chatModel == "" {
+		oa.chatModel = openai.GPT3Dot5Turbo
+	}
+	if oa.emebddingModel == "" {
+		oa.emebddingModel = openai.AdaEmbeddingV2.String()
+	}
+	return oa
+}
+
+// NewAzureOpenAI creates the llm of Azure OpenAI deployments, the chat models of agents' settings are deployments too
+func NewAzureOpenAI(c AzureConfig) *OpenAI {
+	conf := openai.DefaultAzureConfig(c.APIKey, strings.TrimRight(c.Endpoint, "/"))
+	if c.APIVersion != "" {
+		conf.APIVersion = c.APIVersion
+	}
+	// embeddings are requested by the model, which is mapped to the embedding deployment
+	conf.AzureModelMapperFunc = func(model string) string {
+		if model == openai.AdaEmbeddingV2.String() {
+			return c.EmbeddingDeployment
+		}
+		return model
+	}
+	conf.HTTPClient = retryClient(c.Retry)
+
 	return &OpenAI{
-		client:         openai.NewClient(key),
-		chatModel:      openai.GPT3Dot5Turbo,
-		emebddingModel: openai.AdaEmbeddingV2,
+		client:         openai.NewClientWithConfig(conf),
+		chatModel:      c.ChatDeployment,
+		emebddingModel: openai.AdaEmbeddingV2.String(),
+		azure:          true,
+		batch:          c.Batch.or(EmbeddingBatch{Size: AZURE_EMBEDDING_BATCH_SIZE, Tokens: OPENAI_EMBEDDING_BATCH_TOKENS}),
+		http:           conf.HTTPClient,
 	}
 }
 
-// Embedding call openai embedding api to generate vectors
-func (oa *OpenAI) Embedding(ctx context.Context, contents []string) (ems []vectors, err error) {
+// Embedding call openai embedding api to generate vectors, the contents are split into batches, see EmbeddingBatch
+func (oa *OpenAI) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	return embedInBatches(ctx, oa.batch, contents, oa.embedding)
+}
+
+// embedding requests the vectors of the contents at once
+func (oa *OpenAI) embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	var model openai.EmbeddingModel
+	_ = model.UnmarshalText([]byte(oa.emebddingModel))
+	if model == openai.Unknown {
+		return oa.embeddingOf(ctx, contents)
+	}
+
 	req := openai.EmbeddingRequest{
 		Input: contents,
-		Model: openai.AdaEmbeddingV2,
+		Model: model,
 	}
 
 	res, err := oa.client.CreateEmbeddings(ctx, req)
 	if err != nil {
 		return nil, NewWrapError(500, err, "openai embedding api error occurred")
 	}
+	return embeddingsOf(len(contents), res.Data)
+}
 
-	ems = make([]vectors, len(contents))
-	for _, em := range res.Data {
-		ems[em.Index] = em.Embedding // using embedding's own index
+// embeddingOf requests the embedding model which the client doesn't know, e.g. the models of a compatible server
+func (oa *OpenAI) embeddingOf(ctx context.Context, contents []string) ([]vectors, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": contents, "model": oa.emebddingModel})
+	if err != nil {
+		return nil, err
 	}
-	return
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, oa.baseURL+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if oa.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+oa.apiKey)
+	}
+	if oa.org != "" {
+		req.Header.Set("OpenAI-Organization", oa.org)
+	}
+
+	res, err := oa.http.Do(req)
+	if err != nil {
+		return nil, NewWrapError(500, err, "openai embedding api error occurred")
+	}
+	defer res.Body.Close()
+
+	var data struct {
+		Data  []openai.Embedding `json:"data"`
+		Error *openai.APIError   `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil && res.StatusCode == http.StatusOK {
+		return nil, NewWrapError(500, err, "can't decode openai embedding response")
+	}
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("status code %d", res.StatusCode)
+		if data.Error != nil {
+			err = fmt.Errorf("status code %d: %s", res.StatusCode, data.Error.Message)
+		}
+		return nil, NewWrapError(500, err, "openai embedding api error occurred")
+	}
+	return embeddingsOf(len(contents), data.Data)
 }
 
-// Chat to openai chat api, and get the response
-func (oa *OpenAI) Chat(ctx context.Context, messages []ChatMessage) (result ChatMessage, err error) {
-	msgs := make([]openai.ChatCompletionMessage, len(messages))
-	for i, m := range messages {
-		msgs[i] = openai.ChatCompletionMessage{
-			Role:    m.Role,
-			Content: m.Content,
+// embeddingsOf orders the embeddings by their own indexes, every content should have one
+func embeddingsOf(n int, data []openai.Embedding) ([]vectors, error) {
+	ems := make([]vectors, n)
+	for _, em := range data {
+		if em.Index < 0 || em.Index >= n {
+			return nil, NewWrapError(500, fmt.Errorf("embedding index out of range: %d", em.Index), "")
 		}
+		ems[em.Index] = em.Embedding // using embedding's own index
 	}
-	res, err := oa.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-		Model:    oa.chatModel,
-		Messages: msgs,
-	})
+	for idx, em := range ems {
+		if em == nil {
+			return nil, NewWrapError(500, fmt.Errorf("no embedding of content %d", idx), "")
+		}
+	}
+	return ems, nil
+}
+
+// Chat to openai chat api, and get the response, the model settings which ctx carries override the defaults
+func (oa *OpenAI) Chat(ctx context.Context, messages []ChatMessage) (result ChatMessage, err error) {
+	res, err := oa.client.CreateChatCompletion(ctx, oa.completionRequest(ctx, messages))
 	if err != nil {
 		err = NewWrapError(500, err, "openai chat api error occurred")
 		return
 	}
+	if len(res.Choices) == 0 {
+		err = NewWrapError(500, errors.New("no choices in the response"), "openai chat api error occurred")
+		return
+	}
 
 	result = ChatMessage{Role: res.Choices[0].Message.Role, Content: res.Choices[0].Message.Content}
 	return
 }
+
+// ChatStream to openai chat api, onDelta is called with each piece of the reply as it arrives.
+// cancelling ctx closes the upstream request. the api doesn't report the usage of streams,
+// so the completion tokens are the number of pieces, and the prompt tokens are estimated
+func (oa *OpenAI) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(delta string) error) (ChatMessage, *Usage, error) {
+	stream, err := oa.client.CreateChatCompletionStream(ctx, oa.completionRequest(ctx, messages))
+	if err != nil {
+		return ChatMessage{}, nil, NewWrapError(500, err, "openai chat api error occurred")
+	}
+	defer stream.Close()
+
+	result := ChatMessage{Role: openai.ChatMessageRoleAssistant}
+	var content []byte
+	pieces := 0
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return ChatMessage{}, nil, NewWrapError(500, err, "openai chat stream error occurred")
+		}
+		if len(res.Choices) == 0 {
+			continue
+		}
+
+		delta := res.Choices[0].Delta
+		if delta.Role != "" {
+			result.Role = delta.Role
+		}
+		if delta.Content == "" {
+			continue
+		}
+		pieces++
+		content = append(content, delta.Content...)
+		if err := onDelta(delta.Content); err != nil {
+			return ChatMessage{}, nil, err
+		}
+	}
+
+	result.Content = string(content)
+	return result, estimateUsage(messages, result, pieces), nil
+}
+
+// completionRequest applies the model settings which ctx carries,
+// a zero temperature is sent as the smallest one, because the client omits zero and the api would default it to 1
+func (oa *OpenAI) completionRequest(ctx context.Context, messages []ChatMessage) openai.ChatCompletionRequest {
+	req := openai.ChatCompletionRequest{
+		Model:    oa.chatModel,
+		Messages: completionMessages(messages),
+	}
+	if settings := ModelSettingsFromContext(ctx); settings != nil {
+		if settings.Model != "" {
+			req.Model = settings.Model
+		}
+		if settings.Temperature != nil {
+			req.Temperature = *settings.Temperature
+			if req.Temperature == 0 {
+				req.Temperature = math.SmallestNonzeroFloat32
+			}
+		}
+		req.MaxTokens = settings.MaxTokens
+	}
+	return req
+}
+
+func completionMessages(messages []ChatMessage) []openai.ChatCompletionMessage {
+	msgs := make([]openai.ChatCompletionMessage, len(messages))
+	for i, m := range messages {
+		msgs[i] = openai.ChatCompletionMessage{
+			Role:    m.Role,
+			Content: m.Content,
+		}
+	}
+	return msgs
+}
@@ -2,8 +2,15 @@ package memo
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 
+	openai "github.com/sashabaranov/go-openai"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,8 +18,9 @@ func TestEmbedding(t *testing.T) {
 	// check agents is implements AgentModel
 	var _ LLM = (*OpenAI)(nil)
 
-	memo := FromConfig("../.config.toml")
-	oa := NewOpenAI(memo.Config.OpenAIAPIKey)
+	conf, err := LoadConfig("../.config.toml", nil)
+	assert.NoError(t, err)
+	oa := NewOpenAI(conf.OpenAIAPIKey)
 	ctx := context.TODO()
 	ems, err := oa.Embedding(ctx, []string{"hello", "world"})
 	assert.NoError(t, err)
@@ -20,10 +28,182 @@ func TestEmbedding(t *testing.T) {
 }
 
 func TestChat(t *testing.T) {
-	memo := FromConfig("../.config.toml")
-	oa := NewOpenAI(memo.Config.OpenAIAPIKey)
+	conf, err := LoadConfig("../.config.toml", nil)
+	assert.NoError(t, err)
+	oa := NewOpenAI(conf.OpenAIAPIKey)
 	ctx := context.TODO()
 	res, err := oa.Chat(ctx, []ChatMessage{{Role: "user", Content: "hello"}})
 	assert.NoError(t, err)
 	t.Log(res, err)
 }
+
+func TestOpenAIChatStream(t *testing.T) {
+	cancelled := make(chan struct{})
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, delta := range []string{`{"role":"assistant"}`, `{"content":"Hello"}`, `{"content":", there"}`} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":%s}]}\n\n", delta)
+		}
+		w.(http.Flusher).Flush()
+		// the first stream is done, the second one hangs until it is cancelled
+		if atomic.AddInt32(&requests, 1) == 1 {
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer srv.Close()
+
+	conf := openai.DefaultConfig("key")
+	conf.BaseURL = srv.URL
+	oa := &OpenAI{client: openai.NewClientWithConfig(conf), chatModel: openai.GPT3Dot5Turbo}
+
+	var deltas []string
+	reply, usage, err := oa.ChatStream(context.TODO(), []ChatMessage{{Role: "user", Content: "hello"}}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Hello", ", there"}, deltas)
+	assert.Equal(t, ChatMessage{Role: "assistant", Content: "Hello, there"}, reply)
+	assert.Equal(t, 2, usage.CompletionTokens)
+	assert.True(t, usage.Estimated)
+
+	// cancelling the context closes the upstream request
+	ctx, cancel := context.WithCancel(context.TODO())
+	_, _, err = oa.ChatStream(ctx, []ChatMessage{{Role: "user", Content: "hello"}}, func(delta string) error {
+		cancel()
+		return nil
+	})
+	assert.Error(t, err)
+	<-cancelled
+}
+
+func TestOpenAIModelSettings(t *testing.T) {
+	var got openai.ChatCompletionRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"}}]}`)
+	}))
+	defer srv.Close()
+
+	conf := openai.DefaultConfig("key")
+	conf.BaseURL = srv.URL
+	oa := &OpenAI{client: openai.NewClientWithConfig(conf), chatModel: openai.GPT3Dot5Turbo}
+
+	_, err := oa.Chat(context.TODO(), []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+	assert.Equal(t, openai.GPT3Dot5Turbo, got.Model)
+	assert.Zero(t, got.MaxTokens)
+
+	// the settings which ctx carries override the defaults
+	temperature := float32(0.3)
+	ctx := WithModelSettings(context.TODO(), &ModelSettings{Model: openai.GPT4, Temperature: &temperature, MaxTokens: 64})
+	reply, err := oa.Chat(ctx, []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", reply.Content)
+	assert.Equal(t, openai.GPT4, got.Model)
+	assert.Equal(t, temperature, got.Temperature)
+	assert.Equal(t, 64, got.MaxTokens)
+
+	// a zero temperature is sent, rather than omitted for the api's default
+	got, temperature = openai.ChatCompletionRequest{}, 0
+	_, err = oa.Chat(WithModelSettings(context.TODO(), &ModelSettings{Temperature: &temperature}), []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+	assert.Greater(t, got.Temperature, float32(0))
+	assert.Less(t, got.Temperature, float32(1e-6))
+}
+
+func TestOpenAICompatible(t *testing.T) {
+	var paths, orgs, models []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		paths, orgs, models = append(paths, r.URL.Path), append(orgs, r.Header.Get("OpenAI-Organization")), append(models, body["model"].(string))
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/embeddings" {
+			// out of order, the indexes tell
+			fmt.Fprint(w, `{"data":[{"index":1,"embedding":[0,1]},{"index":0,"embedding":[1,0]}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"}}]}`)
+	}))
+	defer srv.Close()
+
+	// the client doesn't know the embedding model, it is requested directly
+	oa := NewOpenAIWithConfig(OpenAIConfig{APIKey: "key", BaseURL: srv.URL + "/v1/", Org: "org", ChatModel: "mistral", EmbeddingModel: "bge-small"})
+	ems, err := oa.Embedding(context.TODO(), []string{"hello", "world"})
+	assert.NoError(t, err)
+	assert.Equal(t, []vectors{{1, 0}, {0, 1}}, ems)
+
+	reply, err := oa.Chat(context.TODO(), []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", reply.Content)
+
+	// known embedding models go through the client
+	oa = NewOpenAIWithConfig(OpenAIConfig{APIKey: "key", BaseURL: srv.URL + "/v1", Org: "org"})
+	_, err = oa.Embedding(context.TODO(), []string{"hello", "world"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"/v1/embeddings", "/v1/chat/completions", "/v1/embeddings"}, paths)
+	assert.Equal(t, []string{"org", "org", "org"}, orgs)
+	assert.Equal(t, []string{"bge-small", "mistral", "text-embedding-ada-002"}, models)
+
+	// errors of the server are wrapped
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"message":"model not found"}}`)
+	})
+	oa = NewOpenAIWithConfig(OpenAIConfig{BaseURL: srv.URL, EmbeddingModel: "bge-small"})
+	_, err = oa.Embedding(context.TODO(), []string{"hello"})
+	assert.Equal(t, 500, err.(WrapError).Code())
+	assert.ErrorContains(t, err.(WrapError).Unwrap(), "model not found")
+
+	// a reply without choices is an error too
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[]}`)
+	})
+	_, err = oa.Chat(context.TODO(), []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.Equal(t, 500, err.(WrapError).Code())
+	assert.ErrorContains(t, err.(WrapError).Unwrap(), "no choices")
+}
+
+func TestAzureOpenAI(t *testing.T) {
+	var urls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urls = append(urls, r.URL.String())
+		assert.Equal(t, "key", r.Header.Get("api-key"))
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/embeddings") {
+			fmt.Fprint(w, `{"data":[{"index":0,"embedding":[1,0]}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"}}]}`)
+	}))
+	defer srv.Close()
+
+	oa := NewAzureOpenAI(AzureConfig{Endpoint: srv.URL + "/", APIKey: "key", APIVersion: "2023-07-01-preview", ChatDeployment: "chat", EmbeddingDeployment: "embed"})
+	ems, err := oa.Embedding(context.TODO(), []string{"hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, []vectors{{1, 0}}, ems)
+
+	_, err = oa.Chat(context.TODO(), []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+
+	// agent's model is a deployment
+	_, err = oa.Chat(WithModelSettings(context.TODO(), &ModelSettings{Model: "gpt4"}), []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"/openai/deployments/embed/embeddings?api-version=2023-07-01-preview",
+		"/openai/deployments/chat/chat/completions?api-version=2023-07-01-preview",
+		"/openai/deployments/gpt4/chat/completions?api-version=2023-07-01-preview",
+	}, urls)
+}
@@ -0,0 +1,216 @@
+package memo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const OUTBOX_COLLECTION = "outbox"
+
+// outbox task operations
+const OUTBOX_DELETE_DOCUMENTS = "delete_documents"   // remove documents whose points were never written
+const OUTBOX_DELETE_MEMORIES = "delete_memories"     // remove documents and the points which may have been written
+const OUTBOX_RESTORE_DOCUMENTS = "restore_documents" // put back the previous documents and their points
+
+// how long a compensation may take, it doesn't use the request's context which may be canceled already
+const COMPENSATION_TIMEOUT = 10 * time.Second
+
+// outboxTask is a compensation of a half applied write
+type outboxTask struct {
+	ID  primitive.ObjectID `bson:"_id"`
+	AID primitive.ObjectID `bson:"aid"`
+	Op  string             `bson:"op"`
+
+	MIDs      []primitive.ObjectID `bson:"mids,omitempty"`
+	Documents []*Memory            `bson:"documents,omitempty"`
+	// updated_at written by the failed write, the documents changed since are not restored,
+	// nil if the documents were deleted, then they are restored only if they are still missing
+	Stamp *time.Time `bson:"stamp,omitempty"`
+
+	Attempts int       `bson:"attempts"`
+	Error    string    `bson:"error"` // last error
+	Created  time.Time `bson:"created_at"`
+}
+
+// compensate undoes a half applied write with the task right away,
+// or queues the task in the outbox if it fails too.
+// op is the name of the write, cause is the error which broke the write.
+func (ms *Memories) compensate(ctx context.Context, op string, cause error, task *outboxTask) error {
+	cctx, cancel := context.WithTimeout(context.Background(), COMPENSATION_TIMEOUT)
+	defer cancel()
+
+	err := ms.applyTask(cctx, task)
+	if err == nil {
+		return NewWrapError(500, fmt.Errorf("%w: %v", ErrRolledBack, cause), fmt.Sprintf("memories %s failed and was rolled back", op))
+	}
+
+	if ms.outbox != nil {
+		task.ID = primitive.NewObjectID()
+		task.Attempts = 1
+		task.Error = err.Error()
+		task.Created = time.Now()
+		_, qerr := ms.outbox.InsertOne(cctx, task)
+		if qerr == nil {
+			return NewWrapError(500, fmt.Errorf("%w: %v, compensation: %v", ErrRepairPending, cause, err), fmt.Sprintf("memories %s failed, repair is pending", op))
+		}
+		err = errors.Join(err, qerr)
+	}
+
+	return NewWrapError(500, fmt.Errorf("%w: %v, compensation: %v", ErrInconsistent, cause, err), fmt.Sprintf("memories %s failed and left inconsistent data", op))
+}
+
+// ApplyOutbox retries the queued compensations from the oldest,
+// applied tasks are removed, and it returns the number of them
+func (ms *Memories) ApplyOutbox(ctx context.Context) (int, error) {
+	if ms.outbox == nil {
+		return 0, nil
+	}
+
+	cur, err := ms.outbox.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var tasks []*outboxTask
+	if err = cur.All(ctx, &tasks); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	var errs []error
+	for _, task := range tasks {
+		if err := ms.applyTask(ctx, task); err != nil {
+			errs = append(errs, fmt.Errorf("outbox task %s: %w", task.ID.Hex(), err))
+			_, _ = ms.outbox.UpdateByID(ctx, task.ID, bson.M{"$inc": bson.M{"attempts": 1}, "$set": bson.M{"error": err.Error()}})
+			continue
+		}
+		if _, err := ms.outbox.DeleteOne(ctx, bson.M{"_id": task.ID}); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		applied++
+	}
+	return applied, errors.Join(errs...)
+}
+
+// applyTask applies the compensation, its memories are marked dirty for a running re-embedding job
+func (ms *Memories) applyTask(ctx context.Context, task *outboxTask) error {
+	switch task.Op {
+	case OUTBOX_DELETE_DOCUMENTS:
+		_, err := ms.mongo.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": task.MIDs}, "aid": task.AID})
+		if err != nil {
+			return err
+		}
+		return ms.markDirty(ctx, task.AID, task.MIDs)
+	case OUTBOX_DELETE_MEMORIES:
+		_, err := ms.mongo.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": task.MIDs}, "aid": task.AID})
+		if err != nil {
+			return err
+		}
+		collection, err := ms.collectionOf(ctx, task.AID)
+		if err != nil {
+			return err
+		}
+		if err := ms.deleteMemoryPoints(ctx, collection, task.MIDs); err != nil {
+			return err
+		}
+		return ms.markDirty(ctx, task.AID, task.MIDs)
+	case OUTBOX_RESTORE_DOCUMENTS:
+		return ms.restoreDocuments(ctx, task)
+	default:
+		return fmt.Errorf("unknown outbox operation: %s", task.Op)
+	}
+}
+
+// newStamp is the updated_at of a write, in the milliseconds which mongodb keeps, so it can be matched later
+func newStamp() time.Time {
+	return time.Now().Truncate(time.Millisecond)
+}
+
+// restoreDocuments puts back the previous documents which are still as the failed write left them, then re-upserts
+// the points of the live ones with their previous contents and payloads, as the failed write may have changed or
+// deleted them. the documents restored by an earlier attempt are matched again, so their points are retried
+func (ms *Memories) restoreDocuments(ctx context.Context, task *outboxTask) error {
+	var live []*Memory
+	mids := make([]primitive.ObjectID, 0, len(task.Documents))
+	for _, doc := range task.Documents {
+		restored, err := ms.restoreDocument(ctx, task, doc)
+		if err != nil {
+			return err
+		}
+		if restored && doc.Archived == nil {
+			live = append(live, doc)
+		}
+		mids = append(mids, doc.ID)
+	}
+
+	if len(live) > 0 {
+		ems, _, err := ms.embed(ctx, task.AID, contentsOf(live))
+		if err != nil {
+			return err
+		}
+		if err := ms.upsertPoints(ctx, task.AID, live, ems); err != nil {
+			return err
+		}
+	}
+	return ms.markDirty(ctx, task.AID, mids)
+}
+
+// restoreDocument puts back the previous document, it reports whether the document is the previous one now
+func (ms *Memories) restoreDocument(ctx context.Context, task *outboxTask, doc *Memory) (bool, error) {
+	unchanged := bson.M{"_id": doc.ID, "aid": task.AID, "updated_at": bson.M{"$exists": false}}
+	if doc.Updated != nil {
+		unchanged["updated_at"] = *doc.Updated
+	}
+
+	if task.Stamp == nil {
+		_, err := ms.mongo.InsertOne(ctx, doc)
+		if err == nil {
+			return true, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return false, err
+		}
+		n, err := ms.mongo.CountDocuments(ctx, unchanged)
+		return n > 0, err
+	}
+
+	filter := bson.M{"_id": doc.ID, "aid": task.AID, "$or": bson.A{bson.M{"updated_at": *task.Stamp}, bson.M{"updated_at": unchanged["updated_at"]}}}
+	res, err := ms.mongo.ReplaceOne(ctx, filter, doc)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// RunOutbox applies the memories model's outbox every interval until ctx is done,
+// it does nothing if the model has no outbox
+func (m *Memo) RunOutbox(ctx context.Context, interval time.Duration) {
+	applier, ok := m.Memories.(OutboxApplier)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := applier.ApplyOutbox(ctx)
+			if n > 0 && m.Logger != nil {
+				m.Logger.Infof("outbox: %d compensations applied", n)
+			}
+			if err != nil && m.Logger != nil {
+				m.Logger.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	pb "github.com/qdrant/go-client/qdrant"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// payload keys of memory points
+const PAYLOAD_MID = "mid"
+const PAYLOAD_TAGS = "tags"
+const PAYLOAD_SOURCE = "source"
+const PAYLOAD_METADATA = "metadata"
+const PAYLOAD_CREATED = "created_at" // unix seconds
+
+// payload fields which are indexed when an agent's collection is created, metadata keys are free-form,
+// so only the ones of metadata_indexes are indexed, see Config.PayloadIndexes
+var payloadIndexes = map[string]pb.FieldType{
+	PAYLOAD_TAGS:    pb.FieldType_FieldTypeKeyword,
+	PAYLOAD_SOURCE:  pb.FieldType_FieldTypeKeyword,
+	PAYLOAD_CREATED: pb.FieldType_FieldTypeInteger,
+}
+
+// index types of metadata keys
+var metadataIndexTypes = map[string]pb.FieldType{
+	"keyword": pb.FieldType_FieldTypeKeyword,
+	"integer": pb.FieldType_FieldTypeInteger,
+	"float":   pb.FieldType_FieldTypeFloat,
+}
+
+// parseMetadataIndexes parses comma separated "key:type" into the index types of the metadata keys
+func parseMetadataIndexes(s string) (map[string]pb.FieldType, error) {
+	indexes := make(map[string]pb.FieldType)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, name, _ := strings.Cut(item, ":")
+		if key == "" || strings.ContainsAny(key, ".$") {
+			return nil, fmt.Errorf("invalid metadata key: %q", key)
+		}
+		typ, ok := metadataIndexTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("metadata key %s should be indexed as keyword, integer or float, got %q", key, name)
+		}
+		indexes[key] = typ
+	}
+	return indexes, nil
+}
+
+// PayloadIndexes returns the payload fields to index, the metadata keys of metadata_indexes included
+func (c *Config) PayloadIndexes() map[string]pb.FieldType {
+	indexes := make(map[string]pb.FieldType, len(payloadIndexes))
+	for field, typ := range payloadIndexes {
+		indexes[field] = typ
+	}
+	metadata, _ := parseMetadataIndexes(c.MetadataIndexes) // checked by Validate
+	for key, typ := range metadata {
+		indexes[PAYLOAD_METADATA+"."+key] = typ
+	}
+	return indexes
+}
+
+// createPayloadIndexes creates the payload indexes of memory points in the collection, payloadIndexes if indexes is nil
+func createPayloadIndexes(ctx context.Context, points pb.PointsClient, name string, indexes map[string]pb.FieldType) error {
+	if indexes == nil {
+		indexes = payloadIndexes
+	}
+	wait := true
+	for field, typ := range indexes {
+		typ := typ
+		_, err := points.CreateFieldIndex(ctx, &pb.CreateFieldIndexCollection{
+			CollectionName: name,
+			Wait:           &wait,
+			FieldName:      field,
+			FieldType:      &typ,
+		})
+		if err != nil {
+			return NewWrapError(500, err, "memory payload index create error")
+		}
+	}
+	return nil
+}
+
+// missingPayloadIndexes returns the indexes which the collection doesn't have, a collection created before
+// the indexes were added or configured lacks them
+func missingPayloadIndexes(ctx context.Context, qdrant pb.CollectionsClient, name string, indexes map[string]pb.FieldType) (map[string]pb.FieldType, error) {
+	if indexes == nil {
+		indexes = payloadIndexes
+	}
+	res, err := qdrant.Get(ctx, &pb.GetCollectionInfoRequest{CollectionName: name})
+	if err != nil {
+		return nil, NewWrapError(500, err, "qdrant collection get error")
+	}
+	schema := res.GetResult().GetPayloadSchema()
+	missing := make(map[string]pb.FieldType)
+	for field, typ := range indexes {
+		if _, ok := schema[field]; !ok {
+			missing[field] = typ
+		}
+	}
+	return missing, nil
+}
+
+// memoryPayload mirrors the memory's searchable fields into the point's payload
+func memoryPayload(m *Memory) map[string]*pb.Value {
+	payload := map[string]*pb.Value{
+		PAYLOAD_MID:     toValue(m.ID.Hex()),
+		PAYLOAD_CREATED: toValue(m.Created.Unix()),
+	}
+	if len(m.Tags) > 0 {
+		payload[PAYLOAD_TAGS] = toValue(m.Tags)
+	}
+	if m.Source != "" {
+		payload[PAYLOAD_SOURCE] = toValue(m.Source)
+	}
+	if len(m.Metadata) > 0 {
+		payload[PAYLOAD_METADATA] = toValue(m.Metadata)
+	}
+	return payload
+}
+
+// validateMemoryFields checks importance, and tags and metadata keys which are used as mongodb and qdrant field paths
+func validateMemoryFields(m *Memory) error {
+	if m.Importance < 0 || m.Importance > 1 {
+		return NewWrapError(400, fmt.Errorf("memory importance should be in [0, 1]"), "")
+	}
+	for _, tag := range m.Tags {
+		if tag == "" {
+			return NewWrapError(400, fmt.Errorf("memory tag should not be empty"), "")
+		}
+	}
+	for key := range m.Metadata {
+		if key == "" || strings.ContainsAny(key, ".$") {
+			return NewWrapError(400, fmt.Errorf("invalid memory metadata key: %q", key), "")
+		}
+	}
+	return nil
+}
+
+// toValue converts json or bson decoded values into qdrant values,
+// unsupported values are converted into their string forms
+func toValue(v interface{}) *pb.Value {
+	switch x := v.(type) {
+	case nil:
+		return &pb.Value{Kind: &pb.Value_NullValue{}}
+	case *pb.Value:
+		return x
+	case string:
+		return &pb.Value{Kind: &pb.Value_StringValue{StringValue: x}}
+	case bool:
+		return &pb.Value{Kind: &pb.Value_BoolValue{BoolValue: x}}
+	case int:
+		return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: int64(x)}}
+	case int32:
+		return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: int64(x)}}
+	case int64:
+		return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: x}}
+	case float32:
+		return &pb.Value{Kind: &pb.Value_DoubleValue{DoubleValue: float64(x)}}
+	case float64:
+		// json numbers are float64, keep the whole ones as integers
+		if x == float64(int64(x)) {
+			return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: int64(x)}}
+		}
+		return &pb.Value{Kind: &pb.Value_DoubleValue{DoubleValue: x}}
+	case time.Time:
+		return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: x.Unix()}}
+	case primitive.DateTime:
+		return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: x.Time().Unix()}}
+	case primitive.ObjectID:
+		return &pb.Value{Kind: &pb.Value_StringValue{StringValue: x.Hex()}}
+	case []string:
+		values := make([]*pb.Value, len(x))
+		for i, s := range x {
+			values[i] = toValue(s)
+		}
+		return &pb.Value{Kind: &pb.Value_ListValue{ListValue: &pb.ListValue{Values: values}}}
+	case []interface{}:
+		return toListValue(x)
+	case primitive.A:
+		return toListValue(x)
+	case map[string]interface{}:
+		fields := make(map[string]*pb.Value, len(x))
+		for k, e := range x {
+			fields[k] = toValue(e)
+		}
+		return &pb.Value{Kind: &pb.Value_StructValue{StructValue: &pb.Struct{Fields: fields}}}
+	case primitive.M:
+		return toValue(map[string]interface{}(x))
+	case primitive.D:
+		fields := make(map[string]*pb.Value, len(x))
+		for _, e := range x {
+			fields[e.Key] = toValue(e.Value)
+		}
+		return &pb.Value{Kind: &pb.Value_StructValue{StructValue: &pb.Struct{Fields: fields}}}
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: rv.Int()}}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &pb.Value{Kind: &pb.Value_IntegerValue{IntegerValue: int64(rv.Uint())}}
+	}
+	return &pb.Value{Kind: &pb.Value_StringValue{StringValue: fmt.Sprint(v)}}
+}
+
+func toListValue(x []interface{}) *pb.Value {
+	values := make([]*pb.Value, len(x))
+	for i, e := range x {
+		values[i] = toValue(e)
+	}
+	return &pb.Value{Kind: &pb.Value_ListValue{ListValue: &pb.ListValue{Values: values}}}
+}
+
+// mergeMemory applies the provided fields of m onto a copy of prev,
+// empty content or source, zero importance, and nil tags or metadata are left as they were.
+// it reports whether the content changed, which needs a new embedding,
+// and whether anything changed at all
+func mergeMemory(prev, m *Memory) (next *Memory, contentChanged bool, changed bool) {
+	merged := *prev
+	if m.Content != "" && m.Content != prev.Content {
+		merged.Content = m.Content
+		contentChanged = true
+	}
+	if m.Tags != nil && !reflect.DeepEqual(m.Tags, prev.Tags) && (len(m.Tags) > 0 || len(prev.Tags) > 0) {
+		merged.Tags = m.Tags
+		changed = true
+	}
+	if m.Source != "" && m.Source != prev.Source {
+		merged.Source = m.Source
+		changed = true
+	}
+	if m.Importance != 0 && m.Importance != prev.Importance {
+		merged.Importance = m.Importance
+		changed = true
+	}
+	if m.Metadata != nil && !reflect.DeepEqual(m.Metadata, prev.Metadata) && (len(m.Metadata) > 0 || len(prev.Metadata) > 0) {
+		merged.Metadata = m.Metadata
+		changed = true
+	}
+	return &merged, contentChanged, changed || contentChanged
+}
@@ -0,0 +1,130 @@
+package memo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/qdrant/go-client/qdrant"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+)
+
+func TestToValue(t *testing.T) {
+	assert.Equal(t, "hello", toValue("hello").GetStringValue())
+	assert.Equal(t, true, toValue(true).GetBoolValue())
+	assert.Equal(t, int64(42), toValue(42).GetIntegerValue())
+	assert.Equal(t, int64(42), toValue(uint8(42)).GetIntegerValue())
+	// whole json numbers are integers
+	assert.Equal(t, int64(3), toValue(3.0).GetIntegerValue())
+	assert.Equal(t, 3.5, toValue(3.5).GetDoubleValue())
+	assert.IsType(t, &pb.Value_NullValue{}, toValue(nil).GetKind())
+
+	now := time.Now()
+	assert.Equal(t, now.Unix(), toValue(now).GetIntegerValue())
+	assert.Equal(t, now.Unix(), toValue(primitive.NewDateTimeFromTime(now)).GetIntegerValue())
+
+	list := toValue(primitive.A{"a", 1}).GetListValue().GetValues()
+	assert.Len(t, list, 2)
+	assert.Equal(t, "a", list[0].GetStringValue())
+	assert.Equal(t, int64(1), list[1].GetIntegerValue())
+
+	nested := toValue(map[string]interface{}{"user": primitive.D{{Key: "name", Value: "aspirin"}}})
+	assert.Equal(t, "aspirin", nested.GetStructValue().GetFields()["user"].GetStructValue().GetFields()["name"].GetStringValue())
+
+	// unsupported values are strings
+	assert.Equal(t, "[1 2]", toValue([]float32{1, 2}).GetStringValue())
+}
+
+func TestMemoryPayload(t *testing.T) {
+	m := &Memory{ID: primitive.NewObjectID(), Created: time.Unix(100, 0)}
+	payload := memoryPayload(m)
+	assert.Len(t, payload, 2)
+	assert.Equal(t, m.ID.Hex(), payload[PAYLOAD_MID].GetStringValue())
+	assert.Equal(t, int64(100), payload[PAYLOAD_CREATED].GetIntegerValue())
+
+	m.Tags = []string{"work"}
+	m.Source = "slack"
+	m.Metadata = map[string]interface{}{"channel": "general", "priority": 2.0}
+	payload = memoryPayload(m)
+	assert.Equal(t, "work", payload[PAYLOAD_TAGS].GetListValue().GetValues()[0].GetStringValue())
+	assert.Equal(t, "slack", payload[PAYLOAD_SOURCE].GetStringValue())
+	fields := payload[PAYLOAD_METADATA].GetStructValue().GetFields()
+	assert.Equal(t, "general", fields["channel"].GetStringValue())
+	assert.Equal(t, int64(2), fields["priority"].GetIntegerValue())
+}
+
+func TestValidateMemoryFields(t *testing.T) {
+	assert.NoError(t, validateMemoryFields(&Memory{Tags: []string{"a"}, Metadata: map[string]interface{}{"k": 1}}))
+
+	for _, m := range []*Memory{
+		{Tags: []string{""}},
+		{Metadata: map[string]interface{}{"": 1}},
+		{Metadata: map[string]interface{}{"a.b": 1}},
+		{Metadata: map[string]interface{}{"$gt": 1}},
+	} {
+		err := validateMemoryFields(m)
+		assert.Equal(t, 400, err.(WrapError).Code())
+	}
+}
+
+func TestMergeMemory(t *testing.T) {
+	prev := &Memory{Content: "red", Tags: []string{"a"}, Source: "slack"}
+
+	_, contentChanged, changed := mergeMemory(prev, &Memory{Content: "red"})
+	assert.False(t, contentChanged)
+	assert.False(t, changed)
+
+	// nil tags and empty source are left as they were
+	next, contentChanged, changed := mergeMemory(prev, &Memory{Metadata: map[string]interface{}{"k": "v"}})
+	assert.False(t, contentChanged)
+	assert.True(t, changed)
+	assert.Equal(t, "red", next.Content)
+	assert.Equal(t, []string{"a"}, next.Tags)
+	assert.Equal(t, "slack", next.Source)
+	assert.Equal(t, "v", next.Metadata["k"])
+
+	// empty tags clear them
+	next, _, changed = mergeMemory(prev, &Memory{Tags: []string{}})
+	assert.True(t, changed)
+	assert.Empty(t, next.Tags)
+	assert.Equal(t, []string{"a"}, prev.Tags)
+
+	next, contentChanged, _ = mergeMemory(prev, &Memory{Content: "blue"})
+	assert.True(t, contentChanged)
+	assert.Equal(t, "blue", next.Content)
+}
+
+// schemaCollections has the payload indexes of the schema in every collection
+type schemaCollections struct {
+	pb.CollectionsClient
+	schema map[string]*pb.PayloadSchemaInfo
+}
+
+func (sc schemaCollections) Get(ctx context.Context, in *pb.GetCollectionInfoRequest, opts ...grpc.CallOption) (*pb.GetCollectionInfoResponse, error) {
+	return &pb.GetCollectionInfoResponse{Result: &pb.CollectionInfo{PayloadSchema: sc.schema}}, nil
+}
+
+func TestPayloadIndexes(t *testing.T) {
+	conf := DefaultConfig()
+	assert.Equal(t, payloadIndexes, conf.PayloadIndexes())
+
+	conf.MetadataIndexes = "priority:integer, team:keyword"
+	indexes := conf.PayloadIndexes()
+	assert.Len(t, indexes, len(payloadIndexes)+2)
+	assert.Equal(t, pb.FieldType_FieldTypeInteger, indexes["metadata.priority"])
+	assert.Equal(t, pb.FieldType_FieldTypeKeyword, indexes["metadata.team"])
+
+	_, err := LoadConfig(writeConfig(t, `metadata_indexes = "priority:date"`), nil)
+	assert.ErrorContains(t, err, "metadata_indexes")
+	_, err = LoadConfig(writeConfig(t, `metadata_indexes = "a.b:keyword"`), nil)
+	assert.ErrorContains(t, err, "metadata_indexes")
+
+	// a collection created before the indexes lacks them
+	qdrant := schemaCollections{schema: map[string]*pb.PayloadSchemaInfo{PAYLOAD_TAGS: {}}}
+	missing, err := missingPayloadIndexes(context.TODO(), qdrant, "aid", indexes)
+	assert.NoError(t, err)
+	assert.Len(t, missing, len(indexes)-1)
+	assert.NotContains(t, missing, PAYLOAD_TAGS)
+}
@@ -0,0 +1,104 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// range of the sampling temperature of agent's model settings
+const MIN_TEMPERATURE = 0.0
+const MAX_TEMPERATURE = 2.0
+
+// ModelSettings are agent's settings of the chats llm makes on its behalf, zero values are llm's defaults
+type ModelSettings struct {
+	Model       string   `bson:"model,omitempty" json:"model,omitempty"`             // chat model
+	Temperature *float32 `bson:"temperature,omitempty" json:"temperature,omitempty"` // sampling temperature
+	MaxTokens   int      `bson:"max_tokens,omitempty" json:"max_tokens,omitempty"`   // maximal tokens of a reply
+}
+
+// Validate checks the temperature is in range and max tokens is not negative
+func (s *ModelSettings) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.Temperature != nil && (*s.Temperature < MIN_TEMPERATURE || *s.Temperature > MAX_TEMPERATURE) {
+		return NewWrapError(400, fmt.Errorf("temperature should be in [%g, %g], got %g", MIN_TEMPERATURE, MAX_TEMPERATURE, *s.Temperature), "")
+	}
+	if s.MaxTokens < 0 {
+		return NewWrapError(400, fmt.Errorf("max_tokens should not be negative"), "")
+	}
+	return nil
+}
+
+type modelSettingsKey struct{}
+
+// WithModelSettings returns a copy of ctx which carries the model settings, llm's chats read them from ctx
+func WithModelSettings(ctx context.Context, settings *ModelSettings) context.Context {
+	if settings == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, modelSettingsKey{}, settings)
+}
+
+// ModelSettingsFromContext returns the model settings which ctx carries, nil if there are none
+func ModelSettingsFromContext(ctx context.Context) *ModelSettings {
+	settings, _ := ctx.Value(modelSettingsKey{}).(*ModelSettings)
+	return settings
+}
+
+// clearedProfile returns the profile fields which are empty, an update of the agent unsets them
+func (a *Agent) clearedProfile() bson.M {
+	cleared := bson.M{}
+	if a.Description == "" {
+		cleared["description"] = ""
+	}
+	if len(a.Persona) == 0 {
+		cleared["persona"] = ""
+	}
+	if a.SystemPrompt == "" {
+		cleared["system_prompt"] = ""
+	}
+	if a.LLM == nil {
+		cleared["llm"] = ""
+	}
+	return cleared
+}
+
+// Validate checks agent's profile, retrieval and model settings
+func (a *Agent) Validate() error {
+	for _, trait := range a.Persona {
+		if strings.TrimSpace(trait) == "" {
+			return NewWrapError(400, fmt.Errorf("persona traits should not be empty"), "")
+		}
+	}
+	if err := a.Retrieval.Validate(); err != nil {
+		return err
+	}
+	return a.LLM.Validate()
+}
+
+// context returns a copy of ctx which carries agent's model settings, for the chats made on its behalf
+func (a *Agent) context(ctx context.Context) context.Context {
+	return WithModelSettings(ctx, a.LLM)
+}
+
+// profile is the system prompt which introduces the agent: its own system prompt,
+// or "You are <name>." if it has none, followed by its description and persona
+func (a *Agent) profile() string {
+	var sb strings.Builder
+	if prompt := strings.TrimSpace(a.SystemPrompt); prompt != "" {
+		sb.WriteString(prompt)
+	} else {
+		fmt.Fprintf(&sb, "You are %s.", a.Name)
+	}
+	if description := strings.TrimSpace(a.Description); description != "" {
+		fmt.Fprintf(&sb, "\nDescription: %s", description)
+	}
+	if len(a.Persona) > 0 {
+		fmt.Fprintf(&sb, "\nPersona: %s", strings.Join(a.Persona, ", "))
+	}
+	return sb.String()
+}
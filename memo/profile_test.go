@@ -0,0 +1,135 @@
+package memo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProfileSuite struct {
+	suite.Suite
+	memo  *Memo
+	llm   *Local
+	agent *Agent
+
+	settings *ModelSettings // the model settings of the last chat
+	prompts  []ChatMessage  // the messages of the last chat
+}
+
+func (s *ProfileSuite) SetupTest() {
+	temperature := float32(0.2)
+	s.agent = &Agent{
+		Name:         "aspirin",
+		Description:  "A retired sailor who runs a bookshop.",
+		Persona:      []string{"grumpy", "kind-hearted"},
+		SystemPrompt: "You are aspirin, talk like a pirate.",
+		LLM:          &ModelSettings{Model: "gpt-4", Temperature: &temperature, MaxTokens: 128},
+	}
+	s.memo, s.llm = newTestMemo(s.T(), s.agent)
+	s.llm.ChatFunc = func(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+		s.settings, s.prompts = ModelSettingsFromContext(ctx), messages
+		return ChatMessage{Role: "assistant", Content: "Ahoy!"}, nil
+	}
+}
+
+func (s *ProfileSuite) TestValidate() {
+	s.NoError((&Agent{Name: "aspirin"}).Validate())
+
+	hot, cold := float32(2.5), float32(-0.1)
+	for _, agent := range []*Agent{
+		{Persona: []string{"grumpy", " "}},
+		{LLM: &ModelSettings{Temperature: &hot}},
+		{LLM: &ModelSettings{Temperature: &cold}},
+		{LLM: &ModelSettings{MaxTokens: -1}},
+		{Retrieval: &Retrieval{}},
+	} {
+		err := agent.Validate()
+		s.Error(err)
+		s.Equal(400, err.(WrapError).Code())
+	}
+
+	_, err := s.memo.Agents.Add(context.TODO(), &Agent{Name: "bad", LLM: &ModelSettings{MaxTokens: -1}})
+	s.Equal(400, err.(WrapError).Code())
+	err = s.memo.Agents.Update(context.TODO(), &Agent{ID: s.agent.ID, Persona: []string{""}})
+	s.Equal(400, err.(WrapError).Code())
+}
+
+func (s *ProfileSuite) TestProfile() {
+	s.Equal("You are aspirin.", (&Agent{Name: "aspirin"}).profile())
+	s.Equal("You are aspirin, talk like a pirate.\nDescription: A retired sailor who runs a bookshop.\nPersona: grumpy, kind-hearted", s.agent.profile())
+}
+
+func (s *ProfileSuite) TestChatWithProfile() {
+	_, err := s.memo.Chat(context.TODO(), s.agent.ID, &ChatRequest{Messages: []ChatMessage{{Role: "user", Content: "Hello"}}})
+	s.NoError(err)
+
+	s.True(strings.HasPrefix(s.prompts[0].Content, s.agent.profile()+"\n"))
+	s.Equal(s.agent.LLM.Model, s.settings.Model)
+	s.Equal(*s.agent.LLM.Temperature, *s.settings.Temperature)
+	s.Equal(128, s.settings.MaxTokens)
+
+	// other features chat with the same settings
+	s.settings = nil
+	_, err = s.memo.Extract(context.TODO(), s.agent.ID, &ExtractionRequest{Messages: []ChatMessage{{Role: "user", Content: "Hello"}}})
+	s.NoError(err)
+	s.Equal("gpt-4", s.settings.Model)
+}
+
+func (s *ProfileSuite) TestAgentHandlers() {
+	gin.SetMode(gin.TestMode)
+	r := NewRouter(s.memo)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", API_BASE_PATH+"/agents/"+s.agent.ID.Hex(), nil)
+	r.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	var agent Agent
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &agent))
+	s.Equal(s.agent.Description, agent.Description)
+	s.Equal(s.agent.Persona, agent.Persona)
+	s.Equal(s.agent.SystemPrompt, agent.SystemPrompt)
+	s.Equal(s.agent.LLM, agent.LLM)
+
+	// the profile is replaced, the fields which are not supplied are cleared
+	body, _ := json.Marshal(&Agent{ID: s.agent.ID, Name: "aspirin", Persona: s.agent.Persona, LLM: &ModelSettings{Model: "gpt-3.5-turbo"}})
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("PUT", API_BASE_PATH+"/agents/"+s.agent.ID.Hex(), bytes.NewReader(body))
+	r.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	updated, err := s.memo.Agents.Get(context.TODO(), s.agent.ID)
+	s.NoError(err)
+	s.Empty(updated.Description)
+	s.Empty(updated.SystemPrompt)
+	s.Equal(s.agent.Persona, updated.Persona)
+	s.Equal(&ModelSettings{Model: "gpt-3.5-turbo"}, updated.LLM)
+
+	s.NoError(s.memo.Agents.Update(context.TODO(), &Agent{ID: s.agent.ID, Name: "aspirin"}))
+	updated, err = s.memo.Agents.Get(context.TODO(), s.agent.ID)
+	s.NoError(err)
+	s.Empty(updated.Persona)
+	s.Nil(updated.LLM)
+
+	body, _ = json.Marshal(&Agent{Name: "hot", LLM: &ModelSettings{Temperature: new(float32)}})
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", API_BASE_PATH+"/agents", bytes.NewReader(body))
+	r.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	body = []byte(`{"name":"hot","llm":{"temperature":3}}`)
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", API_BASE_PATH+"/agents", bytes.NewReader(body))
+	r.ServeHTTP(w, req)
+	s.Equal(400, w.Code)
+}
+
+func TestProfileSuite(t *testing.T) {
+	suite.Run(t, new(ProfileSuite))
+}
@@ -0,0 +1,109 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+)
+
+// capabilities of a llm provider
+const CAPABILITY_EMBEDDING = "embedding"
+const CAPABILITY_CHAT = "chat"
+
+// NewLLM creates the llm of the config, its embeddings and chats come from the providers of
+// embedding_llm and chat_llm, which are llm's by default
+func NewLLM(conf *Config) (LLM, error) {
+	embedding, chat := conf.EmbeddingLLM, conf.ChatLLM
+	if embedding == "" {
+		embedding = conf.LLM
+	}
+	if chat == "" {
+		chat = conf.LLM
+	}
+
+	if chat == embedding {
+		return newProvider(conf, embedding, CAPABILITY_EMBEDDING, CAPABILITY_CHAT)
+	}
+	embedder, err := newProvider(conf, embedding, CAPABILITY_EMBEDDING)
+	if err != nil {
+		return nil, err
+	}
+	chatter, err := newProvider(conf, chat, CAPABILITY_CHAT)
+	if err != nil {
+		return nil, err
+	}
+	return &splitLLM{embedder: embedder, chatter: chatter}, nil
+}
+
+// newProvider creates the llm of the provider, the settings which the capabilities need are checked
+func newProvider(conf *Config, provider string, capabilities ...string) (LLM, error) {
+	switch provider {
+	case LLM_OPENAI, "":
+		// compatible servers may not need a key
+		if conf.OpenAIAPIKey == "" && conf.OpenAIBaseURL == "" {
+			return nil, fmt.Errorf("openai_api_key is empty")
+		}
+		return NewOpenAIWithConfig(OpenAIConfig{
+			APIKey:         conf.OpenAIAPIKey,
+			BaseURL:        conf.OpenAIBaseURL,
+			Org:            conf.OpenAIOrg,
+			ChatModel:      conf.OpenAIChatModel,
+			EmbeddingModel: conf.OpenAIEmbeddingModel,
+			Batch:          conf.EmbeddingBatch(),
+			Retry:          conf.RetryPolicy(),
+		}), nil
+	case LLM_AZURE:
+		if conf.AzureEndpoint == "" || conf.AzureAPIKey == "" {
+			return nil, fmt.Errorf("azure_endpoint and azure_api_key should not be empty")
+		}
+		for _, capability := range capabilities {
+			if capability == CAPABILITY_EMBEDDING && conf.AzureEmbeddingDeployment == "" {
+				return nil, fmt.Errorf("azure_embedding_deployment is empty")
+			}
+			if capability == CAPABILITY_CHAT && conf.AzureChatDeployment == "" {
+				return nil, fmt.Errorf("azure_chat_deployment is empty")
+			}
+		}
+		return NewAzureOpenAI(AzureConfig{
+			Endpoint:            conf.AzureEndpoint,
+			APIKey:              conf.AzureAPIKey,
+			APIVersion:          conf.AzureAPIVersion,
+			ChatDeployment:      conf.AzureChatDeployment,
+			EmbeddingDeployment: conf.AzureEmbeddingDeployment,
+			Batch:               conf.EmbeddingBatch(),
+			Retry:               conf.RetryPolicy(),
+		}), nil
+	case LLM_OLLAMA:
+		if conf.OllamaUri == "" {
+			return nil, fmt.Errorf("ollama_uri is empty")
+		}
+		return NewOllamaWithConfig(OllamaConfig{
+			URI:            conf.OllamaUri,
+			ChatModel:      conf.OllamaChatModel,
+			EmbeddingModel: conf.OllamaEmbeddingModel,
+			Batch:          conf.EmbeddingBatch(),
+			Retry:          conf.RetryPolicy(),
+		}), nil
+	case LLM_LOCAL:
+		return NewLocal(conf.EmbeddingDim), nil
+	default:
+		return nil, fmt.Errorf("unknown llm: %s", provider)
+	}
+}
+
+// splitLLM embeds with one provider and chats with another
+type splitLLM struct {
+	embedder LLM
+	chatter  LLM
+}
+
+func (s *splitLLM) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	return s.embedder.Embedding(ctx, contents)
+}
+
+func (s *splitLLM) Chat(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+	return s.chatter.Chat(ctx, messages)
+}
+
+func (s *splitLLM) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(delta string) error) (ChatMessage, *Usage, error) {
+	return s.chatter.ChatStream(ctx, messages, onDelta)
+}
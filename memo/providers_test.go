@@ -0,0 +1,64 @@
+package memo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLLM(t *testing.T) {
+	conf := DefaultConfig()
+	_, err := NewLLM(conf)
+	assert.ErrorContains(t, err, "openai_api_key")
+
+	// compatible servers may not need a key
+	conf.OpenAIBaseURL = "http://localhost:8000/v1"
+	llm, err := NewLLM(conf)
+	assert.NoError(t, err)
+	assert.IsType(t, &OpenAI{}, llm)
+
+	conf.LLM = LLM_AZURE
+	_, err = NewLLM(conf)
+	assert.ErrorContains(t, err, "azure_endpoint")
+	conf.AzureEndpoint, conf.AzureAPIKey = "https://memo.openai.azure.com", "key"
+	_, err = NewLLM(conf)
+	assert.ErrorContains(t, err, "azure_embedding_deployment")
+	conf.AzureEmbeddingDeployment = "embed"
+	_, err = NewLLM(conf)
+	assert.ErrorContains(t, err, "azure_chat_deployment")
+
+	// embeddings and chats come from their own providers
+	conf.ChatLLM = LLM_OLLAMA
+	llm, err = NewLLM(conf)
+	assert.NoError(t, err)
+	split := llm.(*splitLLM)
+	assert.IsType(t, &OpenAI{}, split.embedder)
+	assert.IsType(t, &Ollama{}, split.chatter)
+
+	conf = DefaultConfig()
+	conf.LLM, conf.ChatLLM = LLM_LOCAL, LLM_LOCAL
+	llm, err = NewLLM(conf)
+	assert.NoError(t, err)
+	assert.IsType(t, &Local{}, llm)
+}
+
+func TestSplitLLM(t *testing.T) {
+	var chats []ollamaChatRequest
+	srv := ollamaServer(t, &chats)
+	defer srv.Close()
+
+	llm := &splitLLM{embedder: NewLocal(8), chatter: NewOllama(srv.URL, "llama2", "llama2")}
+	ems, err := llm.Embedding(context.TODO(), []string{"hello"})
+	assert.NoError(t, err)
+	assert.Len(t, ems[0], 8)
+
+	reply, err := llm.Chat(context.TODO(), []ChatMessage{{Role: "user", Content: "hello"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, there", reply.Content)
+
+	_, usage, err := llm.ChatStream(context.TODO(), []ChatMessage{{Role: "user", Content: "hello"}}, func(string) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 14, usage.TotalTokens)
+	assert.Len(t, chats, 2)
+}
@@ -0,0 +1,286 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	pb "github.com/qdrant/go-client/qdrant"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RepairMode selects which kinds of drift Reconcile repairs, modes can be combined
+type RepairMode uint
+
+const (
+	REPAIR_MISSING_POINTS      RepairMode = 1 << iota // re-embed memories which have no point
+	REPAIR_ORPHAN_POINTS                              // delete points which have no memory
+	REPAIR_MISSING_COLLECTIONS                        // recreate agents' missing collections
+	REPAIR_MISSING_INDEXES                            // create the payload indexes which collections lack
+
+	REPAIR_NONE RepairMode = 0
+	REPAIR_ALL             = REPAIR_MISSING_POINTS | REPAIR_ORPHAN_POINTS | REPAIR_MISSING_COLLECTIONS | REPAIR_MISSING_INDEXES
+)
+
+// how many memories are re-embedded per request when repairing missing points
+const REPAIR_BATCH_SIZE = 64
+
+var repairModeNames = map[string]RepairMode{
+	"none":                REPAIR_NONE,
+	"missing-points":      REPAIR_MISSING_POINTS,
+	"orphan-points":       REPAIR_ORPHAN_POINTS,
+	"missing-collections": REPAIR_MISSING_COLLECTIONS,
+	"missing-indexes":     REPAIR_MISSING_INDEXES,
+	"all":                 REPAIR_ALL,
+}
+
+// ParseRepairMode parses comma separated mode names: none, missing-points, orphan-points,
+// missing-collections, missing-indexes and all
+func ParseRepairMode(s string) (RepairMode, error) {
+	mode := REPAIR_NONE
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		m, ok := repairModeNames[name]
+		if !ok {
+			return REPAIR_NONE, fmt.Errorf("unknown repair mode: %s", name)
+		}
+		mode |= m
+	}
+	return mode, nil
+}
+
+// Drift between an agent's memories in mongodb and its qdrant collection
+type Drift struct {
+	AID primitive.ObjectID `json:"aid"`
+
+	MissingCollection bool                 `json:"missing_collection"` // agent has no collection
+	MissingPoints     []primitive.ObjectID `json:"missing_points"`     // memories whose point doesn't exist
+	OrphanPoints      []string             `json:"orphan_points"`      // points whose memory doesn't exist
+	MissingIndexes    []string             `json:"missing_indexes"`    // payload fields which the collection doesn't index
+
+	Repaired RepairMode `json:"repaired"` // kinds of drift which have been repaired
+}
+
+// Consistent reports if no drift is left, the repaired drift doesn't count
+func (d *Drift) Consistent() bool {
+	return (!d.MissingCollection || d.Repaired&REPAIR_MISSING_COLLECTIONS != 0) &&
+		(len(d.MissingPoints) == 0 || d.Repaired&REPAIR_MISSING_POINTS != 0) &&
+		(len(d.OrphanPoints) == 0 || d.Repaired&REPAIR_ORPHAN_POINTS != 0) &&
+		(len(d.MissingIndexes) == 0 || d.Repaired&REPAIR_MISSING_INDEXES != 0)
+}
+
+// Reconcile finds the drift of the agent between mongodb and qdrant, and repairs it by mode
+func (ms *Memories) Reconcile(ctx context.Context, aid primitive.ObjectID, mode RepairMode) (*Drift, error) {
+	drift := &Drift{AID: aid}
+
+	collection, err := ms.resolveCollection(ctx, aid)
+	if err != nil {
+		return nil, err
+	}
+	exists := collection != ""
+
+	if !exists {
+		drift.MissingCollection = true
+		if mode&REPAIR_MISSING_COLLECTIONS != 0 {
+			spec, err := ms.recordedEmbedding(ctx, aid)
+			if err != nil {
+				return drift, err
+			}
+			if spec == nil {
+				spec = ms.Embedding
+			}
+			if spec == nil {
+				spec = DefaultConfig().EmbeddingSpec()
+			}
+			if err := createAgentCollection(ctx, ms.collections, ms.qdrant, aid, spec, ms.PayloadIndexes); err != nil {
+				return drift, err
+			}
+			// the new collection is found by the alias, rather than the one recorded on the agent
+			if ms.agents != nil {
+				if _, err := ms.agents.UpdateOne(ctx, bson.M{"_id": aid}, bson.M{"$unset": bson.M{"collection": ""}}); err != nil {
+					return drift, err
+				}
+			}
+			drift.Repaired |= REPAIR_MISSING_COLLECTIONS
+			exists = true
+		}
+	}
+
+	// a collection created before the indexes were added or configured lacks them
+	if collection != "" {
+		missing, err := missingPayloadIndexes(ctx, ms.collections, collection, ms.PayloadIndexes)
+		if err != nil {
+			return drift, err
+		}
+		for field := range missing {
+			drift.MissingIndexes = append(drift.MissingIndexes, field)
+		}
+		sort.Strings(drift.MissingIndexes)
+		if mode&REPAIR_MISSING_INDEXES != 0 && len(missing) > 0 {
+			if err := createPayloadIndexes(ctx, ms.qdrant, collection, missing); err != nil {
+				return drift, err
+			}
+			drift.Repaired |= REPAIR_MISSING_INDEXES
+		}
+	}
+
+	// point id -> memory id of all the points
+	points := make(map[string]string)
+	if exists {
+		if points, err = ms.scrollPoints(ctx, aid); err != nil {
+			return drift, err
+		}
+	}
+
+	// archived memories have no points
+	cur, err := ms.mongo.Find(ctx, bson.M{"aid": aid, "archived_at": bson.M{"$exists": false}}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return drift, err
+	}
+	var missing []*Memory
+	linked := make(map[string]bool)
+	for cur.Next(ctx) {
+		var m Memory
+		if err := cur.Decode(&m); err != nil {
+			return drift, err
+		}
+		if mid, ok := points[m.PID]; ok && mid == m.ID.Hex() {
+			linked[m.PID] = true
+			continue
+		}
+		drift.MissingPoints = append(drift.MissingPoints, m.ID)
+		missing = append(missing, &m)
+	}
+	if err := cur.Err(); err != nil {
+		return drift, err
+	}
+
+	for pid := range points {
+		if !linked[pid] {
+			drift.OrphanPoints = append(drift.OrphanPoints, pid)
+		}
+	}
+
+	// orphans go first, a memory whose point carries another memory's id will get a new point
+	if mode&REPAIR_ORPHAN_POINTS != 0 && len(drift.OrphanPoints) > 0 {
+		pids := make([]uuid.UUID, len(drift.OrphanPoints))
+		for idx, pid := range drift.OrphanPoints {
+			if pids[idx], err = uuid.Parse(pid); err != nil {
+				return drift, err
+			}
+		}
+		if err := ms.deletePoints(ctx, aid, pids); err != nil {
+			return drift, err
+		}
+		drift.Repaired |= REPAIR_ORPHAN_POINTS
+	}
+
+	if mode&REPAIR_MISSING_POINTS != 0 && exists && len(missing) > 0 {
+		for start := 0; start < len(missing); start += REPAIR_BATCH_SIZE {
+			end := start + REPAIR_BATCH_SIZE
+			if end > len(missing) {
+				end = len(missing)
+			}
+			if err := ms.reembed(ctx, aid, missing[start:end]); err != nil {
+				return drift, err
+			}
+		}
+		drift.Repaired |= REPAIR_MISSING_POINTS
+	}
+
+	return drift, nil
+}
+
+// reembed memories and upsert them with their own point ids
+func (ms *Memories) reembed(ctx context.Context, aid primitive.ObjectID, memories []*Memory) error {
+	contents := make([]string, len(memories))
+	for idx, m := range memories {
+		contents[idx] = m.Content
+	}
+
+	ems, _, err := ms.embed(ctx, aid, contents)
+	if err != nil {
+		return err
+	}
+	return ms.upsertPoints(ctx, aid, memories, ems)
+}
+
+// scrollPoints returns point id -> memory id of all the agent's points
+func (ms *Memories) scrollPoints(ctx context.Context, aid primitive.ObjectID) (map[string]string, error) {
+	collection, err := ms.collectionOf(ctx, aid)
+	if err != nil {
+		return nil, err
+	}
+	points := make(map[string]string)
+	limit := uint32(256)
+	var offset *pb.PointId
+	for {
+		res, err := ms.qdrant.Scroll(ctx, &pb.ScrollPoints{
+			CollectionName: collection,
+			Offset:         offset,
+			Limit:          &limit,
+			WithPayload:    &pb.WithPayloadSelector{SelectorOptions: &pb.WithPayloadSelector_Enable{Enable: true}},
+			WithVectors:    &pb.WithVectorsSelector{SelectorOptions: &pb.WithVectorsSelector_Enable{Enable: false}},
+		})
+		if err != nil {
+			return nil, NewWrapError(500, err, "memory vectors scroll error")
+		}
+		for _, p := range res.Result {
+			points[p.GetId().GetUuid()] = p.GetPayload()[PAYLOAD_MID].GetStringValue()
+		}
+		if res.NextPageOffset == nil {
+			return points, nil
+		}
+		offset = res.NextPageOffset
+	}
+}
+
+// Reconcile finds and repairs the drift between mongodb and qdrant of the agent,
+// or of all agents if aid is nil, the agents in the trash included, so they are consistent when restored
+func (m *Memo) Reconcile(ctx context.Context, aid primitive.ObjectID, mode RepairMode) ([]*Drift, error) {
+	reconciler, ok := m.Memories.(Reconciler)
+	if !ok {
+		return nil, NewWrapError(400, fmt.Errorf("memory model doesn't support reconcile"), "")
+	}
+
+	if aid != primitive.NilObjectID {
+		if _, err := m.Agents.Get(ctx, aid); err != nil {
+			return nil, err
+		}
+		drift, err := reconciler.Reconcile(ctx, aid, mode)
+		if err != nil {
+			return nil, err
+		}
+		return []*Drift{drift}, nil
+	}
+
+	var drifts []*Drift
+	for _, list := range []func(context.Context, primitive.ObjectID) ([]*Agent, error){m.Agents.List, m.Agents.ListTrash} {
+		offset := primitive.NilObjectID
+		for {
+			agents, err := list(ctx, offset)
+			if err != nil {
+				return drifts, err
+			}
+			if len(agents) == 0 {
+				break
+			}
+			for _, agent := range agents {
+				drift, err := reconciler.Reconcile(ctx, agent.ID, mode)
+				if err != nil {
+					return drifts, err
+				}
+				drifts = append(drifts, drift)
+			}
+			offset = agents[len(agents)-1].ID
+		}
+	}
+	return drifts, nil
+}
@@ -0,0 +1,85 @@
+package memo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseRepairMode(t *testing.T) {
+	mode, err := ParseRepairMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, REPAIR_NONE, mode)
+
+	mode, err = ParseRepairMode("missing-points, orphan-points")
+	assert.NoError(t, err)
+	assert.Equal(t, REPAIR_MISSING_POINTS|REPAIR_ORPHAN_POINTS, mode)
+
+	mode, err = ParseRepairMode("missing-indexes")
+	assert.NoError(t, err)
+	assert.Equal(t, REPAIR_MISSING_INDEXES, mode)
+
+	mode, err = ParseRepairMode("all")
+	assert.NoError(t, err)
+	assert.Equal(t, REPAIR_ALL, mode)
+
+	_, err = ParseRepairMode("everything")
+	assert.Error(t, err)
+}
+
+func TestDriftConsistent(t *testing.T) {
+	assert.True(t, (&Drift{}).Consistent())
+
+	drift := &Drift{MissingCollection: true, OrphanPoints: []string{"pid"}}
+	assert.False(t, drift.Consistent())
+	drift.Repaired = REPAIR_MISSING_COLLECTIONS
+	assert.False(t, drift.Consistent())
+	drift.Repaired |= REPAIR_ORPHAN_POINTS
+	assert.True(t, drift.Consistent())
+
+	drift.MissingIndexes = []string{PAYLOAD_TAGS}
+	assert.False(t, drift.Consistent())
+	drift.Repaired |= REPAIR_MISSING_INDEXES
+	assert.True(t, drift.Consistent())
+}
+
+func TestMemoReconcileNotSupported(t *testing.T) {
+	agents, memories := NewInMemory(NewLocal(8))
+	m := &Memo{Agents: agents, Memories: memories}
+	_, err := m.Reconcile(context.TODO(), primitive.NilObjectID, REPAIR_ALL)
+	assert.Equal(t, 400, err.(WrapError).Code())
+}
+
+// reconciledMemories records the agents it reconciles
+type reconciledMemories struct {
+	*InMemoryMemories
+	aids []primitive.ObjectID
+}
+
+func (rm *reconciledMemories) Reconcile(ctx context.Context, aid primitive.ObjectID, mode RepairMode) (*Drift, error) {
+	rm.aids = append(rm.aids, aid)
+	return &Drift{}, nil
+}
+
+func TestMemoReconcileTrash(t *testing.T) {
+	ctx := context.TODO()
+	agents, memories := NewInMemory(NewLocal(8))
+	agents.ListLimit, agents.TrashRetention = 1, time.Hour // one agent per page
+	reconciled := &reconciledMemories{InMemoryMemories: memories}
+	m := &Memo{Agents: agents, Memories: reconciled}
+
+	kept, trashed := &Agent{Name: "kept"}, &Agent{Name: "trashed"}
+	for _, agent := range []*Agent{kept, trashed} {
+		_, err := agents.Add(ctx, agent)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, agents.Delete(ctx, trashed.ID))
+
+	drifts, err := m.Reconcile(ctx, primitive.NilObjectID, REPAIR_NONE)
+	assert.NoError(t, err)
+	assert.Len(t, drifts, 2)
+	assert.Equal(t, []primitive.ObjectID{kept.ID, trashed.ID}, reconciled.aids)
+}
@@ -0,0 +1,369 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/qdrant/go-client/qdrant"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// how many memories are re-embedded per request by default
+const REEMBED_BATCH_SIZE = 64
+
+// Reembedding is the progress of moving an agent's memories to another embedding model, it is recorded on the agent
+// from the start of the job to its end, so an interrupted job can be resumed
+type Reembedding struct {
+	Collection string             `bson:"collection" json:"collection"`           // the new qdrant collection
+	Embedding  *EmbeddingSpec     `bson:"embedding" json:"embedding"`             // the new embedding model
+	After      primitive.ObjectID `bson:"after,omitempty" json:"after,omitempty"` // the last copied memory, memories are copied in the order of ids
+	Done       int                `bson:"done" json:"done"`                       // how many memories are copied
+	Started    time.Time          `bson:"started_at" json:"started_at"`
+	Switched   bool               `bson:"switched,omitempty" json:"switched,omitempty"` // the agent is on the new collection
+
+	// memories written while the job runs, they are copied again
+	Dirty   []primitive.ObjectID `bson:"dirty,omitempty" json:"-"`
+	Pending []primitive.ObjectID `bson:"pending,omitempty" json:"-"` // dirty ones which are being copied
+}
+
+// newCollectionName names a new qdrant collection of the agent, the agent's id is the alias of its current one
+func newCollectionName(aid primitive.ObjectID) string {
+	return fmt.Sprintf("%s_%d", aid.Hex(), time.Now().UnixNano())
+}
+
+// createAgentCollection creates a new collection for the agent's vectors, and points the agent's alias to it
+func createAgentCollection(ctx context.Context, qdrant pb.CollectionsClient, points pb.PointsClient, aid primitive.ObjectID, spec *EmbeddingSpec, indexes map[string]pb.FieldType) error {
+	name := newCollectionName(aid)
+	if err := createCollection(ctx, qdrant, points, name, spec, indexes); err != nil {
+		return err
+	}
+	return switchAlias(ctx, qdrant, aid, "", name)
+}
+
+// switchAlias points the agent's alias from the old collection to the new one in a single request,
+// the old collection is empty if the alias doesn't exist
+func switchAlias(ctx context.Context, qdrant pb.CollectionsClient, aid primitive.ObjectID, old, name string) error {
+	var actions []*pb.AliasOperations
+	if old != "" {
+		actions = append(actions, &pb.AliasOperations{Action: &pb.AliasOperations_DeleteAlias{DeleteAlias: &pb.DeleteAlias{AliasName: aid.Hex()}}})
+	}
+	actions = append(actions, &pb.AliasOperations{Action: &pb.AliasOperations_CreateAlias{CreateAlias: &pb.CreateAlias{CollectionName: name, AliasName: aid.Hex()}}})
+	if _, err := qdrant.UpdateAliases(ctx, &pb.ChangeAliases{Actions: actions}); err != nil {
+		return NewWrapError(500, err, "qdrant alias update error")
+	}
+	return nil
+}
+
+// resolveCollection returns the collection recorded on the agent, or the one which the agent's alias points to,
+// or the agent's id itself for the agents whose collection was created before aliases,
+// or empty if the agent has no collection
+func (ms *Memories) resolveCollection(ctx context.Context, aid primitive.ObjectID) (string, error) {
+	recorded, err := ms.collectionOf(ctx, aid)
+	if err != nil {
+		return "", err
+	}
+	if recorded == aid.Hex() {
+		aliases, err := ms.collections.ListAliases(ctx, &pb.ListAliasesRequest{})
+		if err != nil {
+			return "", NewWrapError(500, err, "qdrant aliases list error")
+		}
+		for _, a := range aliases.Aliases {
+			if a.AliasName == aid.Hex() {
+				return a.CollectionName, nil
+			}
+		}
+	}
+
+	names, err := agentCollections(ctx, ms.collections, aid)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if name == recorded {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// agentCollections returns all the collections of the agent, the current one, the legacy one named after the agent,
+// and the ones left by unfinished re-embedding jobs
+func agentCollections(ctx context.Context, qdrant pb.CollectionsClient, aid primitive.ObjectID) ([]string, error) {
+	res, err := qdrant.List(ctx, &pb.ListCollectionsRequest{})
+	if err != nil {
+		return nil, NewWrapError(500, err, "qdrant collections list error")
+	}
+	var names []string
+	for _, c := range res.Collections {
+		if c.Name == aid.Hex() || strings.HasPrefix(c.Name, aid.Hex()+"_") {
+			names = append(names, c.Name)
+		}
+	}
+	return names, nil
+}
+
+// Reembed copies the agent's memories into a new collection with the embeddings of llm, which makes the vectors of spec,
+// then switches the agent to spec and the new collection, and drops the old one.
+// searches and writes go to the old collection until the switch, the memories written meanwhile are copied again.
+// a job recorded on the agent is resumed, progress is called after each batch
+func (ms *Memories) Reembed(ctx context.Context, aid primitive.ObjectID, llm LLM, spec *EmbeddingSpec, batchSize int, progress func(*Reembedding)) (*Reembedding, error) {
+	if batchSize <= 0 {
+		batchSize = REEMBED_BATCH_SIZE
+	}
+	r, err := ms.beginReembedding(ctx, aid, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.Switched {
+		for {
+			filter := bson.M{"aid": aid, "archived_at": bson.M{"$exists": false}}
+			if r.After != primitive.NilObjectID {
+				filter["_id"] = bson.M{"$gt": r.After}
+			}
+			cur, err := ms.mongo.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(batchSize)))
+			if err != nil {
+				return r, err
+			}
+			var batch []*Memory
+			if err = cur.All(ctx, &batch); err != nil {
+				return r, err
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			if err := ms.copyPoints(ctx, aid, llm, r, batch); err != nil {
+				return r, err
+			}
+			r.After, r.Done = batch[len(batch)-1].ID, r.Done+len(batch)
+			_, err = ms.agents.UpdateOne(ctx, bson.M{"_id": aid}, bson.M{"$set": bson.M{"reembedding.after": r.After, "reembedding.done": r.Done}})
+			if err != nil {
+				return r, err
+			}
+			if progress != nil {
+				progress(r)
+			}
+		}
+
+		if err := ms.catchUp(ctx, aid, llm, r, batchSize); err != nil {
+			return r, err
+		}
+		if err := ms.switchCollection(ctx, aid, llm, r, batchSize); err != nil {
+			return r, err
+		}
+	}
+
+	// the writes of the old model which raced the switch
+	if err := ms.catchUp(ctx, aid, llm, r, batchSize); err != nil {
+		return r, err
+	}
+	_, err = ms.agents.UpdateOne(ctx, bson.M{"_id": aid}, bson.M{"$unset": bson.M{"reembedding": ""}})
+	if err != nil {
+		return r, err
+	}
+	if progress != nil {
+		progress(r)
+	}
+	return r, nil
+}
+
+// beginReembedding records a new job on the agent and creates its collection, or returns the recorded one
+func (ms *Memories) beginReembedding(ctx context.Context, aid primitive.ObjectID, spec *EmbeddingSpec) (*Reembedding, error) {
+	if spec == nil || spec.Dim <= 0 {
+		return nil, NewWrapError(400, fmt.Errorf("embedding dimension should be positive"), "")
+	}
+
+	var agent Agent
+	opts := options.FindOne().SetProjection(bson.M{"embedding": 1, "reembedding": 1})
+	err := ms.agents.FindOne(ctx, bson.M{"_id": aid}, opts).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		return nil, NewWrapError(404, fmt.Errorf("agent not found: %s", aid.Hex()), "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r := agent.Reembedding; r != nil {
+		if *r.Embedding != *spec {
+			return nil, NewWrapError(409, fmt.Errorf("agent %s is being re-embedded with %s already", aid.Hex(), r.Embedding), "")
+		}
+		return r, nil
+	}
+	if agent.Embedding != nil && *agent.Embedding == *spec {
+		return nil, NewWrapError(400, fmt.Errorf("agent %s is embedded with %s already", aid.Hex(), spec), "")
+	}
+
+	r := &Reembedding{Collection: newCollectionName(aid), Embedding: spec, Started: time.Now()}
+	if err := createCollection(ctx, ms.collections, ms.qdrant, r.Collection, spec, ms.PayloadIndexes); err != nil {
+		return nil, err
+	}
+	// another job may have begun meanwhile, then its collection wins
+	res, err := ms.agents.UpdateOne(ctx, bson.M{"_id": aid, "reembedding": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"reembedding": r}})
+	if err == nil && res.MatchedCount == 0 {
+		err = NewWrapError(409, fmt.Errorf("agent %s is being re-embedded already", aid.Hex()), "")
+	}
+	if err != nil {
+		_, _ = ms.collections.Delete(ctx, &pb.DeleteCollection{CollectionName: r.Collection})
+		return nil, err
+	}
+	return r, nil
+}
+
+// copyPoints embeds the memories with llm, and upserts their points into the new collection
+func (ms *Memories) copyPoints(ctx context.Context, aid primitive.ObjectID, llm LLM, r *Reembedding, memories []*Memory) error {
+	ems, _, err := embedFor(ctx, llm, aid, r.Embedding, r.Embedding, contentsOf(memories))
+	if err != nil {
+		return err
+	}
+	return ms.upsertPointsInto(ctx, r.Collection, memories, ems)
+}
+
+// catchUp copies the dirty memories again until none is left, the ones which are deleted or archived meanwhile
+// are removed from the new collection. dirty ids are moved to pending first, so they survive an interrupted job
+func (ms *Memories) catchUp(ctx context.Context, aid primitive.ObjectID, llm LLM, r *Reembedding, batchSize int) error {
+	take := bson.A{bson.M{"$set": bson.M{
+		"reembedding.pending": bson.M{"$setUnion": bson.A{
+			bson.M{"$ifNull": bson.A{"$reembedding.pending", bson.A{}}},
+			bson.M{"$ifNull": bson.A{"$reembedding.dirty", bson.A{}}},
+		}},
+		"reembedding.dirty": bson.A{},
+	}}}
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"reembedding": 1}).SetReturnDocument(options.After)
+
+	for {
+		var agent Agent
+		err := ms.agents.FindOneAndUpdate(ctx, bson.M{"_id": aid, "reembedding": bson.M{"$exists": true}}, take, opts).Decode(&agent)
+		if err != nil {
+			return err
+		}
+		pending := agent.Reembedding.Pending
+		if len(pending) == 0 {
+			return nil
+		}
+
+		for start := 0; start < len(pending); start += batchSize {
+			end := start + batchSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+			if err := ms.refreshPoints(ctx, aid, llm, r, pending[start:end]); err != nil {
+				return err
+			}
+		}
+		_, err = ms.agents.UpdateOne(ctx, bson.M{"_id": aid}, bson.M{"$pullAll": bson.M{"reembedding.pending": pending}})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// refreshPoints copies the memories by ids into the new collection as they are now
+func (ms *Memories) refreshPoints(ctx context.Context, aid primitive.ObjectID, llm LLM, r *Reembedding, ids []primitive.ObjectID) error {
+	cur, err := ms.mongo.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "aid": aid, "archived_at": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	var memories []*Memory
+	if err = cur.All(ctx, &memories); err != nil {
+		return err
+	}
+
+	kept := make(map[primitive.ObjectID]bool, len(memories))
+	for _, m := range memories {
+		kept[m.ID] = true
+	}
+	var gone []primitive.ObjectID
+	for _, id := range ids {
+		if !kept[id] {
+			gone = append(gone, id)
+		}
+	}
+
+	// the point ids of the gone memories are unknown, so their points are deleted by memory ids
+	if len(gone) > 0 {
+		if err := ms.deleteMemoryPoints(ctx, r.Collection, gone); err != nil {
+			return err
+		}
+	}
+	if len(memories) == 0 {
+		return nil
+	}
+	return ms.copyPoints(ctx, aid, llm, r, memories)
+}
+
+// switchCollection points the agent's alias to the new collection, copies the memories written to the old one
+// meanwhile, then records the new embedding model on the agent, so the writes of the old model are refused from now on,
+// and drops the old collections. the collection of an agent created before aliases is named after the agent,
+// which can't be an alias while it exists, so the new collection is recorded on the agent instead
+func (ms *Memories) switchCollection(ctx context.Context, aid primitive.ObjectID, llm LLM, r *Reembedding, batchSize int) error {
+	recorded, err := ms.collectionOf(ctx, aid)
+	if err != nil {
+		return err
+	}
+	old, err := ms.resolveCollection(ctx, aid)
+	if err != nil {
+		return err
+	}
+	if old != r.Collection {
+		if recorded != aid.Hex() || old == aid.Hex() {
+			_, err = ms.agents.UpdateOne(ctx, bson.M{"_id": aid}, bson.M{"$set": bson.M{"collection": r.Collection}})
+		} else {
+			err = switchAlias(ctx, ms.collections, aid, old, r.Collection)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := ms.catchUp(ctx, aid, llm, r, batchSize); err != nil {
+		return err
+	}
+	_, err = ms.agents.UpdateOne(ctx, bson.M{"_id": aid}, bson.M{"$set": bson.M{"embedding": r.Embedding, "reembedding.switched": true}})
+	if err != nil {
+		return err
+	}
+	r.Switched = true
+
+	names, err := agentCollections(ctx, ms.collections, aid)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == r.Collection {
+			continue
+		}
+		if _, err := ms.collections.Delete(ctx, &pb.DeleteCollection{CollectionName: name}); err != nil {
+			return NewWrapError(500, err, "qdrant collection delete error")
+		}
+	}
+	return nil
+}
+
+// markDirty records the written memories on the agent's re-embedding job if it has one, so they will be copied again.
+// it is called after the memories are written
+func (ms *Memories) markDirty(ctx context.Context, aid primitive.ObjectID, ids []primitive.ObjectID) error {
+	if ms.agents == nil || len(ids) == 0 {
+		return nil
+	}
+	_, err := ms.agents.UpdateOne(ctx, bson.M{"_id": aid, "reembedding": bson.M{"$exists": true}},
+		bson.M{"$addToSet": bson.M{"reembedding.dirty": bson.M{"$each": ids}}})
+	return err
+}
+
+// Reembed moves the agent's memories to the configured embedding model, see Reembedder
+func (m *Memo) Reembed(ctx context.Context, aid primitive.ObjectID, batchSize int, progress func(*Reembedding)) (*Reembedding, error) {
+	reembedder, ok := m.Memories.(Reembedder)
+	if !ok {
+		return nil, NewWrapError(400, fmt.Errorf("memory model doesn't support re-embedding"), "")
+	}
+	if _, err := m.Agents.Get(ctx, aid); err != nil {
+		return nil, err
+	}
+	return reembedder.Reembed(ctx, aid, m.LLM, m.config().EmbeddingSpec(), batchSize, progress)
+}
@@ -0,0 +1,171 @@
+package memo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// flakyLLM fails to embed after it has embedded n times
+type flakyLLM struct {
+	*Local
+	n int
+}
+
+func (f *flakyLLM) Embedding(ctx context.Context, contents []string) ([]vectors, error) {
+	if f.n == 0 {
+		return nil, errors.New("llm is down")
+	}
+	f.n--
+	return f.Local.Embedding(ctx, contents)
+}
+
+type ReembedSuite struct {
+	suite.Suite
+	memo     *Memo
+	agents   *InMemoryAgents
+	memories *InMemoryMemories
+	old, new *EmbeddingSpec
+	agent    *Agent
+	ids      []primitive.ObjectID
+}
+
+func (s *ReembedSuite) SetupTest() {
+	conf := DefaultConfig()
+	conf.LLM, conf.EmbeddingDim = LLM_LOCAL, 32
+	s.old = &EmbeddingSpec{Provider: LLM_LOCAL, Model: LOCAL_EMBEDDING_MODEL, Dim: 64, Distance: DISTANCE_COSINE}
+	s.new = conf.EmbeddingSpec()
+
+	s.agents, s.memories = NewInMemory(NewLocal(64))
+	s.agents.Embedding, s.memories.Embedding = s.old, s.old
+	s.memo = &Memo{Config: conf, Agents: s.agents, Memories: s.memories, LLM: NewLocal(32)}
+
+	s.agent = &Agent{Name: "aspirin"}
+	_, err := s.agents.Add(context.TODO(), s.agent)
+	s.NoError(err)
+	s.ids, err = s.memories.AddMany(context.TODO(), s.agent.ID, []*Memory{
+		{Content: "My favorite color is red."},
+		{Content: "I like tea."},
+		{Content: "I live in Berlin."},
+		{Content: "I have a cat."},
+		{Content: "I work at night."},
+	})
+	s.NoError(err)
+}
+
+// points of the agent, which are checked to be made by the new model
+func (s *ReembedSuite) points() map[string]vectors {
+	s.memories.store.mu.RLock()
+	defer s.memories.store.mu.RUnlock()
+	points := s.memories.store.points[s.agent.ID]
+	for _, v := range points {
+		s.Len(v, s.new.Dim)
+	}
+	return points
+}
+
+func (s *ReembedSuite) TestReembed() {
+	ctx := context.TODO()
+	var done []int
+	r, err := s.memo.Reembed(ctx, s.agent.ID, 2, func(r *Reembedding) {
+		done = append(done, r.Done)
+	})
+	s.NoError(err)
+	s.Equal([]int{2, 4, 5, 5}, done)
+	s.True(r.Switched)
+	s.Equal(s.new, r.Embedding)
+
+	agent, err := s.agents.Get(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Equal(s.new, agent.Embedding)
+	s.Nil(agent.Reembedding)
+	s.Len(s.points(), 5)
+	s.Empty(s.memories.store.reembedded)
+
+	// servers of the old model are refused, the ones of the new model work
+	_, _, err = s.memories.Search(ctx, s.agent.ID, "color", nil)
+	s.Equal(409, err.(WrapError).Code())
+
+	_, memories := NewInMemory(s.memo.LLM)
+	memories.store, memories.Embedding = s.memories.store, s.new
+	found, _, err := memories.Search(ctx, s.agent.ID, "color", nil)
+	s.NoError(err)
+	s.Len(found, 5)
+
+	// it is embedded with the model already
+	_, err = s.memo.Reembed(ctx, s.agent.ID, 2, nil)
+	s.Equal(400, err.(WrapError).Code())
+}
+
+func (s *ReembedSuite) TestWritesMeanwhile() {
+	ctx := context.TODO()
+	var added []primitive.ObjectID
+	_, err := s.memo.Reembed(ctx, s.agent.ID, 2, func(r *Reembedding) {
+		if r.Done != 2 {
+			return
+		}
+		// the first two are copied, the old model keeps serving
+		var err error
+		added, err = s.memories.AddMany(ctx, s.agent.ID, []*Memory{{Content: "I play the piano."}})
+		s.NoError(err)
+		s.NoError(s.memories.UpdateOne(ctx, s.agent.ID, &Memory{ID: s.ids[0], Content: "My favorite color is blue."}))
+		s.NoError(s.memories.DeleteOne(ctx, s.agent.ID, s.ids[1]))
+		s.NoError(s.memories.Archive(ctx, s.agent.ID, []primitive.ObjectID{s.ids[4]}))
+		_, _, err = s.memories.Search(ctx, s.agent.ID, "color", nil)
+		s.NoError(err)
+	})
+	s.NoError(err)
+
+	points := s.points()
+	s.Len(points, 4)
+	memories, err := s.memories.GetMany(ctx, s.agent.ID, []primitive.ObjectID{s.ids[0], added[0]})
+	s.NoError(err)
+	ems, err := s.memo.LLM.Embedding(ctx, []string{"My favorite color is blue.", "I play the piano."})
+	s.NoError(err)
+	s.Equal(ems[0], points[memories[0].PID])
+	s.Equal(ems[1], points[memories[1].PID])
+}
+
+func (s *ReembedSuite) TestResume() {
+	ctx := context.TODO()
+	llm := &flakyLLM{Local: NewLocal(32), n: 1}
+	_, err := s.memories.Reembed(ctx, s.agent.ID, llm, s.new, 2, nil)
+	s.ErrorContains(err, "llm is down")
+
+	// the job is recorded, and the agent stays on the old model
+	agent, err := s.agents.Get(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Equal(s.old, agent.Embedding)
+	s.Equal(2, agent.Reembedding.Done)
+	s.Equal(s.ids[1], agent.Reembedding.After)
+	_, _, err = s.memories.Search(ctx, s.agent.ID, "color", nil)
+	s.NoError(err)
+
+	// only one job at a time
+	other := *s.new
+	other.Dim = 16
+	_, err = s.memories.Reembed(ctx, s.agent.ID, NewLocal(16), &other, 2, nil)
+	s.Equal(409, err.(WrapError).Code())
+
+	llm.n = 2
+	r, err := s.memories.Reembed(ctx, s.agent.ID, llm, s.new, 2, nil)
+	s.NoError(err)
+	s.Equal(5, r.Done)
+	s.Len(s.points(), 5)
+}
+
+func (s *ReembedSuite) TestMemoReembed() {
+	_, err := s.memo.Reembed(context.TODO(), primitive.NewObjectID(), 0, nil)
+	s.Equal(404, err.(WrapError).Code())
+
+	m := &Memo{Agents: s.agents, Memories: struct{ MemoryModel }{s.memories}}
+	_, err = m.Reembed(context.TODO(), s.agent.ID, 0, nil)
+	s.Equal(400, err.(WrapError).Code())
+}
+
+func TestReembedSuite(t *testing.T) {
+	suite.Run(t, new(ReembedSuite))
+}
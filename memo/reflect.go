@@ -0,0 +1,290 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// how long an automatic reflection may take, it doesn't use the request's context
+const REFLECTION_TIMEOUT = 2 * time.Minute
+
+const QUESTIONS_PROMPT = `Given only the statements above, what are the %d most salient high-level questions ` +
+	`we can answer about the subjects in the statements? Answer with one question per line, and nothing else.`
+
+const INSIGHTS_PROMPT = `What %d high-level insights can you infer from the statements above? ` +
+	`Answer with one insight per line in the form "<insight> (because of 1, 5, 3)", where the numbers are the statements' numbers.`
+
+// Reflection is the result of reflecting on agent's recent memories
+type Reflection struct {
+	Questions []string  `json:"questions"`
+	Memories  []*Memory `json:"memories"` // the insights, stored as memories of KIND_REFLECTION
+}
+
+// Reflect synthesises higher-level memories from the agent's recent memories:
+// llm asks salient questions about the recent memories, then the memories searched by
+// each question are the evidence which llm infers insights from. The insights are stored
+// as memories of KIND_REFLECTION linked to their evidence, and the agent's reflected time is updated.
+func (m *Memo) Reflect(ctx context.Context, aid primitive.ObjectID) (*Reflection, error) {
+	conf := m.config()
+
+	agent, err := m.Agents.Get(ctx, aid)
+	if err != nil {
+		return nil, err
+	}
+	ctx = agent.context(ctx) // llm reflects with agent's model settings
+
+	recent, err := m.listMemories(ctx, aid, nil, conf.ReflectionRecent)
+	if err != nil {
+		return nil, err
+	}
+	if len(recent) == 0 {
+		return nil, NewWrapError(400, fmt.Errorf("no memories to reflect on"), "")
+	}
+
+	questions, err := m.salientQuestions(ctx, recent, conf.ReflectionQuestions)
+	if err != nil {
+		return nil, err
+	}
+
+	// memories searched by the questions, without duplicates
+	var evidence []*Memory
+	seen := make(map[primitive.ObjectID]bool)
+	for _, q := range questions {
+		mems, _, err := m.Memories.Search(ctx, aid, q, nil)
+		if e, ok := err.(WrapError); ok && e.Code() == 404 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, mem := range mems {
+			if !seen[mem.ID] {
+				seen[mem.ID] = true
+				evidence = append(evidence, mem)
+			}
+		}
+	}
+
+	reflection := &Reflection{Questions: questions}
+	if len(evidence) > 0 {
+		insights, err := m.insights(ctx, evidence, conf.ReflectionInsights)
+		if err != nil {
+			return nil, err
+		}
+		if len(insights) > 0 {
+			if _, err := m.Memories.AddMany(ctx, aid, insights); err != nil {
+				return nil, err
+			}
+			reflection.Memories = insights
+		}
+	}
+
+	// memories added from now on count towards the next reflection
+	if err := m.Agents.MarkReflected(ctx, aid, time.Now()); err != nil {
+		return nil, err
+	}
+	return reflection, nil
+}
+
+// ReflectIfNeeded reflects when the importance remembered since the agent's last reflection
+// crosses the reflection_threshold, it returns nil if no reflection is needed or the threshold is zero
+func (m *Memo) ReflectIfNeeded(ctx context.Context, aid primitive.ObjectID) (*Reflection, error) {
+	threshold := m.config().ReflectionThreshold
+	if threshold <= 0 {
+		return nil, nil
+	}
+
+	agent, err := m.Agents.Get(ctx, aid)
+	if err != nil {
+		return nil, err
+	}
+	if agent.Unreflected < threshold {
+		return nil, nil
+	}
+	return m.Reflect(ctx, aid)
+}
+
+// Remember adds the memories to the agent, then reflects in background if the added importance crosses
+// the reflection_threshold. it is the Memo's way of adding memories, the memory model's AddMany never reflects
+func (m *Memo) Remember(ctx context.Context, aid primitive.ObjectID, memories []*Memory) ([]primitive.ObjectID, error) {
+	ids, err := m.Memories.AddMany(ctx, aid, memories)
+	if err != nil {
+		return nil, err
+	}
+	m.remembered(ctx, aid, memories)
+	return ids, nil
+}
+
+// RememberDedup adds the memories like Remember, but their near-duplicates are handled by dedup
+func (m *Memo) RememberDedup(ctx context.Context, aid primitive.ObjectID, memories []*Memory, dedup *Dedup) ([]*Insertion, error) {
+	insertions, err := m.Memories.AddManyDedup(ctx, aid, memories, dedup)
+	if err != nil {
+		return nil, err
+	}
+	var inserted []*Memory
+	for idx, ins := range insertions {
+		if ins.Status == INSERTION_INSERTED {
+			inserted = append(inserted, memories[idx])
+		}
+	}
+	m.remembered(ctx, aid, inserted)
+	return insertions, nil
+}
+
+// remembered adds the importance of the added memories to the agent's unreflected importance,
+// and reflects in background if it crosses the reflection_threshold. the memories are added already,
+// so its failure is logged only
+func (m *Memo) remembered(ctx context.Context, aid primitive.ObjectID, memories []*Memory) {
+	var importance float64
+	for _, mem := range memories {
+		importance += mem.Importance
+	}
+	if importance <= 0 {
+		return
+	}
+
+	unreflected, err := m.Agents.AddImportance(ctx, aid, importance)
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Errorw("importance not counted for reflection", "aid", aid.Hex(), "error", err)
+		}
+		return
+	}
+	if threshold := m.config().ReflectionThreshold; threshold > 0 && unreflected >= threshold {
+		m.reflectInBackground(aid)
+	}
+}
+
+// reflectInBackground runs ReflectIfNeeded without blocking the request,
+// only one reflection runs for an agent at the same time, and Close waits for them
+func (m *Memo) reflectInBackground(aid primitive.ObjectID) {
+	if m.config().ReflectionThreshold <= 0 {
+		return
+	}
+	if _, running := m.reflecting.LoadOrStore(aid, true); running {
+		return
+	}
+
+	m.reflections.Add(1)
+	go func() {
+		defer m.reflections.Done()
+		defer m.reflecting.Delete(aid)
+		ctx, cancel := context.WithTimeout(context.Background(), REFLECTION_TIMEOUT)
+		defer cancel()
+
+		reflection, err := m.ReflectIfNeeded(ctx, aid)
+		if m.Logger == nil {
+			return
+		}
+		if err != nil {
+			m.Logger.Errorw("reflection failed", "aid", aid.Hex(), "error", err)
+		} else if reflection != nil {
+			m.Logger.Infow("reflected", "aid", aid.Hex(), "insights", len(reflection.Memories))
+		}
+	}()
+}
+
+// listMemories lists agent's memories from newest to oldest page by page, at most limit of them if limit is positive
+func (m *Memo) listMemories(ctx context.Context, aid primitive.ObjectID, filter *MemoryFilter, limit int) ([]*Memory, error) {
+	var memories []*Memory
+	offset := primitive.NilObjectID
+	for limit <= 0 || len(memories) < limit {
+		page, err := m.Memories.List(ctx, aid, offset, filter)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		memories = append(memories, page...)
+		offset = page[len(page)-1].ID
+	}
+	if limit > 0 && len(memories) > limit {
+		memories = memories[:limit]
+	}
+	return memories, nil
+}
+
+// salientQuestions asks llm at most n questions about the memories
+func (m *Memo) salientQuestions(ctx context.Context, memories []*Memory, n int) ([]string, error) {
+	answer, err := m.LLM.Chat(ctx, []ChatMessage{
+		{Role: "user", Content: numberedStatements(memories) + "\n" + fmt.Sprintf(QUESTIONS_PROMPT, n)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var questions []string
+	for _, line := range strings.Split(answer.Content, "\n") {
+		if q := trimListMarker(line); q != "" {
+			questions = append(questions, q)
+		}
+		if len(questions) == n {
+			break
+		}
+	}
+	if len(questions) == 0 {
+		return nil, NewWrapError(500, fmt.Errorf("llm asked no questions: %q", answer.Content), "")
+	}
+	return questions, nil
+}
+
+var becauseOf = regexp.MustCompile(`(?i)\s*\(\s*because of ([^)]*)\)\W*$`)
+var statementNumber = regexp.MustCompile(`\d+`)
+
+// insights asks llm at most n insights inferred from the evidence, which are linked to the cited evidence
+func (m *Memo) insights(ctx context.Context, evidence []*Memory, n int) ([]*Memory, error) {
+	answer, err := m.LLM.Chat(ctx, []ChatMessage{
+		{Role: "user", Content: "Statements:\n" + numberedStatements(evidence) + "\n" + fmt.Sprintf(INSIGHTS_PROMPT, n)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var insights []*Memory
+	for _, line := range strings.Split(answer.Content, "\n") {
+		line = trimListMarker(line)
+		var cited []primitive.ObjectID
+		if loc := becauseOf.FindStringSubmatchIndex(line); loc != nil {
+			seen := make(map[int]bool)
+			for _, s := range statementNumber.FindAllString(line[loc[2]:loc[3]], -1) {
+				idx, _ := strconv.Atoi(s)
+				if idx >= 1 && idx <= len(evidence) && !seen[idx] {
+					seen[idx] = true
+					cited = append(cited, evidence[idx-1].ID)
+				}
+			}
+			line = strings.TrimSpace(line[:loc[0]])
+		}
+		if line == "" {
+			continue
+		}
+		insights = append(insights, &Memory{Content: line, Kind: KIND_REFLECTION, Evidence: cited})
+		if len(insights) == n {
+			break
+		}
+	}
+	return insights, nil
+}
+
+// numberedStatements lists memories' contents one per line, numbered from 1
+func numberedStatements(memories []*Memory) string {
+	var sb strings.Builder
+	for idx, mem := range memories {
+		fmt.Fprintf(&sb, "%d. %s\n", idx+1, strings.Join(strings.Fields(mem.Content), " "))
+	}
+	return sb.String()
+}
+
+var listMarker = regexp.MustCompile(`^\s*(?:\d+[.):]|[-*•])\s*`)
+
+// trimListMarker trims spaces and the leading "1." or "-" of a list item
+func trimListMarker(line string) string {
+	return strings.TrimSpace(listMarker.ReplaceAllString(line, ""))
+}
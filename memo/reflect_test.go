@@ -0,0 +1,192 @@
+package memo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ReflectSuite struct {
+	suite.Suite
+	memo  *Memo
+	llm   *Local
+	agent *Agent
+}
+
+func (s *ReflectSuite) SetupTest() {
+	s.agent = &Agent{Name: "Klaus"}
+	s.memo, s.llm = newTestMemo(s.T(), s.agent)
+
+	_, err := s.memo.Remember(context.TODO(), s.agent.ID, []*Memory{
+		{Content: "Klaus is reading a book on gentrification", Importance: 0.3},
+		{Content: "Klaus is writing a research paper", Importance: 0.5},
+		{Content: "Klaus is talking with a librarian about his research", Importance: 0.4},
+	})
+	s.NoError(err)
+}
+
+func (s *ReflectSuite) TestReflect() {
+	ctx := context.TODO()
+	s.memo.Config.ReflectionQuestions = 2
+	s.llm.Script(
+		ChatMessage{Content: "1. What is Klaus researching?\n\n2) Who does Klaus talk with?\n3. Ignored question?"},
+		ChatMessage{Content: "1. Klaus is dedicated to his research (because of 1, 2, 2, 9)\n- Klaus enjoys libraries\n"},
+	)
+
+	reflection, err := s.memo.Reflect(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Equal([]string{"What is Klaus researching?", "Who does Klaus talk with?"}, reflection.Questions)
+	s.Len(reflection.Memories, 2)
+
+	insight := reflection.Memories[0]
+	s.Equal("Klaus is dedicated to his research", insight.Content)
+	s.Equal(KIND_REFLECTION, insight.Kind)
+	s.Len(insight.Evidence, 2) // duplicated and unknown statements are dropped
+	s.Empty(reflection.Memories[1].Evidence)
+
+	// the insights are stored, and they are evidenced by the stored memories
+	stored, err := s.memo.Memories.GetOne(ctx, s.agent.ID, insight.ID)
+	s.NoError(err)
+	s.Equal(KIND_REFLECTION, stored.Kind)
+	evidence, err := s.memo.Memories.GetMany(ctx, s.agent.ID, stored.Evidence)
+	s.NoError(err)
+	s.Len(evidence, 2)
+
+	agent, err := s.memo.Agents.Get(ctx, s.agent.ID)
+	s.NoError(err)
+	s.NotNil(agent.Reflected)
+
+	// llm fails to ask any question
+	s.llm.Script(ChatMessage{Content: "\n"})
+	_, err = s.memo.Reflect(ctx, s.agent.ID)
+	s.Equal(500, err.(WrapError).Code())
+}
+
+func (s *ReflectSuite) TestReflectWithoutMemories() {
+	agent := &Agent{Name: "Maria"}
+	_, err := s.memo.Agents.Add(context.TODO(), agent)
+	s.NoError(err)
+
+	_, err = s.memo.Reflect(context.TODO(), agent.ID)
+	s.Equal(400, err.(WrapError).Code())
+
+	_, err = s.memo.Reflect(context.TODO(), primitive.NewObjectID())
+	s.Equal(404, err.(WrapError).Code())
+}
+
+func (s *ReflectSuite) TestReflectIfNeeded() {
+	ctx := context.TODO()
+
+	// disabled
+	reflection, err := s.memo.ReflectIfNeeded(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Nil(reflection)
+
+	s.memo.Config.ReflectionThreshold = 1.5
+	reflection, err = s.memo.ReflectIfNeeded(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Nil(reflection)
+
+	_, err = s.memo.Memories.AddOne(ctx, s.agent.ID, &Memory{Content: "Klaus's paper is accepted", Importance: 0.9})
+	s.NoError(err)
+	reflection, err = s.memo.ReflectIfNeeded(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Nil(reflection) // the memory model doesn't count the importance, Remember does
+
+	_, err = s.memo.Agents.AddImportance(ctx, s.agent.ID, 0.9)
+	s.NoError(err)
+	s.llm.Script(ChatMessage{Content: "What is Klaus researching?"}, ChatMessage{Content: "Klaus is a researcher (because of 1)"})
+	reflection, err = s.memo.ReflectIfNeeded(ctx, s.agent.ID)
+	s.NoError(err)
+	s.NotNil(reflection)
+
+	// importance is accumulated since the last reflection
+	agent, err := s.memo.Agents.Get(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Zero(agent.Unreflected)
+	reflection, err = s.memo.ReflectIfNeeded(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Nil(reflection)
+}
+
+func (s *ReflectSuite) TestReflectKeepsEdits() {
+	ctx := context.TODO()
+	calls := 0
+	s.llm.ChatFunc = func(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+		if calls++; calls == 1 {
+			// the agent is edited while it reflects
+			s.NoError(s.memo.Agents.Update(ctx, &Agent{ID: s.agent.ID, Name: "Klaus Mueller", Description: "A sociology student."}))
+			return ChatMessage{Content: "What is Klaus researching?"}, nil
+		}
+		return ChatMessage{Content: "Klaus is a researcher (because of 1)"}, nil
+	}
+
+	_, err := s.memo.Reflect(ctx, s.agent.ID)
+	s.NoError(err)
+	agent, err := s.memo.Agents.Get(ctx, s.agent.ID)
+	s.NoError(err)
+	s.Equal("Klaus Mueller", agent.Name)
+	s.Equal("A sociology student.", agent.Description)
+	s.NotNil(agent.Reflected)
+}
+
+func (s *ReflectSuite) TestRemember() {
+	ctx := context.TODO()
+	s.memo.Config.ReflectionThreshold = 1.5
+	s.llm.Script(ChatMessage{Content: "What is Klaus researching?"}, ChatMessage{Content: "Klaus is a researcher (because of 1)"})
+
+	// the memories added by the go api count towards the threshold too
+	_, err := s.memo.Remember(ctx, s.agent.ID, []*Memory{{Content: "Klaus's paper is accepted", Importance: 0.9}})
+	s.NoError(err)
+	s.Eventually(func() bool {
+		agent, err := s.memo.Agents.Get(ctx, s.agent.ID)
+		return err == nil && agent.Reflected != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (s *ReflectSuite) TestCloseWaitsForReflections() {
+	ctx := context.TODO()
+	s.memo.Config.ReflectionThreshold = 1.5
+	release := make(chan struct{})
+	s.llm.ChatFunc = func(ctx context.Context, messages []ChatMessage) (ChatMessage, error) {
+		<-release
+		return ChatMessage{Content: "What is Klaus researching?"}, nil
+	}
+
+	_, err := s.memo.Remember(ctx, s.agent.ID, []*Memory{{Content: "Klaus's paper is accepted", Importance: 0.9}})
+	s.NoError(err)
+
+	// the reflection is still running
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	s.ErrorIs(s.memo.Close(tctx), context.DeadlineExceeded)
+
+	close(release)
+	s.NoError(s.memo.Close(ctx))
+}
+
+func (s *ReflectSuite) TestReflectHandler() {
+	gin.SetMode(gin.ReleaseMode)
+	router := NewRouter(s.memo)
+	s.llm.Script(ChatMessage{Content: "What is Klaus researching?"}, ChatMessage{Content: "Klaus is a researcher"})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", API_BASE_PATH+"/agents/"+s.agent.ID.Hex()+"/memories/reflect", bytes.NewBuffer(nil))
+	router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	var reflection Reflection
+	s.NoError(json.NewDecoder(w.Body).Decode(&reflection))
+	s.Equal("Klaus is a researcher", reflection.Memories[0].Content)
+}
+
+func TestReflectSuite(t *testing.T) {
+	suite.Run(t, new(ReflectSuite))
+}
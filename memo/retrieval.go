@@ -0,0 +1,114 @@
+package memo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// default retrieval weights and recency half-life of agents which have no retrieval settings
+const DEFAULT_RECENCY_WEIGHT = 1.0
+const DEFAULT_IMPORTANCE_WEIGHT = 1.0
+const DEFAULT_RELEVANCE_WEIGHT = 1.0
+const DEFAULT_HALF_LIFE_HOURS = 24.0
+
+// how many candidates are ranked for each searched memory, by their relevance first
+const RETRIEVAL_CANDIDATES_FACTOR = 4
+
+// Retrieval is agent's settings of memory retrieval scoring:
+//
+//	score = (recency * Recency + importance * Importance + relevance * Relevance) / (Recency + Importance + Relevance)
+//
+// recency decays by half every HalfLifeHours since the memory was accessed last time
+type Retrieval struct {
+	Recency       float64 `bson:"recency" json:"recency"`
+	Importance    float64 `bson:"importance" json:"importance"`
+	Relevance     float64 `bson:"relevance" json:"relevance"`
+	HalfLifeHours float64 `bson:"half_life_hours" json:"half_life_hours"`
+}
+
+// DefaultRetrieval weighs all the components equally
+func DefaultRetrieval() *Retrieval {
+	return &Retrieval{
+		Recency:       DEFAULT_RECENCY_WEIGHT,
+		Importance:    DEFAULT_IMPORTANCE_WEIGHT,
+		Relevance:     DEFAULT_RELEVANCE_WEIGHT,
+		HalfLifeHours: DEFAULT_HALF_LIFE_HOURS,
+	}
+}
+
+// Validate checks the weights are not negative and not all zero, and the half-life is positive
+func (r *Retrieval) Validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.Recency < 0 || r.Importance < 0 || r.Relevance < 0 {
+		return NewWrapError(400, fmt.Errorf("retrieval weights should not be negative"), "")
+	}
+	if r.Recency+r.Importance+r.Relevance == 0 {
+		return NewWrapError(400, fmt.Errorf("retrieval weights should not be all zero"), "")
+	}
+	if r.HalfLifeHours <= 0 {
+		return NewWrapError(400, fmt.Errorf("retrieval half_life_hours should be positive"), "")
+	}
+	return nil
+}
+
+// Score is a memory's retrieval score with its components, which are all in [0, 1]
+type Score struct {
+	Score      float32 `json:"score"`
+	Recency    float32 `json:"recency"`
+	Importance float32 `json:"importance"`
+	Relevance  float32 `json:"relevance"` // similarity between the query and the memory by the distance, negatives are 0
+}
+
+// score the memory at now, relevance is the similarity to the query
+func (r *Retrieval) score(m *Memory, relevance float32, now time.Time) *Score {
+	accessed := m.Accessed
+	if accessed.IsZero() {
+		accessed = m.Created
+	}
+	recency := 1.0
+	if age := now.Sub(accessed).Hours(); age > 0 {
+		recency = math.Pow(0.5, age/r.HalfLifeHours)
+	}
+
+	s := &Score{
+		Recency:    float32(recency),
+		Importance: float32(clamp(m.Importance)),
+		Relevance:  float32(clamp(float64(relevance))),
+	}
+	sum := r.Recency*float64(s.Recency) + r.Importance*float64(s.Importance) + r.Relevance*float64(s.Relevance)
+	s.Score = float32(sum / (r.Recency + r.Importance + r.Relevance))
+	return s
+}
+
+// rank memories by their retrieval scores, and return at most limit of them
+// relevances are the memories' similarities to the query
+func (r *Retrieval) rank(memories []*Memory, relevances []float32, limit int64, now time.Time) ([]*Memory, []*Score) {
+	type hit struct {
+		memory *Memory
+		score  *Score
+	}
+	hits := make([]hit, len(memories))
+	for idx, m := range memories {
+		hits[idx] = hit{m, r.score(m, relevances[idx], now)}
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].score.Score > hits[j].score.Score })
+	if limit > 0 && int64(len(hits)) > limit {
+		hits = hits[:limit]
+	}
+
+	ranked := make([]*Memory, len(hits))
+	scores := make([]*Score, len(hits))
+	for idx, h := range hits {
+		ranked[idx] = h.memory
+		scores[idx] = h.score
+	}
+	return ranked, scores
+}
+
+func clamp(f float64) float64 {
+	return math.Max(0, math.Min(1, f))
+}
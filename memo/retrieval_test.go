@@ -0,0 +1,70 @@
+package memo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRetrievalValidate(t *testing.T) {
+	var nilRetrieval *Retrieval
+	assert.NoError(t, nilRetrieval.Validate())
+	assert.NoError(t, DefaultRetrieval().Validate())
+	assert.NoError(t, (&Retrieval{Relevance: 1, HalfLifeHours: 1}).Validate())
+
+	for _, r := range []*Retrieval{
+		{Recency: -1, Relevance: 1, HalfLifeHours: 1},
+		{HalfLifeHours: 1},
+		{Relevance: 1},
+	} {
+		err := r.Validate()
+		assert.Equal(t, 400, err.(WrapError).Code(), "%+v", r)
+	}
+}
+
+func TestRetrievalScore(t *testing.T) {
+	now := time.Now()
+	r := &Retrieval{Recency: 1, Importance: 2, Relevance: 1, HalfLifeHours: 24}
+
+	m := &Memory{Created: now.Add(-48 * time.Hour), Accessed: now.Add(-24 * time.Hour), Importance: 0.5}
+	s := r.score(m, 0.8, now)
+	assert.InDelta(t, 0.5, s.Recency, 1e-6) // a half-life since the last access
+	assert.InDelta(t, 0.5, s.Importance, 1e-6)
+	assert.InDelta(t, 0.8, s.Relevance, 1e-6)
+	assert.InDelta(t, (0.5+2*0.5+0.8)/4, s.Score, 1e-6)
+
+	// never accessed, decays from the created time, negative relevance is 0
+	m = &Memory{Created: now.Add(-48 * time.Hour)}
+	s = r.score(m, -0.3, now)
+	assert.InDelta(t, 0.25, s.Recency, 1e-6)
+	assert.Equal(t, float32(0), s.Relevance)
+
+	// accessed in the future, no decay
+	m = &Memory{Accessed: now.Add(time.Hour)}
+	assert.Equal(t, float32(1), r.score(m, 0, now).Recency)
+}
+
+func TestRetrievalRank(t *testing.T) {
+	now := time.Now()
+	old := &Memory{ID: primitive.NewObjectID(), Accessed: now.Add(-240 * time.Hour), Importance: 0.1}
+	important := &Memory{ID: primitive.NewObjectID(), Accessed: now.Add(-240 * time.Hour), Importance: 1}
+	recent := &Memory{ID: primitive.NewObjectID(), Accessed: now, Importance: 0.1}
+	memories := []*Memory{old, important, recent}
+	relevances := []float32{0.9, 0.5, 0.5}
+
+	// relevance only
+	ranked, scores := (&Retrieval{Relevance: 1, HalfLifeHours: 24}).rank(memories, relevances, 2, now)
+	assert.Len(t, ranked, 2)
+	assert.Len(t, scores, 2)
+	assert.Equal(t, old.ID, ranked[0].ID)
+
+	ranked, _ = (&Retrieval{Importance: 1, Relevance: 1, HalfLifeHours: 24}).rank(memories, relevances, 0, now)
+	assert.Len(t, ranked, 3)
+	assert.Equal(t, important.ID, ranked[0].ID)
+
+	ranked, scores = (&Retrieval{Recency: 1, Relevance: 1, HalfLifeHours: 24}).rank(memories, relevances, 1, now)
+	assert.Equal(t, recent.ID, ranked[0].ID)
+	assert.InDelta(t, 0.75, scores[0].Score, 1e-6)
+}
@@ -0,0 +1,137 @@
+package memo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaults of RetryPolicy
+const DEFAULT_LLM_RETRIES = 3
+const DEFAULT_LLM_RETRY_DELAY = 500 * time.Millisecond
+const DEFAULT_LLM_RETRY_MAX_DELAY = 30 * time.Second
+
+// RetryPolicy retries the llm api requests which fail with 429, 5xx or a network error, Retries times at most.
+// the n-th retry waits a random delay between half and all of Delay * 2^(n-1), which is MaxDelay at most,
+// or the response's Retry-After if it has one. a request is not retried if the wait would pass its context's deadline
+type RetryPolicy struct {
+	Retries  int
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy returns the policy of the providers whose config has none
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Retries: DEFAULT_LLM_RETRIES, Delay: DEFAULT_LLM_RETRY_DELAY, MaxDelay: DEFAULT_LLM_RETRY_MAX_DELAY}
+}
+
+// RetryPolicy returns the policy of the config's llm requests
+func (c *Config) RetryPolicy() RetryPolicy {
+	return RetryPolicy{Retries: c.LLMRetries, Delay: c.LLMRetryDelay, MaxDelay: c.LLMRetryMaxDelay}
+}
+
+// orDefault returns the default policy if p is zero
+func (p RetryPolicy) orDefault() RetryPolicy {
+	if p == (RetryPolicy{}) {
+		return DefaultRetryPolicy()
+	}
+	return p
+}
+
+// backoff is the jittered wait before the retry
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Delay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryClient returns an http client which retries its requests by the policy
+func retryClient(p RetryPolicy) *http.Client {
+	return &http.Client{Transport: &retryTransport{base: http.DefaultTransport, policy: p.orDefault()}}
+}
+
+// retryTransport retries the requests whose body can be read again, see RetryPolicy.
+// streamed responses are retried only before they start, by their status
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for retry := 1; ; retry++ {
+		res, err := t.base.RoundTrip(req)
+		if retry > t.policy.Retries || !retryable(ctx, res, err) || (req.Body != nil && req.GetBody == nil) {
+			return res, err
+		}
+
+		wait := t.policy.backoff(retry)
+		if res != nil {
+			if after, ok := retryAfter(res); ok {
+				wait = after
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return res, err
+		}
+		if res != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// retryable reports if the request failed with 429, 5xx or a network error, but not because ctx is done
+func retryable(ctx context.Context, res *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// retryAfter parses the Retry-After header, which is seconds or an http date
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,108 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	assert.Equal(t, DefaultRetryPolicy(), RetryPolicy{}.orDefault())
+
+	p := RetryPolicy{Retries: 5, Delay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, most := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		most *= time.Millisecond
+		d := p.backoff(retry + 1)
+		assert.GreaterOrEqual(t, d, most/2)
+		assert.LessOrEqual(t, d, most)
+	}
+}
+
+func TestRetryClient(t *testing.T) {
+	var statuses []int
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, status)
+	}))
+	defer srv.Close()
+
+	client := retryClient(RetryPolicy{Retries: 2, Delay: time.Millisecond, MaxDelay: time.Millisecond})
+	post := func(ctx context.Context) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL, strings.NewReader("hello"))
+		return client.Do(req)
+	}
+
+	// 429 and 5xx are retried with the body
+	statuses, bodies = []int{429, 503, 200}, nil
+	res, err := post(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []string{"hello", "hello", "hello"}, bodies)
+	res.Body.Close()
+
+	// the last failure is returned after the retries
+	statuses, bodies = []int{500, 500, 500, 200}, nil
+	res, err = post(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Len(t, bodies, 3)
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, "500", string(body))
+	res.Body.Close()
+
+	// the other errors are not
+	statuses, bodies = []int{404, 200}, nil
+	res, err = post(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Len(t, bodies, 1)
+	res.Body.Close()
+
+	// a Retry-After past the deadline is not waited for
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodies = append(bodies, "")
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	bodies = nil
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	start := time.Now()
+	res, err = post(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 429, res.StatusCode)
+	assert.Len(t, bodies, 1)
+	assert.Less(t, time.Since(start), time.Second)
+	res.Body.Close()
+}
+
+func TestRetryAfter(t *testing.T) {
+	res := &http.Response{Header: http.Header{}}
+	_, ok := retryAfter(res)
+	assert.False(t, ok)
+
+	res.Header.Set("Retry-After", "3")
+	d, ok := retryAfter(res)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, d)
+
+	res.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	d, ok = retryAfter(res)
+	assert.True(t, ok)
+	assert.InDelta(t, float64(time.Minute), float64(d), float64(2*time.Second))
+}
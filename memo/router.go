@@ -0,0 +1,80 @@
+package memo
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// API_BASE_PATH is the versioned prefix of all the routes
+const API_BASE_PATH = "/api/v1"
+
+// NewRouter creates a gin engine with all agent and memory routes registered under API_BASE_PATH
+func NewRouter(m *Memo) *gin.Engine {
+	r := gin.Default()
+	m.RegisterRoutes(r.Group(API_BASE_PATH))
+	return r
+}
+
+// RegisterRoutes registers agent and memory handlers to the router group
+//
+//	GET    /stats                          counters of the embedding cache
+//	GET    /agents                         list agents
+//	POST   /agents                         add an agent
+//	GET    /agents/:aid                    get an agent
+//	PUT    /agents/:aid                    update an agent
+//	DELETE /agents/:aid                    delete an agent, or move it into the trash
+//	GET    /agents/trash                   list agents in the trash
+//	POST   /agents/:aid/restore            restore an agent from the trash
+//	DELETE /agents/:aid/purge              delete an agent and its memories permanently
+//	POST   /agents/:aid/chat               chat with an agent, which remembers relevant memories, ?stream=sse|ndjson
+//	GET    /agents/:aid/memories           list agent's memories
+//	POST   /agents/:aid/memories           add memories
+//	PUT    /agents/:aid/memories           update memories
+//	DELETE /agents/:aid/memories?ids=      delete memories
+//	GET    /agents/:aid/memories/batch?ids= get memories by ids
+//	GET    /agents/:aid/memories/search?q= search memories, filtered by url params
+//	POST   /agents/:aid/memories/search    search memories with a query and a filter
+//	POST   /agents/:aid/memories/reflect   reflect on recent memories
+//	POST   /agents/:aid/memories/compact   summarise and archive old memories
+//	POST   /agents/:aid/memories/extract   extract memories from messages or a session
+//	GET    /agents/:aid/sessions           list agent's sessions
+//	POST   /agents/:aid/sessions           add a session
+//	GET    /agents/:aid/sessions/:sid      get a session
+//	PUT    /agents/:aid/sessions/:sid      update a session's title
+//	DELETE /agents/:aid/sessions/:sid      delete a session and its messages
+//	GET    /agents/:aid/sessions/:sid/messages?last=&tokens= list session's latest messages
+//	POST   /agents/:aid/sessions/:sid/messages append messages to a session
+func (m *Memo) RegisterRoutes(rg *gin.RouterGroup) {
+	rg.GET("/stats", m.GetStats)
+
+	agents := rg.Group("/agents")
+	agents.GET("", m.ListAgents)
+	agents.POST("", m.AddAgent)
+	agents.GET("/:aid", m.GetAgent)
+	agents.PUT("/:aid", m.UpdateAgent)
+	agents.DELETE("/:aid", m.DeleteAgent)
+	agents.GET("/trash", m.ListTrash)
+	agents.POST("/:aid/restore", m.RestoreAgent)
+	agents.DELETE("/:aid/purge", m.PurgeAgent)
+	agents.POST("/:aid/chat", m.GetAgentId, m.ChatWithAgent)
+
+	memories := agents.Group("/:aid/memories", m.GetAgentId)
+	memories.GET("", m.ListMemories)
+	memories.POST("", m.AddMemories)
+	memories.PUT("", m.UpdateMemories)
+	memories.DELETE("", m.DeleteMemories)
+	memories.GET("/batch", m.GetMemories)
+	memories.GET("/search", m.SearchMemories)
+	memories.POST("/search", m.SearchMemories)
+	memories.POST("/reflect", m.ReflectMemories)
+	memories.POST("/compact", m.CompactMemories)
+	memories.POST("/extract", m.ExtractMemories)
+
+	sessions := agents.Group("/:aid/sessions", m.GetAgentId, m.GetSessionId)
+	sessions.GET("", m.ListSessions)
+	sessions.POST("", m.AddSession)
+	sessions.GET("/:sid", m.GetSession)
+	sessions.PUT("/:sid", m.UpdateSession)
+	sessions.DELETE("/:sid", m.DeleteSession)
+	sessions.GET("/:sid/messages", m.ListMessages)
+	sessions.POST("/:sid/messages", m.AppendMessages)
+}
@@ -0,0 +1,72 @@
+package memo
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type RouterSuite struct {
+	suite.Suite
+	router *gin.Engine
+}
+
+func (s *RouterSuite) SetupSuite() {
+	gin.SetMode(gin.ReleaseMode)
+	s.router = NewRouter(&Memo{Agents: &mockAgentModel{}, Memories: &mockMemoryModel{}})
+}
+
+func (s *RouterSuite) TestRoutes() {
+	aid := primitive.NewObjectID().Hex()
+	ids := primitive.NewObjectID().Hex()
+
+	routes := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/stats", ""},
+		{"GET", "/agents", ""},
+		{"POST", "/agents", `{"name":"aspirin2d"}`},
+		{"GET", "/agents/" + aid, ""},
+		{"PUT", "/agents/" + aid, `{"id":"` + aid + `","name":"aspirin2d"}`},
+		{"DELETE", "/agents/" + aid, ""},
+		{"GET", "/agents/trash", ""},
+		{"POST", "/agents/" + aid + "/restore", ""},
+		{"DELETE", "/agents/" + aid + "/purge", ""},
+		{"GET", "/agents/" + aid + "/memories", ""},
+		{"POST", "/agents/" + aid + "/memories", `[{"content":"hello"}]`},
+		{"PUT", "/agents/" + aid + "/memories", `[{"id":"` + ids + `"}]`},
+		{"DELETE", "/agents/" + aid + "/memories?ids=" + ids, ""},
+		{"GET", "/agents/" + aid + "/memories/batch?ids=" + ids, ""},
+		{"GET", "/agents/" + aid + "/memories/search?q=hello", ""},
+		{"POST", "/agents/" + aid + "/memories/search", `{"query":"hello","filter":{"tags":["chat"]}}`},
+	}
+
+	for _, r := range routes {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(r.method, API_BASE_PATH+r.path, bytes.NewBufferString(r.body))
+		s.router.ServeHTTP(w, req)
+		s.Equal(200, w.Code, "%s %s", r.method, r.path)
+	}
+
+	// invalid agent id is rejected by the middleware
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", API_BASE_PATH+"/agents/123/memories", nil)
+	s.router.ServeHTTP(w, req)
+	s.Equal(400, w.Code)
+
+	// routes are not registered without the base path
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/agents", nil)
+	s.router.ServeHTTP(w, req)
+	s.Equal(404, w.Code)
+}
+
+func TestRouterSuite(t *testing.T) {
+	suite.Run(t, new(RouterSuite))
+}
@@ -0,0 +1,180 @@
+package memo
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GetSessionId is a gin middleware which parses the session id of the url,
+// it aborts with 501 if sessions are not supported
+func (m *Memo) GetSessionId(c *gin.Context) {
+	if m.Sessions == nil {
+		m.AbortWithError(c, NewWrapError(501, fmt.Errorf("sessions are not supported"), ""))
+		return
+	}
+
+	str := c.Param("sid")
+	if str == "" {
+		c.Next()
+		return
+	}
+
+	sid, err := primitive.ObjectIDFromHex(str)
+	if err != nil {
+		m.AbortWithError(c, NewWrapError(400, fmt.Errorf("session id invalid"), ""))
+		return
+	}
+
+	c.Set("session", sid)
+	c.Next()
+}
+
+// AddSession is a gin Handler which adds a session to the agent.
+func (m *Memo) AddSession(c *gin.Context) {
+	aid, _ := c.Get("agent")
+	agent := aid.(primitive.ObjectID)
+
+	session := new(Session)
+	if err := c.ShouldBindJSON(session); err != nil {
+		m.AbortWithError(c, NewWrapError(400, err, "can't bind json to the session"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	id, err := m.Sessions.Add(ctx, agent, session)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"inserted": id})
+}
+
+// GetSession is a gin Handler which gets agent's session.
+func (m *Memo) GetSession(c *gin.Context) {
+	agent, session := sessionParams(c)
+
+	ctx := c.Request.Context()
+	s, err := m.Sessions.Get(ctx, agent, session)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, s)
+}
+
+// UpdateSession is a gin Handler which updates session's title.
+func (m *Memo) UpdateSession(c *gin.Context) {
+	agent, session := sessionParams(c)
+
+	s := new(Session)
+	if err := c.ShouldBindJSON(s); err != nil {
+		m.AbortWithError(c, NewWrapError(400, err, "can't bind json to the session"))
+		return
+	}
+	s.ID = session
+
+	ctx := c.Request.Context()
+	if err := m.Sessions.Update(ctx, agent, s); err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// DeleteSession is a gin Handler which deletes a session with its messages.
+func (m *Memo) DeleteSession(c *gin.Context) {
+	agent, session := sessionParams(c)
+
+	ctx := c.Request.Context()
+	if err := m.Sessions.Delete(ctx, agent, session); err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// ListSessions is a gin Handler which lists agent's sessions with the offset url param.
+func (m *Memo) ListSessions(c *gin.Context) {
+	aid, _ := c.Get("agent")
+	agent := aid.(primitive.ObjectID)
+
+	oid := primitive.NilObjectID
+	if offset := c.Query("offset"); offset != "" && offset != "nil" && offset != "-1" {
+		var err error
+		oid, err = primitive.ObjectIDFromHex(offset)
+		if err != nil {
+			m.AbortWithError(c, NewWrapError(400, err, "invalid offset id"))
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	sessions, err := m.Sessions.List(ctx, agent, oid)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, sessions)
+}
+
+// AppendMessages is a gin Handler which appends messages to the session.
+func (m *Memo) AppendMessages(c *gin.Context) {
+	agent, session := sessionParams(c)
+
+	var messages []ChatMessage
+	if err := c.ShouldBindJSON(&messages); err != nil {
+		m.AbortWithError(c, NewWrapError(400, err, "can't bind messages"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	stored, err := m.Sessions.Append(ctx, agent, session, messages)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, stored)
+}
+
+// ListMessages is a gin Handler which lists session's latest messages,
+// the last and tokens url params limit how many messages and estimated tokens of them, all messages by default.
+func (m *Memo) ListMessages(c *gin.Context) {
+	agent, session := sessionParams(c)
+
+	window := &Window{}
+	for key, v := range map[string]*int{"last": &window.Last, "tokens": &window.Tokens} {
+		if str := c.Query(key); str != "" {
+			n, err := strconv.Atoi(str)
+			if err != nil {
+				m.AbortWithError(c, NewWrapError(400, err, "invalid "+key))
+				return
+			}
+			*v = n
+		}
+	}
+
+	ctx := c.Request.Context()
+	messages, err := m.Sessions.Messages(ctx, agent, session, window)
+	if err != nil {
+		m.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, messages)
+}
+
+// sessionParams returns agent's and session's ids parsed by the middlewares
+func sessionParams(c *gin.Context) (primitive.ObjectID, primitive.ObjectID) {
+	aid, _ := c.Get("agent")
+	sid, _ := c.Get("session")
+	return aid.(primitive.ObjectID), sid.(primitive.ObjectID)
+}
@@ -0,0 +1,256 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const SESSIONS_COLLECTION = "sessions"
+const SESSION_MESSAGES_COLLECTION = "session_messages"
+
+// Session is a conversation with an agent, its messages are stored in order
+type Session struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	AID      primitive.ObjectID `bson:"aid" json:"aid"` // agent's id
+	Title    string             `bson:"title,omitempty" json:"title,omitempty"`
+	Created  time.Time          `bson:"created_at" json:"created_at"`
+	Updated  time.Time          `bson:"updated_at" json:"updated_at"` // last time messages were appended
+	Messages int                `bson:"messages" json:"messages"`     // number of messages
+}
+
+// SessionMessage is a stored chat message of a session
+type SessionMessage struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	SID         primitive.ObjectID `bson:"sid" json:"sid"` // session's id
+	AID         primitive.ObjectID `bson:"aid" json:"aid"` // agent's id
+	ChatMessage `bson:",inline"`
+	Created     time.Time `bson:"created_at" json:"created_at"`
+}
+
+// Window selects the latest messages of a session, at most Last of them
+// and at most Tokens estimated tokens of them, zero is unlimited
+type Window struct {
+	Last   int `json:"last,omitempty"`
+	Tokens int `json:"tokens,omitempty"`
+}
+
+// SessionWindow returns the default window of the session messages which chats are given
+func (c *Config) SessionWindow() *Window {
+	return &Window{Last: c.SessionWindowMessages, Tokens: c.SessionWindowTokens}
+}
+
+// Validate checks the window is not negative
+func (w *Window) Validate() error {
+	if w != nil && (w.Last < 0 || w.Tokens < 0) {
+		return NewWrapError(400, fmt.Errorf("window should not be negative"), "")
+	}
+	return nil
+}
+
+// fits reports whether n messages of the tokens, counted from the latest one, fit the window
+func (w *Window) fits(n, tokens int) bool {
+	return w == nil || ((w.Last <= 0 || n <= w.Last) && (w.Tokens <= 0 || tokens <= w.Tokens))
+}
+
+// messageTokens estimates the tokens of a message, with its role and separators
+func messageTokens(m ChatMessage) int {
+	return estimateTokens(m.Content) + 4
+}
+
+// Sessions is a model which implements SessionModel interface
+// mongo is a mongo collection of sessions
+// messages is a mongo collection of sessions' messages
+// agents is a mongo collection of agents, sessions can only be added to existing agents
+type Sessions struct {
+	mongo    *mongo.Collection
+	messages *mongo.Collection
+	agents   *mongo.Collection
+
+	ListLimit int64
+}
+
+// EnsureIndexes creates the indexes of the session messages, which are read by session from the latest
+// and deleted by session or agent. it does nothing if they exist
+func (ss *Sessions) EnsureIndexes(ctx context.Context) error {
+	_, err := ss.messages.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "sid", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "aid", Value: 1}}},
+	})
+	return err
+}
+
+// Add session to the agent and return inserted id
+func (ss *Sessions) Add(ctx context.Context, aid primitive.ObjectID, session *Session) (primitive.ObjectID, error) {
+	if session.ID != primitive.NilObjectID {
+		return primitive.NilObjectID, NewWrapError(400, fmt.Errorf("session id should be nil"), "")
+	}
+	err := ss.agents.FindOne(ctx, bson.M{"_id": aid, "deleted_at": bson.M{"$exists": false}}).Err()
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, NewWrapError(404, fmt.Errorf("agent not found: %s", aid.Hex()), "")
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	session.ID = primitive.NewObjectID()
+	session.AID = aid
+	session.Created = time.Now()
+	session.Updated = session.Created
+	session.Messages = 0
+	if _, err := ss.mongo.InsertOne(ctx, session); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return session.ID, nil
+}
+
+// Get agent's session by id
+func (ss *Sessions) Get(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID) (session *Session, err error) {
+	err = ss.mongo.FindOne(ctx, bson.M{"_id": sid, "aid": aid}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, NewWrapError(404, fmt.Errorf("session not found: %s", sid.Hex()), "")
+	}
+	return session, err
+}
+
+// Update session's title
+func (ss *Sessions) Update(ctx context.Context, aid primitive.ObjectID, session *Session) error {
+	res, err := ss.mongo.UpdateOne(ctx, bson.M{"_id": session.ID, "aid": aid}, bson.M{"$set": bson.M{"title": session.Title}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return NewWrapError(404, fmt.Errorf("session not found: %s", session.ID.Hex()), "")
+	}
+	return nil
+}
+
+// Delete session with its messages
+func (ss *Sessions) Delete(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID) error {
+	res, err := ss.mongo.DeleteOne(ctx, bson.M{"_id": sid, "aid": aid})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return NewWrapError(404, fmt.Errorf("session not found: %s", sid.Hex()), "")
+	}
+	_, err = ss.messages.DeleteMany(ctx, bson.M{"sid": sid})
+	return err
+}
+
+// List agent's sessions from newest to oldest, offset is the last session's id
+func (ss *Sessions) List(ctx context.Context, aid primitive.ObjectID, offset primitive.ObjectID) ([]*Session, error) {
+	filter := bson.M{"aid": aid}
+	if offset != primitive.NilObjectID {
+		filter["_id"] = bson.M{"$lt": offset}
+	}
+
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(ss.ListLimit)
+	cursor, err := ss.mongo.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*Session
+	err = cursor.All(ctx, &sessions)
+	return sessions, err
+}
+
+// Append messages to the session in order, and return the stored ones
+func (ss *Sessions) Append(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID, messages []ChatMessage) ([]*SessionMessage, error) {
+	if err := validateChatMessages(messages); err != nil {
+		return nil, err
+	}
+	if _, err := ss.Get(ctx, aid, sid); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	stored, docs := newSessionMessages(aid, sid, messages, now)
+	if len(docs) == 0 {
+		return stored, nil
+	}
+	if _, err := ss.messages.InsertMany(ctx, docs); err != nil {
+		return nil, err
+	}
+
+	_, err := ss.mongo.UpdateOne(ctx, bson.M{"_id": sid}, bson.M{"$set": bson.M{"updated_at": now}, "$inc": bson.M{"messages": len(docs)}})
+	return stored, err
+}
+
+// Messages lists the session's messages in the window from oldest to newest
+func (ss *Sessions) Messages(ctx context.Context, aid primitive.ObjectID, sid primitive.ObjectID, window *Window) ([]*SessionMessage, error) {
+	if err := window.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := ss.Get(ctx, aid, sid); err != nil {
+		return nil, err
+	}
+
+	// from the newest one, until the window is full
+	opts := options.Find().SetSort(bson.M{"_id": -1})
+	if window != nil && window.Last > 0 {
+		opts.SetLimit(int64(window.Last))
+	}
+	cursor, err := ss.messages.Find(ctx, bson.M{"sid": sid}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []*SessionMessage
+	tokens := 0
+	for cursor.Next(ctx) {
+		var m SessionMessage
+		if err := cursor.Decode(&m); err != nil {
+			return nil, err
+		}
+		tokens += messageTokens(m.ChatMessage)
+		if !window.fits(len(messages)+1, tokens) {
+			break
+		}
+		messages = append(messages, &m)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return reverseMessages(messages), nil
+}
+
+// validateChatMessages checks messages have known roles and some contents
+func validateChatMessages(messages []ChatMessage) error {
+	for _, m := range messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			return NewWrapError(400, fmt.Errorf("invalid message role: %q", m.Role), "")
+		}
+		if m.Content == "" {
+			return NewWrapError(400, fmt.Errorf("message should not be empty"), "")
+		}
+	}
+	return nil
+}
+
+// newSessionMessages creates the messages' documents, whose ids are in order
+func newSessionMessages(aid, sid primitive.ObjectID, messages []ChatMessage, now time.Time) ([]*SessionMessage, []interface{}) {
+	stored := make([]*SessionMessage, len(messages))
+	docs := make([]interface{}, len(messages))
+	for idx, m := range messages {
+		stored[idx] = &SessionMessage{ID: primitive.NewObjectID(), SID: sid, AID: aid, ChatMessage: m, Created: now}
+		docs[idx] = stored[idx]
+	}
+	return stored, docs
+}
+
+func reverseMessages(messages []*SessionMessage) []*SessionMessage {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
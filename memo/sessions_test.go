@@ -0,0 +1,160 @@
+package memo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestSessionWindow(t *testing.T) {
+	var all *Window
+	assert.True(t, all.fits(100, 10000))
+
+	w := &Window{Last: 2, Tokens: 10}
+	assert.True(t, w.fits(2, 10))
+	assert.False(t, w.fits(3, 10))
+	assert.False(t, w.fits(1, 11))
+	assert.True(t, (&Window{Tokens: 10}).fits(100, 10))
+
+	assert.Error(t, (&Window{Last: -1}).Validate())
+	assert.Equal(t, 6, messageTokens(ChatMessage{Role: "user", Content: "hello"}))
+}
+
+type SessionsSuite struct {
+	suite.Suite
+	agents   *Agents
+	sessions *Sessions
+
+	agent *Agent
+}
+
+func (ss *SessionsSuite) SetupSuite() {
+	var _ SessionModel = (*Sessions)(nil)
+
+	mc, err := mongo.Connect(context.TODO(), options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		panic(err)
+	}
+
+	db := mc.Database("test-db")
+	ss.agents = &Agents{
+		mongo:     db.Collection("agents"),
+		ListLimit: 15,
+	}
+	ss.sessions = &Sessions{
+		mongo:     db.Collection("sessions"),
+		messages:  db.Collection("session_messages"),
+		agents:    db.Collection("agents"),
+		ListLimit: 2,
+	}
+}
+
+func (ss *SessionsSuite) SetupTest() {
+	ss.agent = &Agent{ID: primitive.NewObjectID(), Name: "Aspirin"}
+	_, err := ss.agents.mongo.InsertOne(context.TODO(), ss.agent)
+	ss.NoError(err)
+}
+
+func (ss *SessionsSuite) TearDownTest() {
+	ctx := context.TODO()
+	_, err := ss.agents.mongo.DeleteOne(ctx, map[string]interface{}{"_id": ss.agent.ID})
+	ss.NoError(err)
+	_, err = ss.sessions.mongo.DeleteMany(ctx, map[string]interface{}{"aid": ss.agent.ID})
+	ss.NoError(err)
+	_, err = ss.sessions.messages.DeleteMany(ctx, map[string]interface{}{"aid": ss.agent.ID})
+	ss.NoError(err)
+}
+
+func (ss *SessionsSuite) TestSessions() {
+	ctx := context.TODO()
+	sid, err := ss.sessions.Add(ctx, ss.agent.ID, &Session{Title: "hello"})
+	ss.NoError(err)
+
+	_, err = ss.sessions.Add(ctx, primitive.NewObjectID(), &Session{})
+	ss.Equal(404, err.(WrapError).Code())
+
+	ss.NoError(ss.sessions.Update(ctx, ss.agent.ID, &Session{ID: sid, Title: "colors"}))
+	session, err := ss.sessions.Get(ctx, ss.agent.ID, sid)
+	ss.NoError(err)
+	ss.Equal("colors", session.Title)
+
+	// another agent's session is not found
+	_, err = ss.sessions.Get(ctx, primitive.NewObjectID(), sid)
+	ss.Equal(404, err.(WrapError).Code())
+
+	for range [2]int{} {
+		_, err = ss.sessions.Add(ctx, ss.agent.ID, &Session{})
+		ss.NoError(err)
+	}
+	sessions, err := ss.sessions.List(ctx, ss.agent.ID, primitive.NilObjectID)
+	ss.NoError(err)
+	ss.Len(sessions, 2)
+	sessions, err = ss.sessions.List(ctx, ss.agent.ID, sessions[1].ID)
+	ss.NoError(err)
+	ss.Equal([]primitive.ObjectID{sid}, []primitive.ObjectID{sessions[0].ID})
+
+	ss.NoError(ss.sessions.Delete(ctx, ss.agent.ID, sid))
+	err = ss.sessions.Delete(ctx, ss.agent.ID, sid)
+	ss.Equal(404, err.(WrapError).Code())
+}
+
+func (ss *SessionsSuite) TestMessages() {
+	ctx := context.TODO()
+	sid, err := ss.sessions.Add(ctx, ss.agent.ID, &Session{})
+	ss.NoError(err)
+
+	_, err = ss.sessions.Append(ctx, ss.agent.ID, sid, []ChatMessage{
+		{Role: "user", Content: "What is my favorite color?"},
+		{Role: "assistant", Content: "Red."},
+		{Role: "user", Content: "And yours?"},
+	})
+	ss.NoError(err)
+
+	_, err = ss.sessions.Append(ctx, ss.agent.ID, sid, []ChatMessage{{Role: "robot", Content: "beep"}})
+	ss.Equal(400, err.(WrapError).Code())
+
+	session, err := ss.sessions.Get(ctx, ss.agent.ID, sid)
+	ss.NoError(err)
+	ss.Equal(3, session.Messages)
+
+	messages, err := ss.sessions.Messages(ctx, ss.agent.ID, sid, nil)
+	ss.NoError(err)
+	ss.Len(messages, 3)
+	ss.Equal("What is my favorite color?", messages[0].Content)
+
+	messages, err = ss.sessions.Messages(ctx, ss.agent.ID, sid, &Window{Last: 2})
+	ss.NoError(err)
+	ss.Equal("Red.", messages[0].Content)
+
+	messages, err = ss.sessions.Messages(ctx, ss.agent.ID, sid, &Window{Tokens: 12})
+	ss.NoError(err)
+	ss.Len(messages, 2) // 7 + 5 tokens
+
+	ss.NoError(ss.sessions.Delete(ctx, ss.agent.ID, sid))
+	n, err := ss.sessions.messages.CountDocuments(ctx, map[string]interface{}{"sid": sid})
+	ss.NoError(err)
+	ss.Zero(n)
+}
+
+func (ss *SessionsSuite) TestEnsureIndexes() {
+	ctx := context.TODO()
+	ss.NoError(ss.sessions.EnsureIndexes(ctx))
+	ss.NoError(ss.sessions.EnsureIndexes(ctx)) // they exist already
+
+	specs, err := ss.sessions.messages.Indexes().ListSpecifications(ctx)
+	ss.NoError(err)
+	var names []string
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	ss.Subset(names, []string{"sid_1__id_-1", "aid_1"})
+}
+
+func TestSessionsSuite(t *testing.T) {
+	suite.Run(t, new(SessionsSuite))
+}
@@ -0,0 +1,25 @@
+package memo
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Stats are the counters of the memo since it was created
+type Stats struct {
+	EmbeddingCache *CacheStats `json:"embedding_cache,omitempty"` // nil if embeddings are not cached
+}
+
+// Stats returns the counters of the memo
+func (m *Memo) Stats() *Stats {
+	stats := &Stats{}
+	if cached, ok := m.LLM.(*CachedLLM); ok {
+		s := cached.Stats()
+		stats.EmbeddingCache = &s
+	}
+	return stats
+}
+
+// GetStats is a gin Handler which returns the counters of the memo
+func (m *Memo) GetStats(c *gin.Context) {
+	c.JSON(200, m.Stats())
+}